@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// listenFDStart is the first file descriptor passed by systemd.
+const listenFDStart = 3
+
+// activatedSocket is a UDP socket, or a TCP listener for the admin API or
+// debug endpoints, passed to janus already bound by systemd socket activation
+// or an upgrade.
+type activatedSocket struct {
+	name string // From LISTEN_FDNAMES; may be empty
+	file *os.File
+	addr *net.UDPAddr // Nil for a TCP listener
+	tcp  *net.TCPAddr // Nil for a UDP socket
+}
+
+// activation holds the sockets passed to janus at startup. They are never
+// closed: each listener using one gets its own duplicate of the socket, so
+// that the socket outlives gateways replaced on reload.
+var activation struct {
+	once    sync.Once
+	sockets []*activatedSocket
+}
+
+// activatedSockets returns the sockets passed to janus, reading them from the
+// environment on first use.
+func activatedSockets() []*activatedSocket {
+	activation.once.Do(func() {
+		files, names := listenFiles()
+		for i, f := range files {
+			sock := &activatedSocket{file: f}
+			if i < len(names) {
+				sock.name = names[i]
+			}
+
+			addr, err := socketAddr(f)
+			if err != nil {
+				glog.Warningf("Ignoring activated socket %d (%s): %v", i, sock.name, err)
+				continue
+			}
+			switch addr := addr.(type) {
+			case *net.UDPAddr:
+				sock.addr = addr
+			case *net.TCPAddr:
+				sock.tcp = addr
+			}
+			glog.Infof("Received activated socket %d (%s) bound to %v", i, sock.name, addr)
+			activation.sockets = append(activation.sockets, sock)
+		}
+	})
+	return activation.sockets
+}
+
+// socketAddr returns the address of f, a UDP socket or TCP listener.
+func socketAddr(f *os.File) (net.Addr, error) {
+	if conn, err := net.FilePacketConn(f); err == nil {
+		defer conn.Close()
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			return addr, nil
+		}
+		return nil, errors.New("not a UDP socket")
+	}
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	if addr, ok := l.Addr().(*net.TCPAddr); ok {
+		return addr, nil
+	}
+	return nil, errors.New("not a UDP socket or TCP listener")
+}
+
+// activatedConn returns a connection to the activated socket for the index'th
+// listener of the port named port, if there is one. A socket is used if it's
+// bound to addr or, failing that, if it's the index'th socket named port.
+func activatedConn(port string, index int, addr *net.UDPAddr) (*net.UDPConn, error) {
+	sockets := activatedSockets()
+
+	var found *activatedSocket
+	for _, sock := range sockets {
+		if sock.addr != nil && sameUDPAddr(sock.addr, addr) {
+			found = sock
+			break
+		}
+	}
+	if found == nil && port != "" {
+		n := 0
+		for _, sock := range sockets {
+			if sock.addr == nil || sock.name != port {
+				continue
+			}
+			if n == index {
+				found = sock
+				break
+			}
+			n++
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+
+	conn, err := net.FilePacketConn(found.file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use activated socket %s bound to %v: %v", found.name, found.addr, err)
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.Zone == b.Zone && a.IP.Equal(b.IP)
+}
+
+// activatedListener returns a listener on the activated TCP socket bound to
+// addr, if there is one.
+func activatedListener(addr string) (net.Listener, error) {
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	for _, sock := range activatedSockets() {
+		if sock.tcp == nil || !sameTCPAddr(sock.tcp, want) {
+			continue
+		}
+		l, err := net.FileListener(sock.file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to use activated socket %s bound to %v: %v", sock.name, sock.tcp, err)
+		}
+		return l, nil
+	}
+	return nil, nil
+}
+
+// sameTCPAddr is like sameUDPAddr, but treats all unspecified IPs as the
+// same, since a listener on ":port" reports its address as "[::]:port".
+func sameTCPAddr(a, b *net.TCPAddr) bool {
+	if a.Port != b.Port || a.Zone != b.Zone {
+		return false
+	}
+	aAny, bAny := a.IP == nil || a.IP.IsUnspecified(), b.IP == nil || b.IP.IsUnspecified()
+	if aAny || bAny {
+		return aAny && bAny
+	}
+	return a.IP.Equal(b.IP)
+}
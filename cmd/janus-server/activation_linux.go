@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// activationSupported is true where activated sockets are read.
+const activationSupported = true
+
+// listenFiles returns the sockets passed by systemd socket activation, or by
+// the process that started this one in an upgrade, and their names. It unsets
+// the variables describing them so that child processes don't inherit them.
+func listenFiles() ([]*os.File, []string) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := os.Getenv("LISTEN_FDNAMES")
+	upgrade := os.Getenv(upgradeEnv) != ""
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	os.Unsetenv(upgradeEnv)
+	if (pid != os.Getpid() && !upgrade) || n <= 0 {
+		return nil, nil
+	}
+
+	files := make([]*os.File, n)
+	for i := range files {
+		fd := listenFDStart + i
+		syscall.CloseOnExec(fd)
+		files[i] = os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+	}
+	if names == "" {
+		return files, nil
+	}
+	return files, strings.Split(names, ":")
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// activationSupported is false where activated sockets aren't read.
+const activationSupported = false
+
+// listenFiles returns no sockets: socket activation is only supported on
+// Linux.
+func listenFiles() ([]*os.File, []string) { return nil, nil }
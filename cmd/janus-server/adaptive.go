@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.spiff.io/codf"
+)
+
+// AdaptiveConfig adjusts the lines per batch of a port to what its upstream
+// can sustain: additively increasing it after each flush that completes
+// within Target, and halving it after each that finds the upstream
+// unreachable or overloaded, or takes longer.
+type AdaptiveConfig struct {
+	Min, Max int           // Bounds of the lines per batch; 0 disables adapting
+	Target   time.Duration // Slowest flush that still grows the batch
+	Step     int           // Lines added to the batch after each fast flush
+}
+
+// handleAdaptiveFlush parses `adaptive-flush off` or `adaptive-flush MIN MAX
+// [target D] [step N]`.
+func (p *PortConfig) handleAdaptiveFlush(args []codf.ExprNode) error {
+	if len(args) == 1 {
+		if w, ok := codf.Word(args[0]); ok && w == "off" {
+			p.Adaptive = AdaptiveConfig{}
+			return nil
+		}
+	}
+
+	a := AdaptiveConfig{Target: time.Second}
+	if err := parseArgsUpTo(args, &a.Min, &a.Max); err != nil {
+		return err
+	}
+	a.Step = a.Min
+	err := parseKwargs("adaptive-flush", args[2:], kwargs{
+		"target": {dest: &a.Target},
+		"step":   {dest: &a.Step},
+	})
+	switch {
+	case err != nil:
+		return err
+	case a.Min < 1:
+		return fmt.Errorf("adaptive-flush min must be >= 1; got %d", a.Min)
+	case a.Max < a.Min:
+		return fmt.Errorf("adaptive-flush max must be >= min (%d); got %d", a.Min, a.Max)
+	case a.Target <= 0:
+		return fmt.Errorf("adaptive-flush target must be > 0s; got %v", a.Target)
+	case a.Step < 1:
+		return fmt.Errorf("adaptive-flush step must be >= 1; got %d", a.Step)
+	}
+	p.Adaptive = a
+	return nil
+}
+
+// adaptiveSizer sets the line limit of a port's lineCounter from the results
+// of its flushes. It starts at the largest batch and backs off from there.
+type adaptiveSizer struct {
+	cfg   AdaptiveConfig
+	lines *lineCounter
+
+	mu    sync.Mutex
+	limit int
+}
+
+func newAdaptiveSizer(cfg AdaptiveConfig, lines *lineCounter) *adaptiveSizer {
+	lines.setLimit(cfg.Max)
+	return &adaptiveSizer{cfg: cfg, lines: lines, limit: cfg.Max}
+}
+
+// observe adjusts the batch size after a flush that took latency. ok is
+// false if the upstream was unreachable or overloaded.
+func (a *adaptiveSizer) observe(ok bool, latency time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ok && latency <= a.cfg.Target {
+		a.limit += a.cfg.Step
+		if a.limit > a.cfg.Max {
+			a.limit = a.cfg.Max
+		}
+	} else {
+		a.limit /= 2
+		if a.limit < a.cfg.Min {
+			a.limit = a.cfg.Min
+		}
+	}
+	a.lines.setLimit(a.limit)
+}
+
+// size returns the current lines per batch.
+func (a *adaptiveSizer) size() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.limit
+}
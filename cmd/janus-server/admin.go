@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// serveAdmin serves the admin API on addr until ctx is done.
+func (s *server) serveAdmin(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", s.handleStats)
+	mux.HandleFunc("/rollups", s.handleRollups)
+	mux.HandleFunc("/state", s.handleState)
+	mux.HandleFunc("/supervisor", s.handleSupervisor)
+	mux.HandleFunc("/listeners", s.handleListeners)
+	mux.HandleFunc("/sources", s.handleSources)
+	mux.HandleFunc("/lockout/reset", s.handleLockoutReset)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	return serveHTTP(ctx, "admin API", addr, mux)
+}
+
+// serveHTTP serves handler on the TCP address addr until ctx is done. what
+// names the server in logs. An activated socket bound to addr is used if
+// there is one, so that an upgraded process can serve on the address while
+// the old one still holds it.
+func serveHTTP(ctx context.Context, what, addr string, handler http.Handler) error {
+	l, err := activatedListener(addr)
+	if err != nil {
+		return err
+	} else if l == nil {
+		if l, err = net.Listen("tcp", addr); err != nil {
+			return err
+		}
+	}
+	if tl, ok := l.(*net.TCPListener); ok {
+		addHTTPListener(what, tl)
+		defer removeHTTPListener(what)
+	}
+
+	hs := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hs.Shutdown(sctx)
+	}()
+
+	glog.Infof("Serving %s on %v", what, l.Addr())
+	if err := hs.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		glog.Errorf("Unable to write admin response: %v", err)
+	}
+}
+
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(expvar.Get("janus").String()))
+}
+
+// handleListeners responds with the configured and bound addresses of each
+// port's listeners.
+func (s *server) handleListeners(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.listenerStatuses())
+}
+
+// handleRollups responds with the retained rollups of all ports, or only
+// of the port given by the port query parameter.
+func (s *server) handleRollups(w http.ResponseWriter, r *http.Request) {
+	rollups := s.portRollups()
+	if port := r.URL.Query().Get("port"); port != "" {
+		list, ok := rollups[port]
+		if !ok {
+			http.Error(w, "no such port", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, list)
+		return
+	}
+	writeJSON(w, rollups)
+}
+
+// handleState responds with the server's state. A POST also writes the state
+// to the configured state file.
+func (s *server) handleState(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		if s.stateFile() == "" {
+			http.Error(w, "no state-file configured", http.StatusConflict)
+			return
+		}
+		if err := s.dumpState(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, s.state())
+}
+
+// handleLockoutReset clears the auth lockouts of all ports, or only of the
+// port given by the port query parameter, and responds with the ports that
+// were locked out. Only POST is allowed.
+func (s *server) handleLockoutReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	port := r.URL.Query().Get("port")
+	if _, ok := s.gateways[port]; port != "" && !ok {
+		http.Error(w, "no such port", http.StatusNotFound)
+		return
+	}
+	reset := []string{}
+	for key, g := range s.gateways {
+		if port != "" && key != port {
+			continue
+		}
+		if g.resetLockouts() {
+			glog.Infof("Reset auth lockout of gateway %v", g)
+			reset = append(reset, key)
+		}
+	}
+	sort.Strings(reset)
+	writeJSON(w, reset)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// affinitySampleRate is the number of batch reads between samples of the
+// CPU handling a listener's packets.
+const affinitySampleRate = 64
+
+// affinityStatus holds the read affinity of each running port's listeners,
+// keyed by port.
+var affinityStatus = new(expvar.Map).Init()
+
+func init() {
+	status.Set("affinity", affinityStatus)
+}
+
+// listenerAffinity records how a listener's packets are spread across CPUs.
+// CPUs are sampled with SO_INCOMING_CPU where it's supported.
+type listenerAffinity struct {
+	packets uint64 // Packets read; accessed atomically
+	batches uint64 // Batch reads; only used by the read loop
+
+	mu   sync.Mutex
+	cpus map[int]uint64 // Samples by CPU
+}
+
+// read records a batch read of n packets from conn, sampling the CPU that
+// handled it every affinitySampleRate batches.
+func (a *listenerAffinity) read(conn *net.UDPConn, n int) {
+	atomic.AddUint64(&a.packets, uint64(n))
+	if a.batches++; a.batches%affinitySampleRate != 1 {
+		return
+	}
+
+	cpu, err := incomingCPU(conn)
+	if err != nil || cpu < 0 {
+		return
+	}
+	a.mu.Lock()
+	if a.cpus == nil {
+		a.cpus = map[int]uint64{}
+	}
+	a.cpus[cpu]++
+	a.mu.Unlock()
+}
+
+// listenerAffinityStatus is the published affinity of a listener.
+type listenerAffinityStatus struct {
+	Packets     uint64         `json:"packets"`
+	CPUs        map[int]uint64 `json:"cpus,omitempty"`          // Samples by CPU
+	TopCPU      int            `json:"top_cpu"`                 // CPU with the most samples, or -1
+	TopCPUShare float64        `json:"top_cpu_share,omitempty"` // Fraction of samples on TopCPU
+}
+
+func (a *listenerAffinity) status() listenerAffinityStatus {
+	st := listenerAffinityStatus{
+		Packets: atomic.LoadUint64(&a.packets),
+		CPUs:    map[int]uint64{},
+		TopCPU:  -1,
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var total, top uint64
+	for cpu, n := range a.cpus {
+		st.CPUs[cpu] = n
+		total += n
+		if n > top || (n == top && cpu < st.TopCPU) {
+			st.TopCPU, top = cpu, n
+		}
+	}
+	if total > 0 {
+		st.TopCPUShare = float64(top) / float64(total)
+	}
+	return st
+}
+
+// affinity returns the read affinity of each of the gateway's listeners and
+// the skew of packets across them: the busiest listener's packets over the
+// mean. A skew of 1 means packets are spread evenly, as REUSEPORT or RSS
+// steering should ideally leave them.
+func (g *gateway) affinity() interface{} {
+	listeners := make(map[string]listenerAffinityStatus, len(g.in))
+	var total, max uint64
+	for _, p := range g.in {
+		st := p.affinity.status()
+		listeners[p.orig.String()] = st
+		total += st.Packets
+		if st.Packets > max {
+			max = st.Packets
+		}
+	}
+
+	skew := 0.0
+	if total > 0 {
+		skew = float64(max) / (float64(total) / float64(len(g.in)))
+	}
+	return map[string]interface{}{
+		"listeners": listeners,
+		"skew":      skew,
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import "syscall"
+
+// soIncomingCPU is SO_INCOMING_CPU from asm-generic/socket.h, which package
+// syscall does not define.
+const soIncomingCPU = 49
+
+// incomingCPU returns the CPU that processed the last packet received by
+// conn.
+func incomingCPU(conn syscall.Conn) (cpu int, err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		cpu, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, soIncomingCPU)
+	})
+	if cerr != nil {
+		return -1, cerr
+	}
+	return cpu, err
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func incomingCPU(conn syscall.Conn) (int, error) {
+	return -1, errors.New("SO_INCOMING_CPU is not supported on this platform")
+}
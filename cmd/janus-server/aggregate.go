@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"go.spiff.io/codf"
+)
+
+// AggregateConfig combines counters and gauges received within an interval
+// into one point per series.
+type AggregateConfig struct {
+	Enabled  bool
+	Interval time.Duration // How long points are combined for; 0 uses the flush interval
+}
+
+// Tags marking the lines an aggregateStage combines, as added to StatsD
+// metrics by their decoder.
+var (
+	counterTag = []byte(",metric_type=counter")
+	gaugeTag   = []byte(",metric_type=gauge")
+)
+
+// handleAggregate parses `aggregate off` or `aggregate [interval D]`.
+func (p *PortConfig) handleAggregate(args []codf.ExprNode) error {
+	if len(args) == 1 {
+		if w, ok := codf.Word(args[0]); ok && w == "off" {
+			p.Aggregate = AggregateConfig{}
+			return nil
+		}
+	}
+
+	a := AggregateConfig{Enabled: true}
+	err := parseKwargs("aggregate", args, kwargs{
+		"interval": {dest: &a.Interval},
+	})
+	if err != nil {
+		return err
+	} else if a.Interval < 0 {
+		return fmt.Errorf("aggregate interval must be >= 0s; got %v", a.Interval)
+	}
+	p.Aggregate = a
+	return nil
+}
+
+// aggregateSeries is the combined value of one series within an interval.
+type aggregateSeries struct {
+	counter bool
+	fields  []aggregateField // Summed fields of a counter, in order first seen
+	line    []byte           // Last line of a gauge
+	stamp   []byte           // Last timestamp of a counter, if any
+}
+
+type aggregateField struct {
+	key     []byte
+	sum     float64
+	integer bool // Whether every value was an integer
+}
+
+// aggregateStage combines lines tagged metric_type=counter or
+// metric_type=gauge by series, their measurement and tag set. Counters are
+// summed, scaled by any sample_rate field, and gauges keep their last line.
+// Combined lines are sent once per interval; other lines pass through.
+type aggregateStage struct {
+	interval time.Duration
+	send     func(payload []byte) error
+	stats    *portStats
+
+	mu     sync.Mutex
+	series map[string]*aggregateSeries
+	order  []string // Keys of series, in order first seen
+}
+
+func newAggregateStage(interval time.Duration, stats *portStats) *aggregateStage {
+	return &aggregateStage{
+		interval: interval,
+		stats:    stats,
+		series:   map[string]*aggregateSeries{},
+	}
+}
+
+func (st *aggregateStage) apply(dst, line []byte) []byte {
+	end := keyEnd(line)
+	if end == -1 {
+		return append(dst, line...)
+	}
+	key := line[:end]
+	counter := hasTag(key, counterTag)
+	if !counter && !hasTag(key, gaugeTag) {
+		return append(dst, line...)
+	}
+
+	fend := fieldsEnd(line, end+1)
+	pairs := splitFields(line[end+1 : fend])
+	if counter && !summable(pairs) {
+		return append(dst, line...)
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s := st.series[string(key)]
+	if s == nil {
+		s = &aggregateSeries{counter: counter}
+		st.series[string(key)] = s
+		st.order = append(st.order, string(key))
+	}
+	st.stats.addAggregated()
+
+	if !counter {
+		s.line = append(s.line[:0], line...)
+		return dst
+	}
+	s.stamp = append(s.stamp[:0], line[fend:]...)
+	rate := 1.0
+	for _, pair := range pairs {
+		if eq := unescapedIndex(pair, '='); string(pair[:eq]) == "sample_rate" {
+			rate, _ = strconv.ParseFloat(string(pair[eq+1:]), 64)
+		}
+	}
+	for _, pair := range pairs {
+		eq := unescapedIndex(pair, '=')
+		k, v := pair[:eq], pair[eq+1:]
+		if string(k) == "sample_rate" {
+			continue
+		}
+		integer := v[len(v)-1] == 'i'
+		n, _ := strconv.ParseFloat(string(bytes.TrimSuffix(v, []byte{'i'})), 64)
+		if rate > 0 && rate != 1 {
+			n, integer = n/rate, false
+		}
+		s.add(k, n, integer)
+	}
+	return dst
+}
+
+// hasTag reports whether the measurement and tag set key holds the encoded
+// tag, including its leading comma.
+func hasTag(key, tag []byte) bool {
+	for i := bytes.Index(key, tag); i != -1; {
+		end := i + len(tag)
+		if end == len(key) || key[end] == ',' {
+			return true
+		}
+		next := bytes.Index(key[end:], tag)
+		if next == -1 {
+			break
+		}
+		i = end + next
+	}
+	return false
+}
+
+func (s *aggregateSeries) add(key []byte, n float64, integer bool) {
+	for i := range s.fields {
+		if f := &s.fields[i]; bytes.Equal(f.key, key) {
+			f.sum += n
+			f.integer = f.integer && integer
+			return
+		}
+	}
+	s.fields = append(s.fields, aggregateField{key: append([]byte(nil), key...), sum: n, integer: integer})
+}
+
+// summable reports whether every field in pairs is a float or integer, so a
+// counter's fields can be summed.
+func summable(pairs [][]byte) bool {
+	for _, pair := range pairs {
+		eq := unescapedIndex(pair, '=')
+		if eq == -1 {
+			return false
+		}
+		v := pair[eq+1:]
+		if len(v) == 0 {
+			return false
+		}
+		if v[len(v)-1] == 'i' {
+			v = v[:len(v)-1]
+		}
+		if _, err := strconv.ParseFloat(string(v), 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// flush sends the combined lines of the current interval and starts a new
+// interval.
+func (st *aggregateStage) flush() {
+	st.mu.Lock()
+	var buf []byte
+	for _, key := range st.order {
+		s := st.series[key]
+		if !s.counter {
+			buf = append(append(buf, s.line...), '\n')
+			continue
+		}
+		buf = append(append(buf, key...), ' ')
+		for i, f := range s.fields {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = append(append(buf, f.key...), '=')
+			if f.integer {
+				buf = append(strconv.AppendInt(buf, int64(f.sum), 10), 'i')
+			} else {
+				buf = strconv.AppendFloat(buf, f.sum, 'g', -1, 64)
+			}
+		}
+		buf = append(append(buf, s.stamp...), '\n')
+	}
+	st.series = map[string]*aggregateSeries{}
+	st.order = st.order[:0]
+	st.mu.Unlock()
+
+	if len(buf) == 0 {
+		return
+	}
+	if err := st.send(buf); err != nil {
+		glog.Errorf("Unable to write aggregated lines: %v", err)
+	}
+}
+
+// run flushes the stage each interval until ctx is done.
+func (st *aggregateStage) run(ctx context.Context) {
+	ticker := time.NewTicker(st.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			st.flush()
+		}
+	}
+}
@@ -3,45 +3,120 @@ package main
 import (
 	"crypto/rand"
 	"fmt"
+	"io"
 	"math"
 	"math/big"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 )
 
 type backoff struct {
+	Strategy string        // One of the backoff strategies; defaults to backoffCurve
 	Interval time.Duration // Defaults to 15s
-	Factor   float64       // Defaults to 1
+	Factor   float64       // Defaults to 1, or 2 for exponential backoff; 0 is the default
 	Grow     time.Duration // Defaults to 1s
 	Min      time.Duration // Defaults to 7s
 	Max      time.Duration // Defaults to 3m
-	MaxExp   int           // 63 if out of range or 0
+	MaxExp   int           // 1..maxBackoffExp; 0 is maxBackoffExp
 	ExpM     float64       // >= 0
 	ExpScale float64       // (minimum is >= 0, defaults to 1.5)
+	Jitter   string        // jitterRandom (the default) or jitterNone
+
+	// Rand is the source of jitter. If nil, crypto/rand is used. Seeding a
+	// math/rand source here gives reproducible retry schedules.
+	Rand io.Reader
+}
+
+// Backoff strategies. The curve is the original one, tuned by exp-m, exp-y,
+// and exp-max; the others grow the interval in the usual ways and are only
+// limited by min and max.
+const (
+	backoffCurve        = "curve"
+	backoffExponential  = "exponential"         // INTERVAL * factor^(retry-1)
+	backoffLinear       = "linear"              // INTERVAL + grow-by*(retry-1)
+	backoffFibonacci    = "fibonacci"           // INTERVAL * fib(retry)
+	backoffDecorrelated = "decorrelated-jitter" // Between INTERVAL and 3 times the last wait
+)
+
+// strategyBackoff returns the defaults for a backoff strategy. Exponential
+// backoff doubles by default, linear backoff grows by its interval, and
+// none of the strategies other than the curve have a minimum.
+func strategyBackoff(strategy string) (backoff, error) {
+	switch strategy {
+	case backoffCurve:
+		return DefaultBackoff, nil
+	case backoffExponential, backoffLinear, backoffFibonacci, backoffDecorrelated:
+		b := DefaultBackoff
+		b.Strategy, b.Factor, b.Grow, b.Min = strategy, 2, 0, 0
+		return b, nil
+	}
+	return backoff{}, fmt.Errorf("invalid backoff strategy %q; must be curve, exponential, linear, fibonacci, or decorrelated-jitter", strategy)
+}
+
+// Backoff jitter modes.
+const (
+	jitterRandom = "random" // Scale each wait by a random factor
+	jitterNone   = "none"   // Scale each wait by the expected factor
+)
+
+// maxBackoffExp is the largest exponent the curve allows, and the default
+// for exp-max.
+const maxBackoffExp = 60
+
+// setDefaults replaces zero fields that have defaults: a zero factor becomes
+// the strategy's default and a zero exp-max becomes maxBackoffExp.
+func (b *backoff) setDefaults() {
+	if b.Factor == 0 {
+		b.Factor = 1
+		if b.Strategy == backoffExponential {
+			b.Factor = 2
+		}
+	}
+	if b.MaxExp == 0 {
+		b.MaxExp = maxBackoffExp
+	}
 }
 
+// Check returns an error naming the first field of b that is out of range.
+// Defaults must already be set.
 func (b *backoff) Check() error {
 	switch {
+	case b.Interval < 0:
+		return fmt.Errorf("interval must be >= 0s; got %v", b.Interval)
 	case b.Factor < 1:
-		return fmt.Errorf("factor must be > 1; got %v", b.Factor)
+		return fmt.Errorf("factor must be >= 1; got %v", b.Factor)
 	case b.Grow < 0:
-		return fmt.Errorf("grow must be >= 0s; got %s", b.Grow)
+		return fmt.Errorf("grow-by must be >= 0s; got %v", b.Grow)
 	case b.Min < 0:
-		return fmt.Errorf("min must be >= 0s; got %s", b.Min)
+		return fmt.Errorf("min must be >= 0s; got %v", b.Min)
 	case b.Max < b.Min:
-		return fmt.Errorf("max must be >= min (%s); got %s", b.Min, b.Max)
-	case b.MaxExp <= 0 || b.MaxExp > 60:
-		return fmt.Errorf("max-exp must be > 0 and <= 60; got %f", b.MaxExp)
+		return fmt.Errorf("max must be >= min (%v); got %v", b.Min, b.Max)
+	case b.MaxExp < 1 || b.MaxExp > maxBackoffExp:
+		return fmt.Errorf("exp-max must be within 1..%d, or 0 for %[1]d; got %d", maxBackoffExp, b.MaxExp)
 	case b.ExpM < 0:
-		return fmt.Errorf("exp-m must be >= 0; got %f", b.ExpM)
+		return fmt.Errorf("exp-m must be >= 0; got %v", b.ExpM)
 	case b.ExpScale < 0:
-		return fmt.Errorf("exp-y must be >= 0; got %f", b.ExpScale)
+		return fmt.Errorf("exp-y must be >= 0; got %v", b.ExpScale)
+	case b.Jitter != jitterRandom && b.Jitter != jitterNone:
+		return fmt.Errorf("invalid jitter %q; must be random or none", b.Jitter)
 	}
 	return nil
 }
 
-var DefaultBackoff = backoff{15 * time.Second, 1, time.Second, 7 * time.Second, 3 * time.Minute, 20, 1, 1.5}
+var DefaultBackoff = backoff{
+	Strategy: backoffCurve,
+	Interval: 15 * time.Second,
+	Factor:   1,
+	Grow:     time.Second,
+	Min:      7 * time.Second,
+	Max:      3 * time.Minute,
+	MaxExp:   20,
+	ExpM:     1,
+	ExpScale: 1.5,
+	Jitter:   jitterRandom,
+}
 
 func (b *backoff) randfactor(retry int) float64 {
 	if retry < 1 {
@@ -49,8 +124,8 @@ func (b *backoff) randfactor(retry int) float64 {
 	}
 
 	maxex := b.MaxExp
-	if maxex <= 0 || maxex > 60 {
-		maxex = 60
+	if maxex <= 0 || maxex > maxBackoffExp {
+		maxex = maxBackoffExp
 	}
 
 	if retry > maxex {
@@ -60,9 +135,18 @@ func (b *backoff) randfactor(retry int) float64 {
 	max := big.NewInt(128 + 1<<uint(retry))
 	max = max.Add(max.Lsh(max, uint(retry-1)), big.NewInt(128))
 
-	n, err := rand.Int(rand.Reader, max)
-	if err != nil {
-		panic(err)
+	var n *big.Int
+	if b.Jitter == jitterNone {
+		n = new(big.Int).Rsh(max, 1)
+	} else {
+		src := b.Rand
+		if src == nil {
+			src = rand.Reader
+		}
+		var err error
+		if n, err = rand.Int(src, max); err != nil {
+			panic(err)
+		}
 	}
 
 	f := big.NewFloat(4)
@@ -83,13 +167,79 @@ func (b *backoff) randfactor(retry int) float64 {
 	return r
 }
 
+// uniform returns a random float in [0, 1), or 0.5 without jitter.
+func (b *backoff) uniform() float64 {
+	if b.Jitter == jitterNone {
+		return 0.5
+	}
+	src := b.Rand
+	if src == nil {
+		src = rand.Reader
+	}
+	n, err := rand.Int(src, big.NewInt(1<<53))
+	if err != nil {
+		panic(err)
+	}
+	return float64(n.Int64()) / (1 << 53)
+}
+
+// strategyWait returns the wait before a retry for the strategies other than
+// the curve, without min and max applied. Waits are jittered to between half
+// and all of the strategy's wait.
+func (b *backoff) strategyWait(retry int) float64 {
+	maxex := b.MaxExp
+	if maxex <= 0 || maxex > maxBackoffExp {
+		maxex = maxBackoffExp
+	}
+	if retry > maxex {
+		retry = maxex
+	}
+
+	interval := float64(b.Interval)
+	var wait float64
+	switch b.Strategy {
+	case backoffExponential:
+		wait = interval * math.Pow(b.Factor, float64(retry-1))
+	case backoffLinear:
+		grow := float64(b.Grow)
+		if grow == 0 {
+			grow = interval
+		}
+		wait = interval + grow*float64(retry-1)
+	case backoffFibonacci:
+		prev, cur := 0.0, 1.0
+		for i := 1; i < retry; i++ {
+			prev, cur = cur, prev+cur
+		}
+		wait = interval * cur
+	case backoffDecorrelated:
+		// Each wait depends on the last, which isn't kept between retries,
+		// so the sequence is drawn again up to retry.
+		wait = interval
+		for i := 1; i < retry; i++ {
+			wait = interval + b.uniform()*(3*wait-interval)
+			if max := float64(b.Max); max > 0 && wait > max {
+				wait = max
+			}
+		}
+		return wait
+	}
+	return wait/2 + b.uniform()*wait/2
+}
+
 func (b *backoff) backoff(retry, _ int) time.Duration {
 	if retry < 1 {
 		return b.Min
 	}
 
 	next := b.Interval
-	if factor := (b.Factor * float64(retry)) * float64(b.Grow); factor > 0 {
+	if b.Strategy != "" && b.Strategy != backoffCurve {
+		if wait := b.strategyWait(retry); wait >= float64(math.MaxInt64) {
+			next = math.MaxInt64
+		} else {
+			next = time.Duration(wait)
+		}
+	} else if factor := (b.Factor * float64(retry)) * float64(b.Grow); factor > 0 {
 		next += time.Duration(factor * b.randfactor(retry))
 	}
 
@@ -104,3 +254,67 @@ func (b *backoff) backoff(retry, _ int) time.Duration {
 	glog.Info("retry=", retry, " next=", next)
 	return next
 }
+
+// flushResetStreak is the number of successful flushes in a row after which a
+// port's backoff forgets the batches it gave up on.
+const flushResetStreak = 3
+
+// backoffState carries failures across sequences of retries that each start
+// over, such as the retries of a port's successive batches, so that waits keep
+// growing while an upstream stays down. Failures are forgotten once resetAfter
+// attempts in a row succeed.
+type backoffState struct {
+	b          backoff
+	resetAfter int
+
+	mu       sync.Mutex
+	failures int // Failures since the last reset
+	streak   int // Successes in a row
+}
+
+func newBackoffState(b backoff, resetAfter int) *backoffState {
+	if resetAfter < 1 {
+		resetAfter = 1
+	}
+	return &backoffState{b: b, resetAfter: resetAfter}
+}
+
+// backoff returns the wait before the retry'th retry of a sequence, counting
+// the failures carried from earlier sequences. It may be passed to
+// outflux.BackoffFunc.
+func (s *backoffState) backoff(retry, max int) time.Duration {
+	if retry < 1 {
+		return s.b.backoff(retry, max)
+	}
+	s.mu.Lock()
+	carried := s.failures
+	s.mu.Unlock()
+	return s.b.backoff(retry+carried, max)
+}
+
+// next returns the wait after the latest failure.
+func (s *backoffState) next() time.Duration {
+	s.mu.Lock()
+	failures := s.failures
+	s.mu.Unlock()
+	return s.b.backoff(failures, 0)
+}
+
+// fail records a failure and returns the number since the last reset.
+func (s *backoffState) fail() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures++
+	s.streak = 0
+	return s.failures
+}
+
+// succeed records a success, forgetting earlier failures once enough have
+// succeeded in a row.
+func (s *backoffState) succeed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.streak++; s.streak >= s.resetAfter {
+		s.failures = 0
+	}
+}
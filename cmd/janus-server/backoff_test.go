@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBackoffSchedule(t *testing.T) {
+	strategy := func(name string) backoff {
+		b, err := strategyBackoff(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Interval, b.Grow, b.Max, b.Jitter = time.Second, time.Second, 10*time.Second, jitterNone
+		b.setDefaults()
+		return b
+	}
+	curve := DefaultBackoff
+	curve.Jitter = jitterNone
+
+	tests := []struct {
+		name string
+		b    backoff
+		want []time.Duration // Waits before retries 0, 1, 2, ...
+	}{
+		{"curve", curve, []time.Duration{
+			7 * time.Second,
+			17954198473,
+			20939393939,
+			23946745562,
+			26962616822,
+			29977711738,
+		}},
+		{"exponential", strategy(backoffExponential), []time.Duration{
+			0,
+			750 * time.Millisecond,
+			1500 * time.Millisecond,
+			3 * time.Second,
+			6 * time.Second,
+			10 * time.Second,
+		}},
+		{"linear", strategy(backoffLinear), []time.Duration{
+			0,
+			750 * time.Millisecond,
+			1500 * time.Millisecond,
+			2250 * time.Millisecond,
+			3 * time.Second,
+		}},
+		{"fibonacci", strategy(backoffFibonacci), []time.Duration{
+			0,
+			750 * time.Millisecond,
+			750 * time.Millisecond,
+			1500 * time.Millisecond,
+			2250 * time.Millisecond,
+			3750 * time.Millisecond,
+		}},
+		{"decorrelated-jitter", strategy(backoffDecorrelated), []time.Duration{
+			0,
+			time.Second,
+			2 * time.Second,
+			3500 * time.Millisecond,
+			5750 * time.Millisecond,
+			9125 * time.Millisecond,
+			10 * time.Second,
+		}},
+	}
+	for _, tt := range tests {
+		for retry, want := range tt.want {
+			if got := tt.b.backoff(retry, 0); got != want {
+				t.Errorf("%s: backoff(%d) = %v; want %v", tt.name, retry, got, want)
+			}
+		}
+	}
+}
+
+func TestBackoffSeededJitter(t *testing.T) {
+	for _, name := range []string{backoffCurve, backoffExponential, backoffLinear, backoffFibonacci, backoffDecorrelated} {
+		b, err := strategyBackoff(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.setDefaults()
+
+		// Equally seeded sources give the same schedule.
+		b1, b2 := b, b
+		b1.Rand, b2.Rand = rand.New(rand.NewSource(1)), rand.New(rand.NewSource(1))
+		for retry := 1; retry <= 10; retry++ {
+			w1, w2 := b1.backoff(retry, 0), b2.backoff(retry, 0)
+			if w1 != w2 {
+				t.Errorf("%s: backoff(%d) = %v and %v with the same seed", name, retry, w1, w2)
+			}
+			if w1 < b.Min || w1 > b.Max {
+				t.Errorf("%s: backoff(%d) = %v; want within %v..%v", name, retry, w1, b.Min, b.Max)
+			}
+		}
+	}
+}
+
+func TestBackoffStateCarriesFailures(t *testing.T) {
+	b := DefaultBackoff
+	b.Jitter = jitterNone
+	s := newBackoffState(b, 2)
+
+	s.fail()
+	s.fail()
+	if got, want := s.backoff(1, 0), b.backoff(3, 0); got != want {
+		t.Errorf("backoff(1) after 2 failures = %v; want %v", got, want)
+	}
+
+	s.succeed()
+	if got, want := s.next(), b.backoff(2, 0); got != want {
+		t.Errorf("next() after 1 success = %v; want %v", got, want)
+	}
+	s.succeed()
+	if got, want := s.backoff(1, 0), b.backoff(1, 0); got != want {
+		t.Errorf("backoff(1) after 2 successes = %v; want %v", got, want)
+	}
+}
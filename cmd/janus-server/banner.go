@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/golang/glog"
+)
+
+// logPorts logs a summary table of the ports in config.
+func logPorts(config *Config) {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tLISTEN\tPASS\tFLUSH\tTRANSFORMS")
+	for _, p := range config.Ports {
+		name := p.Name
+		if name == "" {
+			name = "-"
+		}
+		if !p.Enabled {
+			name += " (disabled)"
+		}
+
+		listen := make([]string, len(p.Listen))
+		for i, addr := range p.Listen {
+			listen[i] = addr.String()
+			if resolved, err := addr.Resolve(); err != nil {
+				listen[i] += "=<" + err.Error() + ">"
+			} else if resolved.String() != addr.Addr {
+				listen[i] += "=" + resolved.String()
+			}
+		}
+
+		transforms := strings.Join(p.transforms(), ",")
+		if transforms == "" {
+			transforms = "-"
+		}
+
+		flush := fmt.Sprintf("%v/%dB", p.FlushInterval, p.FlushSizeBytes)
+		if p.FlushWhen != nil {
+			flush += " when " + p.FlushWhen.String()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\t%s\n",
+			name,
+			strings.Join(listen, " "),
+			redactURL(p.Forward),
+			flush,
+			transforms,
+		)
+	}
+	w.Flush()
+
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		glog.Info(line)
+	}
+}
@@ -0,0 +1,5 @@
+package main
+
+// readBatchSize is the number of datagrams read per syscall. On Linux, batch
+// reads use recvmmsg.
+const readBatchSize = 32
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// readBatchSize is the number of datagrams read per call. Batch reads fall
+// back to one datagram at a time outside of Linux.
+const readBatchSize = 1
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// benchTick is how often the load generator sends the datagrams due since
+// its last tick.
+const benchTick = time.Millisecond
+
+// benchMain runs `janus-server bench`, which sends line protocol datagrams to
+// a janus listener at a fixed rate and reports the rate achieved. If given
+// the admin stats URL of the target, it also reports how many datagrams the
+// target didn't receive.
+func benchMain(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	var (
+		target   = fs.String("target", "", "Listener to send to, as udp://HOST:PORT")
+		rate     = fs.Int("rate", 10000, "Datagrams to send per second")
+		size     = fs.Int("payload-size", 200, "Approximate size of each datagram in bytes")
+		duration = fs.Duration("duration", 10*time.Second, "How long to send for")
+		stats    = fs.String("stats", "", "Admin stats `URL` of the target, as http://HOST:PORT/stats, to measure loss")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(*target)
+	switch {
+	case *target == "":
+		return errors.New("bench requires a -target")
+	case err != nil:
+		return err
+	case u.Scheme != "udp" && u.Scheme != "udp4" && u.Scheme != "udp6":
+		return fmt.Errorf("-target must be a udp URL; got %q", *target)
+	case *rate < 1:
+		return fmt.Errorf("-rate must be >= 1; got %d", *rate)
+	case *size < 32 || *size > maxDatagram:
+		return fmt.Errorf("-payload-size must be within 32..%d; got %d", maxDatagram, *size)
+	case *duration <= 0:
+		return fmt.Errorf("-duration must be > 0s; got %v", *duration)
+	}
+
+	conn, err := net.Dial(u.Scheme, u.Host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var before uint64
+	if *stats != "" {
+		if before, err = benchReceived(*stats); err != nil {
+			return fmt.Errorf("unable to read stats: %v", err)
+		}
+	}
+
+	fmt.Printf("Sending %d datagrams/s of %d bytes to %s for %v\n", *rate, *size, u.Host, *duration)
+	var (
+		sent, failed uint64
+		payload      []byte
+		start        = time.Now()
+		ticker       = time.NewTicker(benchTick)
+		deadline     = time.NewTimer(*duration)
+	)
+	defer ticker.Stop()
+	defer deadline.Stop()
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-deadline.C:
+			break loop
+		case now := <-ticker.C:
+			due := uint64(now.Sub(start).Seconds() * float64(*rate))
+			for n := sent + failed; n < due; n++ {
+				payload = benchPayload(payload[:0], n, *size)
+				if _, err := conn.Write(payload); err != nil {
+					failed++
+				} else {
+					sent++
+				}
+			}
+		}
+	}
+	elapsed := time.Since(start)
+
+	fmt.Printf("Sent %d datagrams in %v (%.0f/s, %.2f MB/s); %d send errors\n",
+		sent, elapsed.Round(time.Millisecond), float64(sent)/elapsed.Seconds(),
+		float64(sent)*float64(*size)/elapsed.Seconds()/1e6, failed)
+
+	if *stats != "" {
+		// Let the target read what's left in its socket buffers.
+		sleep(ctx, time.Second)
+		after, err := benchReceived(*stats)
+		if err != nil {
+			return fmt.Errorf("unable to read stats: %v", err)
+		}
+		received := after - before
+		var lost uint64
+		if received < sent {
+			lost = sent - received
+		}
+		fmt.Printf("Target received %d datagrams; %d lost (%.3f%%)\n",
+			received, lost, 100*float64(lost)/float64(sent))
+	}
+	return nil
+}
+
+// benchPayload appends a line protocol point numbered seq to dst, padded to
+// about size bytes.
+func benchPayload(dst []byte, seq uint64, size int) []byte {
+	dst = append(dst, "janus_bench,seq="...)
+	dst = strconv.AppendUint(dst, seq%1000, 10)
+	dst = append(dst, " n="...)
+	dst = strconv.AppendUint(dst, seq, 10)
+	dst = append(dst, `i,pad="`...)
+	for pad := size - len(dst) - 2; pad > 0; pad-- {
+		dst = append(dst, 'x')
+	}
+	return append(dst, "\"\n"...)
+}
+
+// benchReceived returns the datagrams received by all ports of the janus
+// whose admin stats are at statsURL.
+func benchReceived(statsURL string) (uint64, error) {
+	resp, err := http.Get(statsURL)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s: %s", statsURL, resp.Status)
+	}
+
+	var body struct {
+		Ports map[string]struct {
+			Packets uint64 `json:"packets"`
+		} `json:"ports"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, port := range body.Ports {
+		n += port.Packets
+	}
+	return n, nil
+}
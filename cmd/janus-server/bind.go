@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"go.spiff.io/codf"
+)
+
+// Simple directives are bound to struct fields with a codf tag naming the
+// directive, in the form `codf:"name[,min=N]"`. The directive's parameters are
+// parsed into the field with parseArgs. If min is given, the parsed value
+// must be >= N. Fields whose pointer implements codf.Walker may be bound to
+// sections without parameters the same way.
+//
+// Directives that need more than this are handled by Walker methods.
+
+// bindStatement parses stmt into the field of dst, a struct pointer, tagged
+// with its name. It returns false if no field has that name.
+func bindStatement(dst interface{}, stmt *codf.Statement) (bool, error) {
+	field, opts, ok := lookupField(dst, stmt.Name())
+	if !ok {
+		return false, nil
+	}
+
+	if err := parseArgs(stmt.Parameters(), field.Addr().Interface()); err != nil {
+		return true, err
+	}
+
+	if min, ok := opts["min"]; ok {
+		if err := checkMin(stmt.Name(), field, min); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// bindSection returns the field of dst tagged with sect's name as a Walker. It
+// returns false if no field has that name.
+func bindSection(dst interface{}, sect *codf.Section) (codf.Walker, bool, error) {
+	field, _, ok := lookupField(dst, sect.Name())
+	if !ok {
+		return nil, false, nil
+	}
+
+	w, ok := field.Addr().Interface().(codf.Walker)
+	if !ok {
+		return nil, true, fmt.Errorf("%s is not a section", sect.Name())
+	}
+	if err := parseArgs(sect.Parameters()); err != nil {
+		return nil, true, err
+	}
+	return w, true, nil
+}
+
+func lookupField(dst interface{}, name string) (reflect.Value, map[string]string, bool) {
+	rv := reflect.ValueOf(dst).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		tag, ok := rt.Field(i).Tag.Lookup("codf")
+		if !ok {
+			continue
+		}
+
+		parts := strings.Split(tag, ",")
+		if parts[0] != name {
+			continue
+		}
+
+		opts := map[string]string{}
+		for _, opt := range parts[1:] {
+			if eq := strings.IndexByte(opt, '='); eq != -1 {
+				opts[opt[:eq]] = opt[eq+1:]
+			} else {
+				opts[opt] = ""
+			}
+		}
+		return rv.Field(i), opts, true
+	}
+	return reflect.Value{}, nil, false
+}
+
+func checkMin(name string, field reflect.Value, min string) error {
+	var below bool
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(min, 10, 64)
+		if err != nil {
+			panic(fmt.Sprintf("invalid min for %s: %v", name, err))
+		}
+		below = field.Int() < n
+		min = fmt.Sprint(reflect.ValueOf(n).Convert(field.Type()))
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(min, 64)
+		if err != nil {
+			panic(fmt.Sprintf("invalid min for %s: %v", name, err))
+		}
+		below = field.Float() < f
+	default:
+		panic(fmt.Sprintf("min is not supported for %s of type %v", name, field.Type()))
+	}
+
+	if below {
+		return fmt.Errorf("%s must be >= %s; got %v", name, min, field.Interface())
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.spiff.io/codf"
+)
+
+// BudgetConfig is a rate budget shared by a group of ports.
+type BudgetConfig struct {
+	Points int64         // Points allowed per period
+	Per    time.Duration // The period
+}
+
+// handleBudget parses `budget NAME RATE [points/s|points/m|points/h]`, where
+// RATE is an integer with an optional k or m suffix.
+func (c *Config) handleBudget(args []codf.ExprNode) error {
+	var name, rate, unit string
+	if len(args) == 2 {
+		if err := parseArgs(args, &name, &rate); err != nil {
+			return err
+		}
+	} else if err := parseArgs(args, &name, &rate, &unit); err != nil {
+		return err
+	}
+
+	if _, ok := c.Budgets[name]; ok {
+		return fmt.Errorf("budget %s is already defined", name)
+	}
+
+	points, err := parseCount(rate)
+	if err != nil {
+		return argError(1, args[1], err)
+	} else if points <= 0 {
+		return argError(1, args[1], fmt.Errorf("budget must be > 0; got %d", points))
+	}
+
+	b := &BudgetConfig{Points: points, Per: time.Second}
+	switch unit {
+	case "", "points/s":
+	case "points/m":
+		b.Per = time.Minute
+	case "points/h":
+		b.Per = time.Hour
+	default:
+		return argError(2, args[2], fmt.Errorf("invalid budget unit %q; must be points/s, points/m, or points/h", unit))
+	}
+
+	if c.Budgets == nil {
+		c.Budgets = map[string]*BudgetConfig{}
+	}
+	c.Budgets[name] = b
+	return nil
+}
+
+// parseCount parses an integer with an optional k (thousands) or m
+// (millions) suffix.
+func parseCount(s string) (int64, error) {
+	scale := int64(1)
+	switch lower := strings.ToLower(s); {
+	case strings.HasSuffix(lower, "k"):
+		s, scale = s[:len(s)-1], 1000
+	case strings.HasSuffix(lower, "m"):
+		s, scale = s[:len(s)-1], 1000000
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid count %q", s)
+	}
+	return n * scale, nil
+}
+
+// handleBudget parses `budget NAME [weight W]`, drawing the port's points from
+// the named budget.
+func (p *PortConfig) handleBudget(args []codf.ExprNode) error {
+	var name string
+	if err := parseArgsUpTo(args, &name); err != nil {
+		return err
+	}
+
+	weight := 1
+	err := parseKwargs("budget", args[1:], kwargs{
+		"weight": {dest: &weight},
+	})
+	if err != nil {
+		return err
+	} else if weight < 1 {
+		return fmt.Errorf("budget weight must be >= 1; got %d", weight)
+	}
+
+	p.Budget, p.BudgetWeight = name, weight
+	return nil
+}
+
+// budgetPool divides a budget of points per period among the ports drawing
+// from it in proportion to their weights. Each port is guaranteed its share
+// of every period. Points a port leaves unused may be borrowed by the others
+// once the remaining budget covers what's still guaranteed to everyone else.
+type budgetPool struct {
+	mu        sync.Mutex
+	cfg       BudgetConfig
+	start     time.Time // Start of the current period
+	remaining int64
+	weights   int64
+	members   map[*budgetMember]struct{}
+}
+
+// budgetMember is a port's claim on a budgetPool.
+type budgetMember struct {
+	pool   *budgetPool
+	weight int64
+	used   int64 // Points taken in the current period
+}
+
+func newBudgetPool(cfg BudgetConfig) *budgetPool {
+	return &budgetPool{
+		cfg:     cfg,
+		members: map[*budgetMember]struct{}{},
+	}
+}
+
+// configure changes the pool's budget, starting a new period.
+func (b *budgetPool) configure(cfg BudgetConfig) {
+	b.mu.Lock()
+	b.cfg, b.start = cfg, time.Time{}
+	b.mu.Unlock()
+}
+
+// member returns a claim on the pool with the given weight. It doesn't
+// count toward the pool's shares until it joins.
+func (b *budgetPool) member(weight int) *budgetMember {
+	return &budgetMember{pool: b, weight: int64(weight)}
+}
+
+func (m *budgetMember) join() {
+	b := m.pool
+	b.mu.Lock()
+	if _, ok := b.members[m]; !ok {
+		b.members[m] = struct{}{}
+		b.weights += m.weight
+	}
+	b.mu.Unlock()
+}
+
+func (m *budgetMember) leave() {
+	b := m.pool
+	b.mu.Lock()
+	if _, ok := b.members[m]; ok {
+		delete(b.members, m)
+		b.weights -= m.weight
+	}
+	b.mu.Unlock()
+}
+
+// share returns the points guaranteed to m each period. Must be called with
+// the pool locked.
+func (m *budgetMember) share() int64 {
+	b := m.pool
+	if b.weights == 0 {
+		return 0
+	}
+	return b.cfg.Points * m.weight / b.weights
+}
+
+func (m *budgetMember) take() bool {
+	b := m.pool
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now := time.Now(); now.Sub(b.start) >= b.cfg.Per {
+		b.start, b.remaining = now, b.cfg.Points
+		for other := range b.members {
+			other.used = 0
+		}
+	}
+
+	if b.remaining <= 0 {
+		return false
+	}
+
+	if m.used >= m.share() {
+		var reserved int64
+		for other := range b.members {
+			if other != m && other.used < other.share() {
+				reserved += other.share() - other.used
+			}
+		}
+		if b.remaining <= reserved {
+			return false
+		}
+	}
+
+	m.used++
+	b.remaining--
+	return true
+}
+
+// budgetStage drops lines once its port has exhausted what it may draw from
+// its budget for the current period.
+type budgetStage struct {
+	member *budgetMember
+	stats  *portStats
+	dead   *deadLetter
+}
+
+func (s *budgetStage) apply(dst, line []byte) []byte {
+	if s.member.take() {
+		return append(dst, line...)
+	}
+	s.stats.addOverflow()
+	s.stats.addDrop()
+	s.dead.add(deadBudget, line)
+	return dst
+}
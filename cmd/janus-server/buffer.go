@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+
+	"go.spiff.io/codf"
+)
+
+// Buffer overflow policies.
+const (
+	bufferDropOldest = "drop-oldest" // Drop the oldest unsent batch at its next attempt, or the payload if there's none
+	bufferDropNewest = "drop-newest" // Drop the payload being written
+	bufferBlock      = "block"       // Wait for room, stalling the port's workers
+)
+
+// BufferConfig bounds the bytes a port holds that haven't been delivered
+// upstream, whether accumulating or waiting to be retried.
+type BufferConfig struct {
+	Max      int64  // Bytes; 0 is unbounded
+	Overflow string // Policy for payloads written while the buffer is full
+}
+
+// handleMaxBufferBytes parses `max-buffer-bytes SIZE [overflow POLICY]`.
+func (p *PortConfig) handleMaxBufferBytes(args []codf.ExprNode) error {
+	b := BufferConfig{Overflow: bufferDropNewest}
+	if err := parseArgsUpTo(args, &b.Max); err != nil {
+		return err
+	}
+	err := parseKwargs("max-buffer-bytes", args[1:], kwargs{
+		"overflow": {dest: &b.Overflow},
+	})
+	if err != nil {
+		return err
+	}
+
+	if b.Max < 0 {
+		return fmt.Errorf("max-buffer-bytes must be >= 0; got %d", b.Max)
+	}
+	switch b.Overflow {
+	case bufferDropOldest, bufferDropNewest, bufferBlock:
+	default:
+		return fmt.Errorf("invalid buffer overflow policy %q; must be drop-oldest, drop-newest, or block", b.Overflow)
+	}
+	p.Buffer = b
+	return nil
+}
+
+// bufferLimit counts the bytes written to a port's proxy until the batches
+// holding them are delivered or given up on, and applies the overflow policy
+// once they pass the limit.
+type bufferLimit struct {
+	cfg   BufferConfig
+	stats *portStats
+
+	mu      sync.Mutex
+	pending int64          // Bytes written and not yet released
+	batches []*tracedBatch // Sent batches not yet released, oldest first
+	room    chan struct{}  // Closed when bytes are released
+	done    chan struct{}  // Closed when the port stops
+}
+
+func newBufferLimit(cfg BufferConfig, stats *portStats) *bufferLimit {
+	return &bufferLimit{
+		cfg:   cfg,
+		stats: stats,
+		room:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// reserve claims room for n bytes about to be written. It reports whether
+// they may be written.
+func (b *bufferLimit) reserve(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// A payload larger than the whole buffer is only written once it's empty.
+	for b.pending > 0 && b.pending+int64(n) > b.cfg.Max {
+		switch b.cfg.Overflow {
+		case bufferDropOldest:
+			if len(b.batches) == 0 {
+				// The buffer is all unsent writes; nothing can be evicted,
+				// so the payload is dropped as with drop-newest.
+				b.stats.addBufferDropped()
+				return false
+			}
+			b.evict(b.batches[0])
+		case bufferBlock:
+			room := b.room
+			b.mu.Unlock()
+			select {
+			case <-room:
+			case <-b.done:
+				b.mu.Lock()
+				b.stats.addBufferDropped()
+				return false
+			}
+			b.mu.Lock()
+		default:
+			b.stats.addBufferDropped()
+			return false
+		}
+	}
+	b.pending += int64(n)
+	return true
+}
+
+// cancel returns room reserved for n bytes that weren't written.
+func (b *bufferLimit) cancel(n int) {
+	b.mu.Lock()
+	if b.pending -= int64(n); b.pending < 0 {
+		b.pending = 0
+	}
+	b.mu.Unlock()
+}
+
+// sent adds a batch taken from the proxy's buffer to those awaiting delivery.
+// Batches past maxPendingBatches have been forgotten by the port's tracer, so
+// the oldest are released.
+func (b *bufferLimit) sent(batch *tracedBatch) {
+	b.mu.Lock()
+	b.batches = append(b.batches, batch)
+	for len(b.batches) > maxPendingBatches {
+		b.releaseLocked(b.batches[0])
+	}
+	b.mu.Unlock()
+}
+
+// evict releases the bytes of batch and marks it to be dropped at its next
+// attempt. Must be called with b.mu held.
+func (b *bufferLimit) evict(batch *tracedBatch) {
+	glog.Warningf("Buffer of %d bytes is full; dropping batch %s of %d bytes", b.cfg.Max, batch.id, batch.raw)
+	batch.evicted = true
+	b.stats.addBufferEvicted()
+	b.releaseLocked(batch)
+}
+
+// evicted reports whether batch was dropped to make room.
+func (b *bufferLimit) evicted(batch *tracedBatch) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return batch.evicted
+}
+
+// release frees the bytes of a batch that was delivered or given up on.
+// Releasing a batch more than once has no effect.
+func (b *bufferLimit) release(batch *tracedBatch) {
+	b.mu.Lock()
+	b.releaseLocked(batch)
+	b.mu.Unlock()
+}
+
+func (b *bufferLimit) releaseLocked(batch *tracedBatch) {
+	for i, other := range b.batches {
+		if other != batch {
+			continue
+		}
+		b.batches = append(b.batches[:i], b.batches[i+1:]...)
+		if b.pending -= batch.raw; b.pending < 0 {
+			b.pending = 0
+		}
+		close(b.room)
+		b.room = make(chan struct{})
+		return
+	}
+}
+
+// stop wakes any blocked writers, which drop their payloads.
+func (b *bufferLimit) stop() { close(b.done) }
+
+// usage returns the bytes currently held.
+func (b *bufferLimit) usage() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pending
+}
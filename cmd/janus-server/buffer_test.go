@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+// TestBufferDropOldest checks that drop-oldest evicts sent batches to make
+// room and drops the payload once there's none left to evict.
+func TestBufferDropOldest(t *testing.T) {
+	stats := new(portStats)
+	b := newBufferLimit(BufferConfig{Max: 10, Overflow: bufferDropOldest}, stats)
+
+	if !b.reserve(6) {
+		t.Fatal("first payload was dropped")
+	}
+	batch := &tracedBatch{id: "a", raw: 6}
+	b.sent(batch)
+
+	if !b.reserve(6) {
+		t.Fatal("payload wasn't written in place of the oldest batch")
+	}
+	if !b.evicted(batch) || stats.BufferEvicted != 1 {
+		t.Errorf("oldest batch wasn't evicted")
+	}
+
+	if b.reserve(6) {
+		t.Error("payload was written with nothing left to evict")
+	}
+	if stats.BufferDropped != 1 {
+		t.Errorf("buffer_dropped = %d; want 1", stats.BufferDropped)
+	}
+	if n := b.usage(); n > 10 {
+		t.Errorf("buffer holds %d bytes; want at most 10", n)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// captureMagic begins every capture file, followed by its version.
+const (
+	captureMagic   = "JANUSCAP"
+	captureVersion = 1
+)
+
+// A capture file holds the datagrams received by a port. After its header,
+// each record is a big-endian uint32 length of the rest of the record
+// followed by:
+//
+//	int64  time received, in Unix nanoseconds
+//	uint8  length of the listener's network, then the network
+//	uint8  length of the listener's address, then the address
+//	uint8  length of the sender's address, then the address
+//	[]byte the datagram
+type captureRecord struct {
+	Time    time.Time
+	Network string
+	Addr    string
+	Source  string
+	Payload []byte
+}
+
+// captureFlushInterval is how often a recorder flushes its buffered records
+// to disk.
+const captureFlushInterval = time.Second
+
+// recorder appends the datagrams received by a port's listeners to a capture
+// file.
+type recorder struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	hdr  []byte
+	err  error // The first write error; recording stops after one
+}
+
+// openRecorder opens the capture file at path, writing its header if it's
+// new. Records are appended to an existing capture.
+func openRecorder(path string) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		_, err = f.Write(append([]byte(captureMagic), captureVersion))
+	} else {
+		err = readCaptureHeader(io.NewSectionReader(f, 0, fi.Size()))
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return &recorder{path: path, file: f, w: bufio.NewWriterSize(f, 64*1024)}, nil
+}
+
+// record appends a datagram received by listener from src.
+func (r *recorder) record(listener *Addr, src net.Addr, payload []byte) {
+	var source string
+	if src != nil {
+		source = src.String()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+
+	hdr := r.hdr[:0]
+	hdr = append(hdr, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(hdr[4:], uint64(time.Now().UnixNano()))
+	for _, s := range []string{listener.Network, listener.Addr, source} {
+		if len(s) > 255 {
+			s = s[:255]
+		}
+		hdr = append(append(hdr, byte(len(s))), s...)
+	}
+	binary.BigEndian.PutUint32(hdr, uint32(len(hdr)-4+len(payload)))
+	r.hdr = hdr
+
+	if _, err := r.w.Write(hdr); err == nil {
+		_, r.err = r.w.Write(payload)
+	} else {
+		r.err = err
+	}
+	if r.err != nil {
+		glog.Errorf("Unable to record to %s; recording stopped: %v", r.path, r.err)
+	}
+}
+
+// run flushes buffered records periodically until ctx is done, then closes
+// the capture file.
+func (r *recorder) run(ctx context.Context) {
+	ticker := time.NewTicker(captureFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.close()
+			return
+		case <-ticker.C:
+			r.flush()
+		}
+	}
+}
+
+func (r *recorder) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		if r.err = r.w.Flush(); r.err != nil {
+			glog.Errorf("Unable to record to %s; recording stopped: %v", r.path, r.err)
+		}
+	}
+}
+
+func (r *recorder) close() {
+	r.flush()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.file.Close(); err != nil {
+		glog.Errorf("Unable to close capture %s: %v", r.path, err)
+	}
+	if r.err == nil {
+		r.err = os.ErrClosed // Drop datagrams read while listeners stop
+	}
+}
+
+func readCaptureHeader(rd io.Reader) error {
+	var hdr [len(captureMagic) + 1]byte
+	if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+		return fmt.Errorf("unable to read capture header: %v", err)
+	}
+	if string(hdr[:len(captureMagic)]) != captureMagic {
+		return errors.New("not a capture file")
+	}
+	if v := hdr[len(captureMagic)]; v != captureVersion {
+		return fmt.Errorf("unsupported capture version %d", v)
+	}
+	return nil
+}
+
+// readCaptureRecord reads the next record of a capture. It returns io.EOF
+// after the last one.
+func readCaptureRecord(rd io.Reader) (*captureRecord, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(rd, size[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	if len(buf) < 8 {
+		return nil, errors.New("truncated capture record")
+	}
+	rec := &captureRecord{Time: time.Unix(0, int64(binary.BigEndian.Uint64(buf)))}
+	buf = buf[8:]
+	for _, dst := range []*string{&rec.Network, &rec.Addr, &rec.Source} {
+		if len(buf) < 1 || len(buf) < 1+int(buf[0]) {
+			return nil, errors.New("truncated capture record")
+		}
+		n := 1 + int(buf[0])
+		*dst, buf = string(buf[1:n]), buf[n:]
+	}
+	rec.Payload = buf
+	return rec, nil
+}
+
+// replayCaptureMain runs `janus-server replay-capture [-speed F] [-target
+// HOST:PORT] FILE`, which resends the datagrams of a capture to the listeners
+// they were received on, or to the target.
+func replayCaptureMain(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("replay-capture", flag.ContinueOnError)
+	speed := fs.Float64("speed", 1, "Replay speed relative to the capture; 0 sends as fast as possible")
+	target := fs.String("target", "", "Send all datagrams to this UDP `address` instead of the listeners that received them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: janus-server replay-capture [-speed F] [-target HOST:PORT] FILE")
+	} else if *speed < 0 {
+		return fmt.Errorf("-speed must be >= 0; got %v", *speed)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rd := bufio.NewReaderSize(f, 64*1024)
+	if err := readCaptureHeader(rd); err != nil {
+		return err
+	}
+
+	conns := map[string]net.Conn{}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	var (
+		first, start time.Time
+		sent         int
+		size         int64
+	)
+	for ctx.Err() == nil {
+		rec, err := readCaptureRecord(rd)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("record %d: %v", sent+1, err)
+		}
+
+		if first.IsZero() {
+			first, start = rec.Time, time.Now()
+		} else if *speed > 0 {
+			due := start.Add(time.Duration(float64(rec.Time.Sub(first)) / *speed))
+			if wait := time.Until(due); wait > 0 {
+				sleep(ctx, wait)
+			}
+		}
+
+		network, addr := "udp", *target
+		if addr == "" {
+			network, addr = rec.Network, rec.Addr
+		}
+		key := network + " " + addr
+		conn, ok := conns[key]
+		if !ok {
+			if conn, err = net.Dial(network, addr); err != nil {
+				return err
+			}
+			conns[key] = conn
+		}
+
+		if _, err := conn.Write(rec.Payload); err != nil {
+			glog.Warningf("Unable to send record %d to %s: %v", sent+1, addr, err)
+		}
+		sent++
+		size += int64(len(rec.Payload))
+	}
+
+	glog.Infof("Replayed %d datagrams (%d bytes) in %v", sent, size, time.Since(start))
+	return ctx.Err()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"go.spiff.io/codf"
+)
+
+// Actions for lines with tag values past a port's cardinality limit.
+const (
+	cardinalityDrop  = "drop"  // Drop the line
+	cardinalityStrip = "strip" // Forward the line without the tags past the limit
+)
+
+// maxCardinalityKeys bounds the tag keys a cardinalityGuard tracks. Values of
+// keys past it are handled as over the limit.
+const maxCardinalityKeys = 1 << 12
+
+// CardinalityConfig limits the distinct values each tag key may take within
+// a window.
+type CardinalityConfig struct {
+	Limit  int           // Distinct values allowed per tag key; 0 disables the guard
+	Window time.Duration // How long values are counted before they're forgotten
+	Action string        // What's done with lines past the limit
+}
+
+// handleCardinalityGuard parses `cardinality-guard off` or
+// `cardinality-guard LIMIT [window D] [action drop|strip]`.
+func (p *PortConfig) handleCardinalityGuard(args []codf.ExprNode) error {
+	if len(args) == 1 {
+		if w, ok := codf.Word(args[0]); ok && w == "off" {
+			p.Cardinality = CardinalityConfig{}
+			return nil
+		}
+	}
+
+	c := CardinalityConfig{Window: time.Hour, Action: cardinalityStrip}
+	if err := parseArgsUpTo(args, &c.Limit); err != nil {
+		return err
+	}
+	err := parseKwargs("cardinality-guard", args[1:], kwargs{
+		"window": {dest: &c.Window},
+		"action": {dest: &c.Action},
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c.Limit < 1:
+		return fmt.Errorf("cardinality-guard limit must be >= 1; got %d", c.Limit)
+	case c.Window <= 0:
+		return fmt.Errorf("cardinality-guard window must be > 0s; got %v", c.Window)
+	}
+	switch c.Action {
+	case cardinalityDrop, cardinalityStrip:
+	default:
+		return fmt.Errorf("invalid cardinality-guard action %q; must be drop or strip", c.Action)
+	}
+	p.Cardinality = c
+	return nil
+}
+
+// cardinalityGuard counts the distinct values of each tag key over a window
+// and drops lines, or strips their tags, once a key takes more values than
+// its limit. The window is fixed: every value is forgotten once it ends.
+// Keys and values are compared escaped.
+type cardinalityGuard struct {
+	cfg   CardinalityConfig
+	stats *portStats
+	dead  *deadLetter
+
+	mu       sync.Mutex
+	start    time.Time
+	values   map[string]map[string]struct{} // Values seen this window, by key
+	exceeded map[string]bool                // Keys past the limit this window
+}
+
+func newCardinalityGuard(cfg CardinalityConfig, stats *portStats, dead *deadLetter) *cardinalityGuard {
+	return &cardinalityGuard{
+		cfg:      cfg,
+		stats:    stats,
+		dead:     dead,
+		start:    time.Now(),
+		values:   map[string]map[string]struct{}{},
+		exceeded: map[string]bool{},
+	}
+}
+
+// admit reports whether the tag key=value is within the limit, and counts
+// value if it's new.
+func (c *cardinalityGuard) admit(key, value string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now := time.Now(); now.Sub(c.start) >= c.cfg.Window {
+		c.start = now
+		c.values = map[string]map[string]struct{}{}
+		c.exceeded = map[string]bool{}
+	}
+
+	seen := c.values[key]
+	if seen == nil {
+		if len(c.values) >= maxCardinalityKeys {
+			return false
+		}
+		seen = map[string]struct{}{}
+		c.values[key] = seen
+	}
+	if _, ok := seen[value]; ok {
+		return true
+	}
+	if len(seen) < c.cfg.Limit {
+		seen[value] = struct{}{}
+		return true
+	}
+
+	if !c.exceeded[key] {
+		c.exceeded[key] = true
+		glog.Warningf("Tag %s has reached %d values within %v; new values are handled by action %s",
+			key, c.cfg.Limit, c.cfg.Window, c.cfg.Action)
+	}
+	return false
+}
+
+func (c *cardinalityGuard) apply(dst, line []byte) []byte {
+	end := keyEnd(line)
+	mend := measurementEnd(line)
+	if end == -1 || mend == -1 || mend == end {
+		return append(dst, line...)
+	}
+
+	// Tags are checked in place, and only copied once one is stripped.
+	n := len(dst)
+	stripped := false
+	dst = append(dst, line[:mend]...)
+	for set := line[mend:end]; len(set) > 0; {
+		tag := set
+		if i := unescapedIndex(set[1:], ','); i != -1 {
+			tag, set = set[:i+1], set[i+1:]
+		} else {
+			set = nil
+		}
+
+		eq := unescapedIndex(tag, '=')
+		if eq == -1 || c.admit(string(tag[1:eq]), string(tag[eq+1:])) {
+			dst = append(dst, tag...)
+			continue
+		}
+		if c.cfg.Action == cardinalityDrop {
+			c.stats.addTagsLimited()
+			c.stats.addDrop()
+			c.dead.add(deadCardinality, line)
+			return dst[:n]
+		}
+		stripped = true
+	}
+	if stripped {
+		c.stats.addTagsLimited()
+	}
+	return append(dst, line[end:]...)
+}
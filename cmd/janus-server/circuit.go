@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"go.spiff.io/codf"
+	"golang.org/x/net/context"
+)
+
+// Circuit breaker spool policies.
+const (
+	spoolNone   = "none"   // Fail flushes while the circuit is open
+	spoolMemory = "memory" // Hold batches in memory
+	spoolDisk   = "disk"   // Write batches to a directory
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// errSpooled is returned in place of sending a batch while the circuit is
+// open, once the batch is spooled to be replayed.
+var errSpooled = errors.New("batch spooled while the circuit breaker is open")
+
+// BreakerConfig configures the circuit breaker around a port's flushes.
+type BreakerConfig struct {
+	Failures  int           // Consecutive failed flushes that open the circuit; 0 disables the breaker
+	Cooldown  time.Duration // How long the circuit stays open before a probe flush
+	Spool     string        // What to do with batches while the circuit is open
+	Dir       string        // Directory of the disk spool
+	Max       int64         // Bytes the spool may hold; the oldest batches are dropped past it
+	Threshold int64         // Bytes of spooled batches that emit a spool-threshold event; 0 never does
+}
+
+// handleCircuitBreaker parses `circuit-breaker off` or
+// `circuit-breaker FAILURES [cooldown D] [spool none|memory|disk] [dir PATH] [max BYTES] [threshold BYTES]`.
+func (p *PortConfig) handleCircuitBreaker(args []codf.ExprNode) error {
+	if len(args) == 1 {
+		if w, ok := codf.Word(args[0]); ok && w == "off" {
+			p.Breaker = BreakerConfig{}
+			return nil
+		}
+	}
+
+	b := BreakerConfig{Cooldown: 30 * time.Second, Spool: spoolNone, Max: 64 << 20}
+	if err := parseArgsUpTo(args, &b.Failures); err != nil {
+		return err
+	}
+	err := parseKwargs("circuit-breaker", args[1:], kwargs{
+		"cooldown":  {dest: &b.Cooldown},
+		"spool":     {dest: &b.Spool},
+		"dir":       {dest: &b.Dir},
+		"max":       {dest: &b.Max},
+		"threshold": {dest: &b.Threshold},
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case b.Failures < 1:
+		return fmt.Errorf("circuit-breaker failures must be >= 1; got %d", b.Failures)
+	case b.Cooldown <= 0:
+		return fmt.Errorf("circuit-breaker cooldown must be > 0s; got %v", b.Cooldown)
+	case b.Max <= 0:
+		return fmt.Errorf("circuit-breaker max must be > 0; got %d", b.Max)
+	case b.Threshold < 0 || b.Threshold > b.Max:
+		return fmt.Errorf("circuit-breaker threshold must be between 0 and max (%d); got %d", b.Max, b.Threshold)
+	case b.Threshold > 0 && b.Spool == spoolNone:
+		return errors.New("circuit-breaker threshold requires a spool")
+	}
+
+	switch b.Spool {
+	case spoolNone, spoolMemory:
+		if b.Dir != "" {
+			return fmt.Errorf("circuit-breaker dir is only allowed with spool %s", spoolDisk)
+		}
+	case spoolDisk:
+		if b.Dir == "" {
+			return fmt.Errorf("circuit-breaker spool %s requires a dir", spoolDisk)
+		}
+	default:
+		return fmt.Errorf("invalid circuit-breaker spool %q; must be none, memory, or disk", b.Spool)
+	}
+
+	p.Breaker = b
+	return nil
+}
+
+// Circuit states.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// breakerTransport stops sending flushes to an upstream after consecutive
+// failures. While the circuit is open, batches are spooled, if the policy
+// allows, and errSpooled returned so that the port's classifyTransport,
+// which it sits under, acknowledges them and the proxy doesn't retry them.
+// Once the cooldown passes, one flush is let through as a probe: if it
+// succeeds, the circuit closes and spooled batches are replayed. Replays are
+// sent straight to base, so they aren't counted as the port's flushes.
+type breakerTransport struct {
+	base    http.RoundTripper
+	cfg     BreakerConfig
+	port    string        // Port description, for events
+	header  string        // Request header of batch IDs, dropped from replays, if any
+	timeout time.Duration // Timeout of replayed flushes
+	stats   *portStats
+	spool   spool // nil if the policy is none
+
+	mu        sync.Mutex
+	ctx       context.Context // Context of the gateway, set by start
+	state     string
+	failures  int
+	opened    time.Time
+	template  *http.Request // Request replayed batches are sent as
+	replaying bool
+	spoolOver bool // Whether the spool is past its threshold
+}
+
+func newBreakerTransport(base http.RoundTripper, cfg BreakerConfig, port, header string, timeout time.Duration, stats *portStats) (*breakerTransport, error) {
+	t := &breakerTransport{
+		base:    base,
+		cfg:     cfg,
+		port:    port,
+		header:  header,
+		timeout: timeout,
+		stats:   stats,
+		state:   circuitClosed,
+		ctx:     context.Background(),
+	}
+
+	var err error
+	switch cfg.Spool {
+	case spoolMemory:
+		t.spool = &memorySpool{max: cfg.Max, stats: stats}
+	case spoolDisk:
+		t.spool, err = newDiskSpool(cfg.Dir, cfg.Max, stats)
+	}
+	return t, err
+}
+
+// start sets the context replayed batches are sent under. Replays stop once
+// ctx is done.
+func (t *breakerTransport) start(ctx context.Context) {
+	t.mu.Lock()
+	t.ctx = ctx
+	t.mu.Unlock()
+}
+
+// allow reports whether a request may be sent, moving an open circuit to
+// half-open once its cooldown has passed.
+func (t *breakerTransport) allow() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch t.state {
+	case circuitOpen:
+		if time.Since(t.opened) < t.cfg.Cooldown {
+			return false
+		}
+		glog.Infof("Circuit breaker of %v is half-open; sending a probe flush", t.port)
+		t.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		return false // Only the probe is sent
+	}
+	return true
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	if t.template == nil {
+		t.template = templateRequest(req, t.header)
+	}
+	t.mu.Unlock()
+
+	if !t.allow() {
+		return t.hold(req)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	failed := err != nil
+	if err == nil {
+		_, failed = classifyStatus(resp.StatusCode)
+	}
+	t.record(failed)
+	return resp, err
+}
+
+// hold spools a request's batch while the circuit is open, returning
+// errSpooled, or fails the request if there is no spool.
+func (t *breakerTransport) hold(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	if t.spool == nil {
+		return nil, errCircuitOpen
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.spool.push(body); err != nil {
+		return nil, fmt.Errorf("%w; unable to spool batch: %v", errCircuitOpen, err)
+	}
+	t.stats.addSpooled()
+	t.checkSpool()
+	return nil, errSpooled
+}
+
+// checkSpool emits a spool-threshold event when the spool grows past its
+// threshold. It's emitted again only once the spool has dropped back under
+// the threshold.
+func (t *breakerTransport) checkSpool() {
+	if t.cfg.Threshold <= 0 {
+		return
+	}
+	size := t.spool.size()
+	t.mu.Lock()
+	crossed := size >= t.cfg.Threshold && !t.spoolOver
+	t.spoolOver = size >= t.cfg.Threshold
+	t.mu.Unlock()
+
+	if crossed {
+		glog.Warningf("Spool of %v holds %d bytes, past its threshold of %d", t.port, size, t.cfg.Threshold)
+		emitEvent(eventSpoolThreshold, t.port, "Spool holds %d bytes, past its threshold of %d", size, t.cfg.Threshold)
+	}
+}
+
+// record updates the circuit with the result of a flush.
+func (t *breakerTransport) record(failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !failed {
+		if t.state != circuitClosed {
+			glog.Infof("Circuit breaker of %v closed", t.port)
+		}
+		t.state, t.failures = circuitClosed, 0
+		if t.spool != nil && !t.replaying && t.spool.len() > 0 {
+			t.replaying = true
+			go t.replay()
+		}
+		return
+	}
+
+	t.failures++
+	if t.state == circuitHalfOpen || (t.state == circuitClosed && t.failures >= t.cfg.Failures) {
+		t.state, t.opened = circuitOpen, time.Now()
+		t.stats.addCircuitOpen()
+		glog.Errorf("Circuit breaker of %v opened after %d consecutive failed flushes; pausing flushes for %v",
+			t.port, t.failures, t.cfg.Cooldown)
+		emitEvent(eventCircuitOpen, t.port, "Circuit breaker opened after %d consecutive failed flushes", t.failures)
+	}
+}
+
+// replay sends spooled batches, oldest first, until the spool is empty or a
+// batch fails, in which case it's returned to the head of the spool.
+func (t *breakerTransport) replay() {
+	defer func() {
+		t.mu.Lock()
+		t.replaying = false
+		t.mu.Unlock()
+	}()
+
+	t.mu.Lock()
+	parent := t.ctx
+	t.mu.Unlock()
+
+	for {
+		if !t.closed() || parent.Err() != nil {
+			return
+		}
+
+		body, ok, err := t.spool.pop()
+		if err != nil {
+			glog.Errorf("Unable to read spooled batch for %v: %v", t.port, err)
+			return
+		} else if !ok {
+			return
+		}
+		t.checkSpool()
+
+		ctx, cancel := parent, context.CancelFunc(func() {})
+		if t.timeout > 0 {
+			ctx, cancel = context.WithTimeout(parent, t.timeout)
+		}
+		t.mu.Lock()
+		req := t.template.WithContext(ctx)
+		t.mu.Unlock()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+
+		resp, err := t.base.RoundTrip(req)
+		failed := err != nil
+		if err == nil {
+			_, failed = classifyStatus(resp.StatusCode)
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		cancel()
+		if failed {
+			if err := t.spool.pushFront(body); err != nil {
+				glog.Errorf("Unable to return batch to the spool of %v: %v", t.port, err)
+			}
+			t.checkSpool()
+			t.record(true) // Failed
+			return
+		}
+		t.stats.addReplayed()
+	}
+}
+
+func (t *breakerTransport) closed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state == circuitClosed
+}
+
+// circuitState returns the state of the circuit.
+func (t *breakerTransport) circuitState() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+// templateRequest returns a copy of req without its body or the batch ID in
+// header, if set, to send replayed batches with.
+func templateRequest(req *http.Request, header string) *http.Request {
+	dup := new(http.Request)
+	*dup = *req
+	dup.Body, dup.GetBody, dup.ContentLength = nil, nil, 0
+	dup.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		dup.Header[k] = v
+	}
+	if header != "" {
+		dup.Header.Del(header)
+	}
+	return dup
+}
@@ -1,44 +1,163 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/golang/glog"
+
 	"go.spiff.io/codf"
 )
 
 type Config struct {
-	Ports []*PortConfig
+	Ports     []*PortConfig
+	Templates map[string]*PortConfig
+	DNS       DNSConfig      `codf:"dns"`
+	Identity  IdentityConfig `codf:"identity"`
+	OTLP      OTLPConfig     `codf:"otlp"`
+	Hooks     []*EventHook
+	Budgets   map[string]*BudgetConfig
+	// PortSource is a store to read more port sections from, if any.
+	PortSource *PortSourceConfig
+	// Supervisor controls what happens when a gateway fails.
+	Supervisor SupervisorConfig
+
+	MaxRequests      int   `codf:"max-requests"`
+	MaxInflightBytes int64 `codf:"max-inflight-bytes,min=0"`
+	MaxEgressRate    int64 `codf:"max-egress-rate,min=0"` // Bytes per second sent to upstreams across all ports; 0 is unlimited
+
+	// ReloadOverlap is how long replaced gateways keep running alongside their
+	// replacements when reloading. Listeners are bound with SO_REUSEPORT when
+	// it is greater than zero.
+	ReloadOverlap time.Duration `codf:"reload-overlap,min=0"`
+
+	// AdminListen is the TCP address to serve the admin API on, if any. It is
+	// only read at startup.
+	AdminListen string `codf:"admin-listen"`
+
+	// DebugListen is the TCP address to serve pprof and expvar on, if any. It
+	// is only read at startup.
+	DebugListen string `codf:"debug-listen"`
+
+	// User and Group are the user and group to switch to once listeners are
+	// bound. They are only read at startup.
+	User  string `codf:"user"`
+	Group string `codf:"group"`
+
+	// RollupRetention is how long per-minute rollups of port counters are
+	// kept in memory. Zero disables rollups.
+	RollupRetention time.Duration `codf:"rollup-retention,min=0"`
+
+	// StatsInterval is how often to log a summary of each port's counters.
+	// Zero disables it.
+	StatsInterval time.Duration `codf:"stats-interval,min=0"`
+
+	// StateFile is the path to write a JSON dump of the server's state to on
+	// a fatal error or when requested through the admin API.
+	StateFile string `codf:"state-file"`
+
+	// HealthFlushes is the number of recent flushes to each upstream that
+	// must have succeeded for the server to be ready. At most 16 are checked.
+	HealthFlushes int `codf:"health-flushes,min=1"`
+
+	// Hash is the SHA-256 hash of the config files' contents.
+	Hash string
+
+	// Source is the contents of the config files, in order, as a single
+	// config that loads to the same Config.
+	Source []byte
+}
+
+func NewConfig() *Config {
+	return &Config{
+		RollupRetention: 6 * time.Hour,
+		OTLP:            OTLPConfig{Sample: 1},
+		HealthFlushes:   3,
+		Supervisor:      defaultSupervisor(),
+	}
+}
+
+// loadConfig parses cfgfiles, in order, into a new Config.
+func loadConfig(cfgfiles []string) (*Config, error) {
+	config := NewConfig()
+	hash := sha256.New()
+	var source bytes.Buffer
+	for _, fp := range cfgfiles {
+		if fp == "-" {
+			glog.Info("Reading config from standard input...")
+		}
+
+		fmt.Fprintf(&source, "' file: %s\n", fileName(fp))
+		if err := parseConfig(config, fp, io.MultiWriter(hash, &source)); err != nil {
+			return nil, fmt.Errorf("unable to load config: %v", err)
+		}
+		if b := source.Bytes(); b[len(b)-1] != '\n' {
+			source.WriteByte('\n')
+		}
+	}
+	config.Hash = hex.EncodeToString(hash.Sum(nil))
+	config.Source = source.Bytes()
+
+	if config.ReloadOverlap > 0 && !reusePortSupported {
+		return nil, errors.New("unable to load config: reload-overlap requires SO_REUSEPORT, which is not supported on this platform")
+	}
 
-	MaxRequests int
+	for _, port := range config.Ports {
+		if _, ok := config.Budgets[port.Budget]; port.Budget != "" && !ok {
+			return nil, fmt.Errorf("unable to load config: port %v uses undefined budget %s", port.Listen, port.Budget)
+		}
+	}
+	return config, nil
 }
 
-func parseConfig(dst *Config, fpath string) (err error) {
-	doc, err := loadDocument(fpath)
+func parseConfig(dst *Config, fpath string, hash io.Writer) (err error) {
+	doc, err := loadDocument(fpath, hash)
 	if err != nil {
 		return err
 	}
-	return codf.Walk(doc, dst)
+	return codf.Walk(doc, &fileWalker{file: fileName(fpath), w: dst})
 }
 
 var _ codf.Walker = (*Config)(nil)
 
 func (c *Config) Statement(stmt *codf.Statement) error {
+	if ok, err := bindStatement(c, stmt); ok {
+		return err
+	}
+
 	switch name := stmt.Name(); name {
-	case "max-requests":
-		return c.handleMaxRequests(stmt.Parameters())
+	case "budget":
+		return c.handleBudget(stmt.Parameters())
+	case "port-source":
+		return c.handlePortSource(stmt.Parameters())
+	case "on-gateway-failure":
+		return c.handleOnGatewayFailure(stmt.Parameters())
 	default:
 		return fmt.Errorf("unrecognized directive %s", name)
 	}
 }
 
 func (c *Config) EnterSection(sect *codf.Section) (codf.Walker, error) {
+	if w, ok, err := bindSection(c, sect); ok {
+		return w, err
+	}
+
 	switch name := sect.Name(); name {
 	case "port":
 		return c.enterPort(sect.Parameters())
+	case "template":
+		return c.enterTemplate(sect.Parameters())
+	case "on-event":
+		return c.enterOnEvent(sect.Parameters())
 	default:
 		return nil, fmt.Errorf("unrecognized section %s", name)
 	}
@@ -46,64 +165,375 @@ func (c *Config) EnterSection(sect *codf.Section) (codf.Walker, error) {
 
 // Config handlers
 
-func (c *Config) handleMaxRequests(args []codf.ExprNode) error {
-	return parseArgs(args, &c.MaxRequests)
-}
-
+// enterPort begins a port section. Any section parameters are handled as
+// addresses to listen on, as with the listen directive.
 func (c *Config) enterPort(args []codf.ExprNode) (codf.Walker, error) {
-	if err := parseArgs(args); err != nil {
+	port := NewPortConfig()
+	if err := port.handleListen(args); err != nil {
 		return nil, err
 	}
-	port := NewPortConfig()
 	c.Ports = append(c.Ports, port)
-	return port, nil
+	return &portSection{PortConfig: port, templates: c.Templates}, nil
+}
+
+func (c *Config) enterTemplate(args []codf.ExprNode) (codf.Walker, error) {
+	var name string
+	if err := parseArgs(args, &name); err != nil {
+		return nil, err
+	}
+	if _, ok := c.Templates[name]; ok {
+		return nil, fmt.Errorf("template %s is already defined", name)
+	}
+	if c.Templates == nil {
+		c.Templates = map[string]*PortConfig{}
+	}
+	tmpl := NewPortConfig()
+	c.Templates[name] = tmpl
+	return &templateSection{portSection{PortConfig: tmpl, templates: c.Templates}}, nil
+}
+
+// enterOnEvent begins a section of hooks to run for the event types given as
+// its parameters.
+func (c *Config) enterOnEvent(args []codf.ExprNode) (codf.Walker, error) {
+	hook := new(EventHook)
+	if err := parseArgs(args, &hook.Events); err != nil {
+		return nil, err
+	}
+	for i, typ := range hook.Events {
+		if !eventTypes[typ] {
+			return nil, argError(i, args[i], fmt.Errorf("unrecognized event type %s", typ))
+		}
+	}
+	c.Hooks = append(c.Hooks, hook)
+	return hook, nil
+}
+
+// portSection walks a port section, handling directives that refer to the
+// rest of the config before passing statements on to its PortConfig.
+type portSection struct {
+	*PortConfig
+	templates map[string]*PortConfig
+	seen      bool // Whether any statements have been seen yet
+}
+
+var _ codf.WalkExiter = (*portSection)(nil)
+
+func (p *portSection) Statement(stmt *codf.Statement) error {
+	defer func() { p.seen = true }()
+	if stmt.Name() == "use" {
+		return p.handleUse(stmt.Parameters())
+	}
+	return p.PortConfig.Statement(stmt)
+}
+
+func (p *portSection) handleUse(args []codf.ExprNode) error {
+	var name string
+	if err := parseArgs(args, &name); err != nil {
+		return err
+	}
+	if p.seen {
+		return fmt.Errorf("use %s must come before any other directive", name)
+	}
+	tmpl, ok := p.templates[name]
+	if !ok {
+		return fmt.Errorf("undefined template %s", name)
+	}
+	// Keep listeners given as section parameters.
+	listen := p.Listen
+	*p.PortConfig = *tmpl.clone()
+	p.Listen = append(p.Listen, listen...)
+	return nil
+}
+
+// templateSection is a port section that defines a template. Templates are
+// not required to be complete ports.
+type templateSection struct {
+	portSection
+}
+
+var _ codf.WalkExiter = (*templateSection)(nil)
+
+func (t *templateSection) ExitSection(codf.Walker, *codf.Section, codf.ParentNode) error {
+	return nil
 }
 
 type PortConfig struct {
+	Name           string `codf:"name"`
+	Enabled        bool   `codf:"enabled"`
 	Listen         []*Addr
-	Forward        *url.URL
+	Forward        *url.URL `codf:"pass"`
+	Protocol       string
+	Strictness     strictness // How decoders handle recoverable issues
 	FlushInterval  time.Duration
 	FlushSizeBytes int
-	WriteTimeout   time.Duration
-	ReadTimeout    time.Duration
-	MaxRetries     int
+	FlushLines     int           `codf:"flush-lines,min=0"` // Flush after this many lines; 0 disables
+	FlushWhen      flushExpr     // Flush whenever this holds, within the interval and size
+	FlushJitter    float64       // Fraction of the flush interval to randomly spread flushes over
+	IdleFlush      time.Duration `codf:"idle-flush,min=0"` // Flush after receiving nothing for this long
+	WriteTimeout   time.Duration `codf:"write-timeout,min=0"`
+	ReadTimeout    time.Duration `codf:"read-timeout,min=0"`
+	ReadBuffer     int           `codf:"so-rcvbuf,min=0"` // Socket receive buffer size of each listener; 0 keeps the OS default
+	MaxRetries     int           `codf:"max-retries"`
+	MaxRequests    int           `codf:"max-requests,min=0"` // Concurrent requests of the port, instead of the shared limit; 0 shares it
+	EgressRate     int64         `codf:"egress-rate,min=0"`  // Bytes per second the port sends to upstreams; 0 is unlimited
 	Backoff        backoff
+	Rebind         RebindConfig
+	OnBindFailure  string // Policy for listeners that can't be bound
+	RetryBudget    RetryBudgetConfig
+	DropOn         classSet // Error classes of failed flushes dropped rather than retried
+	Buffer         BufferConfig
+	Adaptive       AdaptiveConfig
+	WAL            WALConfig
+	Record         string        `codf:"record"`                 // Capture file to record received datagrams to, if any
+	ErrorBodyLimit int           `codf:"error-body-limit,min=0"` // Bytes of failed responses to log
+	AuthLockout    int           `codf:"auth-lockout,min=0"`     // Consecutive auth failures before locking out the upstream
+	TraceHeader    string        `codf:"trace-header"`           // Request header to send batch IDs in, if any
+	SRVRefresh     time.Duration `codf:"srv-refresh"`            // How often to resolve an SRV forwarding URL again
+	Transport      TransportConfig
+
+	Quota       QuotaConfig
+	Sample      SampleConfig
+	Dedup       time.Duration     // Window to drop repeated payloads within; 0 disables
+	Peers       PeersConfig       // Senders to accept datagrams from, if restricted
+	SourceStats SourceStatsConfig // Per-sender counters, if enabled
+	Schema      *SchemaConfig     // Points accepted, if restricted
+	Cardinality CardinalityConfig // Limits distinct tag values, if enabled
+	Aggregate   AggregateConfig   // Combines counters and gauges, if enabled
+	Downsample  []DownsampleRule  // Rules reducing lines per measurement, in order
+	DeadLetter  DeadLetterConfig  // Where dropped lines are written, if anywhere
+	Transform   []string          // Command to pipe batches through before sending, if any
+	Script      ScriptConfig      // Script transforming payloads, if any
+
+	Timestamps        TimestampConfig
+	RejectOlder       time.Duration     `codf:"reject-older-than,min=0"` // Drop points older than this; 0 disables
+	RejectFuture      time.Duration     `codf:"reject-future,min=0"`     // Drop points further ahead than this; 0 disables
+	Routes            []*RouteConfig    // Upstreams for lines of matching measurements, in order
+	Renames           map[string]string // Measurements to rename, by old name
+	MeasurementPrefix string            `codf:"measurement-prefix"` // Prefix added to every measurement
+	Workers           WorkerConfig
+	HealthCheck       ProbeConfig
+	Breaker           BreakerConfig
+
+	Budget       string // Name of the budget to draw points from, if any
+	BudgetWeight int    // The port's share of the budget relative to other ports
+
+	SelfReport         bool
+	SelfReportInterval time.Duration
 }
 
 func NewPortConfig() *PortConfig {
 	return &PortConfig{
+		Enabled:        true,
+		Protocol:       protoLine,
 		FlushInterval:  time.Second * 5,
 		FlushSizeBytes: 16000,
 		WriteTimeout:   time.Second * 15,
 		ReadTimeout:    time.Second * 10,
 		MaxRetries:     10,
+		DropOn:         defaultDropOn,
 		Backoff:        DefaultBackoff,
+		Rebind:         DefaultRebind,
+		OnBindFailure:  bindFatal,
+		ErrorBodyLimit: 512,
+		AuthLockout:    3,
+		SRVRefresh:     30 * time.Second,
+		Workers:        WorkerConfig{Count: 1, Queue: 256, Overflow: queueDropNewest},
+
+		SelfReportInterval: time.Minute,
+	}
+}
+
+// clone returns a deep copy of p.
+func (p *PortConfig) clone() *PortConfig {
+	dup := new(PortConfig)
+	*dup = *p
+	dup.Listen = make([]*Addr, len(p.Listen))
+	for i, addr := range p.Listen {
+		a := *addr
+		a.Tags = append([]Tag(nil), addr.Tags...)
+		dup.Listen[i] = &a
+	}
+	if p.Forward != nil {
+		u := *p.Forward
+		dup.Forward = &u
+	}
+	if p.Transport.Proxy != nil {
+		u := *p.Transport.Proxy
+		dup.Transport.Proxy = &u
 	}
+	dup.Peers.Hosts = append([]string(nil), p.Peers.Hosts...)
+	dup.Downsample = append([]DownsampleRule(nil), p.Downsample...)
+	if p.Schema != nil {
+		dup.Schema = p.Schema.clone()
+	}
+	if p.Routes != nil {
+		dup.Routes = make([]*RouteConfig, len(p.Routes))
+		for i, r := range p.Routes {
+			route := *r
+			route.Match = append([]string(nil), r.Match...)
+			if r.Forward != nil {
+				u := *r.Forward
+				route.Forward = &u
+			}
+			dup.Routes[i] = &route
+		}
+	}
+	if p.Renames != nil {
+		dup.Renames = make(map[string]string, len(p.Renames))
+		for from, to := range p.Renames {
+			dup.Renames[from] = to
+		}
+	}
+	return dup
+}
+
+// transforms returns the names of the optional stages enabled for the port.
+func (p *PortConfig) transforms() (names []string) {
+	if p.Protocol != protoLine {
+		names = append(names, "protocol:"+p.Protocol)
+	}
+	if p.Strictness != unchecked {
+		names = append(names, "decode:"+p.Strictness.String())
+	}
+	if len(p.Peers.Hosts) > 0 {
+		names = append(names, "expect-peers")
+	}
+	if p.Dedup > 0 {
+		names = append(names, "dedup")
+	}
+	if p.Schema != nil {
+		names = append(names, "schema")
+	}
+	if p.Cardinality.Limit > 0 {
+		names = append(names, "cardinality-guard")
+	}
+	if p.Aggregate.Enabled {
+		names = append(names, "aggregate")
+	}
+	if len(p.Downsample) > 0 {
+		names = append(names, "downsample")
+	}
+	if len(p.Renames) > 0 || p.MeasurementPrefix != "" {
+		names = append(names, "measurement")
+	}
+	if p.Timestamps.enabled() {
+		names = append(names, "timestamps")
+	}
+	if p.RejectOlder > 0 || p.RejectFuture > 0 {
+		names = append(names, "reject-skewed")
+	}
+	if p.Sample.enabled() {
+		names = append(names, "sample")
+	}
+	if p.Quota.Lines > 0 {
+		names = append(names, "quota:"+p.Quota.Overflow)
+	}
+	if p.Budget != "" {
+		names = append(names, "budget:"+p.Budget)
+	}
+	for _, r := range p.Routes {
+		names = append(names, "route:"+r.Name)
+	}
+	if p.Breaker.Failures > 0 {
+		names = append(names, "circuit-breaker:"+p.Breaker.Spool)
+	}
+	if len(p.Transform) > 0 {
+		names = append(names, "transform:exec")
+	}
+	if p.SelfReport {
+		names = append(names, "self-report")
+	}
+	return names
 }
 
 var _ codf.WalkExiter = (*PortConfig)(nil)
 
 func (p *PortConfig) Statement(stmt *codf.Statement) error {
+	if ok, err := bindStatement(p, stmt); ok {
+		return err
+	}
+
 	switch name := stmt.Name(); name {
 	case "listen":
 		return p.handleListen(stmt.Parameters())
-	case "pass":
-		return p.handlePass(stmt.Parameters())
+	case "flush-jitter":
+		return p.handleFlushJitter(stmt.Parameters())
+	case "adaptive-flush":
+		return p.handleAdaptiveFlush(stmt.Parameters())
 	case "flush":
 		return p.handleFlush(stmt.Parameters())
-	case "max-retries":
-		return p.handleMaxRetries(stmt.Parameters())
 	case "timeout":
 		return p.handleTimeout(stmt.Parameters())
 	case "backoff":
 		return p.handleBackoff(stmt.Parameters())
+	case "retry-budget":
+		return p.handleRetryBudget(stmt.Parameters())
+	case "retry-on":
+		return p.handleRetryOn(stmt.Parameters())
+	case "rebind":
+		return p.handleRebind(stmt.Parameters())
+	case "on-bind-failure":
+		return p.handleOnBindFailure(stmt.Parameters())
+	case "max-buffer-bytes":
+		return p.handleMaxBufferBytes(stmt.Parameters())
+	case "wal":
+		return p.handleWAL(stmt.Parameters())
+	case "self-report":
+		return p.handleSelfReport(stmt.Parameters())
+	case "quota":
+		return p.handleQuota(stmt.Parameters())
+	case "budget":
+		return p.handleBudget(stmt.Parameters())
+	case "workers":
+		return p.handleWorkers(stmt.Parameters())
+	case "health-check":
+		return p.handleHealthCheck(stmt.Parameters())
+	case "circuit-breaker":
+		return p.handleCircuitBreaker(stmt.Parameters())
+	case "sample":
+		return p.handleSample(stmt.Parameters())
+	case "dedup":
+		return p.handleDedup(stmt.Parameters())
+	case "expect-peers":
+		return p.handleExpectPeers(stmt.Parameters())
+	case "source-stats":
+		return p.handleSourceStats(stmt.Parameters())
+	case "cardinality-guard":
+		return p.handleCardinalityGuard(stmt.Parameters())
+	case "aggregate":
+		return p.handleAggregate(stmt.Parameters())
+	case "downsample":
+		return p.handleDownsample(stmt.Parameters())
+	case "dead-letter":
+		return p.handleDeadLetter(stmt.Parameters())
+	case "transform":
+		return p.handleTransform(stmt.Parameters())
+	case "script":
+		return p.handleScript(stmt.Parameters())
+	case "http-proxy":
+		return p.handleHTTPProxy(stmt.Parameters())
+	case "connections":
+		return p.handleConnections(stmt.Parameters())
+	case "rename-measurement":
+		return p.handleRenameMeasurement(stmt.Parameters())
+	case "timestamps":
+		return p.handleTimestamps(stmt.Parameters())
+	case "protocol":
+		return p.handleProtocol(stmt.Parameters())
 	default:
 		return fmt.Errorf("unrecognized directive %s", name)
 	}
 }
 
 func (p *PortConfig) EnterSection(sect *codf.Section) (codf.Walker, error) {
-	return nil, fmt.Errorf("unrecognized section %s", sect.Name())
+	switch name := sect.Name(); name {
+	case "route":
+		return p.enterRoute(sect.Parameters())
+	case "schema":
+		return p.enterSchema(sect.Parameters())
+	default:
+		return nil, fmt.Errorf("unrecognized section %s", name)
+	}
 }
 
 func (p *PortConfig) ExitSection(_ codf.Walker, _ *codf.Section, _ codf.ParentNode) error {
@@ -113,105 +543,307 @@ func (p *PortConfig) ExitSection(_ codf.Walker, _ *codf.Section, _ codf.ParentNo
 	case p.Forward == nil:
 		return errors.New("port requires a forwarding URL")
 	}
+	if err := p.Backoff.Check(); err != nil {
+		return fmt.Errorf("backoff: %v", err)
+	}
+	if err := p.Rebind.Backoff.Check(); err != nil {
+		return fmt.Errorf("rebind backoff: %v", err)
+	}
+	if isSRV(p.Forward) {
+		if p.SRVRefresh <= 0 {
+			return fmt.Errorf("srv-refresh must be > 0s; got %v", p.SRVRefresh)
+		}
+		return validateSRV(p.Forward)
+	}
 	return nil
 }
 
+// handleListen parses one or more listen addresses. Each address may be
+// followed by options: `via IFACE`, giving the interface to join a multicast
+// address's group on, `device IFACE`, binding its socket to an interface, and
+// `freebind`, allowing it to be bound before it's assigned to the host, and
+// `dual-stack`, listening on it as both udp4 and udp6. The options may be
+// followed by a tags=KEY:VALUE[,KEY:VALUE...] parameter giving
+// tags to add to all points received by that address.
 func (p *PortConfig) handleListen(args []codf.ExprNode) error {
-	for i, arg := range args {
+	var last []*Addr
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
 		var s string
 		if err := parseArg(arg, &s); err != nil {
-			return fmt.Errorf("error parsing parameter %d: %v", i+1, err)
+			return argError(i, arg, err)
+		}
+
+		switch s {
+		case "via", "device", "freebind", "dual-stack":
+			if len(last) == 0 {
+				return argError(i, arg, fmt.Errorf("%s must follow an address", s))
+			}
+		}
+
+		switch s {
+		case "via", "device":
+			if i+1 == len(args) {
+				return argError(i, arg, fmt.Errorf("%s requires an interface", s))
+			}
+			i++
+			var iface string
+			if err := parseArg(args[i], &iface); err != nil {
+				return argError(i, args[i], err)
+			}
+			if iface == "" {
+				return argError(i, args[i], errors.New("interface must not be empty"))
+			}
+			for _, addr := range last {
+				if s == "device" {
+					addr.Device = iface
+				} else if err := addr.setInterface(iface); err != nil {
+					return argError(i, args[i], err)
+				}
+			}
+			continue
+		case "freebind":
+			for _, addr := range last {
+				addr.FreeBind = true
+			}
+			continue
+		case "dual-stack":
+			// Each address is listened on as udp4 and udp6, so that a host
+			// with both A and AAAA records is bound on both families.
+			var v6 []*Addr
+			for _, addr := range last {
+				host, _, _ := net.SplitHostPort(addr.Addr)
+				if addr.Network != "udp" {
+					return argError(i, arg, fmt.Errorf("dual-stack requires a udp address; got %v", addr))
+				} else if net.ParseIP(host) != nil {
+					return argError(i, arg, fmt.Errorf("dual-stack requires a hostname; got %s", host))
+				}
+				dup := *addr
+				addr.Network, dup.Network = "udp4", "udp6"
+				v6 = append(v6, &dup)
+			}
+			p.Listen = append(p.Listen, v6...)
+			last = append(last, v6...)
+			continue
+		}
+
+		if strings.HasPrefix(s, "tags=") {
+			if len(last) == 0 {
+				return argError(i, arg, errors.New("tags must follow an address"))
+			}
+			tags, err := parseTags(strings.TrimPrefix(s, "tags="))
+			if err != nil {
+				return argError(i, arg, err)
+			}
+			for _, addr := range last {
+				addr.Tags = append(addr.Tags, tags...)
+			}
+			last = nil
+			continue
 		}
-		addr, err := ParseAddr(s)
+
+		addrs, err := ParseAddrRange(s)
 		if err != nil {
-			return fmt.Errorf("error parsing parameter %d: %v", i+1, err)
+			return argError(i, arg, err)
 		}
-		p.Listen = append(p.Listen, addr)
+		p.Listen = append(p.Listen, addrs...)
+		last = addrs
 	}
 	return nil
 }
 
-func (p *PortConfig) handlePass(args []codf.ExprNode) error {
-	return parseArgs(args, &p.Forward)
-}
-
+// handleFlush parses either `flush INTERVAL [SIZE]`, the keyword form
+// `flush interval INTERVAL [size SIZE]`, or a flush expression, `flush when
+// ...`. See parseFlushExpr.
 func (p *PortConfig) handleFlush(args []codf.ExprNode) error {
+	if len(args) > 0 {
+		if w, ok := codf.Word(args[0]); ok && w == "when" {
+			when, err := parseFlushExpr(args[1:])
+			if err != nil {
+				return err
+			}
+			p.FlushWhen = when
+			return nil
+		} else if ok {
+			return parseKwargs("flush", args, kwargs{
+				"interval": {dest: &p.FlushInterval, required: true},
+				"size":     {dest: &p.FlushSizeBytes},
+			})
+		}
+	}
+
 	if len(args) == 1 {
 		return parseArgs(args, &p.FlushInterval)
 	}
 	return parseArgs(args, &p.FlushInterval, &p.FlushSizeBytes)
 }
 
-func (p *PortConfig) handleMaxRetries(args []codf.ExprNode) error {
-	return parseArgs(args, &p.MaxRetries)
-}
-
+// handleTimeout parses either `timeout BOTH`, `timeout WRITE READ`, or the
+// keyword form `timeout [write WRITE] [read READ]`.
 func (p *PortConfig) handleTimeout(args []codf.ExprNode) error {
-	if len(args) == 1 {
-		var timeout time.Duration
-		if err := parseArgs(args, timeout); err != nil {
-			return err
-		}
-		p.ReadTimeout, p.WriteTimeout = timeout, timeout
+	write, read := p.WriteTimeout, p.ReadTimeout
+	keyword := false
+	if len(args) > 0 {
+		_, keyword = codf.Word(args[0])
+	}
+
+	var err error
+	switch {
+	case keyword:
+		err = parseKwargs("timeout", args, kwargs{
+			"write": {dest: &write},
+			"read":  {dest: &read},
+		})
+	case len(args) == 1:
+		err = parseArgs(args, &write)
+		read = write
+	default:
+		err = parseArgs(args, &write, &read)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case write < 0:
+		return fmt.Errorf("timeout write must be >= 0s; got %v", write)
+	case read < 0:
+		return fmt.Errorf("timeout read must be >= 0s; got %v", read)
 	}
-	return parseArgs(args, &p.WriteTimeout, &p.ReadTimeout)
+	p.WriteTimeout, p.ReadTimeout = write, read
+	return nil
 }
 
 func (p *PortConfig) handleBackoff(args []codf.ExprNode) error {
+	b, err := parseBackoff("backoff", args)
+	if err != nil {
+		return err
+	}
+	p.Backoff = b
+	return nil
+}
+
+// parseBackoff parses the parameters of a backoff, `[STRATEGY] INTERVAL
+// [KEYWORD VALUE...]`, for directive.
+func parseBackoff(directive string, args []codf.ExprNode) (backoff, error) {
 	if len(args) == 0 {
-		return fmt.Errorf("expected 1 or more arguments")
+		return backoff{}, fmt.Errorf("expected 1 or more arguments")
 	}
 
-	if err := parseArgsUpTo(args, &p.Backoff.Interval); err != nil {
+	b := DefaultBackoff
+	if w, ok := codf.Word(args[0]); ok {
+		var err error
+		if b, err = strategyBackoff(w); err != nil {
+			return backoff{}, err
+		}
+		if args = args[1:]; len(args) == 0 {
+			return backoff{}, fmt.Errorf("expected an interval after %s", w)
+		}
+	}
+	if err := parseArgsUpTo(args, &b.Interval); err != nil {
+		return backoff{}, err
+	}
+
+	err := parseKwargs(directive, args[1:], kwargs{
+		"factor":  {dest: &b.Factor},
+		"grow-by": {dest: &b.Grow},
+		"min":     {dest: &b.Min},
+		"max":     {dest: &b.Max},
+		"exp-max": {dest: &b.MaxExp},
+		"exp-m":   {dest: &b.ExpM},
+		"exp-y":   {dest: &b.ExpScale},
+		"jitter":  {dest: &b.Jitter},
+	})
+	if err != nil {
+		return backoff{}, err
+	}
+
+	b.setDefaults()
+	return b, nil
+}
+
+func (p *PortConfig) handleProtocol(args []codf.ExprNode) error {
+	var proto, level Word
+	if len(args) == 1 {
+		if err := parseArgs(args, &proto); err != nil {
+			return err
+		}
+	} else if err := parseArgs(args, &proto, &level); err != nil {
 		return err
 	}
-	args = args[1:]
 
-	var (
-		seenFactor   bool
-		seenGrow     bool
-		seenMin      bool
-		seenMax      bool
-		seenMaxExp   bool
-		seenExpM     bool
-		seenExpScale bool
-	)
+	if err := validProtocol(string(proto)); err != nil {
+		return err
+	}
+	p.Protocol, p.Strictness = string(proto), unchecked
 
-	b := DefaultBackoff
-	for len(args) > 0 {
-		// TODO: Better keyword arguments so that errors can be returned for when the
-		// keyword matches vs. when the tuple is invalid.
-		switch {
-		case !seenFactor && parseArgsUpTo(args, Keyword("factor"), &b.Factor) == nil:
-			seenFactor, args = true, args[2:]
-		case !seenGrow && parseArgsUpTo(args, Keyword("grow-by"), &b.Grow) == nil:
-			seenGrow, args = true, args[2:]
-		case !seenMin && parseArgsUpTo(args, Keyword("min"), &b.Min) == nil:
-			seenMin, args = true, args[2:]
-		case !seenMax && parseArgsUpTo(args, Keyword("max"), &b.Max) == nil:
-			seenMax, args = true, args[2:]
-		case !seenMaxExp && parseArgsUpTo(args, Keyword("exp-max"), &b.MaxExp) == nil:
-			seenMaxExp, args = true, args[2:]
-		case !seenExpM && parseArgsUpTo(args, Keyword("exp-m"), &b.ExpM) == nil:
-			seenExpM, args = true, args[2:]
-		case !seenExpScale && parseArgsUpTo(args, Keyword("exp-y"), &b.ExpScale) == nil:
-			seenExpScale, args = true, args[2:]
-		default:
-			return fmt.Errorf("invalid argument %v", args[0].Token().Value)
+	if level != "" {
+		strictness, err := parseStrictness(string(level))
+		if err != nil {
+			return err
 		}
+		p.Strictness = strictness
 	}
+	return nil
+}
 
-	if err := b.Check(); err != nil {
+func (p *PortConfig) handleSelfReport(args []codf.ExprNode) error {
+	var mode Word
+	if len(args) == 1 {
+		if err := parseArgs(args, &mode); err != nil {
+			return err
+		}
+	} else if err := parseArgs(args, &mode, &p.SelfReportInterval); err != nil {
 		return err
 	}
 
-	p.Backoff = b
+	switch mode {
+	case "inline":
+		p.SelfReport = true
+	case "off":
+		p.SelfReport = false
+	default:
+		return fmt.Errorf("invalid self-report mode %q; must be inline or off", mode)
+	}
+
+	if p.SelfReportInterval <= 0 {
+		return fmt.Errorf("self-report interval must be > 0s; got %v", p.SelfReportInterval)
+	}
 	return nil
 }
 
 type Addr struct {
-	Network string
-	Addr    string
+	Network   string
+	Addr      string
+	Interface string // Interface to join the address's multicast group on, if any
+	Device    string // Interface to bind the socket to with SO_BINDTODEVICE, if any
+	FreeBind  bool   // Whether to bind with IP_FREEBIND, allowing addresses not yet on the host
+	Tags      []Tag  // Tags added to points received on the address
+}
+
+// setInterface sets the interface a multicast address joins its group on.
+// Addresses given as IPs must be multicast; hostnames are checked once
+// resolved.
+func (a *Addr) setInterface(iface string) error {
+	host, _, _ := net.SplitHostPort(a.Addr)
+	if ip := net.ParseIP(host); ip != nil && !ip.IsMulticast() {
+		return fmt.Errorf("via requires a multicast address; got %s", host)
+	}
+	a.Interface = iface
+	return nil
+}
+
+// parseTags parses a comma-separated list of KEY:VALUE tags.
+func parseTags(s string) ([]Tag, error) {
+	var tags []Tag
+	for _, kv := range strings.Split(s, ",") {
+		sep := strings.IndexByte(kv, ':')
+		if sep <= 0 || sep == len(kv)-1 {
+			return nil, fmt.Errorf("invalid tag %q: must be KEY:VALUE", kv)
+		}
+		tags = append(tags, Tag{Key: kv[:sep], Value: kv[sep+1:]})
+	}
+	return tags, nil
 }
 
 func ParseAddr(hostport string) (addr *Addr, err error) {
@@ -249,8 +881,76 @@ func ParseAddr(hostport string) (addr *Addr, err error) {
 	}, nil
 }
 
-func (a *Addr) String() string { return a.Network + "(" + a.Addr + ")" }
+// maxPortRange is the largest number of ports a single address may expand to.
+const maxPortRange = 1024
+
+// ParseAddrRange parses an address the same as ParseAddr, except that its port
+// may be a range of the form LOW-HIGH. An address with a port range returns
+// one Addr per port in the range, inclusive.
+func ParseAddrRange(hostport string) ([]*Addr, error) {
+	// The end of the range is cut from the port before parsing the address,
+	// since neither a URL nor a host and port may hold a range.
+	var end string
+	ranged := false
+	if i := strings.LastIndexByte(hostport, ':'); i != -1 {
+		if sep := strings.IndexByte(hostport[i:], '-'); sep != -1 {
+			hostport, end, ranged = hostport[:i+sep], hostport[i+sep+1:], true
+		}
+	}
+
+	addr, err := ParseAddr(hostport)
+	if err != nil {
+		return nil, err
+	}
+	if !ranged {
+		return []*Addr{addr}, nil
+	}
+
+	host, start, _ := net.SplitHostPort(addr.Addr)
+	port := start + "-" + end
+	low, err := strconv.ParseUint(start, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %q: %v", port, err)
+	}
+	high, err := strconv.ParseUint(end, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %q: %v", port, err)
+	}
+
+	switch {
+	case low == 0:
+		return nil, fmt.Errorf("invalid port range %q: ports must be > 0", port)
+	case high < low:
+		return nil, fmt.Errorf("invalid port range %q: end must be >= start", port)
+	case high-low >= maxPortRange:
+		return nil, fmt.Errorf("invalid port range %q: cannot exceed %d ports", port, maxPortRange)
+	}
+
+	addrs := make([]*Addr, 0, high-low+1)
+	for p := low; p <= high; p++ {
+		addrs = append(addrs, &Addr{
+			Network:   addr.Network,
+			Addr:      net.JoinHostPort(host, strconv.FormatUint(p, 10)),
+			Interface: addr.Interface,
+			Device:    addr.Device,
+			FreeBind:  addr.FreeBind,
+			Tags:      addr.Tags,
+		})
+	}
+	return addrs, nil
+}
+
+func (a *Addr) String() string {
+	s := a.Network + "(" + a.Addr
+	if a.Interface != "" {
+		s += " via " + a.Interface
+	}
+	if a.Device != "" {
+		s += " device " + a.Device
+	}
+	return s + ")"
+}
 
 func (a *Addr) Resolve() (*net.UDPAddr, error) {
-	return net.ResolveUDPAddr(a.Network, a.Addr)
+	return dns.ResolveUDPAddr(a.Network, a.Addr)
 }
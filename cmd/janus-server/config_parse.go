@@ -4,17 +4,21 @@ import (
 	"bufio"
 	"encoding"
 	"fmt"
+	"io"
 	"math"
 	"math/big"
 	"net/url"
 	"os"
 	"reflect"
+	"sort"
 	"time"
 
 	"go.spiff.io/codf"
 )
 
-func loadDocument(fpath string) (doc *codf.Document, err error) {
+// loadDocument parses the config file at fpath, writing its contents to hash
+// as it's read.
+func loadDocument(fpath string, hash io.Writer) (doc *codf.Document, err error) {
 	fi := os.Stdin
 	if fpath != "-" {
 		fi, err = os.Open(fpath)
@@ -24,15 +28,98 @@ func loadDocument(fpath string) (doc *codf.Document, err error) {
 		defer fi.Close()
 	}
 
-	r := bufio.NewReader(fi)
-	lex := codf.NewLexer(r)
+	return parseDocument(fileName(fpath), io.TeeReader(fi, hash))
+}
+
+// parseDocument parses a config document read from r. The name of the
+// document is used in errors.
+func parseDocument(name string, r io.Reader) (*codf.Document, error) {
+	lex := codf.NewLexer(bufio.NewReader(r))
 	parser := codf.NewParser()
 	if err := parser.Parse(lex); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s: %v", name, err)
 	}
 	return parser.Document(), nil
 }
 
+// fileName returns the name of a config file for use in errors.
+func fileName(fpath string) string {
+	if fpath == "-" {
+		return "<stdin>"
+	}
+	return fpath
+}
+
+// posError is an error at a location in a config file.
+type posError struct {
+	file string
+	loc  codf.Location
+	err  error
+}
+
+func (e *posError) Error() string {
+	if e.file == "" {
+		return fmt.Sprintf("%d:%d: %v", e.loc.Line, e.loc.Column, e.err)
+	}
+	return fmt.Sprintf("%s:%d:%d: %v", e.file, e.loc.Line, e.loc.Column, e.err)
+}
+
+// atNode returns err located at node, unless err already has a location.
+func atNode(node codf.Node, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*posError); ok {
+		return err
+	}
+	return &posError{loc: node.Token().Start, err: err}
+}
+
+// argError returns an error for the i'th (zero-based) parameter, arg.
+func argError(i int, arg codf.ExprNode, err error) error {
+	return atNode(arg, fmt.Errorf("error parsing parameter %d: %v", i+1, err))
+}
+
+// fileWalker wraps a Walker, and the Walkers of its sections, so that any
+// errors they return are located in file.
+type fileWalker struct {
+	file string
+	w    codf.Walker
+}
+
+var _ codf.WalkExiter = (*fileWalker)(nil)
+
+func (f *fileWalker) wrap(node codf.Node, err error) error {
+	err = atNode(node, err)
+	if pe, ok := err.(*posError); ok && pe.file == "" {
+		pe.file = f.file
+	}
+	return err
+}
+
+func (f *fileWalker) Statement(stmt *codf.Statement) error {
+	return f.wrap(stmt, f.w.Statement(stmt))
+}
+
+func (f *fileWalker) EnterSection(sect *codf.Section) (codf.Walker, error) {
+	w, err := f.w.EnterSection(sect)
+	if err != nil {
+		return nil, f.wrap(sect, err)
+	}
+	return &fileWalker{file: f.file, w: w}, nil
+}
+
+func (f *fileWalker) ExitSection(parent codf.Walker, sect *codf.Section, parentNode codf.ParentNode) error {
+	ex, ok := f.w.(codf.WalkExiter)
+	if !ok {
+		return nil
+	}
+	if pw, ok := parent.(*fileWalker); ok {
+		parent = pw.w
+	}
+	return f.wrap(sect, ex.ExitSection(parent, sect, parentNode))
+}
+
 func parseArgsUpTo(args []codf.ExprNode, dest ...interface{}) error {
 	if len(args) > len(dest) {
 		args = args[:len(dest)]
@@ -40,13 +127,87 @@ func parseArgsUpTo(args []codf.ExprNode, dest ...interface{}) error {
 	return parseArgs(args, dest...)
 }
 
+// parseArgs parses each of args into the corresponding dest. If the last dest
+// is a pointer to a slice, it is variadic: it collects all remaining args,
+// of which there must be at least one.
 func parseArgs(args []codf.ExprNode, dest ...interface{}) error {
+	if n := len(dest); n > 0 && isSlicePtr(dest[n-1]) {
+		if len(args) < n {
+			return fmt.Errorf("expected %d or more arguments; got %d", n, len(args))
+		}
+		for len(dest) < len(args) {
+			dest = append(dest, dest[n-1])
+		}
+	}
+
 	if len(args) != len(dest) {
 		return fmt.Errorf("expected %d arguments; got %d", len(dest), len(args))
 	}
 	for i, p := range dest {
 		if err := parseArg(args[i], p); err != nil {
-			return fmt.Errorf("error parsing parameter %d: %v", i+1, err)
+			return argError(i, args[i], err)
+		}
+	}
+	return nil
+}
+
+func isSlicePtr(dest interface{}) bool {
+	t := reflect.TypeOf(dest)
+	return t != nil && t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Slice
+}
+
+// kwarg describes a keyword argument, given in a directive as a keyword
+// followed by its value.
+type kwarg struct {
+	dest     interface{} // Pointer to parse the value into
+	required bool        // Whether the keyword must be given
+	def      interface{} // If not nil, assigned to dest when the keyword is absent
+
+	seen bool
+}
+
+// kwargs maps keywords to their arguments.
+type kwargs map[string]*kwarg
+
+// parseKwargs parses args as a sequence of keyword-value pairs into kws. Each
+// keyword may only be given once. Errors are prefixed with the directive
+// name and keyword, where known.
+func parseKwargs(directive string, args []codf.ExprNode, kws kwargs) error {
+	for len(args) > 0 {
+		key, ok := codf.Word(args[0])
+		if !ok {
+			return atNode(args[0], fmt.Errorf("%s: expected keyword; got %s", directive, args[0].Token().Kind))
+		}
+
+		switch kw := kws[key]; {
+		case kw == nil:
+			return atNode(args[0], fmt.Errorf("%s: unrecognized keyword %s", directive, key))
+		case kw.seen:
+			return atNode(args[0], fmt.Errorf("%s %s: keyword given more than once", directive, key))
+		case len(args) < 2:
+			return atNode(args[0], fmt.Errorf("%s %s: missing value", directive, key))
+		default:
+			if err := parseArg(args[1], kw.dest); err != nil {
+				return atNode(args[1], fmt.Errorf("%s %s: %v", directive, key, err))
+			}
+			kw.seen = true
+		}
+		args = args[2:]
+	}
+
+	keys := make([]string, 0, len(kws))
+	for key := range kws {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		switch kw := kws[key]; {
+		case kw.seen:
+		case kw.required:
+			return fmt.Errorf("%s: missing required keyword %s", directive, key)
+		case kw.def != nil:
+			reflect.ValueOf(kw.dest).Elem().Set(reflect.ValueOf(kw.def))
 		}
 	}
 	return nil
@@ -75,7 +236,7 @@ func parseArg(arg codf.ExprNode, dest interface{}) error {
 		expected = "bigint"
 
 	case *big.Int:
-		if bi := codf.BigInt(arg); bi == nil {
+		if bi := codf.BigInt(arg); bi != nil {
 			v.Set(bi)
 			return nil
 		}
@@ -138,6 +299,69 @@ func parseArg(arg codf.ExprNode, dest interface{}) error {
 		}
 		expected = "integer"
 
+	case *int8:
+		if i, ok := codf.Int64(arg); ok {
+			if i > math.MaxInt8 || i < math.MinInt8 {
+				return fmt.Errorf("integer out of range: must be within %d..%d",
+					math.MinInt8, math.MaxInt8)
+			}
+			*v = int8(i)
+			return nil
+		}
+		expected = "integer"
+
+	case *uint:
+		if u, ok, err := parseUint(arg, uint64(maxUint)); ok {
+			if err == nil {
+				*v = uint(u)
+			}
+			return err
+		}
+		expected = "unsigned integer"
+
+	case *uint64:
+		if u, ok, err := parseUint(arg, math.MaxUint64); ok {
+			if err == nil {
+				*v = u
+			}
+			return err
+		}
+		expected = "unsigned integer"
+
+	case *uint32:
+		if u, ok, err := parseUint(arg, math.MaxUint32); ok {
+			if err == nil {
+				*v = uint32(u)
+			}
+			return err
+		}
+		expected = "unsigned integer"
+
+	case *uint16:
+		if u, ok, err := parseUint(arg, math.MaxUint16); ok {
+			if err == nil {
+				*v = uint16(u)
+			}
+			return err
+		}
+		expected = "unsigned integer"
+
+	case *uint8:
+		if u, ok, err := parseUint(arg, math.MaxUint8); ok {
+			if err == nil {
+				*v = uint8(u)
+			}
+			return err
+		}
+		expected = "unsigned integer"
+
+	case *bool:
+		if b, ok := parseBool(arg); ok {
+			*v = b
+			return nil
+		}
+		expected = "boolean"
+
 	case *string:
 		if s, ok := codf.String(arg); ok {
 			*v = s
@@ -166,6 +390,7 @@ func parseArg(arg codf.ExprNode, dest interface{}) error {
 				return err
 			}
 			*v = *u
+			return nil
 		}
 		expected = "URL"
 
@@ -180,6 +405,17 @@ func parseArg(arg codf.ExprNode, dest interface{}) error {
 		}
 		expected = "URL"
 
+	case *time.Time:
+		if s, ok := codf.String(arg); ok {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return err
+			}
+			*v = t
+			return nil
+		}
+		expected = "RFC3339 time"
+
 	case *time.Duration:
 		if d, ok := codf.Duration(arg); ok {
 			*v = d
@@ -193,13 +429,67 @@ func parseArg(arg codf.ExprNode, dest interface{}) error {
 		}
 		expected = reflect.TypeOf(v).Name()
 
+	case *[]*Addr:
+		if s, ok := codf.String(arg); ok {
+			addrs, err := ParseAddrRange(s)
+			if err != nil {
+				return err
+			}
+			*v = append(*v, addrs...)
+			return nil
+		}
+		expected = "address"
+
 	default:
+		// Slices are appended to, one element per argument.
+		if isSlicePtr(dest) {
+			slice := reflect.ValueOf(dest).Elem()
+			elem := reflect.New(slice.Type().Elem())
+			if err := parseArg(arg, elem.Interface()); err != nil {
+				return err
+			}
+			slice.Set(reflect.Append(slice, elem.Elem()))
+			return nil
+		}
 		return fmt.Errorf("cannot parse argument of type %T", dest)
 	}
 	return fmt.Errorf("expected %s; got %s",
 		expected, arg.Token().Kind)
 }
 
+// parseUint returns the value of an unsigned integer argument no greater than
+// max. If ok is true but err is not nil, the argument was an integer out of
+// range.
+func parseUint(arg codf.ExprNode, max uint64) (u uint64, ok bool, err error) {
+	if i, ok := codf.Int64(arg); ok {
+		if i >= 0 && uint64(i) <= max {
+			return uint64(i), true, nil
+		}
+	} else if bi := codf.BigInt(arg); bi != nil {
+		if bi.Sign() >= 0 && bi.IsUint64() && bi.Uint64() <= max {
+			return bi.Uint64(), true, nil
+		}
+	} else {
+		return 0, false, nil
+	}
+	return 0, true, fmt.Errorf("integer out of range: must be within 0..%d", max)
+}
+
+// parseBool returns the value of a boolean argument. In addition to boolean
+// literals, the words true, yes, on, false, no, and off are accepted.
+func parseBool(arg codf.ExprNode) (value, ok bool) {
+	if b, ok := arg.Token().Value.(bool); ok {
+		return b, true
+	}
+	switch w, _ := codf.Word(arg); w {
+	case "true", "yes", "on":
+		return true, true
+	case "false", "no", "off":
+		return false, true
+	}
+	return false, false
+}
+
 // Auxiliary types for performing more specific matches
 
 type Keyword string
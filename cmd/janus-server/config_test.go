@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseAddrRange(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"udp://0.0.0.0:9000", []string{"0.0.0.0:9000"}},
+		{"udp://0.0.0.0:9000-9002", []string{"0.0.0.0:9000", "0.0.0.0:9001", "0.0.0.0:9002"}},
+		{"udp4://127.0.0.1:9000-9000", []string{"127.0.0.1:9000"}},
+		{"udp6://[::1]:9000-9001", []string{"[::1]:9000", "[::1]:9001"}},
+		{"udp://my-host:9000-9001", []string{"my-host:9000", "my-host:9001"}},
+		{"0.0.0.0:9000-9001", []string{"0.0.0.0:9000", "0.0.0.0:9001"}},
+	}
+	for _, tt := range tests {
+		addrs, err := ParseAddrRange(tt.in)
+		if err != nil {
+			t.Errorf("ParseAddrRange(%q): %v", tt.in, err)
+			continue
+		}
+		got := make([]string, len(addrs))
+		for i, addr := range addrs {
+			got[i] = addr.Addr
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseAddrRange(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseAddrRangeNetwork(t *testing.T) {
+	addrs, err := ParseAddrRange("udp4://0.0.0.0:9000-9010")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 11 {
+		t.Fatalf("got %d addresses; want 11", len(addrs))
+	}
+	for _, addr := range addrs {
+		if addr.Network != "udp4" {
+			t.Errorf("%v has network %q; want udp4", addr, addr.Network)
+		}
+	}
+}
+
+func TestParseAddrRangeInvalid(t *testing.T) {
+	for _, in := range []string{
+		"udp://0.0.0.0:9010-9000",
+		"udp://0.0.0.0:0-10",
+		"udp://0.0.0.0:9000-",
+		"udp://0.0.0.0:9000-x",
+		"udp://0.0.0.0:1-2000",
+		"udp://0.0.0.0:9000-70000",
+		"tcp://0.0.0.0:9000-9001",
+	} {
+		if addrs, err := ParseAddrRange(in); err == nil {
+			t.Errorf("ParseAddrRange(%q) = %v; want error", in, addrs)
+		}
+	}
+}
+
+func TestHandleSelfReport(t *testing.T) {
+	tests := []struct {
+		in       string
+		enabled  bool
+		interval time.Duration
+	}{
+		{"self-report inline;", true, NewPortConfig().SelfReportInterval},
+		{"self-report inline 30s;", true, 30 * time.Second},
+		{"self-report off;", false, NewPortConfig().SelfReportInterval},
+	}
+	for _, tt := range tests {
+		p := NewPortConfig()
+		if err := p.handleSelfReport(testArgs(t, tt.in)); err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		if p.SelfReport != tt.enabled || p.SelfReportInterval != tt.interval {
+			t.Errorf("%s: got %t, %v; want %t, %v", tt.in, p.SelfReport, p.SelfReportInterval, tt.enabled, tt.interval)
+		}
+	}
+}
+
+func TestHandleSelfReportInvalid(t *testing.T) {
+	for _, in := range []string{
+		"self-report;",
+		"self-report on;",
+		"self-report inline 0s;",
+		"self-report inline -1s;",
+		"self-report inline 10s extra;",
+	} {
+		if err := NewPortConfig().handleSelfReport(testArgs(t, in)); err == nil {
+			t.Errorf("%s: want error", in)
+		}
+	}
+}
+
+func TestHandleScript(t *testing.T) {
+	f, err := ioutil.TempFile("", "janus-script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	const src = "def transform(payload):\n    return payload\n"
+	f.WriteString(src)
+	f.Close()
+
+	p := NewPortConfig()
+	if err := p.handleScript(testArgs(t, fmt.Sprintf("script %q;", f.Name()))); err != nil {
+		t.Fatal(err)
+	}
+	if want := (ScriptConfig{Path: f.Name(), Source: src}); p.Script != want {
+		t.Errorf("script = %+v; want %+v", p.Script, want)
+	}
+
+	if err := p.handleScript(testArgs(t, "script off;")); err != nil {
+		t.Fatal(err)
+	}
+	if p.Script != (ScriptConfig{}) {
+		t.Errorf("script off = %+v; want no script", p.Script)
+	}
+
+	for _, in := range []string{
+		"script;",
+		`script "";`,
+		`script "/nonexistent/janus.star";`,
+		"script a b;",
+	} {
+		if err := NewPortConfig().handleScript(testArgs(t, in)); err == nil {
+			t.Errorf("%s: want error", in)
+		}
+	}
+}
+
+func TestHandleCircuitBreakerThreshold(t *testing.T) {
+	p := NewPortConfig()
+	if err := p.handleCircuitBreaker(testArgs(t, "circuit-breaker 3 spool memory max 1000 threshold 800;")); err != nil {
+		t.Fatal(err)
+	}
+	if p.Breaker.Threshold != 800 {
+		t.Errorf("threshold = %d; want 800", p.Breaker.Threshold)
+	}
+
+	for _, in := range []string{
+		"circuit-breaker 3 spool memory max 1000 threshold -1;",
+		"circuit-breaker 3 spool memory max 1000 threshold 1001;",
+		"circuit-breaker 3 threshold 100;",
+	} {
+		if err := NewPortConfig().handleCircuitBreaker(testArgs(t, in)); err == nil {
+			t.Errorf("%s: want error", in)
+		}
+	}
+}
+
+func TestHandleQuotaInvalid(t *testing.T) {
+	for _, in := range []string{
+		"quota 0;",
+		"quota -1;",
+		"quota 100 per 0s;",
+		"quota 100 overflow divert;",
+		"quota 100 db other;",
+	} {
+		if err := NewPortConfig().handleQuota(testArgs(t, in)); err == nil {
+			t.Errorf("%s: want error", in)
+		}
+	}
+}
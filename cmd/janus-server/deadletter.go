@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"go.spiff.io/codf"
+	"go.spiff.io/dagr/outflux"
+)
+
+// Reasons a payload or line is dead-lettered.
+const (
+	deadDecode      = "decode"       // The payload couldn't be decoded, or the line was dropped by a lenient decoder
+	deadPeer        = "peer"         // The datagram came from an unexpected sender
+	deadTimestamp   = "timestamp"    // The line's timestamp was outside the accepted window
+	deadSchema      = "schema"       // The line violated the schema
+	deadCardinality = "cardinality"  // The line had tag values past the cardinality limit
+	deadQuota       = "quota"        // The line was over the port's quota
+	deadBudget      = "budget"       // The line was over the port's share of its budget
+	deadRoute       = "route"        // The line couldn't be written to its route
+	deadScript      = "script"       // The port's script failed on the payload
+	deadTooLarge    = "too_large"    // The line was rejected by the upstream as too large
+	deadRejected    = "rejected"     // The line was rejected by the upstream as invalid
+	deadOverflow    = "overflow"     // The datagram was dropped by the port's full write queue
+	deadBuffer      = "buffer"       // The payload or batch was dropped to bound the port's buffer
+	deadRetryBudget = "retry_budget" // The batch was dropped with the retry budget exhausted
+	deadGivenUp     = "given_up"     // The batch failed its last attempt
+	deadLockedOut   = "locked_out"   // The batch was dropped with the upstream locked out
+)
+
+// deadLetterMeasurement is the measurement of dead letters written upstream.
+const deadLetterMeasurement = "janus_dead_letter"
+
+// DeadLetterConfig sets where a port writes what it drops. At most one of
+// File and DB is set.
+type DeadLetterConfig struct {
+	File string // File to append dead letters to as JSON lines
+	DB   string // Database of the port's upstream to write dead letters to
+}
+
+func (d DeadLetterConfig) enabled() bool { return d.File != "" || d.DB != "" }
+
+// handleDeadLetter parses `dead-letter off`, `dead-letter file PATH`, or
+// `dead-letter db NAME`.
+func (p *PortConfig) handleDeadLetter(args []codf.ExprNode) error {
+	if len(args) == 1 {
+		if w, ok := codf.Word(args[0]); ok && w == "off" {
+			p.DeadLetter = DeadLetterConfig{}
+			return nil
+		}
+	}
+
+	var d DeadLetterConfig
+	err := parseKwargs("dead-letter", args, kwargs{
+		"file": {dest: &d.File},
+		"db":   {dest: &d.DB},
+	})
+	switch {
+	case err != nil:
+		return err
+	case d.File != "" && d.DB != "":
+		return errors.New("dead-letter takes one of file or db")
+	case !d.enabled():
+		return errors.New("dead-letter requires a file or db")
+	}
+	p.DeadLetter = d
+	return nil
+}
+
+// deadLetterEntry is a dead letter as written to a file.
+type deadLetterEntry struct {
+	Time    time.Time `json:"time"`
+	Reason  string    `json:"reason"`
+	Batch   string    `json:"batch,omitempty"` // ID of the dropped batch, if the payload is one
+	Payload string    `json:"payload"`
+}
+
+// deadLetter records payloads and lines a port drops, with the reason each
+// was dropped, to a file or to another database of the port's upstream.
+// Methods of a nil deadLetter do nothing.
+type deadLetter struct {
+	path  string
+	proxy *outflux.Proxy
+	stats *portStats
+
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	buf  []byte
+	err  error // The first file write error; writing stops after one
+}
+
+// openDeadLetterFile opens the file at path to append dead letters to.
+func openDeadLetterFile(path string, stats *portStats) (*deadLetter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetter{path: path, stats: stats, file: f, w: bufio.NewWriterSize(f, 64*1024)}, nil
+}
+
+// add records payload as dropped for reason.
+func (d *deadLetter) add(reason string, payload []byte) {
+	d.addBatch(reason, nil, payload)
+}
+
+// addBatch records payload, the body of batch, as dropped for reason. A nil
+// batch records a payload or line that isn't a batch.
+func (d *deadLetter) addBatch(reason string, batch *tracedBatch, payload []byte) {
+	if d == nil {
+		return
+	}
+	var id string
+	if batch != nil {
+		id = batch.id
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.proxy != nil {
+		d.buf = append(d.buf[:0], deadLetterMeasurement...)
+		d.buf = append(d.buf, encodeTags([]Tag{{"reason", reason}})...)
+		d.buf = appendFieldString(append(d.buf, " payload="...), string(payload))
+		if id != "" {
+			d.buf = appendFieldString(append(d.buf, ",batch="...), id)
+		}
+		d.buf = append(d.buf, '\n')
+		if _, err := d.proxy.Write(d.buf); err != nil {
+			glog.Errorf("Unable to write dead letter: %v", err)
+			return
+		}
+		d.stats.addDeadLettered()
+		return
+	}
+
+	if d.err != nil {
+		return
+	}
+	entry, err := json.Marshal(deadLetterEntry{Time: time.Now(), Reason: reason, Batch: id, Payload: string(payload)})
+	if err == nil {
+		if _, err = d.w.Write(entry); err == nil {
+			err = d.w.WriteByte('\n')
+		}
+	}
+	if err != nil {
+		d.err = err
+		glog.Errorf("Unable to write dead letter to %s; dead-lettering stopped: %v", d.path, err)
+		return
+	}
+	d.stats.addDeadLettered()
+}
+
+// run flushes a dead letter file periodically until ctx is done, then closes
+// it.
+func (d *deadLetter) run(ctx context.Context) {
+	if d.file == nil {
+		return
+	}
+	ticker := time.NewTicker(captureFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			d.close()
+			return
+		case <-ticker.C:
+			d.flush()
+		}
+	}
+}
+
+func (d *deadLetter) flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err == nil {
+		if d.err = d.w.Flush(); d.err != nil {
+			glog.Errorf("Unable to write dead letter to %s; dead-lettering stopped: %v", d.path, d.err)
+		}
+	}
+}
+
+func (d *deadLetter) close() {
+	d.flush()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.file.Close(); err != nil {
+		glog.Errorf("Unable to close dead letter file %s: %v", d.path, err)
+	}
+	if d.err == nil {
+		d.err = os.ErrClosed
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"golang.org/x/net/context"
+)
+
+// serveDebug serves pprof profiles and expvar variables on addr until ctx is
+// done. It shouldn't be exposed beyond the host: profiles can be expensive and
+// reveal internals.
+func serveDebug(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return serveHTTP(ctx, "debug endpoints", addr, mux)
+}
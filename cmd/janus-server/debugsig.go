@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// isSignal reports whether sig is one of signals.
+func isSignal(sig os.Signal, signals []os.Signal) bool {
+	for _, s := range signals {
+		if sig == s {
+			return true
+		}
+	}
+	return false
+}
+
+// dumpStats logs the counters of every running gateway along with its
+// supervisor state and queue depth, and the process's goroutine count.
+func (s *server) dumpStats() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	glog.Infof("Dumping stats: goroutines=%d gateways=%d", runtime.NumGoroutine(), len(s.gateways))
+	keys := make([]string, 0, len(s.gateways))
+	for key := range s.gateways {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		g := s.gateways[key]
+		fields := g.stats.snapshot().fields()
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		counters := make([]string, len(names))
+		for i, name := range names {
+			counters[i] = fmt.Sprintf("%s=%d", name, fields[name])
+		}
+		glog.Infof("Stats for %v: state=%s restarts=%d queue=%d/%d %s",
+			g, g.state, g.restarts, g.queue.depth(), g.cfg.Workers.Queue, strings.Join(counters, " "))
+	}
+}
+
+// verbosity is the glog verbosity toggled by verboseSignals.
+var verbosity struct {
+	sync.Mutex
+	saved string // The level before verbose logging was turned on, while on
+	on    bool
+}
+
+// verboseLevel is the glog verbosity set while verbose logging is toggled on.
+const verboseLevel = "2"
+
+// toggleVerbose switches glog between verboseLevel and the level it had
+// before.
+func toggleVerbose() {
+	v := flag.Lookup("v")
+	if v == nil {
+		return
+	}
+
+	verbosity.Lock()
+	defer verbosity.Unlock()
+	level := verboseLevel
+	if verbosity.on {
+		level = verbosity.saved
+	} else {
+		verbosity.saved = v.Value.String()
+	}
+	if err := v.Value.Set(level); err != nil {
+		glog.Errorf("Unable to set log verbosity to %s: %v", level, err)
+		return
+	}
+	verbosity.on = !verbosity.on
+	glog.Infof("Log verbosity set to %s", level)
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// dumpSignals are the signals that log the stats of every gateway.
+var dumpSignals = []os.Signal{syscall.SIGUSR1}
+
+// verboseSignals are the signals that toggle verbose logging.
+var verboseSignals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,10 @@
+package main
+
+import "os"
+
+// dumpSignals and verboseSignals are empty: Windows has no user signals to
+// handle.
+var (
+	dumpSignals    []os.Signal
+	verboseSignals []os.Signal
+)
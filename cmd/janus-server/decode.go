@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Protocols a port may receive.
+const (
+	protoLine     = "line"     // InfluxDB line protocol, forwarded as is
+	protoStatsd   = "statsd"   // StatsD, including DogStatsD tags
+	protoJSON     = "json"     // JSON points
+	protoGraphite = "graphite" // Graphite plaintext, with optional tags
+	protoAuto     = "auto"     // Detected per payload
+)
+
+// strictness controls how a decoder handles recoverable issues in a line,
+// such as trailing whitespace, a missing timestamp, or an out-of-range value.
+type strictness int
+
+const (
+	unchecked  strictness = iota // Issues are not checked for
+	strict                       // The payload is rejected
+	lenient                      // The line is dropped
+	permissive                   // The line is fixed up
+)
+
+func (s strictness) String() string {
+	switch s {
+	case strict:
+		return "strict"
+	case lenient:
+		return "lenient"
+	case permissive:
+		return "permissive"
+	}
+	return "unchecked"
+}
+
+func parseStrictness(s string) (strictness, error) {
+	switch s {
+	case "strict":
+		return strict, nil
+	case "lenient":
+		return lenient, nil
+	case "permissive":
+		return permissive, nil
+	}
+	return unchecked, fmt.Errorf("invalid strictness %q; must be strict, lenient, or permissive", s)
+}
+
+func validProtocol(proto string) error {
+	switch proto {
+	case protoLine, protoStatsd, protoJSON, protoGraphite, protoAuto:
+		return nil
+	}
+	return fmt.Errorf("invalid protocol %q; must be line, statsd, json, graphite, or auto", proto)
+}
+
+// decoder converts payloads of a port's protocol to line protocol.
+type decoder struct {
+	proto   string
+	level   strictness
+	forward *url.URL // Used for the precision of added timestamps
+	stats   *portStats
+	dead    *deadLetter
+	gauges  *statsdGauges // Last values of StatsD gauges
+}
+
+// newDecoder returns the decoder for a port. Line protocol ports that don't
+// check for issues have no decoder.
+func newDecoder(cfg *PortConfig, stats *portStats, dead *deadLetter) (*decoder, error) {
+	if err := validProtocol(cfg.Protocol); err != nil {
+		return nil, err
+	}
+	if cfg.Protocol == protoLine && cfg.Strictness == unchecked {
+		return nil, nil
+	}
+	return &decoder{
+		proto:   cfg.Protocol,
+		level:   cfg.Strictness,
+		forward: cfg.Forward,
+		stats:   stats,
+		dead:    dead,
+		gauges:  newStatsdGauges(),
+	}, nil
+}
+
+// decode appends payload to dst as line protocol.
+func (d *decoder) decode(dst, payload []byte) ([]byte, error) {
+	proto := d.proto
+	if proto == protoAuto {
+		proto = detectProtocol(payload)
+	}
+
+	switch proto {
+	case protoJSON:
+		return d.decodeJSON(dst, payload)
+	case protoStatsd:
+		return d.decodeStatsd(dst, payload)
+	case protoGraphite:
+		return d.decodeGraphite(dst, payload)
+	}
+	return d.decodeLine(dst, payload)
+}
+
+// issue handles a recoverable issue found in line. It returns true if the
+// line should be fixed up and kept, false if it should be dropped, or an
+// error if the payload should be rejected.
+func (d *decoder) issue(line []byte, what string) (fix bool, err error) {
+	switch d.level {
+	case strict:
+		d.stats.addDecodeRejected()
+		return false, fmt.Errorf("%s: %q", what, line)
+	case lenient:
+		d.stats.addDecodeDropped()
+		d.dead.add(deadDecode, line)
+		return false, nil
+	}
+	d.stats.addDecodeFixed()
+	return true, nil
+}
+
+// checkWhitespace checks line for trailing whitespace. It returns the line
+// to use, which is nil if the line was dropped.
+func (d *decoder) checkWhitespace(line []byte) ([]byte, error) {
+	trimmed := bytes.TrimRight(line, " \t\r")
+	if d.level == unchecked || len(trimmed) == len(line) {
+		return trimmed, nil
+	}
+	if fix, err := d.issue(line, "trailing whitespace"); !fix {
+		return nil, err
+	}
+	return trimmed, nil
+}
+
+// now returns the current time in the precision of the upstream.
+func (d *decoder) now() int64 {
+	return timestamp(d.forward, time.Now())
+}
+
+// clampNumber returns the nearest representable value to an out-of-range
+// number. The number may carry a line protocol i or u suffix. It returns nil
+// if the number is in range or isn't a number.
+func clampNumber(num []byte) []byte {
+	if len(num) == 0 {
+		return nil
+	}
+
+	var err error
+	switch suffix := num[len(num)-1]; suffix {
+	case 'i':
+		_, err = strconv.ParseInt(string(num[:len(num)-1]), 10, 64)
+		if isRangeError(err) {
+			if num[0] == '-' {
+				return append(strconv.AppendInt(nil, math.MinInt64, 10), 'i')
+			}
+			return append(strconv.AppendInt(nil, math.MaxInt64, 10), 'i')
+		}
+	case 'u':
+		_, err = strconv.ParseUint(string(num[:len(num)-1]), 10, 64)
+		if isRangeError(err) {
+			return append(strconv.AppendUint(nil, math.MaxUint64, 10), 'u')
+		}
+	default:
+		var f float64
+		f, err = strconv.ParseFloat(string(num), 64)
+		if isRangeError(err) && math.IsInf(f, 0) {
+			return strconv.AppendFloat(nil, math.Copysign(math.MaxFloat64, f), 'g', -1, 64)
+		}
+	}
+	return nil
+}
+
+func isRangeError(err error) bool {
+	ne, ok := err.(*strconv.NumError)
+	return ok && ne.Err == strconv.ErrRange
+}
+
+// detectProtocol guesses the protocol of a payload from its first non-blank
+// line.
+func detectProtocol(payload []byte) string {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return protoJSON
+	}
+
+	line := trimmed
+	if i := bytes.IndexByte(line, '\n'); i != -1 {
+		line = line[:i]
+	}
+	switch {
+	case isStatsdLine(line):
+		return protoStatsd
+	case isGraphiteLine(line):
+		return protoGraphite
+	}
+	return protoLine
+}
+
+// isStatsdLine reports whether line looks like NAME:VALUE|TYPE, with no
+// space in its name.
+func isStatsdLine(line []byte) bool {
+	colon := bytes.IndexByte(line, ':')
+	if colon <= 0 || bytes.IndexByte(line[:colon], ' ') != -1 {
+		return false
+	}
+	pipe := bytes.IndexByte(line[colon:], '|')
+	return pipe > 1 && colon+pipe+1 < len(line)
+}
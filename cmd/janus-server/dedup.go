@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.spiff.io/codf"
+)
+
+// maxDedupEntries bounds the payloads a dedupFilter remembers. Past it, the
+// oldest are forgotten early.
+const maxDedupEntries = 1 << 16
+
+// handleDedup parses `dedup off` or `dedup WINDOW`.
+func (p *PortConfig) handleDedup(args []codf.ExprNode) error {
+	if len(args) == 1 {
+		if w, ok := codf.Word(args[0]); ok && w == "off" {
+			p.Dedup = 0
+			return nil
+		}
+	}
+
+	var window time.Duration
+	if err := parseArgs(args, &window); err != nil {
+		return err
+	} else if window <= 0 {
+		return fmt.Errorf("dedup window must be > 0s; got %v", window)
+	}
+	p.Dedup = window
+	return nil
+}
+
+type dedupEntry struct {
+	sum  [sha1.Size]byte
+	seen time.Time
+}
+
+// dedupFilter recognizes payloads identical to one received within its
+// window, as sent by agents that retransmit datagrams. It's shared by a
+// port's listeners.
+type dedupFilter struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	seen  map[[sha1.Size]byte]time.Time
+	order []dedupEntry // Oldest first
+}
+
+func newDedupFilter(window time.Duration) *dedupFilter {
+	return &dedupFilter{window: window, seen: map[[sha1.Size]byte]time.Time{}}
+}
+
+// duplicate reports whether payload was already received within the window,
+// and remembers it if not.
+func (d *dedupFilter) duplicate(payload []byte) bool {
+	sum := sha1.Sum(payload)
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	expired := now.Add(-d.window)
+	for len(d.order) > 0 && (d.order[0].seen.Before(expired) || len(d.order) >= maxDedupEntries) {
+		e := d.order[0]
+		if d.seen[e.sum] == e.seen {
+			delete(d.seen, e.sum)
+		}
+		d.order = d.order[1:]
+	}
+
+	if _, ok := d.seen[sum]; ok {
+		return true
+	}
+	d.seen[sum] = now
+	d.order = append(d.order, dedupEntry{sum: sum, seen: now})
+	return false
+}
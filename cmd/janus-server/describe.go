@@ -0,0 +1,818 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// directiveDoc documents a config directive or section for the describe
+// command.
+type directiveDoc struct {
+	Name    string
+	Context string // Where the directive may appear
+	Syntax  string
+	Args    string // Argument types
+	Default string
+	Summary string
+	Example string
+}
+
+// directiveDocs is the registry of directives printed by describe. It must be
+// kept in step with the config walkers.
+var directiveDocs = []directiveDoc{
+	// Top level
+	{
+		Name: "port", Context: "top level",
+		Syntax:  "port [ADDR...] { ... }",
+		Args:    "ADDR: listen address, as with listen",
+		Summary: "Defines a gateway from one or more UDP listeners to an upstream.",
+		Example: "port udp4://127.0.0.1:24337 {\n    pass http://localhost:8086/write?db=metrics;\n}",
+	},
+	{
+		Name: "template", Context: "top level",
+		Syntax:  "template NAME { ... }",
+		Args:    "NAME: string",
+		Summary: "Defines port settings that ports may copy with use.",
+		Example: "template common {\n    flush 10s 60000;\n}",
+	},
+	{
+		Name: "on-event", Context: "top level",
+		Syntax:  "on-event TYPE... { ... }",
+		Args:    "TYPE: gateway-down, reload-failed, auth-lockout, circuit-open, or spool-threshold",
+		Summary: "Runs webhooks and commands when one of the events occurs.",
+		Example: "on-event gateway-down {\n    exec /usr/local/bin/page-oncall;\n}",
+	},
+	{
+		Name: "dns", Context: "top level",
+		Syntax:  "dns { ... }",
+		Summary: "Configures host overrides and caching for name resolution.",
+		Example: "dns {\n    ttl 1m;\n    host influx.local 10.0.0.5;\n}",
+	},
+	{
+		Name: "otlp", Context: "top level",
+		Syntax:  "otlp { ... }",
+		Summary: "Exports a span for each attempt to flush a batch upstream to an OpenTelemetry collector over OTLP/HTTP with JSON encoding. Attempts of the same batch share a trace. Requests to upstreams carry a traceparent header.",
+		Example: "otlp {\n    endpoint http://127.0.0.1:4318/v1/traces;\n    sample 0.1;\n}",
+	},
+	{
+		Name: "port-source", Context: "top level",
+		Syntax:  "port-source consul|etcd URL PREFIX [interval D] [token TOKEN];",
+		Args:    "URL: Consul or etcd HTTP address; PREFIX: key prefix; D: duration > 0; TOKEN: Consul ACL token",
+		Default: "interval 10s",
+		Summary: "Reads more port sections from the keys under PREFIX and starts and stops their gateways as the keys change. Each key holds port sections as written in a config file, and may use the config's templates and budgets. Consul is watched with blocking queries of up to D; etcd is polled every D through its v3 JSON gateway.",
+		Example: "port-source consul http://127.0.0.1:8500 janus/ports/;",
+	},
+	{
+		Name: "identity", Context: "top level",
+		Syntax:  "identity { ... }",
+		Summary: "Configures how the instance identity is found. The identity is the host of self-reports and events, and is shown in the status API.",
+		Example: "identity {\n    sources env ec2 hostname;\n    env INSTANCE_ID;\n}",
+	},
+	{
+		Name: "budget", Context: "top level",
+		Syntax:  "budget NAME RATE [points/s|points/m|points/h];",
+		Args:    "NAME: string; RATE: integer with an optional k or m suffix",
+		Default: "points/s",
+		Summary: "Defines a rate budget shared by the ports that use it, in proportion to their weights. Ports may borrow points others leave unused.",
+		Example: `budget edge 50k points/s;`,
+	},
+	{
+		Name: "max-requests", Context: "top level",
+		Syntax:  "max-requests N;",
+		Args:    "N: integer",
+		Default: "0 (no limit)",
+		Summary: "Limits concurrent requests to upstreams across all ports.",
+		Example: "max-requests 4;",
+	},
+	{
+		Name: "max-inflight-bytes", Context: "top level",
+		Syntax:  "max-inflight-bytes N;",
+		Args:    "N: integer >= 0",
+		Default: "0 (no limit)",
+		Summary: "Limits the bytes of requests in flight to upstreams across all ports.",
+		Example: "max-inflight-bytes 16000000;",
+	},
+	{
+		Name: "max-egress-rate", Context: "top level",
+		Syntax:  "max-egress-rate BYTES;",
+		Args:    "BYTES: bytes per second, integer >= 0",
+		Default: "0 (no limit)",
+		Summary: "Limits the rate at which request bodies are sent to upstreams across all ports, allowing bursts of one second's worth. Flushes are smoothed over time instead of bursting on every interval.",
+		Example: "max-egress-rate 1048576;",
+	},
+	{
+		Name: "reload-overlap", Context: "top level",
+		Syntax:  "reload-overlap DURATION;",
+		Args:    "DURATION: duration >= 0",
+		Default: "0s (no overlap)",
+		Summary: "Keeps replaced gateways running alongside their replacements on reload, using SO_REUSEPORT. Only supported on Linux.",
+		Example: "reload-overlap 2s;",
+	},
+	{
+		Name: "on-gateway-failure", Context: "top level",
+		Syntax:  "on-gateway-failure shutdown | on-gateway-failure restart [max-failures N] [max-restarts N] [window D] [backoff BACKOFF...];",
+		Args:    "N: integer >= 0; D: duration; BACKOFF: the parameters of backoff",
+		Default: "shutdown; restart defaults to max-failures 5 max-restarts 0 window 10m backoff exponential 1s max 1m",
+		Summary: "Sets what happens when a gateway fails. Restarted gateways wait out their backoff first, leaving other ports running; the process shuts down once max-failures gateway failures occur within the window, unless max-failures is 0. A gateway restarted max-restarts times within the window is left failed until a reload, unless max-restarts is 0. Gateway states are served at /supervisor.",
+		Example: "on-gateway-failure restart max-failures 10 window 5m;",
+	},
+	{
+		Name: "admin-listen", Context: "top level",
+		Syntax:  "admin-listen ADDR;",
+		Args:    "ADDR: TCP host:port",
+		Summary: "Serves the admin API on ADDR. Only read at startup. The listener is handed over to the new process in an upgrade.",
+		Example: "admin-listen 127.0.0.1:24380;",
+	},
+	{
+		Name: "health-flushes", Context: "top level",
+		Syntax:  "health-flushes N;",
+		Args:    "N: integer from 1 to 16",
+		Default: "3",
+		Summary: "The number of recent flushes to each upstream that must have succeeded for /readyz to report ready.",
+		Example: "health-flushes 5;",
+	},
+	{
+		Name: "rollup-retention", Context: "top level",
+		Syntax:  "rollup-retention DURATION;",
+		Args:    "DURATION: duration >= 0",
+		Default: "6h",
+		Summary: "How long per-minute rollups of port counters are kept. 0s disables rollups.",
+		Example: "rollup-retention 24h;",
+	},
+	{
+		Name: "debug-listen", Context: "top level",
+		Syntax:  "debug-listen ADDR;",
+		Args:    "ADDR: TCP host:port",
+		Summary: "Serves pprof profiles under /debug/pprof/ and expvar variables at /debug/vars on ADDR. Only read at startup. The listener is handed over to the new process in an upgrade. Keep it on a loopback address.",
+		Example: "debug-listen 127.0.0.1:6060;",
+	},
+	{
+		Name: "user", Context: "top level",
+		Syntax:  "user NAME;",
+		Args:    "NAME: user name",
+		Summary: "Switches to the user once the listeners of the first config are bound, so that janus can bind ports below 1024 as root and read as NAME. Only read at startup. Listeners added by later reloads must be bindable by NAME.",
+		Example: "user janus;",
+	},
+	{
+		Name: "group", Context: "top level",
+		Syntax:  "group NAME;",
+		Args:    "NAME: group name",
+		Default: "the user's primary group",
+		Summary: "The group to switch to along with user. Requires user. Only read at startup.",
+		Example: "group janus;",
+	},
+	{
+		Name: "stats-interval", Context: "top level",
+		Syntax:  "stats-interval DURATION;",
+		Args:    "DURATION: duration >= 0",
+		Default: "0s (off)",
+		Summary: "Logs a one-line summary of each port's packets, bytes, flushes, failures, drops, and queue depth over each interval.",
+		Example: "stats-interval 5m;",
+	},
+	{
+		Name: "state-file", Context: "top level",
+		Syntax:  "state-file PATH;",
+		Args:    "PATH: string",
+		Summary: "Writes a JSON dump of the server's state (port counters, buffered lines and bytes, write queue depths, in-flight usage, and recent events) to PATH on fatal errors or on request.",
+		Example: "state-file /var/lib/janus/state.json;",
+	},
+
+	// dns
+	{
+		Name: "ttl", Context: "dns",
+		Syntax:  "ttl DURATION;",
+		Args:    "DURATION: duration >= 0",
+		Default: "0s (no caching)",
+		Summary: "How long to cache lookups.",
+		Example: "ttl 1m;",
+	},
+	{
+		Name: "host", Context: "dns",
+		Syntax:  "host NAME IP...;",
+		Args:    "NAME: string; IP: IP address",
+		Summary: "Resolves NAME to the given addresses without a lookup.",
+		Example: "host influx.local 10.0.0.5 10.0.0.6;",
+	},
+
+	// identity
+	{
+		Name: "name", Context: "identity",
+		Syntax:  "name NAME;",
+		Args:    "NAME: string",
+		Summary: "Uses NAME as the identity instead of asking any source.",
+		Example: "name edge-01;",
+	},
+	{
+		Name: "sources", Context: "identity",
+		Syntax:  "sources SOURCE...;",
+		Args:    "SOURCE: env, ec2, gcp, or hostname",
+		Default: "env hostname",
+		Summary: "The sources to take the identity from, in order. The first to provide one is used. ec2 and gcp read the instance ID or name from instance metadata.",
+		Example: "sources ec2 hostname;",
+	},
+	{
+		Name: "env", Context: "identity",
+		Syntax:  "env NAME;",
+		Args:    "NAME: environment variable",
+		Default: "JANUS_IDENTITY",
+		Summary: "The environment variable read by the env source.",
+		Example: "env INSTANCE_ID;",
+	},
+	{
+		Name: "timeout", Context: "identity",
+		Syntax:  "timeout DURATION;",
+		Args:    "DURATION: duration >= 0",
+		Default: "2s",
+		Summary: "Timeout of each instance metadata request.",
+		Example: "timeout 500ms;",
+	},
+
+	// otlp
+	{
+		Name: "endpoint", Context: "otlp",
+		Syntax:  "endpoint URL;",
+		Args:    "URL: http or https URL of the collector's traces endpoint",
+		Summary: "Where to export spans. Required.",
+		Example: "endpoint http://127.0.0.1:4318/v1/traces;",
+	},
+	{
+		Name: "service", Context: "otlp",
+		Syntax:  "service NAME;",
+		Args:    "NAME: string",
+		Default: "janus",
+		Summary: "The service.name of exported spans.",
+		Example: "service janus-edge;",
+	},
+	{
+		Name: "sample", Context: "otlp",
+		Syntax:  "sample FRACTION;",
+		Args:    "FRACTION: number between 0 and 1",
+		Default: "1",
+		Summary: "The fraction of batches to trace.",
+		Example: "sample 0.05;",
+	},
+	{
+		Name: "header", Context: "otlp",
+		Syntax:  "header NAME VALUE;",
+		Args:    "NAME: HTTP header; VALUE: string",
+		Summary: "Sends a header with each export, as for collector authentication.",
+		Example: `header Authorization "Bearer TOKEN";`,
+	},
+
+	// on-event
+	{
+		Name: "webhook", Context: "on-event",
+		Syntax:  "webhook URL [TEMPLATE];",
+		Args:    "URL: URL; TEMPLATE: text/template of an Event",
+		Default: "the event as JSON",
+		Summary: "POSTs the event, or the rendered template, to URL.",
+		Example: `webhook https://hooks.example.com/janus "{{.Type}} on {{.Host}}: {{.Message}}";`,
+	},
+	{
+		Name: "exec", Context: "on-event",
+		Syntax:  "exec PATH [ARG...];",
+		Args:    "PATH: string; ARG: text/template of an Event",
+		Summary: "Runs PATH with the rendered args, the event as JSON on stdin, and JANUS_EVENT set.",
+		Example: `exec /usr/bin/logger -t janus "{{.Message}}";`,
+	},
+
+	// port and template
+	{
+		Name: "use", Context: "port",
+		Syntax:  "use NAME;",
+		Args:    "NAME: template name",
+		Summary: "Copies the settings of a template. Must come first.",
+		Example: "use common;",
+	},
+	{
+		Name: "name", Context: "port",
+		Syntax:  "name NAME;",
+		Args:    "NAME: string",
+		Summary: "Names the port in logs, status, and events. Sockets passed by systemd socket activation, or handed over by the process being replaced in an upgrade, are used by listeners bound to the same address or, failing that, in order by listeners of the port whose name matches the socket's FileDescriptorName. On Linux, SIGTTIN starts an upgrade: the running executable is started again with the port's sockets, and the old process exits -upgrade-drain after the new one is ready. (SIGUSR2 toggles verbose logging.)",
+		Example: "name app-metrics;",
+	},
+	{
+		Name: "enabled", Context: "port",
+		Syntax:  "enabled BOOL;",
+		Args:    "BOOL: boolean",
+		Default: "true",
+		Summary: "Disabled ports are skipped.",
+		Example: "enabled false;",
+	},
+	{
+		Name: "listen", Context: "port",
+		Syntax:  "listen ADDR [via IFACE] [device IFACE] [freebind] [dual-stack] [tags=K:V,...]...;",
+		Args:    "ADDR: [udp|udp4|udp6://]HOST:PORT or HOST:PORT-PORT; IFACE: network interface name",
+		Summary: "Adds UDP addresses to listen on, optionally tagging their points; a point that already has one of the tags keeps its own value. Multicast addresses join their group, on the via interface if given. device binds the socket to an interface (SO_BINDTODEVICE) and freebind allows binding an address not yet on the host (IP_FREEBIND), such as a VIP that may move to it; both are Linux only. dual-stack listens on a udp address as both udp4 and udp6, for hosts with both A and AAAA records. Bound addresses are served at /listeners.",
+		Example: "listen udp4://0.0.0.0:24337 tags=dc:east 127.0.0.1:24400-24410 udp://224.0.0.251:5353 via eth0;",
+	},
+	{
+		Name: "pass", Context: "port",
+		Syntax:  "pass URL;",
+		Args:    "URL: InfluxDB write URL; srv+http or srv+https to name the upstream by SRV record",
+		Summary: "Sets the upstream to forward points to. With an srv+ scheme, the host is an SRV record and each flush goes to one of its targets, chosen by priority and weight.",
+		Example: "pass srv+https://_influx._tcp.service.consul/write?db=metrics;",
+	},
+	{
+		Name: "srv-refresh", Context: "port",
+		Syntax:  "srv-refresh DURATION;",
+		Args:    "DURATION: duration > 0",
+		Default: "30s",
+		Summary: "How often to resolve the SRV record of an srv+ pass URL again. If a lookup fails, the previous targets are kept.",
+		Example: "srv-refresh 1m;",
+	},
+	{
+		Name: "protocol", Context: "port",
+		Syntax:  "protocol line|statsd|json|graphite|auto [strict|lenient|permissive];",
+		Default: "line, with no checks",
+		Summary: "Sets the protocol received and how recoverable issues are handled: rejecting the payload, dropping the line, or fixing it up. Auto detects the protocol of each datagram from its first line, so agents sending different protocols can share a port. StatsD gauges with a + or - sign change the gauge's last value, as in StatsD.",
+		Example: "protocol auto lenient;",
+	},
+	{
+		Name: "flush", Context: "port",
+		Syntax:  "flush INTERVAL [SIZE]; or flush interval INTERVAL [size SIZE]; or flush when size|age|points >=|> VALUE [and|or ...];",
+		Args:    "INTERVAL: duration; SIZE: bytes; VALUE: bytes (with b, kb, mb, or gb), duration, or integer",
+		Default: "5s 16000",
+		Summary: "Flushes points upstream on an interval or once SIZE bytes are buffered, and also whenever a when expression holds.",
+		Example: "flush when size >= 64kb or age >= 2s or points >= 5000;",
+	},
+	{
+		Name: "flush-jitter", Context: "port",
+		Syntax:  "flush-jitter FRACTION;",
+		Args:    "FRACTION: number between 0 and 1",
+		Default: "0 (flush on the interval)",
+		Summary: "Waits a random time between each flush, spread over FRACTION of the flush interval around it, so processes sharing an interval don't flush in lockstep. Proxies still flush on their own at twice the interval.",
+		Example: "flush-jitter 0.2;",
+	},
+	{
+		Name: "adaptive-flush", Context: "port",
+		Syntax:  "adaptive-flush off | adaptive-flush MIN MAX [target D] [step N];",
+		Args:    "MIN, MAX: lines, integers >= 1; D: duration > 0; N: lines, integer >= 1",
+		Default: "off; target 1s, step MIN",
+		Summary: "Flushes once a batch reaches a number of lines that adapts to the upstream, starting at MAX. Each flush taking at most D grows it by N, and each slower one, or one failing with a network error, 429, or 5xx, halves it, within MIN and MAX. Requests are capped at the current number of lines as with flush-lines, which this replaces.",
+		Example: "adaptive-flush 500 20000 target 500ms;",
+	},
+	{
+		Name: "flush-lines", Context: "port",
+		Syntax:  "flush-lines N;",
+		Args:    "N: integer >= 0",
+		Default: "0 (disabled)",
+		Summary: "Starts a flush once N lines are buffered, and sends no more than N lines per request: lines written while the flush takes the buffer join the batch, which is sent in pieces of N lines if it grew past N. If any piece fails, the whole batch is retried.",
+		Example: "flush-lines 5000;",
+	},
+	{
+		Name: "idle-flush", Context: "port",
+		Syntax:  "idle-flush DURATION;",
+		Args:    "DURATION: duration >= 0",
+		Default: "0s (disabled)",
+		Summary: "Flushes early once nothing has been received for DURATION.",
+		Example: "idle-flush 1s;",
+	},
+	{
+		Name: "timeout", Context: "port",
+		Syntax:  "timeout WRITE [READ]; or timeout [write WRITE] [read READ];",
+		Args:    "WRITE, READ: duration >= 0",
+		Default: "15s 10s",
+		Summary: "Sets the upstream write timeout and the listener read timeout.",
+		Example: "timeout 2m 2m;",
+	},
+	{
+		Name: "write-timeout", Context: "port",
+		Syntax:  "write-timeout DURATION;",
+		Args:    "DURATION: duration >= 0",
+		Default: "15s",
+		Summary: "Sets the upstream write timeout.",
+		Example: "write-timeout 30s;",
+	},
+	{
+		Name: "read-timeout", Context: "port",
+		Syntax:  "read-timeout DURATION;",
+		Args:    "DURATION: duration >= 0",
+		Default: "10s",
+		Summary: "Sets the listener read timeout.",
+		Example: "read-timeout 30s;",
+	},
+	{
+		Name: "so-rcvbuf", Context: "port",
+		Syntax:  "so-rcvbuf BYTES;",
+		Args:    "BYTES: integer >= 0",
+		Default: "0 (the OS default)",
+		Summary: "Sets the socket receive buffer of each listener. The effective size is logged on bind; Linux doubles it and caps it at net.core.rmem_max.",
+		Example: "so-rcvbuf 8388608;",
+	},
+	{
+		Name: "max-retries", Context: "port",
+		Syntax:  "max-retries N;",
+		Args:    "N: integer",
+		Default: "10",
+		Summary: "Limits retries of a failed flush. Batches the upstream rejects as too large (413) are split in half and the halves sent instead, down to single lines, which are dropped.",
+		Example: "max-retries 7;",
+	},
+	{
+		Name: "max-requests", Context: "port",
+		Syntax:  "max-requests N;",
+		Args:    "N: integer >= 0",
+		Default: "0 (the top level max-requests)",
+		Summary: "Gives the port its own limit of concurrent requests to its upstreams, in place of the top level limit it would otherwise share with other ports.",
+		Example: "max-requests 2;",
+	},
+	{
+		Name: "egress-rate", Context: "port",
+		Syntax:  "egress-rate BYTES;",
+		Args:    "BYTES: bytes per second, integer >= 0",
+		Default: "0 (no limit)",
+		Summary: "Limits the rate at which the port and its routes send request bodies to upstreams, in addition to any max-egress-rate.",
+		Example: "egress-rate 262144;",
+	},
+	{
+		Name: "backoff", Context: "port",
+		Syntax:  "backoff [curve|exponential|linear|fibonacci|decorrelated-jitter] INTERVAL [factor F] [grow-by D] [min D] [max D] [exp-max N] [exp-m F] [exp-y F] [jitter random|none];",
+		Args:    "INTERVAL, D: duration; F: float; N: integer",
+		Default: "curve 15s factor 1 grow-by 1s min 7s max 3m exp-max 20 exp-m 1 exp-y 1.5 jitter random",
+		Summary: "Sets the backoff between retries. The curve is tuned by exp-m, exp-y, and exp-max; exponential multiplies INTERVAL by factor (default 2) each retry, linear adds grow-by (default INTERVAL), fibonacci scales INTERVAL by the Fibonacci sequence, and decorrelated-jitter waits between INTERVAL and three times the last wait. With jitter none, each wait is the expected one, so retry schedules are reproducible.",
+		Example: "backoff exponential 1s max 1m;",
+	},
+	{
+		Name: "rebind", Context: "port",
+		Syntax:  "rebind [retries N|forever] [delay D] [backoff BACKOFF...];",
+		Args:    "N: integer; D: duration; BACKOFF: the parameters of backoff",
+		Default: "retries 10 delay 2s backoff 15s",
+		Summary: "Sets how listeners retry after failing to bind or read. The wait after the Nth failure in a row is N times delay plus the Nth backoff; failures are forgotten once a listener stays up for a minute.",
+		Example: "rebind retries forever delay 1s backoff exponential 1s max 1m;",
+	},
+	{
+		Name: "on-bind-failure", Context: "port",
+		Syntax:  "on-bind-failure fatal|ignore|retry-forever;",
+		Default: "fatal",
+		Summary: "Sets what happens when a listener can't be bound, or fails and runs out of rebind retries: fatal stops the port and the process, ignore stops only the listener, and retry-forever keeps retrying.",
+		Example: "on-bind-failure ignore;",
+	},
+	{
+		Name: "max-buffer-bytes", Context: "port",
+		Syntax:  "max-buffer-bytes SIZE [overflow drop-oldest|drop-newest|block];",
+		Args:    "SIZE: integer >= 0, in bytes",
+		Default: "0 (unbounded) overflow drop-newest",
+		Summary: "Bounds the bytes a port holds that haven't been delivered, including batches waiting to be retried. Once full, drop-oldest drops the oldest batch at its next attempt, or the incoming payload if no batch has been sent, drop-newest drops incoming payloads, and block stalls the port's workers until a batch is delivered.",
+		Example: "max-buffer-bytes 67108864 overflow drop-oldest;",
+	},
+	{
+		Name: "record", Context: "port",
+		Syntax:  "record PATH;",
+		Args:    "PATH: file",
+		Default: "none",
+		Summary: "Appends every datagram the port receives, with the time and sender, to the capture file at PATH. Captures are resent with janus-server replay-capture [-speed F] [-target HOST:PORT] PATH.",
+		Example: "record /var/tmp/janus-8089.cap;",
+	},
+	{
+		Name: "wal", Context: "port",
+		Syntax:  "wal off; or wal DIR [sync BOOL];",
+		Args:    "DIR: directory, one per port; BOOL: boolean",
+		Default: "off sync false",
+		Summary: "Appends each payload to a segment file in DIR before buffering it, deleting segments once their batches are delivered. Payloads that can't be appended are dropped and counted as wal_errors. Segments of batches that are given up on or dropped, and those left by a crash, are kept and sent again on start, so payloads are delivered at least once. DIR is locked while in use: a port replacing another on a reload or upgrade only recovers its segments once the old port has stopped. With sync, each append is fsynced.",
+		Example: "wal /var/lib/janus/wal/app sync true;",
+	},
+	{
+		Name: "retry-budget", Context: "port",
+		Syntax:  "retry-budget off; or retry-budget RATIO [window DURATION] [min N];",
+		Args:    "RATIO: float > 0 and <= 1; DURATION: duration >= 10ms; N: integer >= 0",
+		Default: "off (window 1m min 10)",
+		Summary: "Allows at most RATIO retries per flush over the sliding window, plus min retries per window. Batches that would exceed the budget are dropped and counted as retry_dropped.",
+		Example: "retry-budget 0.2 window 1m;",
+	},
+	{
+		Name: "retry-on", Context: "port",
+		Syntax:  "retry-on all | retry-on none | retry-on CLASS...;",
+		Args:    "CLASS: auth, schema (400), throttled (429), client (other 4xx), server (5xx), timeout, refused, or network",
+		Default: "every class but schema",
+		Summary: "Sets which failed flushes are retried. Batches failing with other classes are dropped at once and counted as not_retried. Retries of throttled batches wait for the upstream's Retry-After, up to 5m. Lines an InfluxDB upstream names in a 400 response as ones it couldn't parse are dropped and counted as lines_rejected. If the upstream wrote none of the batch, the rest of it is sent again before the batch counts as failed; if it wrote the rest, as InfluxDB 1.x does, the batch counts as delivered.",
+		Example: "retry-on server throttled timeout refused network;",
+	},
+	{
+		Name: "error-body-limit", Context: "port",
+		Syntax:  "error-body-limit N;",
+		Args:    "N: integer >= 0",
+		Default: "512",
+		Summary: "Bytes of failed upstream responses to log.",
+		Example: "error-body-limit 1024;",
+	},
+	{
+		Name: "auth-lockout", Context: "port",
+		Syntax:  "auth-lockout N;",
+		Args:    "N: integer >= 0",
+		Default: "3",
+		Summary: "Consecutive auth failures before the upstream is locked out, dropping its batches and counting them as locked_out, until a reload changes its credentials or it's reset with a POST to /lockout/reset on the admin API. 0 disables lockouts.",
+		Example: "auth-lockout 5;",
+	},
+	{
+		Name: "trace-header", Context: "port",
+		Syntax:  "trace-header NAME;",
+		Args:    "NAME: HTTP header name",
+		Summary: "Sends each batch's ID, as seen in flush and retry logs, to the upstream in the NAME header.",
+		Example: "trace-header X-Janus-Batch;",
+	},
+	{
+		Name: "rename-measurement", Context: "port",
+		Syntax:  "rename-measurement OLD NEW;",
+		Args:    "OLD, NEW: measurement names",
+		Summary: "Renames measurement OLD to NEW in line protocol. May be given once per measurement.",
+		Example: "rename-measurement cpu_usage cpu;",
+	},
+	{
+		Name: "measurement-prefix", Context: "port",
+		Syntax:  "measurement-prefix PREFIX;",
+		Args:    "PREFIX: string",
+		Default: `""`,
+		Summary: "Adds PREFIX to every measurement in line protocol, after any rename-measurement.",
+		Example: `measurement-prefix "svc_";`,
+	},
+	{
+		Name: "timestamps", Context: "port",
+		Syntax:  "timestamps off; or timestamps add|normalize...;",
+		Args:    "add: append the time received to points without a timestamp; normalize: convert timestamps to the precision of pass",
+		Default: "off",
+		Summary: "Makes line protocol timestamps match the precision query parameter of the forwarding URL. Normalizing guesses each timestamp's precision (s, ms, us, or ns) from its magnitude.",
+		Example: "timestamps add normalize;",
+	},
+	{
+		Name: "reject-older-than", Context: "port",
+		Syntax:  "reject-older-than DURATION;",
+		Args:    "DURATION: duration >= 0",
+		Default: "0s (disabled)",
+		Summary: "Drops line protocol points whose timestamps are more than DURATION in the past. Timestamps are read in the precision of pass, after any timestamps normalize.",
+		Example: "reject-older-than 1h;",
+	},
+	{
+		Name: "reject-future", Context: "port",
+		Syntax:  "reject-future DURATION;",
+		Args:    "DURATION: duration >= 0",
+		Default: "0s (disabled)",
+		Summary: "Drops line protocol points whose timestamps are more than DURATION in the future. Timestamps are read in the precision of pass, after any timestamps normalize.",
+		Example: "reject-future 5m;",
+	},
+	{
+		Name: "http-proxy", Context: "port",
+		Syntax:  "http-proxy URL|env|off;",
+		Args:    "URL: http, https, or socks5 URL",
+		Default: "env",
+		Summary: "Sets the proxy that connections to upstreams go through. env uses HTTP_PROXY, HTTPS_PROXY, and NO_PROXY; off always connects directly.",
+		Example: "http-proxy http://proxy.corp.example.com:3128;",
+	},
+	{
+		Name: "connections", Context: "port",
+		Syntax:  "connections [max-idle N] [max-idle-per-host N] [idle-timeout DURATION] [tls-handshake-timeout DURATION] [http2 BOOL];",
+		Args:    "N: integer >= 0; DURATION: duration >= 0; BOOL: boolean",
+		Default: "max-idle 100 max-idle-per-host 2 idle-timeout 90s tls-handshake-timeout 10s http2 false",
+		Summary: "Tunes the pool of connections to upstreams. Raise max-idle-per-host when flushing often to avoid reconnecting; enable http2 to multiplex flushes over one connection.",
+		Example: "connections max-idle-per-host 16 idle-timeout 5m http2 true;",
+	},
+	{
+		Name: "transform", Context: "port",
+		Syntax:  "transform off; or transform exec PATH [ARG...];",
+		Args:    "PATH: executable; ARG: string",
+		Default: "off",
+		Summary: "Runs PATH for each batch sent upstream, with the batch as its stdin, and sends its stdout instead. If it fails or runs past the write timeout, the flush fails and is retried.",
+		Example: "transform exec /usr/local/bin/rename-hosts --site ams1;",
+	},
+	{
+		Name: "script", Context: "port",
+		Syntax:  "script off; or script PATH;",
+		Args:    "PATH: Starlark file",
+		Default: "off",
+		Summary: "Calls transform(payload) in the Starlark script at PATH with each payload, as line protocol, once it has passed through the port's other directives. It returns the payload to send, possibly modified; None to drop it; or a (ROUTE, payload) tuple to send it to the named route instead. Payloads the script fails on, including calls running longer than 1s, are dropped and counted as script_errors. The script is read again on reload.",
+		Example: "script /etc/janus/app.star;",
+	},
+	{
+		Name: "expect-peers", Context: "port",
+		Syntax:  "expect-peers off | expect-peers HOST... [refresh D];",
+		Args:    "HOST: hostname or IP; D: duration",
+		Default: "off; refresh 1m",
+		Summary: "Drops datagrams from senders other than the addresses HOST resolves to, resolving them again every refresh. A host that fails to resolve keeps its last addresses.",
+		Example: "expect-peers agent1.example.com agent2.example.com refresh 5m;",
+	},
+	{
+		Name: "source-stats", Context: "port",
+		Syntax:  "source-stats off | source-stats [max N] [top N];",
+		Args:    "N: integer >= 1",
+		Default: "off; max 1024, top 20",
+		Summary: "Counts packets and bytes received from each sender IP, up to max senders, counting any past that as other. The top senders by bytes are served at /sources on the admin API.",
+		Example: "source-stats max 4096 top 50;",
+	},
+	{
+		Name: "cardinality-guard", Context: "port",
+		Syntax:  "cardinality-guard off | cardinality-guard LIMIT [window D] [action drop|strip];",
+		Args:    "LIMIT: integer >= 1; D: duration > 0",
+		Default: "off; window 1h, action strip",
+		Summary: "Counts the distinct values of each tag key within each window. Once a key has LIMIT values, lines with new values of it are dropped or forwarded without that tag, preventing runaway series upstream.",
+		Example: "cardinality-guard 10000 window 1h action strip;",
+	},
+	{
+		Name: "aggregate", Context: "port",
+		Syntax:  "aggregate off | aggregate [interval D];",
+		Args:    "D: duration >= 0",
+		Default: "off; interval 0, the flush interval",
+		Summary: "Combines lines tagged metric_type=counter or metric_type=gauge, as decoded from StatsD, into one point per measurement and tag set each interval. Counters are summed, scaled by their sample rates, and gauges keep their last value.",
+		Example: "aggregate interval 10s;",
+	},
+	{
+		Name: "downsample", Context: "port",
+		Syntax:  "downsample PATTERN mean|sum|min|max|first|last|count INTERVAL;",
+		Args:    "PATTERN: measurement glob, as in path.Match; INTERVAL: duration > 0",
+		Summary: "Combines the numeric fields of matching measurements into one point per tag set and INTERVAL, stamped with the start of the interval. Lines are bucketed by when they're received. May be given more than once; the first matching rule wins.",
+		Example: "downsample cpu mean 10s;",
+	},
+	{
+		Name: "dead-letter", Context: "port",
+		Syntax:  "dead-letter off | dead-letter file PATH | dead-letter db NAME;",
+		Args:    "PATH: file; NAME: database",
+		Default: "off",
+		Summary: "Writes what the port drops (datagrams dropped by a full write queue; payloads that fail to decode, come from unexpected peers, fail in the port's script, or don't fit in max-buffer-bytes; batches evicted from the buffer, dropped with the retry budget exhausted or the upstream locked out, or given up on after their last attempt, with the batch's ID; and lines dropped for their timestamps, schema, cardinality, quota, budget, a failed route, or, to a file only, being rejected by the upstream as invalid or too large) with the reason for each. A file gets one JSON object per line; a db of the port's upstream gets janus_dead_letter points.",
+		Example: "dead-letter file /var/lib/janus/dead-letters.jsonl;",
+	},
+	{
+		Name: "dedup", Context: "port",
+		Syntax:  "dedup off; or dedup WINDOW;",
+		Args:    "WINDOW: duration > 0",
+		Default: "off",
+		Summary: "Drops payloads identical to one received by the port within WINDOW, counting them as duplicates. Useful for agents that retransmit datagrams.",
+		Example: "dedup 5s;",
+	},
+	{
+		Name: "sample", Context: "port",
+		Syntax:  "sample FRACTION; or sample every N;",
+		Args:    "FRACTION: number > 0 and <= 1; N: integer >= 1",
+		Default: "1 (every payload)",
+		Summary: "Forwards only a fraction of payloads: each with probability FRACTION, or every Nth payload. Payloads not forwarded are counted as sampled_out.",
+		Example: "sample every 10;",
+	},
+	{
+		Name: "quota", Context: "port",
+		Syntax:  "quota LINES [per DURATION] [overflow drop|mark|divert] [db NAME];",
+		Args:    "LINES: integer >= 1; DURATION: duration > 0; NAME: database, only with divert",
+		Default: "per 1s overflow drop",
+		Summary: "Limits the rate at which lines are forwarded, handling the overflow by policy.",
+		Example: "quota 10000 per 1s overflow divert db overflow;",
+	},
+	{
+		Name: "circuit-breaker", Context: "port",
+		Syntax:  "circuit-breaker off; or circuit-breaker FAILURES [cooldown D] [spool none|memory|disk] [dir PATH] [max BYTES] [threshold BYTES];",
+		Args:    "FAILURES: integer >= 1; D: duration > 0; PATH: directory, only with disk; BYTES: integer > 0 for max, from 0 to max for threshold, only with a spool",
+		Default: "off; when on, cooldown 30s spool none max 67108864 threshold 0",
+		Summary: "Stops flushing to the upstream after FAILURES consecutive failed flushes. For the cooldown, batches are spooled, or failed with spool none. A probe flush then closes the circuit and replays spooled batches, or reopens it. A spool-threshold event is emitted when the spool grows to threshold bytes, and again only once it has dropped back under it; threshold 0 emits none.",
+		Example: "circuit-breaker 5 cooldown 1m spool disk dir /var/spool/janus/app;",
+	},
+	{
+		Name: "health-check", Context: "port",
+		Syntax:  "health-check off; or health-check INTERVAL [method GET|HEAD] [path PATH] [timeout D] [failures N];",
+		Args:    "INTERVAL, D: duration > 0; PATH: URL path; N: integer >= 1",
+		Default: "off; when on, method GET path /ping timeout 5s failures 2",
+		Summary: "Probes the upstream on an interval. After N failed probes it's considered down, and flushes wait for it to recover instead of spending retries.",
+		Example: "health-check 10s path /ping;",
+	},
+	{
+		Name: "workers", Context: "port",
+		Syntax:  "workers N [queue DEPTH] [overflow block|drop-oldest|drop-newest] [block-timeout DURATION];",
+		Args:    "N: integer >= 1; DEPTH: integer >= 1; DURATION: duration >= 0, only with block",
+		Default: "1 queue 256 overflow drop-newest",
+		Summary: "Sets how many workers write received packets to the upstream and what happens when they fall behind. Drops and time spent blocked are counted in the port's status. More than one worker may reorder packets.",
+		Example: "workers 4 queue 1024 overflow drop-oldest;",
+	},
+	{
+		Name: "budget", Context: "port",
+		Syntax:  "budget NAME [weight W];",
+		Args:    "NAME: budget name; W: integer >= 1",
+		Default: "weight 1",
+		Summary: "Draws the port's points from a shared budget, dropping lines over its share once nothing is left to borrow.",
+		Example: "budget edge weight 2;",
+	},
+	{
+		Name: "self-report", Context: "port",
+		Syntax:  "self-report inline|off [INTERVAL];",
+		Args:    "INTERVAL: duration > 0",
+		Default: "off 1m",
+		Summary: "Writes the port's own counters upstream as janus_port points.",
+		Example: "self-report inline 30s;",
+	},
+	{
+		Name: "route", Context: "port",
+		Syntax:  "route NAME { ... }",
+		Args:    "NAME: string, unique within the port",
+		Summary: "Sends lines whose measurements match the route to its own upstream, or to the port's with a different db, rp, or precision. Routes are tried in order and the first match wins. Routes are not health checked or circuit broken.",
+		Example: "route system {\n    match cpu mem \"disk*\";\n    pass http://localhost:8086/write?db=telegraf;\n}",
+	},
+
+	{
+		Name: "schema", Context: "port",
+		Syntax:  "schema { ... }",
+		Summary: "Drops or quarantines lines missing required tags or holding fields of unexpected types, before they can cause write errors upstream. Names are matched escaped, as in line protocol.",
+		Example: "schema {\n    require-tags \"*\" host;\n    field-type cpu \"*\" float;\n    on-violation quarantine db schema_errors;\n}",
+	},
+
+	// route
+	{
+		Name: "match", Context: "route",
+		Syntax:  "match PATTERN...;",
+		Args:    "PATTERN: measurement glob, as in path.Match",
+		Summary: "Adds patterns of measurements sent to the route. May be given more than once.",
+		Example: `match cpu "net_*";`,
+	},
+	{
+		Name: "pass", Context: "route",
+		Syntax:  "pass URL;",
+		Args:    "URL: http, https, srv+http, or srv+https URL",
+		Default: "the port's pass",
+		Summary: "Sets the URL that the route's lines are written to.",
+		Example: "pass http://localhost:8086/write?db=telegraf;",
+	},
+	{
+		Name: "db", Context: "route",
+		Syntax:  "db NAME;",
+		Args:    "NAME: database",
+		Summary: "Overrides the db query parameter of the route's URL.",
+		Example: "db telegraf;",
+	},
+	{
+		Name: "rp", Context: "route",
+		Syntax:  "rp NAME;",
+		Args:    "NAME: retention policy",
+		Summary: "Overrides the rp query parameter of the route's URL.",
+		Example: "rp two_weeks;",
+	},
+	{
+		Name: "precision", Context: "route",
+		Syntax:  "precision h|m|s|ms|us|ns;",
+		Summary: "Overrides the precision query parameter of the route's URL. Timestamps are converted from the precision of the port's pass.",
+		Example: "precision s;",
+	},
+
+	// schema
+	{
+		Name: "require-tags", Context: "schema",
+		Syntax:  "require-tags PATTERN TAG...;",
+		Args:    "PATTERN: measurement glob, as in path.Match",
+		Summary: "Requires lines whose measurements match PATTERN to have every TAG. May be given more than once.",
+		Example: `require-tags "*" host region;`,
+	},
+	{
+		Name: "field-type", Context: "schema",
+		Syntax:  "field-type PATTERN FIELD TYPE...;",
+		Args:    "PATTERN, FIELD: globs, as in path.Match; TYPE: float, integer, unsigned, string, or boolean",
+		Summary: "Restricts fields matching FIELD, in measurements matching PATTERN, to the given types. May be given more than once.",
+		Example: "field-type cpu \"usage_*\" float;",
+	},
+	{
+		Name: "on-violation", Context: "schema",
+		Syntax:  "on-violation drop|quarantine [db NAME];",
+		Args:    "NAME: database, only with quarantine",
+		Default: "drop",
+		Summary: "Sets what's done with lines violating the schema: dropping them, or writing them to database NAME of the port's upstream.",
+		Example: "on-violation quarantine db schema_errors;",
+	},
+}
+
+// describe writes the documentation of the named directives to w, or a list
+// of all directives if no names are given.
+func describe(w io.Writer, names []string) error {
+	if len(names) == 0 {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "DIRECTIVE\tCONTEXT\tSUMMARY")
+		docs := append([]directiveDoc(nil), directiveDocs...)
+		sort.SliceStable(docs, func(i, j int) bool { return docs[i].Name < docs[j].Name })
+		for _, d := range docs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", d.Name, d.Context, d.Summary)
+		}
+		return tw.Flush()
+	}
+
+	for i, name := range names {
+		found := false
+		for _, d := range directiveDocs {
+			if d.Name != name {
+				continue
+			}
+			if found || i > 0 {
+				fmt.Fprintln(w)
+			}
+			found = true
+			d.write(w)
+		}
+		if !found {
+			return fmt.Errorf("unknown directive %q", name)
+		}
+	}
+	return nil
+}
+
+func (d *directiveDoc) write(w io.Writer) {
+	fmt.Fprintf(w, "%s (%s)\n\n    %s\n\n", d.Name, d.Context, d.Syntax)
+	fmt.Fprintf(w, "%s\n", d.Summary)
+	if d.Args != "" {
+		fmt.Fprintf(w, "\nArguments: %s\n", d.Args)
+	}
+	if d.Default != "" {
+		fmt.Fprintf(w, "Default: %s\n", d.Default)
+	}
+	fmt.Fprintf(w, "\nExample:\n\n    %s\n", strings.Replace(d.Example, "\n", "\n    ", -1))
+}
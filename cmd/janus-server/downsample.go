@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"go.spiff.io/codf"
+)
+
+// Downsampling functions.
+const (
+	downsampleMean  = "mean"
+	downsampleSum   = "sum"
+	downsampleMin   = "min"
+	downsampleMax   = "max"
+	downsampleFirst = "first"
+	downsampleLast  = "last"
+	downsampleCount = "count"
+)
+
+// DownsampleRule reduces the lines of matching measurements to one point per
+// series and interval.
+type DownsampleRule struct {
+	Match    string // Measurement pattern, as used by path.Match
+	Func     string // How each field's values are combined
+	Interval time.Duration
+}
+
+// handleDownsample parses `downsample PATTERN FUNC INTERVAL`. It may be given
+// more than once; each line is downsampled by the first rule matching it.
+func (p *PortConfig) handleDownsample(args []codf.ExprNode) error {
+	var r DownsampleRule
+	if err := parseArgs(args, &r.Match, &r.Func, &r.Interval); err != nil {
+		return err
+	}
+	if _, err := path.Match(r.Match, ""); err != nil {
+		return argError(0, args[0], fmt.Errorf("invalid pattern %q: %v", r.Match, err))
+	}
+	switch r.Func {
+	case downsampleMean, downsampleSum, downsampleMin, downsampleMax,
+		downsampleFirst, downsampleLast, downsampleCount:
+	default:
+		return argError(1, args[1], fmt.Errorf("invalid downsample function %q; must be mean, sum, min, max, first, last, or count", r.Func))
+	}
+	if r.Interval <= 0 {
+		return argError(2, args[2], fmt.Errorf("downsample interval must be > 0s; got %v", r.Interval))
+	}
+	p.Downsample = append(p.Downsample, r)
+	return nil
+}
+
+// downsampleField is the combined value of one field of a series.
+type downsampleField struct {
+	key     []byte
+	value   float64
+	count   int
+	integer bool // Whether every value was an integer
+}
+
+// downsampleSeries is the combined fields of one series within an interval.
+type downsampleSeries struct {
+	fields []downsampleField // In order first seen
+}
+
+// downsampleStage combines the lines of measurements matching its rule into
+// one point per series, their measurement and tag set, per interval. Lines
+// are bucketed by when they're received, and each point is stamped with the
+// start of its interval in the upstream's precision. Lines with non-numeric
+// fields and lines of other measurements pass through.
+type downsampleStage struct {
+	rule    DownsampleRule
+	forward *url.URL
+	send    func(payload []byte) error
+	stats   *portStats
+
+	mu     sync.Mutex
+	start  time.Time // Start of the current interval
+	series map[string]*downsampleSeries
+	order  []string // Keys of series, in order first seen
+}
+
+func newDownsampleStage(rule DownsampleRule, forward *url.URL, stats *portStats) *downsampleStage {
+	return &downsampleStage{
+		rule:    rule,
+		forward: forward,
+		stats:   stats,
+		start:   time.Now().Truncate(rule.Interval),
+		series:  map[string]*downsampleSeries{},
+	}
+}
+
+func (st *downsampleStage) apply(dst, line []byte) []byte {
+	end := keyEnd(line)
+	mend := measurementEnd(line)
+	if end == -1 || mend == -1 {
+		return append(dst, line...)
+	}
+	if ok, _ := path.Match(st.rule.Match, string(line[:mend])); !ok {
+		return append(dst, line...)
+	}
+	pairs := splitFields(line[end+1 : fieldsEnd(line, end+1)])
+	if !summable(pairs) {
+		return append(dst, line...)
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	key := string(line[:end])
+	s := st.series[key]
+	if s == nil {
+		s = new(downsampleSeries)
+		st.series[key] = s
+		st.order = append(st.order, key)
+	}
+	for _, pair := range pairs {
+		eq := unescapedIndex(pair, '=')
+		v := pair[eq+1:]
+		integer := v[len(v)-1] == 'i'
+		n, _ := strconv.ParseFloat(string(bytes.TrimSuffix(v, []byte{'i'})), 64)
+		s.add(st.rule.Func, pair[:eq], n, integer)
+	}
+	st.stats.addDownsampled()
+	return dst
+}
+
+func (s *downsampleSeries) add(fn string, key []byte, n float64, integer bool) {
+	var f *downsampleField
+	for i := range s.fields {
+		if bytes.Equal(s.fields[i].key, key) {
+			f = &s.fields[i]
+			break
+		}
+	}
+	if f == nil {
+		s.fields = append(s.fields, downsampleField{key: append([]byte(nil), key...), value: n, count: 1, integer: integer})
+		return
+	}
+
+	f.count++
+	f.integer = f.integer && integer
+	switch fn {
+	case downsampleMean, downsampleSum:
+		f.value += n
+	case downsampleMin:
+		f.value = math.Min(f.value, n)
+	case downsampleMax:
+		f.value = math.Max(f.value, n)
+	case downsampleLast:
+		f.value = n
+	}
+}
+
+// appendValue appends the combined value of f, for the function fn.
+func (f *downsampleField) appendValue(dst []byte, fn string) []byte {
+	switch {
+	case fn == downsampleCount:
+		return append(strconv.AppendInt(dst, int64(f.count), 10), 'i')
+	case fn == downsampleMean:
+		return strconv.AppendFloat(dst, f.value/float64(f.count), 'g', -1, 64)
+	case f.integer:
+		return append(strconv.AppendInt(dst, int64(f.value), 10), 'i')
+	}
+	return strconv.AppendFloat(dst, f.value, 'g', -1, 64)
+}
+
+// flush sends the combined lines of the current interval and starts a new
+// interval.
+func (st *downsampleStage) flush() {
+	st.mu.Lock()
+	stamp := strconv.AppendInt([]byte{' '}, timestamp(st.forward, st.start), 10)
+	var buf []byte
+	for _, key := range st.order {
+		buf = append(append(buf, key...), ' ')
+		for i := range st.series[key].fields {
+			f := &st.series[key].fields[i]
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = append(append(buf, f.key...), '=')
+			buf = f.appendValue(buf, st.rule.Func)
+		}
+		buf = append(append(buf, stamp...), '\n')
+	}
+	st.start = time.Now().Truncate(st.rule.Interval)
+	st.series = map[string]*downsampleSeries{}
+	st.order = st.order[:0]
+	st.mu.Unlock()
+
+	if len(buf) == 0 {
+		return
+	}
+	if err := st.send(buf); err != nil {
+		glog.Errorf("Unable to write downsampled %s lines: %v", st.rule.Match, err)
+	}
+}
+
+// run flushes the stage at the end of each interval until ctx is done.
+// Intervals are aligned to multiples of the rule's interval.
+func (st *downsampleStage) run(ctx context.Context) {
+	for {
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(st.rule.Interval).Add(st.rule.Interval).Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			st.flush()
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// socketDrops returns the number of datagrams the kernel has dropped for
+// conn, as reported by the drops column of /proc/net/udp or /proc/net/udp6.
+func socketDrops(conn syscall.Conn) (uint64, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var st syscall.Stat_t
+	cerr := rc.Control(func(fd uintptr) {
+		err = syscall.Fstat(int(fd), &st)
+	})
+	if cerr != nil {
+		return 0, cerr
+	} else if err != nil {
+		return 0, err
+	}
+
+	inode := strconv.FormatUint(st.Ino, 10)
+	for _, table := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		drops, ok, err := findSocketDrops(table, inode)
+		if err != nil {
+			return 0, err
+		} else if ok {
+			return drops, nil
+		}
+	}
+	return 0, fmt.Errorf("socket inode %s not found in /proc/net/udp", inode)
+}
+
+func findSocketDrops(table, inode string) (drops uint64, ok bool, err error) {
+	f, err := os.Open(table)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	defer f.Close()
+
+	// Columns: sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+	// retrnsmt uid timeout inode ref pointer drops
+	const inodeCol, dropsCol = 9, 12
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) <= dropsCol || fields[inodeCol] != inode {
+			continue
+		}
+		drops, err = strconv.ParseUint(fields[dropsCol], 10, 64)
+		return drops, err == nil, err
+	}
+	return 0, false, scanner.Err()
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func socketDrops(conn syscall.Conn) (uint64, error) {
+	return 0, errors.New("reading socket drops is not supported on this platform")
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"go.spiff.io/codf"
+)
+
+// Kinds of dynamic port sources.
+const (
+	sourceConsul = "consul" // A Consul KV prefix, watched with blocking queries
+	sourceEtcd   = "etcd"   // An etcd v3 key prefix, polled through its JSON gateway
+)
+
+// PortSourceConfig configures a store that port sections are read from in
+// addition to the config files. Each key under the prefix holds one or more
+// port sections, written as they would be in a config file.
+type PortSourceConfig struct {
+	Kind     string
+	Addr     *url.URL
+	Prefix   string
+	Interval time.Duration // Poll interval of etcd, and wait time of Consul queries
+	Token    string        // Consul ACL token, if any
+}
+
+// handlePortSource parses
+// `port-source consul|etcd URL PREFIX [interval D] [token TOKEN]`.
+func (c *Config) handlePortSource(args []codf.ExprNode) error {
+	src := &PortSourceConfig{Interval: 10 * time.Second}
+	var addr string
+	if err := parseArgsUpTo(args, &src.Kind, &addr, &src.Prefix); err != nil {
+		return err
+	} else if len(args) < 3 {
+		return fmt.Errorf("expected 3 or more arguments; got %d", len(args))
+	}
+
+	err := parseKwargs("port-source", args[3:], kwargs{
+		"interval": {dest: &src.Interval},
+		"token":    {dest: &src.Token},
+	})
+	if err != nil {
+		return err
+	}
+
+	switch src.Kind {
+	case sourceConsul:
+	case sourceEtcd:
+		if src.Token != "" {
+			return fmt.Errorf("port-source token is only allowed with %s", sourceConsul)
+		}
+	default:
+		return argError(0, args[0], fmt.Errorf("invalid port-source %q; must be consul or etcd", src.Kind))
+	}
+
+	if src.Addr, err = url.Parse(addr); err != nil {
+		return argError(1, args[1], err)
+	} else if src.Addr.Scheme != "http" && src.Addr.Scheme != "https" {
+		return argError(1, args[1], fmt.Errorf("port-source URL must be http or https; got %q", addr))
+	}
+
+	if src.Interval <= 0 {
+		return fmt.Errorf("port-source interval must be > 0s; got %v", src.Interval)
+	}
+	if c.PortSource != nil {
+		return fmt.Errorf("port-source is already defined")
+	}
+	c.PortSource = src
+	return nil
+}
+
+// portSourceWalker walks a dynamic port entry, which may only hold port
+// sections.
+type portSourceWalker struct {
+	cfg *Config
+}
+
+func (w *portSourceWalker) Statement(stmt *codf.Statement) error {
+	return fmt.Errorf("directive %s is not allowed in a dynamic port", stmt.Name())
+}
+
+func (w *portSourceWalker) EnterSection(sect *codf.Section) (codf.Walker, error) {
+	if sect.Name() != "port" {
+		return nil, fmt.Errorf("section %s is not allowed in a dynamic port", sect.Name())
+	}
+	return w.cfg.enterPort(sect.Parameters())
+}
+
+// parsePortEntry parses the port sections of a dynamic port entry. Templates
+// and budgets of base may be used.
+func parsePortEntry(base *Config, key string, value []byte) ([]*PortConfig, error) {
+	doc, err := parseDocument(key, bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+
+	scratch := &Config{Templates: base.Templates}
+	if err := codf.Walk(doc, &fileWalker{file: key, w: &portSourceWalker{cfg: scratch}}); err != nil {
+		return nil, err
+	}
+	for _, port := range scratch.Ports {
+		if _, ok := base.Budgets[port.Budget]; port.Budget != "" && !ok {
+			return nil, fmt.Errorf("%s: port %v uses undefined budget %s", key, port.Listen, port.Budget)
+		}
+	}
+	return scratch.Ports, nil
+}
+
+// sourceEntry is a key and value read from a port source.
+type sourceEntry struct {
+	Key   string
+	Value []byte
+}
+
+// watchPortSource reads entries from src until ctx is done, passing each
+// changed set of entries to update.
+func watchPortSource(ctx context.Context, src *PortSourceConfig, update func([]sourceEntry)) {
+	client := &http.Client{Transport: newTransport()}
+
+	var (
+		index  uint64 // Consul's index of the last read; 0 before the first
+		last   []sourceEntry
+		failed = false
+	)
+	for ctx.Err() == nil {
+		var (
+			entries []sourceEntry
+			err     error
+		)
+		switch src.Kind {
+		case sourceConsul:
+			entries, index, err = readConsul(ctx, client, src, index)
+		case sourceEtcd:
+			entries, err = readEtcd(ctx, client, src)
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if !failed {
+				glog.Errorf("Unable to read ports from %s %v: %v", src.Kind, redactURL(src.Addr), err)
+			}
+			failed, index = true, 0
+			sleep(ctx, src.Interval)
+			continue
+		}
+		failed = false
+
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+		if last == nil || !entriesEqual(last, entries) {
+			last = entries
+			update(entries)
+		}
+
+		if src.Kind == sourceEtcd {
+			sleep(ctx, src.Interval)
+		}
+	}
+}
+
+func entriesEqual(a, b []sourceEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || !bytes.Equal(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// readConsul reads the entries under src's prefix. If index is not zero, it
+// blocks until they change past index or the wait time passes.
+func readConsul(ctx context.Context, client *http.Client, src *PortSourceConfig, index uint64) ([]sourceEntry, uint64, error) {
+	u := *src.Addr
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/kv/" + strings.TrimPrefix(src.Prefix, "/")
+	params := url.Values{"recurse": {"true"}}
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", fmt.Sprintf("%ds", int(src.Interval.Seconds()+0.5)))
+	}
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if src.Token != "" {
+		req.Header.Set("X-Consul-Token", src.Token)
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if next < index {
+		next = 0 // The index went backwards; start over
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		io.Copy(ioutil.Discard, resp.Body)
+		return []sourceEntry{}, next, nil
+	case http.StatusOK:
+	default:
+		return nil, 0, fmt.Errorf("consul responded with %s", resp.Status)
+	}
+
+	var kvs []struct {
+		Key   string
+		Value []byte // Base64, decoded by encoding/json
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&kvs); err != nil {
+		return nil, 0, err
+	}
+
+	entries := make([]sourceEntry, 0, len(kvs))
+	for _, kv := range kvs {
+		if len(kv.Value) > 0 {
+			entries = append(entries, sourceEntry{Key: kv.Key, Value: kv.Value})
+		}
+	}
+	return entries, next, nil
+}
+
+// readEtcd reads the keys under src's prefix through etcd's v3 JSON gateway.
+func readEtcd(ctx context.Context, client *http.Client, src *PortSourceConfig) ([]sourceEntry, error) {
+	// The range end of a prefix is the prefix with its last byte incremented.
+	end := []byte(src.Prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			end = end[:i+1]
+			break
+		}
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(src.Prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(end),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	u := *src.Addr
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v3/kv/range"
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("etcd responded with %s", resp.Status)
+	}
+
+	var result struct {
+		KVs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	entries := make([]sourceEntry, 0, len(result.KVs))
+	for _, kv := range result.KVs {
+		if len(kv.Value) > 0 {
+			entries = append(entries, sourceEntry{Key: string(kv.Key), Value: kv.Value})
+		}
+	}
+	return entries, nil
+}
+
+// parseDynamic parses the ports defined by entries read from a port source.
+// Entries that can't be parsed are skipped.
+func parseDynamic(base *Config, entries []sourceEntry) []*PortConfig {
+	var ports []*PortConfig
+	for _, e := range entries {
+		parsed, err := parsePortEntry(base, e.Key, e.Value)
+		if err != nil {
+			glog.Errorf("Skipping dynamic port %s: %v", e.Key, err)
+			continue
+		}
+		ports = append(ports, parsed...)
+	}
+	return ports
+}
+
+// updateDynamic applies the ports defined by entries read from the port
+// source alongside those of the config files.
+func (s *server) updateDynamic(ctx context.Context, entries []sourceEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ctx.Err() != nil {
+		return // Replaced by a reload
+	}
+
+	prevEntries, prev := s.entries, s.dynamic
+	s.entries, s.dynamic = entries, parseDynamic(s.base, entries)
+	if err := s.applyLocked(s.base); err != nil {
+		glog.Errorf("Unable to apply dynamic ports: %v", err)
+		s.entries, s.dynamic = prevEntries, prev
+		return
+	}
+	glog.Infof("Applied %d dynamic ports from %d entries", len(s.dynamic), len(entries))
+}
+
+// withDynamic returns config with the server's dynamic ports added. Dynamic
+// ports whose listeners are already used by the config are skipped.
+func (s *server) withDynamic(config *Config) *Config {
+	if len(s.dynamic) == 0 {
+		return config
+	}
+
+	keys := make(map[string]bool, len(config.Ports))
+	for _, port := range config.Ports {
+		keys[portKey(port)] = true
+	}
+
+	merged := *config
+	merged.Ports = append([]*PortConfig(nil), config.Ports...)
+	for _, port := range s.dynamic {
+		key := portKey(port)
+		if keys[key] {
+			glog.Warningf("Skipping dynamic port for listeners %v; already configured", key)
+			continue
+		}
+		keys[key] = true
+		merged.Ports = append(merged.Ports, port)
+	}
+	return &merged
+}
+
+// watchSource starts watching the port source of config, if it has one,
+// stopping any earlier watch. Must be called with s.mu held.
+func (s *server) watchSource(config *Config) {
+	if s.stopSource != nil {
+		s.stopSource()
+		s.stopSource = nil
+	}
+
+	src := config.PortSource
+	if src == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.stopSource = cancel
+	glog.Infof("Watching %s %v for ports under %s", src.Kind, redactURL(src.Addr), src.Prefix)
+	go watchPortSource(ctx, src, func(entries []sourceEntry) { s.updateDynamic(ctx, entries) })
+}
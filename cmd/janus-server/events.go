@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"go.spiff.io/codf"
+)
+
+// Event types that hooks may be attached to.
+const (
+	eventGatewayDown    = "gateway-down"    // A gateway failed
+	eventReloadFailed   = "reload-failed"   // A config reload failed
+	eventAuthLockout    = "auth-lockout"    // An upstream was locked out
+	eventCircuitOpen    = "circuit-open"    // An upstream's circuit breaker opened
+	eventSpoolThreshold = "spool-threshold" // A circuit breaker's spool grew past its threshold
+)
+
+var eventTypes = map[string]bool{
+	eventGatewayDown:    true,
+	eventReloadFailed:   true,
+	eventAuthLockout:    true,
+	eventCircuitOpen:    true,
+	eventSpoolThreshold: true,
+}
+
+// hookTimeout bounds how long a single hook may run.
+const hookTimeout = 30 * time.Second
+
+// Event is passed to hook templates and, encoded as JSON, to hooks without
+// templates.
+type Event struct {
+	Type    string
+	Port    string `json:",omitempty"`
+	Message string
+	Host    string `json:",omitempty"`
+	Time    time.Time
+}
+
+// EventHook runs webhooks and commands when one of its events occurs.
+type EventHook struct {
+	Events   []string
+	Webhooks []*webhook
+	Execs    []*execHook
+}
+
+type webhook struct {
+	URL  *url.URL
+	Body *template.Template // If nil, the event is sent as JSON
+}
+
+type execHook struct {
+	Path string
+	Args []*template.Template
+}
+
+var _ codf.Walker = (*EventHook)(nil)
+
+func (h *EventHook) Statement(stmt *codf.Statement) error {
+	switch name := stmt.Name(); name {
+	case "webhook":
+		return h.handleWebhook(stmt.Parameters())
+	case "exec":
+		return h.handleExec(stmt.Parameters())
+	default:
+		return fmt.Errorf("unrecognized directive %s", name)
+	}
+}
+
+func (h *EventHook) EnterSection(sect *codf.Section) (codf.Walker, error) {
+	return nil, fmt.Errorf("unrecognized section %s", sect.Name())
+}
+
+func (h *EventHook) handleWebhook(args []codf.ExprNode) error {
+	var (
+		hook webhook
+		body string
+		err  error
+	)
+	if len(args) == 1 {
+		err = parseArgs(args, &hook.URL)
+	} else {
+		err = parseArgs(args, &hook.URL, &body)
+	}
+	if err != nil {
+		return err
+	}
+
+	if body != "" {
+		if hook.Body, err = template.New("webhook").Parse(body); err != nil {
+			return argError(1, args[1], err)
+		}
+	}
+	h.Webhooks = append(h.Webhooks, &hook)
+	return nil
+}
+
+func (h *EventHook) handleExec(args []codf.ExprNode) error {
+	var (
+		hook execHook
+		argv []string
+	)
+	if len(args) == 1 {
+		if err := parseArgs(args, &hook.Path); err != nil {
+			return err
+		}
+	} else if err := parseArgs(args, &hook.Path, &argv); err != nil {
+		return err
+	}
+
+	for i, arg := range argv {
+		tmpl, err := template.New("exec").Parse(arg)
+		if err != nil {
+			return argError(i+1, args[i+1], err)
+		}
+		hook.Args = append(hook.Args, tmpl)
+	}
+	h.Execs = append(h.Execs, &hook)
+	return nil
+}
+
+// hooks is the set of event hooks currently configured.
+var hooks struct {
+	sync.Mutex
+	list    []*EventHook
+	running sync.WaitGroup
+}
+
+func setEventHooks(list []*EventHook) {
+	hooks.Lock()
+	defer hooks.Unlock()
+	hooks.list = list
+}
+
+// emitEvent runs, in the background, all hooks attached to the event type.
+func emitEvent(typ, port, format string, args ...interface{}) {
+	ev := &Event{
+		Type:    typ,
+		Port:    port,
+		Message: fmt.Sprintf(format, args...),
+		Time:    time.Now(),
+	}
+	ev.Host = instance.id()
+	recordEvent(ev)
+
+	hooks.Lock()
+	defer hooks.Unlock()
+	for _, h := range hooks.list {
+		for _, t := range h.Events {
+			if t != typ {
+				continue
+			}
+			for _, w := range h.Webhooks {
+				hooks.running.Add(1)
+				go func(w *webhook) { defer hooks.running.Done(); w.run(ev) }(w)
+			}
+			for _, x := range h.Execs {
+				hooks.running.Add(1)
+				go func(x *execHook) { defer hooks.running.Done(); x.run(ev) }(x)
+			}
+		}
+	}
+}
+
+// maxRecentEvents is the number of recent events kept for state dumps.
+const maxRecentEvents = 64
+
+var recent struct {
+	sync.Mutex
+	events []*Event
+}
+
+func recordEvent(ev *Event) {
+	recent.Lock()
+	defer recent.Unlock()
+	if len(recent.events) == maxRecentEvents {
+		copy(recent.events, recent.events[1:])
+		recent.events = recent.events[:maxRecentEvents-1]
+	}
+	recent.events = append(recent.events, ev)
+}
+
+// recentEvents returns the most recent events, oldest first.
+func recentEvents() []*Event {
+	recent.Lock()
+	defer recent.Unlock()
+	return append([]*Event(nil), recent.events...)
+}
+
+// waitEventHooks waits up to timeout for running hooks to finish.
+func waitEventHooks(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() { hooks.running.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		glog.Warning("Timed out waiting for event hooks to finish")
+	}
+}
+
+func (w *webhook) run(ev *Event) {
+	var body bytes.Buffer
+	if w.Body == nil {
+		json.NewEncoder(&body).Encode(ev)
+	} else if err := w.Body.Execute(&body, ev); err != nil {
+		glog.Errorf("Unable to render webhook body for %s event: %v", ev.Type, err)
+		return
+	}
+
+	contentType := "text/plain; charset=utf-8"
+	if json.Valid(body.Bytes()) {
+		contentType = "application/json"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", w.URL.String(), &body)
+	if err != nil {
+		glog.Errorf("Unable to create webhook request for %s event: %v", ev.Type, err)
+		return
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		glog.Errorf("Webhook %v for %s event failed: %v", redactURL(w.URL), ev.Type, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		glog.Errorf("Webhook %v for %s event failed: %s", redactURL(w.URL), ev.Type, resp.Status)
+	}
+}
+
+func (x *execHook) run(ev *Event) {
+	argv := make([]string, len(x.Args))
+	for i, tmpl := range x.Args {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, ev); err != nil {
+			glog.Errorf("Unable to render argument %d of %s for %s event: %v", i+1, x.Path, ev.Type, err)
+			return
+		}
+		argv[i] = buf.String()
+	}
+
+	var stdin bytes.Buffer
+	json.NewEncoder(&stdin).Encode(ev)
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, x.Path, argv...)
+	cmd.Stdin = &stdin
+	cmd.Env = append(os.Environ(), "JANUS_EVENT="+ev.Type)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		glog.Errorf("Hook %s for %s event failed: %v: %q", x.Path, ev.Type, err, out)
+	}
+}
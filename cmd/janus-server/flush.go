@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"go.spiff.io/codf"
+	"golang.org/x/net/context"
+)
+
+// lineCounter counts the lines and bytes written to a proxy since it last
+// sent a request and asks for a flush once limit lines have been written or
+// the port's flush expression holds. A limit <= 0 never asks for a flush.
+// The flush is asked for, not made, so writes racing it still join the
+// batch; the port's splitTransport caps the lines of each request at limit.
+type lineCounter struct {
+	limit int64
+	when  flushExpr
+
+	n     int64
+	bytes int64
+	start int64 // Time of the first write since the last request, in Unix nanoseconds
+
+	flush chan struct{}
+}
+
+func newLineCounter(limit int, when flushExpr) *lineCounter {
+	return &lineCounter{
+		limit: int64(limit),
+		when:  when,
+		flush: make(chan struct{}, 1),
+	}
+}
+
+func (c *lineCounter) add(lines, size int) {
+	n := atomic.AddInt64(&c.n, int64(lines))
+	atomic.AddInt64(&c.bytes, int64(size))
+	atomic.CompareAndSwapInt64(&c.start, 0, time.Now().UnixNano())
+
+	if limit := atomic.LoadInt64(&c.limit); (limit > 0 && n >= limit) || (c.when != nil && c.when.eval(c.batch())) {
+		c.trigger()
+	}
+}
+
+// setLimit changes the number of lines that asks for a flush.
+func (c *lineCounter) setLimit(limit int) {
+	atomic.StoreInt64(&c.limit, int64(limit))
+}
+
+// maxLines returns the most lines a request may carry, or 0 if there's no
+// limit.
+func (c *lineCounter) maxLines() int {
+	if limit := atomic.LoadInt64(&c.limit); limit > 0 {
+		return int(limit)
+	}
+	return 0
+}
+
+func (c *lineCounter) trigger() {
+	select {
+	case c.flush <- struct{}{}:
+	default:
+	}
+}
+
+// batch returns the size, points, and age of the batch being accumulated.
+func (c *lineCounter) batch() batchState {
+	b := batchState{
+		size:   atomic.LoadInt64(&c.bytes),
+		points: atomic.LoadInt64(&c.n),
+	}
+	if start := atomic.LoadInt64(&c.start); start != 0 {
+		b.age = time.Since(time.Unix(0, start))
+	}
+	return b
+}
+
+// reset is called whenever the proxy sends a new batch whose body can't be
+// read, since its buffer has been taken for the batch.
+func (c *lineCounter) reset() {
+	atomic.StoreInt64(&c.n, 0)
+	atomic.StoreInt64(&c.bytes, 0)
+	atomic.StoreInt64(&c.start, 0)
+}
+
+// remove takes the lines and bytes of a batch the proxy sends from the
+// count, leaving those written since the proxy took its buffer.
+func (c *lineCounter) remove(lines, size int) {
+	n := subtractFloor(&c.n, int64(lines))
+	subtractFloor(&c.bytes, int64(size))
+	if n == 0 {
+		atomic.StoreInt64(&c.start, 0)
+	} else {
+		// The rest were written after the batch was taken.
+		atomic.StoreInt64(&c.start, time.Now().UnixNano())
+	}
+}
+
+// subtractFloor subtracts d from *p, stopping at zero, and returns the result.
+func subtractFloor(p *int64, d int64) int64 {
+	for {
+		old := atomic.LoadInt64(p)
+		n := old - d
+		if n < 0 {
+			n = 0
+		}
+		if atomic.CompareAndSwapInt64(p, old, n) {
+			return n
+		}
+	}
+}
+
+// flushOnLines flushes the proxy each time its line limit is reached or its
+// flush expression holds. Expressions with an age condition are also checked
+// on a ticker, since a batch ages without any writes.
+func (g *gateway) flushOnLines(ctx context.Context) {
+	var tick <-chan time.Time
+	if age := g.lines.when.minAge(); age > 0 {
+		check := age / 4
+		if check < 10*time.Millisecond {
+			check = 10 * time.Millisecond
+		}
+		ticker := time.NewTicker(check)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-g.lines.flush:
+		case <-tick:
+			if b := g.lines.batch(); b.points == 0 || !g.lines.when.eval(b) {
+				continue
+			}
+		}
+
+		if err := g.out.Flush(withFlushID(ctx)); err != nil && ctx.Err() == nil {
+			glog.Errorf("Triggered flush of %v failed: %v", g, err)
+		}
+	}
+}
+
+// batchState describes the batch a proxy is accumulating.
+type batchState struct {
+	size   int64 // Bytes
+	points int64
+	age    time.Duration
+}
+
+// flushCond is a single comparison in a flush expression.
+type flushCond struct {
+	metric string // size, age, or points
+	op     string // >= or >
+	value  int64  // Bytes, nanoseconds, or points
+}
+
+func (c flushCond) eval(b batchState) bool {
+	var v int64
+	switch c.metric {
+	case "size":
+		v = b.size
+	case "age":
+		v = int64(b.age)
+	case "points":
+		v = b.points
+	}
+	if c.op == ">" {
+		return v > c.value
+	}
+	return v >= c.value
+}
+
+func (c flushCond) String() string {
+	v := strconv.FormatInt(c.value, 10)
+	if c.metric == "age" {
+		v = time.Duration(c.value).String()
+	}
+	return c.metric + c.op + v
+}
+
+// flushExpr is a disjunction of conjunctions of flush conditions. A nil
+// flushExpr never holds.
+type flushExpr [][]flushCond
+
+func (e flushExpr) eval(b batchState) bool {
+	for _, and := range e {
+		ok := true
+		for _, c := range and {
+			if ok = c.eval(b); !ok {
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// minAge returns the smallest age in the expression, or 0 if it has no age
+// condition.
+func (e flushExpr) minAge() (age time.Duration) {
+	for _, and := range e {
+		for _, c := range and {
+			if d := time.Duration(c.value); c.metric == "age" && (age == 0 || d < age) {
+				age = d
+			}
+		}
+	}
+	return age
+}
+
+func (e flushExpr) String() string {
+	ors := make([]string, len(e))
+	for i, and := range e {
+		conds := make([]string, len(and))
+		for j, c := range and {
+			conds[j] = c.String()
+		}
+		ors[i] = strings.Join(conds, " and ")
+	}
+	return strings.Join(ors, " or ")
+}
+
+// parseFlushExpr parses the conditions of `flush when COND [and|or COND]...`,
+// where each COND is `size|age|points >=|> VALUE`. Sizes may have a b, kb,
+// mb, or gb suffix, in multiples of 1024. and binds tighter than or.
+func parseFlushExpr(args []codf.ExprNode) (flushExpr, error) {
+	var (
+		expr flushExpr
+		and  []flushCond
+	)
+	for i := 0; ; i += 4 {
+		if len(args)-i < 3 {
+			return nil, fmt.Errorf("expected a condition of the form METRIC OP VALUE")
+		}
+
+		var c flushCond
+		if err := parseArg(args[i], &c.metric); err != nil {
+			return nil, argError(i, args[i], err)
+		}
+		if err := parseArg(args[i+1], &c.op); err != nil {
+			return nil, argError(i+1, args[i+1], err)
+		} else if c.op != ">=" && c.op != ">" {
+			return nil, argError(i+1, args[i+1], fmt.Errorf("invalid operator %q; must be >= or >", c.op))
+		}
+
+		var err error
+		switch c.metric {
+		case "size":
+			c.value, err = parseByteSize(args[i+2])
+		case "age":
+			var d time.Duration
+			err = parseArg(args[i+2], &d)
+			c.value = int64(d)
+		case "points":
+			err = parseArg(args[i+2], &c.value)
+		default:
+			return nil, argError(i, args[i], fmt.Errorf("invalid metric %q; must be size, age, or points", c.metric))
+		}
+		if err == nil && c.value <= 0 {
+			err = fmt.Errorf("%s must be > 0", c.metric)
+		}
+		if err != nil {
+			return nil, argError(i+2, args[i+2], err)
+		}
+		and = append(and, c)
+
+		if i+3 == len(args) {
+			return append(expr, and), nil
+		}
+
+		var join string
+		if err := parseArg(args[i+3], &join); err != nil {
+			return nil, argError(i+3, args[i+3], err)
+		}
+		switch join {
+		case "and":
+		case "or":
+			expr, and = append(expr, and), nil
+		default:
+			return nil, argError(i+3, args[i+3], fmt.Errorf("expected and or or; got %q", join))
+		}
+	}
+}
+
+// parseByteSize parses an integer number of bytes or a word with a b, kb, mb,
+// or gb suffix.
+func parseByteSize(arg codf.ExprNode) (int64, error) {
+	if n, ok := codf.Int64(arg); ok {
+		return n, nil
+	}
+
+	var s string
+	if err := parseArg(arg, &s); err != nil {
+		return 0, err
+	}
+	lower := strings.ToLower(s)
+	scale := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		scale  int64
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"b", 1}} {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower, scale = strings.TrimSuffix(lower, unit.suffix), unit.scale
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * scale, nil
+}
+
+// handleFlushJitter parses `flush-jitter FRACTION`, where FRACTION of the
+// flush interval is the spread of each flush around the interval.
+func (p *PortConfig) handleFlushJitter(args []codf.ExprNode) error {
+	var f float64
+	if err := parseArgs(args, &f); err != nil {
+		return err
+	} else if f < 0 || f > 1 {
+		return fmt.Errorf("flush-jitter must be between 0 and 1; got %v", f)
+	}
+	p.FlushJitter = f
+	return nil
+}
+
+// proxyInterval returns the interval the port's proxies flush on by
+// themselves. Flushes are driven by jitterFlush, so that they carry flush IDs
+// to trace batches by, and the proxies' own flushes are only a backstop, at
+// twice the flush interval.
+func (g *gateway) proxyInterval() time.Duration {
+	return 2 * g.cfg.FlushInterval
+}
+
+// jitterFlush flushes the port's proxies at random intervals until ctx is
+// done. Each wait is drawn from the flush interval plus or minus half its
+// jitter, so flushes keep the same average rate without lining up with those
+// of other processes started at the same time. Without jitter, it flushes
+// every flush interval.
+func (g *gateway) jitterFlush(ctx context.Context) {
+	interval, spread := float64(g.cfg.FlushInterval), g.cfg.FlushJitter
+	for {
+		wait := time.Duration(interval * (1 - spread/2 + spread*rand.Float64()))
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		g.flushProxies(ctx, "Scheduled")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.spiff.io/codf"
+)
+
+// testArgs returns the parameters of the single statement in src.
+func testArgs(t *testing.T, src string) []codf.ExprNode {
+	t.Helper()
+	doc, err := parseDocument("test", strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("parse %q: %v", src, err)
+	}
+	kids := doc.Children()
+	if len(kids) != 1 {
+		t.Fatalf("parse %q: got %d statements; want 1", src, len(kids))
+	}
+	stmt, ok := kids[0].(*codf.Statement)
+	if !ok {
+		t.Fatalf("parse %q: got %T; want a statement", src, kids[0])
+	}
+	return stmt.Parameters()
+}
+
+func TestParseFlushExpr(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   string
+		minAge time.Duration
+	}{
+		{"size >= 1mb", "size>=1048576", 0},
+		{"size > 512", "size>512", 0},
+		{"points >= 5000", "points>=5000", 0},
+		{"age > 10s", "age>10s", 10 * time.Second},
+		{"size >= 64KB or age >= 5s", "size>=65536 or age>=5s", 5 * time.Second},
+		{"size >= 1kb and points > 10 or age >= 2s", "size>=1024 and points>10 or age>=2s", 2 * time.Second},
+		{"age >= 5s or points >= 100 and age >= 1s", "age>=5s or points>=100 and age>=1s", time.Second},
+	}
+	for _, tt := range tests {
+		expr, err := parseFlushExpr(testArgs(t, "flush when "+tt.in+";")[1:])
+		if err != nil {
+			t.Errorf("parseFlushExpr(%q): %v", tt.in, err)
+			continue
+		}
+		if got := expr.String(); got != tt.want {
+			t.Errorf("parseFlushExpr(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+		if got := expr.minAge(); got != tt.minAge {
+			t.Errorf("parseFlushExpr(%q).minAge() = %v; want %v", tt.in, got, tt.minAge)
+		}
+	}
+}
+
+func TestParseFlushExprInvalid(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"size >=",
+		"size = 1mb",
+		"bytes >= 1mb",
+		"size >= 0",
+		"age >= -1s",
+		"age >= 10",
+		"points >= 1.5",
+		"size >= 1xb",
+		"size >= 1mb and",
+		"size >= 1mb xor age >= 1s",
+	} {
+		if expr, err := parseFlushExpr(testArgs(t, "flush when "+in+";")[1:]); err == nil {
+			t.Errorf("parseFlushExpr(%q) = %v; want error", in, expr)
+		}
+	}
+}
+
+func TestFlushExprEval(t *testing.T) {
+	expr, err := parseFlushExpr(testArgs(t, "flush when size >= 1kb and points > 10 or age >= 2s;")[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		b    batchState
+		want bool
+	}{
+		{batchState{}, false},
+		{batchState{size: 1024, points: 10}, false},
+		{batchState{size: 1023, points: 11}, false},
+		{batchState{size: 1024, points: 11}, true},
+		{batchState{age: 2 * time.Second}, true},
+		{batchState{age: 2*time.Second - 1}, false},
+	}
+	for _, tt := range tests {
+		if got := expr.eval(tt.b); got != tt.want {
+			t.Errorf("%v: eval(%+v) = %t; want %t", expr, tt.b, got, tt.want)
+		}
+	}
+
+	if flushExpr(nil).eval(batchState{size: 1 << 30, points: 1 << 30, age: time.Hour}) {
+		t.Error("nil flushExpr holds; want never")
+	}
+}
+
+// TestLineCounterRemove checks that lines written after the proxy took its
+// buffer stay counted once the batch is sent.
+func TestLineCounterRemove(t *testing.T) {
+	c := newLineCounter(10, nil)
+	c.add(3, 30) // Taken for the batch
+	c.add(2, 20) // Written since
+	c.remove(3, 30)
+	if b := c.batch(); b.points != 2 || b.size != 20 {
+		t.Errorf("batch = %d lines, %d bytes; want 2 lines, 20 bytes", b.points, b.size)
+	}
+
+	c.remove(5, 50)
+	if b := c.batch(); b.points != 0 || b.size != 0 || b.age != 0 {
+		t.Errorf("batch = %d lines, %d bytes, age %v; want empty", b.points, b.size, b.age)
+	}
+}
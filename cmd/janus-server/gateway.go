@@ -2,61 +2,472 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
 
 	"go.spiff.io/dagr/outflux"
 	"golang.org/x/net/context"
 )
 
 type gateway struct {
-	cfg *PortConfig
-	in  []*porthole
-	out *outflux.Proxy
+	cfg        *PortConfig
+	in         []*porthole
+	out        *outflux.Proxy
+	divert     *outflux.Proxy     // Proxy for diverted overflow, if any
+	quarantine *outflux.Proxy     // Proxy for lines violating the schema, if quarantined
+	aggregate  *aggregateStage    // Combines counters and gauges, if enabled
+	downsample []*downsampleStage // Downsampling rules, in order
+	dead       *deadLetter        // Records dropped lines, if enabled
+	stats      *portStats
+	lockout    *authLockout
+	lockouts   []*authLockout // Lockouts of the port's side databases and routes
+	lines      *lineCounter
+	trace      *batchTracer
+	budget     *budgetMember // The port's claim on its budget, if any
+	queue      *writeQueue
+	flushes    *flushHistory
+	probe      *upstreamProbe
+	breaker    *breakerTransport // Circuit breaker around flushes, if any
+	adaptive   *adaptiveSizer    // Sizes batches from flush results, if enabled
+	sampler    *sampler          // Picks the payloads to forward, if sampling
+	dedup      *dedupFilter      // Drops repeated payloads, if enabled
+	peers      *peerFilter       // Drops datagrams from unexpected senders, if enabled
+	sources    *sourceStats      // Counts traffic per sender, if enabled
+	routes     []*routeTarget    // Upstreams of the port's routes, in order
+	buffer     *bufferLimit      // Bounds undelivered bytes, if enabled
+	wal        *writeAheadLog    // Logs payloads until they're delivered, if enabled
+	record     *recorder         // Records received datagrams, if enabled
+	script     *scriptHook       // Transforms payloads, if the port has a script
 }
 
-func newGateway(cfg *PortConfig, options ...outflux.Option) (g *gateway, err error) {
-	proxy := newProxy(cfg, options...)
+func newGateway(cfg *PortConfig, reuseport bool, inflight *byteLimiter, egress *rateLimiter, budget *budgetPool, options ...outflux.Option) (g *gateway, err error) {
+	{
+		dup := new(PortConfig)
+		*dup = *cfg
+		cfg = dup
+	}
 
-	var holes []*porthole
-	for _, addr := range cfg.Listen {
-		var hole *porthole
-		hole, err = newPorthole(addr, proxy, cfg.ReadTimeout)
+	g = &gateway{
+		cfg:     cfg,
+		stats:   new(portStats),
+		lockout: &authLockout{threshold: cfg.AuthLockout},
+		lines:   newLineCounter(cfg.FlushLines, cfg.FlushWhen),
+		trace:   newBatchTracer(cfg.TraceHeader),
+		flushes: new(flushHistory),
+	}
+	defer func(g *gateway) {
+		if err != nil {
+			g.close()
+		}
+	}(g)
+	g.queue = newWriteQueue(cfg.Workers, g.stats)
+	if cfg.Dedup > 0 {
+		g.dedup = newDedupFilter(cfg.Dedup)
+	}
+	if len(cfg.Peers.Hosts) > 0 {
+		g.peers = newPeerFilter(cfg.Peers)
+	}
+	if cfg.SourceStats.Max > 0 {
+		g.sources = newSourceStats(cfg.SourceStats)
+	}
+	if cfg.Sample.enabled() {
+		g.sampler = &sampler{cfg: cfg.Sample}
+	}
+	if cfg.Buffer.Max > 0 {
+		g.buffer = newBufferLimit(cfg.Buffer, g.stats)
+	}
+	if cfg.Record != "" {
+		if g.record, err = openRecorder(cfg.Record); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.WAL.Dir != "" {
+		if g.wal, err = openWAL(cfg.WAL); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.DeadLetter.File != "" {
+		if g.dead, err = openDeadLetterFile(cfg.DeadLetter.File, g.stats); err != nil {
+			return nil, err
+		}
+	}
+
+	forward, base := resolveUpstream(cfg.Forward, cfg)
+
+	if cfg.HealthCheck.Interval > 0 {
+		g.probe = newUpstreamProbe(cfg.HealthCheck, forward, base())
+	}
+
+	// The port's egress limit is shared by its routes.
+	portEgress := newRateLimiter(cfg.EgressRate)
+
+	var upstream http.RoundTripper = &limitTransport{
+		base:  newThrottleTransport(base(), egress, portEgress),
+		limit: inflight,
+	}
+	if len(cfg.Transform) > 0 {
+		upstream = &execTransport{base: upstream, command: cfg.Transform, timeout: cfg.WriteTimeout}
+	}
+	split := &splitTransport{base: upstream, stats: g.stats, lines: g.lines}
 
+	// The circuit breaker sits under the classifyTransport, so that held
+	// batches are taken from the proxy's buffer like any other, and its
+	// replays don't pass through the port's flush accounting again.
+	var sender http.RoundTripper = split
+	if cfg.Breaker.Failures > 0 {
+		g.breaker, err = newBreakerTransport(split, cfg.Breaker, describePort(cfg), cfg.TraceHeader, cfg.WriteTimeout, g.stats)
 		if err != nil {
 			return nil, err
 		}
-		holes = append(holes, hole)
+		sender = g.breaker
 	}
 
-	{
-		dup := new(PortConfig)
-		*dup = *cfg
-		cfg = dup
+	var retries *retryBudget
+	if cfg.RetryBudget.Ratio > 0 {
+		retries = newRetryBudget(cfg.RetryBudget)
+	}
+
+	classify := &classifyTransport{
+		base:      sender,
+		port:      describePort(cfg),
+		stats:     g.stats,
+		lockout:   g.lockout,
+		lines:     g.lines,
+		trace:     g.trace,
+		flushes:   g.flushes,
+		probe:     g.probe,
+		retries:   retries,
+		buffer:    g.buffer,
+		wal:       g.wal,
+		backoff:   newBackoffState(cfg.Backoff, flushResetStreak),
+		dropOn:    cfg.DropOn,
+		bodyLimit: cfg.ErrorBodyLimit,
+	}
+	if cfg.MaxRetries >= 0 {
+		classify.maxAttempts = cfg.MaxRetries + 1
+	}
+	if cfg.Adaptive.Max > 0 {
+		g.adaptive = newAdaptiveSizer(cfg.Adaptive, g.lines)
+		classify.adaptive = g.adaptive
 	}
 
-	return &gateway{cfg, holes, proxy}, err
+	g.out = newProxy(cfg, forward, classify, withBackoff(options, classify.backoff)...)
+
+	// sideProxy returns a proxy writing to the port's upstream in another
+	// database. Its batches aren't counted by the port's buffer or logged,
+	// and get their own tracing, auth lockout and backoff so they can't
+	// resolve or hold back the port's batches. They skip the circuit breaker.
+	sideProxy := func(db string) *outflux.Proxy {
+		side := &classifyTransport{
+			base:      split,
+			port:      describePort(cfg) + " database " + db,
+			stats:     g.stats,
+			lockout:   g.newLockout(),
+			lines:     newLineCounter(0, nil),
+			trace:     newBatchTracer(cfg.TraceHeader),
+			flushes:   g.flushes,
+			probe:     g.probe,
+			retries:   retries,
+			backoff:   newBackoffState(cfg.Backoff, flushResetStreak),
+			dropOn:    cfg.DropOn,
+			bodyLimit: cfg.ErrorBodyLimit,
+		}
+		side.maxAttempts = classify.maxAttempts
+		return newProxy(cfg, withDB(forward, db), side, withBackoff(options, side.backoff)...)
+	}
+	if db := cfg.DeadLetter.DB; db != "" {
+		g.dead = &deadLetter{proxy: sideProxy(db), stats: g.stats}
+	}
+	split.dead = g.dead
+	classify.dead = g.dead
+	g.queue.dead = g.dead
+
+	var stages []stage
+	if len(cfg.Renames) > 0 || cfg.MeasurementPrefix != "" {
+		stages = append(stages, newMeasurementStage(cfg.Renames, cfg.MeasurementPrefix))
+	}
+	if cfg.Timestamps.enabled() || cfg.RejectOlder > 0 || cfg.RejectFuture > 0 {
+		stages = append(stages, &timestampStage{
+			cfg:     cfg.Timestamps,
+			forward: cfg.Forward,
+			older:   cfg.RejectOlder,
+			future:  cfg.RejectFuture,
+			stats:   g.stats,
+			dead:    g.dead,
+		})
+	}
+	if s := cfg.Schema; s != nil {
+		if s.OnViolation == schemaQuarantine {
+			g.quarantine = sideProxy(s.QuarantineDB)
+		}
+		stages = append(stages, &schemaStage{cfg: s, stats: g.stats, quarantine: g.quarantine, dead: g.dead})
+	}
+	if cfg.Cardinality.Limit > 0 {
+		stages = append(stages, newCardinalityGuard(cfg.Cardinality, g.stats, g.dead))
+	}
+	if q := cfg.Quota; q.Lines > 0 {
+		if q.Overflow == overflowDivert {
+			g.divert = sideProxy(q.DivertDB)
+		}
+		stages = append(stages, newQuotaStage(q, g.stats, g.divert, g.dead))
+	}
+
+	if budget != nil {
+		g.budget = budget.member(cfg.BudgetWeight)
+		stages = append(stages, &budgetStage{member: g.budget, stats: g.stats, dead: g.dead})
+	}
+
+	// Routes get their own transports, without the port's health checks or
+	// circuit breaker, and their own auth lockouts.
+	for _, r := range cfg.Routes {
+		upstreamURL := r.upstream(cfg.Forward)
+		forward, base := resolveUpstream(upstreamURL, cfg)
+		var upstream http.RoundTripper = &limitTransport{base: newThrottleTransport(base(), egress, portEgress), limit: inflight}
+		if len(cfg.Transform) > 0 {
+			upstream = &execTransport{base: upstream, command: cfg.Transform, timeout: cfg.WriteTimeout}
+		}
+		transport := &classifyTransport{
+			base:      &splitTransport{base: upstream, stats: g.stats, dead: g.dead},
+			port:      describePort(cfg) + " route " + r.Name,
+			stats:     g.stats,
+			lockout:   g.newLockout(),
+			lines:     newLineCounter(0, nil),
+			trace:     newBatchTracer(cfg.TraceHeader),
+			flushes:   g.flushes,
+			retries:   retries,
+			dead:      g.dead,
+			backoff:   newBackoffState(cfg.Backoff, flushResetStreak),
+			dropOn:    cfg.DropOn,
+			bodyLimit: cfg.ErrorBodyLimit,
+		}
+		proxy := newProxy(cfg, forward, transport, withBackoff(options, transport.backoff)...)
+		g.routes = append(g.routes, newRouteTarget(r, cfg.Forward, upstreamURL, proxy))
+	}
+	if len(g.routes) > 0 {
+		stages = append(stages, &routeStage{routes: g.routes, stats: g.stats, dead: g.dead})
+	}
+	if cfg.Script.Path != "" {
+		if g.script, err = newScriptHook(cfg.Script, g.routes, g.stats, g.dead); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Aggregate.Enabled {
+		interval := cfg.Aggregate.Interval
+		if interval <= 0 {
+			interval = cfg.FlushInterval
+		}
+		g.aggregate = newAggregateStage(interval, g.stats)
+		stages = append(stages, g.aggregate)
+	}
+	for _, r := range cfg.Downsample {
+		st := newDownsampleStage(r, cfg.Forward, g.stats)
+		g.downsample = append(g.downsample, st)
+		stages = append(stages, st)
+	}
+
+	for i, addr := range cfg.Listen {
+		var hole *porthole
+		hole, err = newPorthole(addr, i, g, stages, reuseport)
+		if err != nil {
+			return nil, err
+		}
+		g.in = append(g.in, hole)
+	}
+	if g.aggregate != nil {
+		// Every listener sends to the same proxy, buffer, and log, so
+		// combined lines are sent as if received by the first.
+		g.aggregate.send = g.in[0].send
+	}
+	for _, st := range g.downsample {
+		st.send = g.in[0].send
+	}
+
+	return g, nil
+}
+
+// close releases the files opened for a gateway that's discarded without
+// being started. A started gateway releases them once Start returns.
+func (g *gateway) close() {
+	if g.record != nil {
+		g.record.close()
+	}
+	if g.wal != nil {
+		g.wal.close()
+	}
+	if g.dead != nil && g.dead.file != nil {
+		g.dead.close()
+	}
 }
 
 func (g *gateway) String() string {
-	u := *g.cfg.Forward
-	u.User = nil
-	params := u.Query()
+	return describePort(g.cfg)
+}
+
+// resolveUpstream returns the URL to send batches to for forward and a
+// function returning base transports to send them with. Upstreams named by
+// SRV record are sent to the record's targets.
+func resolveUpstream(forward *url.URL, cfg *PortConfig) (*url.URL, func() http.RoundTripper) {
+	base := func() http.RoundTripper { return upstreamTransport(cfg.Transport) }
+	if !isSRV(forward) {
+		return forward, base
+	}
+	srv := newSRVUpstream(forward.Host, cfg.SRVRefresh)
+	return srvBaseURL(forward), func() http.RoundTripper {
+		return &srvTransport{base: base(), srv: srv}
+	}
+}
+
+// describePort returns a description of a port, with credentials removed,
+// for logging.
+func describePort(cfg *PortConfig) string {
+	return fmt.Sprint(cfg.Listen, "->", redactURL(cfg.Forward))
+}
+
+// redactURL returns a copy of u with any credentials removed.
+// newLockout returns an auth lockout for one of the port's side databases or
+// routes.
+func (g *gateway) newLockout() *authLockout {
+	l := &authLockout{threshold: g.cfg.AuthLockout}
+	g.lockouts = append(g.lockouts, l)
+	return l
+}
+
+// resetLockouts clears the auth lockouts of the port's upstreams and returns
+// true if any of them was locked out.
+func (g *gateway) resetLockouts() bool {
+	locked := g.lockout.reset()
+	for _, l := range g.lockouts {
+		if l.reset() {
+			locked = true
+		}
+	}
+	return locked
+}
+
+// sameCredentials returns true if a and b carry the same credentials, in
+// their userinfo or u and p parameters.
+func sameCredentials(a, b *url.URL) bool {
+	pa, pb := a.Query(), b.Query()
+	return a.User.String() == b.User.String() &&
+		pa.Get("u") == pb.Get("u") && pa.Get("p") == pb.Get("p")
+}
+
+func redactURL(u *url.URL) *url.URL {
+	dup := *u
+	dup.User = nil
+	params := dup.Query()
 	params.Del("u")
 	params.Del("p")
-	u.RawQuery = params.Encode()
-	return fmt.Sprint(g.cfg.Listen, "->", &u)
+	dup.RawQuery = params.Encode()
+	return &dup
 }
 
 func (g *gateway) Start(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	errch := make(chan error, 3)
+	if g.budget != nil {
+		g.budget.join()
+		defer g.budget.leave()
+	}
+
+	if g.buffer != nil {
+		defer g.buffer.stop()
+	}
+
+	errch := make(chan error, 4)
+
+	if g.breaker != nil {
+		g.breaker.start(ctx)
+	}
 
-	g.out.Start(ctx, g.cfg.FlushInterval)
+	interval := g.proxyInterval()
+	g.out.Start(ctx, interval)
+	if g.wal != nil {
+		defer g.wal.close()
+		// The gateway this replaces, if any, may still be appending to the
+		// log's segments, so they're recovered once it has closed the log.
+		go func() {
+			if err := g.wal.recover(ctx, g.out); err != nil && ctx.Err() == nil {
+				select {
+				case <-ctx.Done():
+				case errch <- fmt.Errorf("unable to recover write-ahead log of %v: %v", g, err):
+				}
+			}
+		}()
+	}
+	if g.divert != nil {
+		g.divert.Start(ctx, interval)
+	}
+	if g.dead != nil {
+		if g.dead.proxy != nil {
+			g.dead.proxy.Start(ctx, interval)
+		}
+		go g.dead.run(ctx)
+	}
+	if g.quarantine != nil {
+		g.quarantine.Start(ctx, interval)
+	}
+	for _, r := range g.routes {
+		r.proxy.Start(ctx, interval)
+	}
+
+	if g.probe != nil {
+		go g.probe.run(ctx)
+	}
+
+	if g.peers != nil {
+		g.peers.resolve(ctx)
+		go g.peers.run(ctx)
+	}
+
+	if g.record != nil {
+		go g.record.run(ctx)
+	}
+
+	if g.aggregate != nil {
+		go g.aggregate.run(ctx)
+	}
+	for _, st := range g.downsample {
+		go st.run(ctx)
+	}
+
+	if g.cfg.SelfReport {
+		go g.selfReport(ctx, g.cfg.SelfReportInterval)
+	}
+
+	if g.cfg.IdleFlush > 0 {
+		go g.idleFlush(ctx, g.cfg.IdleFlush)
+	}
+
+	if g.cfg.FlushInterval > 0 {
+		go g.jitterFlush(ctx)
+	}
 
+	if g.cfg.FlushLines > 0 || g.cfg.FlushWhen != nil || g.adaptive != nil {
+		go g.flushOnLines(ctx)
+	}
+
+	// Listeners are waited for, so that their sockets are closed once Start
+	// returns.
+	var listeners sync.WaitGroup
+	defer func() {
+		cancel()
+		listeners.Wait()
+	}()
 	for _, p := range g.in {
+		listeners.Add(1)
 		go func(p *porthole) {
+			defer listeners.Done()
 			err := p.Listen(ctx)
+			if err != nil && ctx.Err() == nil && g.cfg.OnBindFailure == bindIgnore {
+				glog.Errorf("Listener %v of %v has failed; keeping the rest of the port running: %v", p.orig, g, err)
+				return
+			}
 			select {
 			case <-ctx.Done():
 			case errch <- err:
@@ -64,17 +475,136 @@ func (g *gateway) Start(ctx context.Context) error {
 		}(p)
 	}
 
+	go func() {
+		err := g.queue.run(ctx)
+		select {
+		case <-ctx.Done():
+		case errch <- err:
+		}
+	}()
+
 	go func() { <-ctx.Done(); errch <- ctx.Err() }()
 
 	return <-errch
 }
 
-func newProxy(p *PortConfig, options ...outflux.Option) *outflux.Proxy {
+// idleFlush flushes the proxies once no datagrams have been received for idle,
+// provided any have been received since the last idle flush.
+func (g *gateway) idleFlush(ctx context.Context, idle time.Duration) {
+	check := idle / 4
+	if check < 10*time.Millisecond {
+		check = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+
+	var flushed uint64 // Packets received as of the last idle flush
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s := g.stats.snapshot()
+		if s.Packets == flushed || time.Since(time.Unix(0, s.LastPacket)) < idle {
+			continue
+		}
+
+		flushed = s.Packets
+		g.flush(ctx, "Idle")
+	}
+}
+
+// drain flushes the port for shutdown. Unlike other flushes, it sends the
+// downsampled lines of incomplete intervals, which would otherwise be lost.
+func (g *gateway) drain(ctx context.Context) {
+	for _, st := range g.downsample {
+		st.flush()
+	}
+	g.flush(ctx, "Shutdown")
+}
+
+// flush flushes the port's proxy and those of its routes, after sending any
+// aggregated lines, logging failures under what.
+func (g *gateway) flush(ctx context.Context, what string) {
+	if g.aggregate != nil {
+		g.aggregate.flush()
+	}
+	g.flushProxies(ctx, what)
+}
+
+// flushProxies flushes the port's proxy, those of its routes, and any others
+// it writes to, logging failures under what.
+func (g *gateway) flushProxies(ctx context.Context, what string) {
+	// Each proxy has its own batch tracer, so they can share a flush ID.
+	ctx = withFlushID(ctx)
+	if err := g.out.Flush(ctx); err != nil && ctx.Err() == nil {
+		glog.Errorf("%s flush of %v failed: %v", what, g, err)
+	}
+	if g.divert != nil {
+		if err := g.divert.Flush(ctx); err != nil && ctx.Err() == nil {
+			glog.Errorf("%s flush of %v diverted overflow failed: %v", what, g, err)
+		}
+	}
+	if g.quarantine != nil {
+		if err := g.quarantine.Flush(ctx); err != nil && ctx.Err() == nil {
+			glog.Errorf("%s flush of %v quarantined lines failed: %v", what, g, err)
+		}
+	}
+	if g.dead != nil && g.dead.proxy != nil {
+		if err := g.dead.proxy.Flush(ctx); err != nil && ctx.Err() == nil {
+			glog.Errorf("%s flush of %v dead letters failed: %v", what, g, err)
+		}
+	}
+	for _, r := range g.routes {
+		if err := r.proxy.Flush(ctx); err != nil && ctx.Err() == nil {
+			glog.Errorf("%s flush of %v route %s failed: %v", what, g, r.cfg.Name, err)
+		}
+	}
+}
+
+// newTransport returns the HTTP transport used to connect to upstreams.
+func newTransport() *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dns.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+func newProxy(p *PortConfig, forward *url.URL, rt http.RoundTripper, options ...outflux.Option) *outflux.Proxy {
+	client := &http.Client{Transport: rt}
 	options = append([]outflux.Option{
 		outflux.Timeout(p.WriteTimeout),
 		outflux.RetryLimit(p.MaxRetries),
 		outflux.FlushSize(p.FlushSizeBytes),
 		outflux.BackoffFunc(p.Backoff.backoff),
 	}, options...)
-	return outflux.NewURL(nil, p.Forward, options...)
+	return outflux.NewURL(client, forward, options...)
+}
+
+// withBackoff returns options followed by one using state for the proxy's
+// backoff in place of the port's.
+func withBackoff(options []outflux.Option, state *backoffState) []outflux.Option {
+	return append(options[:len(options):len(options)], outflux.BackoffFunc(state.backoff))
+}
+
+// status returns the port's counters along with the current depth and
+// capacity of its write queue, for the status page.
+func (g *gateway) status() interface{} {
+	fields := g.stats.snapshot().fields()
+	fields["queue_depth"] = uint64(g.queue.depth())
+	fields["queue_capacity"] = uint64(g.cfg.Workers.Queue)
+	if g.adaptive != nil {
+		fields["adaptive_flush_lines"] = uint64(g.adaptive.size())
+	}
+	if g.buffer != nil {
+		fields["buffer_bytes"] = uint64(g.buffer.usage())
+		fields["buffer_capacity"] = uint64(g.cfg.Buffer.Max)
+	}
+	return fields
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// decodeGraphite converts Graphite plaintext lines of the form PATH VALUE
+// [TIMESTAMP] to line protocol. PATH may carry tags as PATH;TAG=VALUE;...
+// Each line becomes a point in the measurement PATH with a value field. The
+// timestamp is in seconds and is converted to the precision of the upstream;
+// a missing timestamp, or -1, is the time received.
+func (d *decoder) decodeGraphite(dst, payload []byte) ([]byte, error) {
+	for len(payload) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(payload, '\n'); i == -1 {
+			line, payload = payload, nil
+		} else {
+			line, payload = payload[:i], payload[i+1:]
+		}
+
+		line, err := d.checkWhitespace(line)
+		if err != nil {
+			return dst, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		if dst, err = d.appendGraphiteLine(dst, line); err != nil {
+			return dst, fmt.Errorf("graphite: %v", err)
+		}
+	}
+	return dst, nil
+}
+
+func (d *decoder) appendGraphiteLine(dst, line []byte) ([]byte, error) {
+	parts := bytes.Fields(line)
+	if len(parts) < 2 || len(parts) > 3 {
+		return dst, fmt.Errorf("expected PATH VALUE [TIMESTAMP]: %q", line)
+	}
+
+	segs := bytes.Split(parts[0], []byte{';'})
+	path := segs[0]
+	if len(path) == 0 {
+		return dst, fmt.Errorf("missing path: %q", line)
+	}
+	tags := make([]Tag, 0, len(segs)-1)
+	for _, seg := range segs[1:] {
+		i := bytes.IndexByte(seg, '=')
+		if i <= 0 {
+			return dst, fmt.Errorf("invalid tag %q: %q", seg, line)
+		}
+		tags = append(tags, Tag{string(seg[:i]), string(seg[i+1:])})
+	}
+
+	// The value is written as parsed, since ParseFloat accepts numbers, such
+	// as hex floats, that line protocol doesn't.
+	value, keep, err := d.parseValue(line, parts[1])
+	if !keep {
+		return dst, err
+	}
+
+	ts := d.now()
+	if len(parts) == 3 {
+		secs, err := strconv.ParseFloat(string(parts[2]), 64)
+		if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) {
+			return dst, fmt.Errorf("invalid timestamp %q: %q", parts[2], line)
+		}
+		if secs != -1 {
+			whole, frac := math.Modf(secs)
+			ts = timestamp(d.forward, time.Unix(int64(whole), int64(frac*float64(time.Second))))
+		}
+	}
+
+	dst = append(dst, measurementEscaper.Replace(string(path))...)
+	dst = append(dst, encodeTags(tags)...)
+	dst = append(dst, " value="...)
+	dst = strconv.AppendFloat(dst, value, 'g', -1, 64)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, ts, 10)
+	return append(dst, '\n'), nil
+}
+
+// isGraphiteLine reports whether line looks like PATH VALUE [TIMESTAMP],
+// where VALUE is a bare number. A line protocol field set always holds an =,
+// so it never parses as a number.
+func isGraphiteLine(line []byte) bool {
+	parts := bytes.Fields(line)
+	if len(parts) < 2 || len(parts) > 3 {
+		return false
+	}
+	if _, err := strconv.ParseFloat(string(parts[1]), 64); err != nil && !isRangeError(err) {
+		return false
+	}
+	if len(parts) == 3 {
+		if _, err := strconv.ParseFloat(string(parts[2]), 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
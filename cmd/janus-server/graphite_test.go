@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeGraphite(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"servers.a.load 0.5 1500000000", "servers.a.load value=0.5 1500000000000000000\n"},
+		{"servers.a.load 2 1500000000.25", "servers.a.load value=2 1500000000250000000\n"},
+		{"disk.used;host=a;dc=east 42 1500000000", "disk.used,host=a,dc=east value=42 1500000000000000000\n"},
+		{"a,b 1 1500000000", "a\\,b value=1 1500000000000000000\n"},
+		{"a 1 1500000000\n\nb 2 1500000001\n", "a value=1 1500000000000000000\nb value=2 1500000001000000000\n"},
+		{"  a\t1   1500000000  ", "a value=1 1500000000000000000\n"},
+		{"a 0x1p-2 1500000000", "a value=0.25 1500000000000000000\n"},
+		{"a +2 1500000000", "a value=2 1500000000000000000\n"},
+	}
+	for _, tt := range tests {
+		d := newTestDecoder(t, protoGraphite, unchecked)
+		got, err := d.decode(nil, []byte(tt.in))
+		if err != nil {
+			t.Errorf("decode(%q): %v", tt.in, err)
+		} else if string(got) != tt.want {
+			t.Errorf("decode(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeGraphiteNow(t *testing.T) {
+	for _, in := range []string{"a 1", "a 1 -1"} {
+		d := newTestDecoder(t, protoGraphite, unchecked)
+		got, err := d.decode(nil, []byte(in))
+		if err != nil {
+			t.Errorf("decode(%q): %v", in, err)
+		} else if !strings.HasPrefix(string(got), "a value=1 ") || strings.HasSuffix(string(got), " -1\n") {
+			t.Errorf("decode(%q) = %q; want a point at the time received", in, got)
+		}
+	}
+}
+
+func TestDecodeGraphiteInvalid(t *testing.T) {
+	for _, in := range []string{
+		"a",
+		"a 1 2 3",
+		";host=a 1",
+		"a;host 1",
+		"a;=b 1",
+		"a one",
+		"a 1 yesterday",
+		"a 1 NaN",
+		"a 1 +Inf",
+		"a NaN 1500000000",
+		"a -Inf 1500000000",
+		"a infinity 1500000000",
+	} {
+		d := newTestDecoder(t, protoGraphite, strict)
+		if got, err := d.decode(nil, []byte(in)); err == nil {
+			t.Errorf("decode(%q) = %q; want error", in, got)
+		}
+	}
+}
+
+func TestIsGraphiteLine(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"a.b 1", true},
+		{"a.b 1.5 1500000000", true},
+		{"a;host=x -2 1500000000", true},
+		{"cpu value=1", false},
+		{"cpu,host=a value=1 1500000000000000000", false},
+		{"cpu value=1 1500000000", false},
+		{"a 1 now", false},
+		{"a", false},
+	}
+	for _, tt := range tests {
+		if got := isGraphiteLine([]byte(tt.in)); got != tt.want {
+			t.Errorf("isGraphiteLine(%q) = %t; want %t", tt.in, got, tt.want)
+		}
+	}
+}
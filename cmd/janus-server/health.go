@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// flushHistorySize is the number of recent flush results kept per port, and
+// the most health-flushes may check.
+const flushHistorySize = 16
+
+// flushHistory records whether a port's most recent flushes succeeded.
+type flushHistory struct {
+	mu      sync.Mutex
+	results [flushHistorySize]bool
+	next    int
+	n       int
+}
+
+func (h *flushHistory) record(ok bool) {
+	h.mu.Lock()
+	h.results[h.next] = ok
+	h.next = (h.next + 1) % len(h.results)
+	if h.n < len(h.results) {
+		h.n++
+	}
+	h.mu.Unlock()
+}
+
+// failures returns how many of the last n flushes failed, and how many of
+// them were recorded.
+func (h *flushHistory) failures(n int) (failed, seen int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n > h.n {
+		n = h.n
+	}
+	for i := 1; i <= n; i++ {
+		if !h.results[(h.next-i+len(h.results))%len(h.results)] {
+			failed++
+		}
+	}
+	return failed, n
+}
+
+// healthReport is the response body of the health endpoints.
+type healthReport struct {
+	OK       bool                `json:"ok"`
+	Problems map[string][]string `json:"problems,omitempty"` // Reasons a port isn't ready, by port
+}
+
+// readiness checks that every running port's listeners are bound, its
+// upstream isn't locked out, and its last health-flushes flushes succeeded.
+func (s *server) readiness() healthReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := healthReport{OK: true, Problems: map[string][]string{}}
+	problem := func(key, format string, args ...interface{}) {
+		report.OK = false
+		report.Problems[key] = append(report.Problems[key], fmt.Sprintf(format, args...))
+	}
+
+	if s.config == nil {
+		report.OK = false
+		return report
+	}
+
+	for key, g := range s.gateways {
+		switch g.state {
+		case gatewayBackingOff:
+			problem(key, "gateway failed and restarts at %v: %s", g.retryAt.Format(time.RFC3339), g.lastError)
+		case gatewayFailed:
+			problem(key, "gateway failed: %s", g.lastError)
+		}
+		for _, p := range g.in {
+			if !p.isBound() {
+				problem(key, "listener %v is not bound", p.orig)
+			}
+		}
+		if g.lockout.isLocked() {
+			problem(key, "upstream is locked out after authentication failures")
+		}
+		if g.probe != nil && g.probe.isDown() {
+			problem(key, "upstream is failing health checks")
+		}
+		if g.breaker != nil && !g.breaker.closed() {
+			problem(key, "upstream circuit is %s", g.breaker.circuitState())
+		}
+		if failed, seen := g.flushes.failures(s.config.HealthFlushes); failed > 0 {
+			problem(key, "%d of the last %d flushes failed", failed, seen)
+		}
+	}
+	return report
+}
+
+// handleHealthz responds with 200 OK while the server is running, for
+// liveness probes. The body reports readiness as well.
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if err := s.ctx.Err(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		writeJSON(w, healthReport{})
+		return
+	}
+	writeJSON(w, s.readiness())
+}
+
+// handleReadyz responds with 200 OK if every port is ready and 503 Service
+// Unavailable otherwise, for readiness and load balancer probes.
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := s.readiness()
+	if s.ctx.Err() != nil {
+		report.OK = false
+	}
+	if !report.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, report)
+}
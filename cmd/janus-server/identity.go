@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"go.spiff.io/codf"
+)
+
+// Identity sources, tried in the configured order.
+const (
+	identityEnv      = "env"      // An environment variable
+	identityEC2      = "ec2"      // The EC2 instance ID, from instance metadata
+	identityGCP      = "gcp"      // The GCE instance name, from instance metadata
+	identityHostname = "hostname" // The OS hostname
+)
+
+var defaultIdentitySources = []string{identityEnv, identityHostname}
+
+// IdentityConfig configures how the instance identity is found. The identity
+// names this janus in self-reports, events, and the status API.
+type IdentityConfig struct {
+	Name    string        `codf:"name"`          // Fixed identity; overrides all sources
+	Env     string        `codf:"env"`           // Environment variable of the env source
+	Timeout time.Duration `codf:"timeout,min=0"` // Timeout of each metadata lookup
+	Sources []string      // Sources to try, in order
+}
+
+var _ codf.Walker = (*IdentityConfig)(nil)
+
+func (c *IdentityConfig) Statement(stmt *codf.Statement) error {
+	if ok, err := bindStatement(c, stmt); ok {
+		return err
+	}
+
+	switch name := stmt.Name(); name {
+	case "sources":
+		return c.handleSources(stmt.Parameters())
+	default:
+		return fmt.Errorf("unrecognized directive %s", name)
+	}
+}
+
+func (c *IdentityConfig) EnterSection(sect *codf.Section) (codf.Walker, error) {
+	return nil, fmt.Errorf("unrecognized section %s", sect.Name())
+}
+
+func (c *IdentityConfig) handleSources(args []codf.ExprNode) error {
+	var sources []string
+	if err := parseArgs(args, &sources); err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		return errors.New("sources requires at least one source")
+	}
+
+	for i, src := range sources {
+		switch src {
+		case identityEnv, identityEC2, identityGCP, identityHostname:
+		default:
+			return argError(i, args[i], fmt.Errorf("invalid identity source %q; must be env, ec2, gcp, or hostname", src))
+		}
+	}
+	c.Sources = sources
+	return nil
+}
+
+// instance is the identity of this janus.
+var instance = new(identityProvider)
+
+func init() {
+	status.Set("identity", expvar.Func(func() interface{} { return instance.id() }))
+}
+
+// identityProvider finds the instance identity from its configured sources.
+// The identity is found on first use after each configure and kept until the
+// next one.
+type identityProvider struct {
+	mu       sync.Mutex
+	cfg      IdentityConfig
+	resolved bool
+	ident    string
+}
+
+// configure replaces the provider's config. If it changed, the identity is
+// found again on next use.
+func (p *identityProvider) configure(cfg IdentityConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resolved && p.cfg.Name == cfg.Name && p.cfg.Env == cfg.Env &&
+		p.cfg.Timeout == cfg.Timeout && strings.Join(p.cfg.Sources, " ") == strings.Join(cfg.Sources, " ") {
+		return
+	}
+	p.cfg, p.resolved, p.ident = cfg, false, ""
+}
+
+// id returns the instance identity, or an empty string if no source
+// provided one.
+func (p *identityProvider) id() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.resolved {
+		p.ident, p.resolved = p.cfg.resolve(), true
+	}
+	return p.ident
+}
+
+// resolve returns the configured name or the first identity provided by the
+// sources.
+func (c *IdentityConfig) resolve() string {
+	if c.Name != "" {
+		return c.Name
+	}
+
+	sources := c.Sources
+	if len(sources) == 0 {
+		sources = defaultIdentitySources
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+
+	for _, src := range sources {
+		id, err := c.lookup(src, timeout)
+		if err != nil {
+			if glog.V(1) {
+				glog.Warningf("Unable to get identity from %s: %v", src, err)
+			}
+			continue
+		}
+		if id = strings.TrimSpace(id); id != "" {
+			glog.Infof("Using instance identity %q from %s", id, src)
+			return id
+		}
+	}
+	glog.Warningf("No identity source provided an instance identity")
+	return ""
+}
+
+func (c *IdentityConfig) lookup(src string, timeout time.Duration) (string, error) {
+	switch src {
+	case identityEnv:
+		name := c.Env
+		if name == "" {
+			name = "JANUS_IDENTITY"
+		}
+		return os.Getenv(name), nil
+	case identityEC2:
+		return ec2InstanceID(timeout)
+	case identityGCP:
+		return metadataGet(timeout, http.MethodGet,
+			"http://metadata.google.internal/computeMetadata/v1/instance/name",
+			http.Header{"Metadata-Flavor": {"Google"}})
+	case identityHostname:
+		return os.Hostname()
+	}
+	return "", fmt.Errorf("unknown identity source %s", src)
+}
+
+// ec2InstanceID returns the EC2 instance ID, using an IMDSv2 session token.
+func ec2InstanceID(timeout time.Duration) (string, error) {
+	const imds = "http://169.254.169.254/latest"
+	token, err := metadataGet(timeout, http.MethodPut, imds+"/api/token",
+		http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"60"}})
+	if err != nil {
+		return "", err
+	}
+	return metadataGet(timeout, http.MethodGet, imds+"/meta-data/instance-id",
+		http.Header{"X-Aws-Ec2-Metadata-Token": {token}})
+}
+
+// metadataGet requests url from an instance metadata service and returns
+// the response body.
+func metadataGet(timeout time.Duration, method, url string, header http.Header) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header = header
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	return string(body), nil
+}
@@ -2,9 +2,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
@@ -16,76 +17,220 @@ import (
 
 var (
 	SHUTDOWN, die = mksignal()
+
+	startupError = flag.String("startup-error", "exit", "What to do if the config can't be loaded at startup: exit, or wait for a reload")
+	reloadError  = flag.String("reload-error", "keep", "What to do if the config can't be reloaded: keep the running config, or exit")
+
+	shutdownDelay = flag.Duration("shutdown-delay", time.Second, "How long gateways keep running to flush after a shutdown signal, or once replaced or removed by a reload")
 )
 
 func main() {
 	outflux.Log = outflux.Stdlog
 	flag.Parse()
 
+	if flag.Arg(0) == "describe" {
+		if err := describe(os.Stdout, flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	switch flag.Arg(0) {
+	case "replay":
+		if err := replayMain(context.Background(), flag.Args()[1:]); err != nil {
+			glog.Exitf("Unable to replay: %v", err)
+		}
+		glog.Flush()
+		return
+	case "replay-capture":
+		if err := replayCaptureMain(context.Background(), flag.Args()[1:]); err != nil {
+			glog.Exitf("Unable to replay capture: %v", err)
+		}
+		glog.Flush()
+		return
+	case "bench":
+		if err := benchMain(context.Background(), flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	if *selfTest {
+		cfgfiles := flag.Args()
+		if len(cfgfiles) == 0 {
+			cfgfiles = []string{"-"}
+		}
+		if err := selfTestMain(context.Background(), cfgfiles); err != nil {
+			glog.Exitf("Self-test failed: %v", err)
+		}
+		glog.Info("Self-test passed")
+		glog.Flush()
+		return
+	}
+
+	switch {
+	case *startupError != "exit" && *startupError != "wait":
+		glog.Fatalf("invalid -startup-error %q; must be exit or wait", *startupError)
+	case *reloadError != "keep" && *reloadError != "exit":
+		glog.Fatalf("invalid -reload-error %q; must be keep or exit", *reloadError)
+	case *shutdownDelay < 0:
+		glog.Fatalf("invalid -shutdown-delay %v; must be >= 0s", *shutdownDelay)
+	case *upgradeTimeout <= 0:
+		glog.Fatalf("invalid -upgrade-timeout %v; must be > 0s", *upgradeTimeout)
+	}
+	takeReadyPipe()
+
+	if *pidfile != "" {
+		var err error
+		if pidLock, err = writePidFile(*pidfile); err != nil {
+			glog.Fatal(err)
+		}
+		defer func() {
+			if pidLock == nil {
+				return
+			}
+			if err := pidLock.release(); err != nil {
+				glog.Errorf("Unable to remove pidfile: %v", err)
+			}
+		}()
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	SHUTDOWN.DelayFunc(time.Second, cancel)
 
-	config := Config{}
 	cfgfiles := flag.Args()
 	if len(cfgfiles) == 0 {
 		cfgfiles = []string{"-"}
 	}
 
-	for _, fp := range cfgfiles {
-		if fp == "-" {
-			glog.Info("Reading config from standard input...")
-		}
-
-		if err := parseConfig(&config, fp); err != nil {
-			glog.Fatalf("Unable to load config file %s: %v", fp, err)
+	srv := newServer(ctx, cancel)
+	SHUTDOWN.AfterFunc(func() {
+		// Gateways keep running for up to the shutdown delay while they
+		// flush, and are stopped once the flush is done.
+		flushCtx, done := context.WithTimeout(ctx, *shutdownDelay)
+		srv.flush(flushCtx)
+		done()
+		cancel()
+	})
+
+	config, loadErr := loadConfig(cfgfiles)
+	lastGood := false
+	if loadErr != nil && *useLastGood {
+		if cfg, err := loadLastGood(); err != nil {
+			glog.Errorf("Unable to load last good config: %v", err)
+		} else {
+			glog.Errorf("Unable to load config; running the last good config: %v", loadErr)
+			config, lastGood = cfg, true
 		}
 	}
+	switch {
+	case loadErr == nil || lastGood:
+		// The load error, if any, is recorded once the config is applied.
+	case *startupError == "wait":
+		glog.Errorf("Unable to load config; waiting for a reload: %v", loadErr)
+		config = NewConfig()
+	default:
+		glog.Fatal(loadErr)
+	}
 
 	go func() {
 		signals := make(chan os.Signal, 1)
-		signal.Notify(signals, os.Interrupt)
+		notify := []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+		notify = append(notify, upgradeSignals...)
+		notify = append(notify, dumpSignals...)
+		notify = append(notify, verboseSignals...)
+		signal.Notify(signals, notify...)
 		for sig := range signals {
+			switch {
+			case isSignal(sig, dumpSignals):
+				srv.dumpStats()
+				continue
+			case isSignal(sig, verboseSignals):
+				toggleVerbose()
+				continue
+			}
+
+			if isUpgradeSignal(sig) {
+				glog.Info("Received ", sig, " signal: upgrading")
+				ready, err := srv.upgrade(cfgfiles)
+				if err != nil {
+					glog.Errorf("Unable to upgrade: %v", err)
+					continue
+				}
+				go func() {
+					if err := <-ready; err != nil {
+						glog.Errorf("Unable to upgrade; keeping this process running: %v", err)
+						return
+					}
+					glog.Infof("New process is ready; shutting down in %v", *upgradeDrain)
+					time.AfterFunc(*upgradeDrain, die)
+				}()
+				continue
+			}
+
+			if sig == syscall.SIGHUP {
+				glog.Info("Received ", sig, " signal: reloading config")
+				if err := srv.reload(cfgfiles); err != nil {
+					emitEvent(eventReloadFailed, "", "Unable to reload config: %v", err)
+					if *reloadError == "exit" {
+						glog.Fatalf("Unable to reload config: %v", err)
+					}
+					glog.Errorf("Unable to reload config; keeping the running config: %v", err)
+					srv.configFailed(err)
+				}
+				continue
+			}
+
 			glog.Info("Received ", sig, " signal: shutting down")
 			die()
-			cancel()
 		}
 	}()
 
 	glog.Info("Started")
-
-	maxreqs := outflux.RequestLimit(config.MaxRequests)
-	glog.Infof("%#+ v", config)
-	gateways := make([]*gateway, len(config.Ports))
-	for i, cfg := range config.Ports {
-		var err error
-		gateways[i], err = newGateway(cfg, maxreqs)
-		if err != nil {
-			glog.Fatalf("Error configuring %v -> %v gateway: %v", cfg.Listen, cfg.Forward.Host, err)
-		}
-
+	if *readOnly {
+		glog.Warningf("Running in read-only mode: writes to upstreams are discarded after %v", *readOnlyLatency)
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(len(gateways))
+	if err := srv.apply(config); err != nil {
+		glog.Fatal(err)
+	}
+	if loadErr != nil {
+		srv.configFailed(loadErr)
+	} else {
+		snapshotConfig(config)
+	}
+	logPorts(config)
+
+	if config.AdminListen != "" {
+		go func() {
+			if err := srv.serveAdmin(ctx, config.AdminListen); err != nil {
+				glog.Errorf("Admin API failed: %v", err)
+			}
+		}()
+	}
 
-	runGateway := func(g *gateway) {
-		defer cancel()
-		defer wg.Done()
-		gwid := g.String()
+	if config.DebugListen != "" {
+		go func() {
+			if err := serveDebug(ctx, config.DebugListen); err != nil {
+				glog.Errorf("Debug listener failed: %v", err)
+			}
+		}()
+	}
 
-		glog.Infof("Starting gateway %v", gwid)
-		err := g.Start(ctx)
-		if err == context.Canceled || err == context.DeadlineExceeded || err == nil {
-			glog.Infof("Gateway %v closed", gwid)
-			return
+	if config.User != "" {
+		if err := srv.dropPrivileges(config.User, config.Group); err != nil {
+			glog.Fatal(err)
 		}
-
-		glog.Errorf("Gateway %v failed: %v", gwid, err)
+	} else if config.Group != "" {
+		glog.Fatal("group requires a user to switch to")
 	}
-
-	for _, g := range gateways {
-		go runGateway(g)
+	privilegesDropped()
+	if loadErr == nil || lastGood {
+		// A process started by an upgrade waiting for a good config leaves
+		// the old one running.
+		reportReady()
 	}
 
 	go func() {
@@ -95,9 +240,13 @@ func main() {
 			return
 		}
 		glog.Error("Encountered fatal gateway error, shutting down")
+		if err := srv.dumpState(); err != nil {
+			glog.Errorf("Unable to write state file: %v", err)
+		}
 		die()
 	}()
 
 	<-SHUTDOWN
-	wg.Wait()
+	srv.Wait()
+	waitEventHooks(hookTimeout)
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonPoint is a point received as JSON.
+type jsonPoint struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        *json.Number           `json:"time"`
+}
+
+// decodeJSON converts a JSON point, or an array of points, to line protocol.
+// Whole-number field values are written as integers, other numbers as
+// floats. The time, if given, is written as is and must match the precision
+// of the upstream. Trailing whitespace is checked for in the measurement and
+// tag values.
+func (d *decoder) decodeJSON(dst, payload []byte) ([]byte, error) {
+	var points []jsonPoint
+	trimmed := bytes.TrimSpace(payload)
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	dec.UseNumber()
+
+	var err error
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		err = dec.Decode(&points)
+	} else {
+		points = make([]jsonPoint, 1)
+		err = dec.Decode(&points[0])
+	}
+	if err != nil {
+		return dst, fmt.Errorf("json: %v", err)
+	}
+
+	for i, pt := range points {
+		if dst, err = d.appendJSONPoint(dst, &pt); err != nil {
+			return dst, fmt.Errorf("json: point %d: %v", i, err)
+		}
+	}
+	return dst, nil
+}
+
+func (d *decoder) appendJSONPoint(dst []byte, pt *jsonPoint) ([]byte, error) {
+	if pt.Measurement == "" {
+		return dst, fmt.Errorf("missing measurement")
+	}
+	if len(pt.Fields) == 0 {
+		return dst, fmt.Errorf("no fields")
+	}
+
+	// Recoverable issues are collected and fixed in place before anything
+	// is appended, so that a dropped point leaves dst unchanged.
+	var issues []string
+	trim := func(s string) string {
+		t := strings.TrimRight(s, " \t\r\n")
+		if t != s && d.level != unchecked {
+			issues = append(issues, "trailing whitespace")
+			return t
+		}
+		return s
+	}
+
+	measurement := trim(pt.Measurement)
+	tags := make([]Tag, 0, len(pt.Tags))
+	for k, v := range pt.Tags {
+		tags = append(tags, Tag{k, trim(v)})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+
+	keys := make([]string, 0, len(pt.Fields))
+	for k := range pt.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		switch v := pt.Fields[k].(type) {
+		case json.Number:
+			num := []byte(v)
+			if !strings.ContainsAny(string(v), ".eE") {
+				num = append(num, 'i')
+			}
+			switch fixed := clampNumber(num); {
+			case fixed == nil:
+			case d.level != unchecked:
+				issues = append(issues, "value out of range")
+				num = fixed
+			case num[len(num)-1] == 'i':
+				num = []byte(v) // Too large for an integer; try a float
+			default:
+				return dst, fmt.Errorf("field %s: invalid number %s", k, v)
+			}
+			if num[len(num)-1] != 'i' {
+				f, err := strconv.ParseFloat(string(num), 64)
+				if err != nil {
+					return dst, fmt.Errorf("field %s: invalid number %s", k, v)
+				}
+				num = strconv.AppendFloat(nil, f, 'g', -1, 64)
+			}
+			values[i] = num
+		case string:
+			values[i] = appendFieldString(nil, v)
+		case bool:
+			values[i] = strconv.AppendBool(nil, v)
+		default:
+			return dst, fmt.Errorf("field %s: unsupported value of type %T", k, v)
+		}
+	}
+
+	var stamp []byte
+	if pt.Time != nil {
+		if _, err := pt.Time.Int64(); err != nil {
+			return dst, fmt.Errorf("invalid time %s", *pt.Time)
+		}
+		stamp = []byte(*pt.Time)
+	} else if d.level != unchecked {
+		issues = append(issues, "missing timestamp")
+		stamp = strconv.AppendInt(nil, d.now(), 10)
+	}
+
+	for _, what := range issues {
+		if fix, err := d.issue([]byte(measurement), what); !fix {
+			return dst, err
+		}
+	}
+
+	dst = append(dst, measurementEscaper.Replace(measurement)...)
+	dst = append(dst, encodeTags(tags)...)
+	for i, k := range keys {
+		if i == 0 {
+			dst = append(dst, ' ')
+		} else {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, tagEscaper.Replace(k)...)
+		dst = append(dst, '=')
+		dst = append(dst, values[i]...)
+	}
+	if stamp != nil {
+		dst = append(dst, ' ')
+		dst = append(dst, stamp...)
+	}
+	return append(dst, '\n'), nil
+}
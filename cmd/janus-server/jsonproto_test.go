@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestDecodeJSON(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{
+			`{"measurement":"cpu","tags":{"host":"a"},"fields":{"usage":0.5},"time":1500000000}`,
+			"cpu,host=a usage=0.5 1500000000\n",
+		},
+		{
+			`{"measurement":"cpu","fields":{"n":3,"f":3.0,"e":1e3}}`,
+			"cpu e=1000,f=3,n=3i\n",
+		},
+		{
+			`{"measurement":"my cpu","tags":{"z":"1","a":"x y"},"fields":{"ok":true,"msg":"say \"hi\""}}`,
+			"my\\ cpu,a=x\\ y,z=1 msg=\"say \\\"hi\\\"\",ok=true\n",
+		},
+		{
+			`[{"measurement":"a","fields":{"v":1}},{"measurement":"b","fields":{"v":2}}]`,
+			"a v=1i\nb v=2i\n",
+		},
+		{
+			`{"measurement":"big","fields":{"v":100000000000000000000}}`,
+			"big v=1e+20\n",
+		},
+	}
+	for _, tt := range tests {
+		d := newTestDecoder(t, protoJSON, unchecked)
+		got, err := d.decode(nil, []byte(tt.in))
+		if err != nil {
+			t.Errorf("decode(%s): %v", tt.in, err)
+		} else if string(got) != tt.want {
+			t.Errorf("decode(%s) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeJSONInvalid(t *testing.T) {
+	for _, in := range []string{
+		`{"fields":{"v":1}}`,
+		`{"measurement":"cpu"}`,
+		`{"measurement":"cpu","fields":{"v":[1]}}`,
+		`{"measurement":"cpu","fields":{"v":1},"time":1.5}`,
+		`{"measurement":"cpu"`,
+	} {
+		d := newTestDecoder(t, protoJSON, unchecked)
+		if got, err := d.decode(nil, []byte(in)); err == nil {
+			t.Errorf("decode(%s) = %q; want error", in, got)
+		}
+	}
+}
+
+func TestDecodeJSONMissingTimestamp(t *testing.T) {
+	const in = `{"measurement":"cpu","fields":{"v":1}}`
+	if _, err := newTestDecoder(t, protoJSON, strict).decode(nil, []byte(in)); err == nil {
+		t.Errorf("strict decode(%s) succeeded; want error", in)
+	}
+	got, err := newTestDecoder(t, protoJSON, lenient).decode(nil, []byte(in))
+	if err != nil || len(got) != 0 {
+		t.Errorf("lenient decode(%s) = %q, %v; want nothing", in, got, err)
+	}
+}
+
+func TestDetectProtocol(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`{"measurement":"cpu"}`, protoJSON},
+		{` [{"measurement":"cpu"}]`, protoJSON},
+		{"hits:1|c", protoStatsd},
+		{"cpu,host=a usage=0.5", protoLine},
+	}
+	for _, tt := range tests {
+		if got := detectProtocol([]byte(tt.in)); got != tt.want {
+			t.Errorf("detectProtocol(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	stateDir    = flag.String("state-dir", "", "Directory to keep a snapshot of the last config loaded successfully in")
+	useLastGood = flag.Bool("use-last-good", false, "If the config can't be loaded at startup, run the last good config from -state-dir")
+)
+
+// lastGoodName is the name of the last-known-good config in the state
+// directory.
+const lastGoodName = "last-good.conf"
+
+// lastGoodPath returns the path of the last-known-good config, or an empty
+// string if there is no state directory.
+func lastGoodPath() string {
+	if *stateDir == "" {
+		return ""
+	}
+	return filepath.Join(*stateDir, lastGoodName)
+}
+
+// saveLastGood writes config to the state directory as the last-known-good
+// config, replacing any earlier one. It does nothing without a state
+// directory.
+func saveLastGood(config *Config) error {
+	path := lastGoodPath()
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(*stateDir, 0700); err != nil {
+		return err
+	}
+
+	header := fmt.Sprintf("' Last good config, saved %s\n' hash: %s\n",
+		time.Now().UTC().Format(time.RFC3339), config.Hash)
+	return writeFileAtomic(path, append([]byte(header), config.Source...))
+}
+
+// loadLastGood loads the last-known-good config from the state directory.
+func loadLastGood() (*Config, error) {
+	path := lastGoodPath()
+	if path == "" {
+		return nil, fmt.Errorf("-use-last-good requires -state-dir")
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("no last good config: %v", err)
+	}
+	return loadConfig([]string{path})
+}
+
+// snapshotConfig saves config as the last-known-good config, logging any
+// error: a failed snapshot doesn't stop a config from being used.
+func snapshotConfig(config *Config) {
+	if err := saveLastGood(config); err != nil {
+		glog.Errorf("Unable to save last good config to %s: %v", *stateDir, err)
+	}
+}
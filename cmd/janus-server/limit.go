@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// byteLimiter bounds the number of request bytes in flight across all
+// upstreams. A limit <= 0 only tracks usage.
+type byteLimiter struct {
+	limit int64
+
+	mu       sync.Mutex
+	used     int64
+	requests int64
+	released chan struct{} // Closed and replaced whenever bytes are released
+}
+
+func newByteLimiter(limit int64) *byteLimiter {
+	return &byteLimiter{
+		limit:    limit,
+		released: make(chan struct{}),
+	}
+}
+
+// acquire blocks until n bytes are available or ctx is done. A request larger
+// than the limit is admitted once nothing else is in flight.
+func (l *byteLimiter) acquire(ctx context.Context, n int64) error {
+	for {
+		l.mu.Lock()
+		if l.limit <= 0 || l.used == 0 || l.used+n <= l.limit {
+			l.used += n
+			l.requests++
+			l.mu.Unlock()
+			return nil
+		}
+		wait := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wait:
+		}
+	}
+}
+
+func (l *byteLimiter) release(n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.used -= n
+	l.requests--
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// usage returns the number of bytes and requests currently in flight.
+func (l *byteLimiter) usage() (bytes, requests int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.used, l.requests
+}
+
+// limitTransport is an http.RoundTripper that holds a request's body size
+// against a byteLimiter until the request has been sent and its response
+// headers received.
+type limitTransport struct {
+	base  http.RoundTripper
+	limit *byteLimiter
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	n := req.ContentLength
+	if n < 0 {
+		n = 0
+	}
+
+	if err := t.limit.acquire(req.Context(), n); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	defer t.limit.release(n)
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+var (
+	tagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	fieldStringEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// appendFieldString appends s to dst as a quoted string field value.
+func appendFieldString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	dst = append(dst, fieldStringEscaper.Replace(s)...)
+	return append(dst, '"')
+}
+
+// Tag is a line protocol tag.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// encodeTags returns tags encoded as a line protocol tag set suffix, including
+// its leading comma.
+func encodeTags(tags []Tag) []byte {
+	var buf bytes.Buffer
+	for _, t := range tags {
+		buf.WriteByte(',')
+		buf.WriteString(tagEscaper.Replace(t.Key))
+		buf.WriteByte('=')
+		buf.WriteString(tagEscaper.Replace(t.Value))
+	}
+	return buf.Bytes()
+}
+
+// keyEnd returns the index of the first unescaped space in line, which ends
+// the measurement and tag set. It returns -1 if there is none.
+func keyEnd(line []byte) int {
+	return unescapedIndex(line, ' ')
+}
+
+// unescapedIndex returns the index of the first c in b not preceded by a
+// backslash, or -1 if there is none.
+func unescapedIndex(b []byte, c byte) int {
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case c:
+			return i
+		}
+	}
+	return -1
+}
+
+// appendTagged appends line to dst with tags, as encoded by encodeTags,
+// inserted after its existing tag set. Tags with keys the line already has
+// are skipped, keeping the line's own values, since a point can't repeat a
+// tag. Lines without a field set are appended unchanged.
+func appendTagged(dst, line, tags []byte) []byte {
+	end := keyEnd(line)
+	if end == -1 {
+		return append(dst, line...)
+	}
+	series := line[:end]
+	dst = append(dst, series...)
+	if unescapedIndex(series, ',') == -1 {
+		dst = append(dst, tags...)
+		return append(dst, line[end:]...)
+	}
+	for len(tags) > 0 {
+		tag := tags
+		if i := unescapedIndex(tags[1:], ','); i != -1 {
+			tag = tags[:i+1]
+		}
+		tags = tags[len(tag):]
+		if !hasTagKey(series, tagKey(tag[1:])) {
+			dst = append(dst, tag...)
+		}
+	}
+	return append(dst, line[end:]...)
+}
+
+// hasTagKey reports whether series, the measurement and tag set of a line,
+// has a tag with the escaped key.
+func hasTagKey(series, key []byte) bool {
+	for i := unescapedIndex(series, ','); i != -1; i = unescapedIndex(series, ',') {
+		series = series[i+1:]
+		tag := series
+		if j := unescapedIndex(tag, ','); j != -1 {
+			tag = tag[:j]
+		}
+		if bytes.Equal(tagKey(tag), key) {
+			return true
+		}
+	}
+	return false
+}
+
+// tagKey returns the key of an escaped key=value tag.
+func tagKey(tag []byte) []byte {
+	if i := unescapedIndex(tag, '='); i != -1 {
+		return tag[:i]
+	}
+	return tag
+}
+
+// countLines returns the number of lines in payload, counting a final line
+// without a newline.
+func countLines(payload []byte) int {
+	n := bytes.Count(payload, []byte{'\n'})
+	if len(payload) > 0 && payload[len(payload)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
+// fieldsEnd returns the index of the first unescaped space after the field
+// set starting at start, or len(line) if the line has no timestamp.
+func fieldsEnd(line []byte, start int) int {
+	quoted := false
+	for i := start; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ' ':
+			if !quoted {
+				return i
+			}
+		}
+	}
+	return len(line)
+}
+
+// splitFields splits a field set into its key=value pairs.
+func splitFields(fields []byte) (pairs [][]byte) {
+	quoted, last := false, 0
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				pairs = append(pairs, fields[last:i])
+				last = i + 1
+			}
+		}
+	}
+	return append(pairs, fields[last:])
+}
+
+// decodeLine checks each line of a line protocol payload for recoverable
+// issues. Lines without a field set are passed on for the upstream to reject.
+func (d *decoder) decodeLine(dst, payload []byte) ([]byte, error) {
+	if d.level == unchecked {
+		return append(dst, payload...), nil
+	}
+
+	for len(payload) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(payload, '\n'); i == -1 {
+			line, payload = payload, nil
+		} else {
+			line, payload = payload[:i], payload[i+1:]
+		}
+
+		if len(bytes.TrimSpace(line)) == 0 || line[0] == '#' {
+			dst = append(append(dst, line...), '\n')
+			continue
+		}
+
+		line, err := d.checkWhitespace(line)
+		if err != nil {
+			return dst, err
+		} else if line == nil {
+			continue
+		}
+
+		end := keyEnd(line)
+		if end == -1 {
+			dst = append(append(dst, line...), '\n')
+			continue
+		}
+		fend := fieldsEnd(line, end+1)
+
+		pairs := splitFields(line[end+1 : fend])
+		fixed := make([][]byte, len(pairs))
+		keep := true
+		for i, pair := range pairs {
+			eq := unescapedIndex(pair, '=')
+			if eq == -1 {
+				continue
+			}
+			v := clampNumber(pair[eq+1:])
+			if v == nil {
+				continue
+			}
+			fixed[i] = append(append([]byte(nil), pair[:eq+1]...), v...)
+			if keep, err = d.issue(line, "value out of range"); err != nil {
+				return dst, err
+			} else if !keep {
+				break
+			}
+		}
+
+		var stamp []byte
+		if keep && fend == len(line) {
+			if keep, err = d.issue(line, "missing timestamp"); err != nil {
+				return dst, err
+			}
+			stamp = strconv.AppendInt([]byte{' '}, d.now(), 10)
+		}
+		if !keep {
+			continue
+		}
+
+		dst = append(dst, line[:end+1]...)
+		for i, pair := range pairs {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			if fixed[i] != nil {
+				pair = fixed[i]
+			}
+			dst = append(dst, pair...)
+		}
+		dst = append(dst, line[fend:]...)
+		dst = append(dst, stamp...)
+		dst = append(dst, '\n')
+	}
+	return dst, nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestAppendTagged(t *testing.T) {
+	tags := encodeTags([]Tag{{"dc", "east"}, {"host", "a"}})
+	tests := []struct {
+		in, want string
+	}{
+		{"cpu value=1", "cpu,dc=east,host=a value=1"},
+		{"cpu,rack=2 value=1 1500000000", "cpu,rack=2,dc=east,host=a value=1 1500000000"},
+		{"cpu,host=b value=1", "cpu,host=b,dc=east value=1"},
+		{"cpu,dc=west,host=b value=1", "cpu,dc=west,host=b value=1"},
+		{`cpu,host\=x=b,hostname=c value=1`, `cpu,host\=x=b,hostname=c,dc=east,host=a value=1`},
+		{"cpu", "cpu"},
+	}
+	for _, tt := range tests {
+		if got := string(appendTagged(nil, []byte(tt.in), tags)); got != tt.want {
+			t.Errorf("appendTagged(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
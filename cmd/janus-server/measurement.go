@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	"go.spiff.io/codf"
+)
+
+// handleRenameMeasurement parses `rename-measurement OLD NEW`. It may be
+// given more than once.
+func (p *PortConfig) handleRenameMeasurement(args []codf.ExprNode) error {
+	var from, to string
+	if err := parseArgs(args, &from, &to); err != nil {
+		return err
+	}
+	switch {
+	case from == "" || to == "":
+		return fmt.Errorf("rename-measurement names must not be empty")
+	case p.Renames[from] != "":
+		return fmt.Errorf("measurement %s is already renamed to %s", from, p.Renames[from])
+	}
+
+	if p.Renames == nil {
+		p.Renames = map[string]string{}
+	}
+	p.Renames[from] = to
+	return nil
+}
+
+// measurementEnd returns the index of the first unescaped comma or space in
+// line, which ends its measurement. It returns -1 if there is neither.
+func measurementEnd(line []byte) int {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case ',', ' ':
+			return i
+		}
+	}
+	return -1
+}
+
+// measurementStage renames measurements and then adds a prefix to every
+// measurement. Names are compared and written escaped.
+type measurementStage struct {
+	renames map[string][]byte
+	prefix  []byte
+}
+
+func newMeasurementStage(renames map[string]string, prefix string) *measurementStage {
+	st := &measurementStage{
+		renames: make(map[string][]byte, len(renames)),
+		prefix:  []byte(measurementEscaper.Replace(prefix)),
+	}
+	for from, to := range renames {
+		st.renames[measurementEscaper.Replace(from)] = []byte(measurementEscaper.Replace(to))
+	}
+	return st
+}
+
+func (st *measurementStage) apply(dst, line []byte) []byte {
+	end := measurementEnd(line)
+	if end == -1 {
+		return append(dst, line...)
+	}
+
+	dst = append(dst, st.prefix...)
+	if to, ok := st.renames[string(line[:end])]; ok {
+		dst = append(dst, to...)
+	} else {
+		dst = append(dst, line[:end]...)
+	}
+	return append(dst, line[end:]...)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"go.spiff.io/codf"
+)
+
+// OTLPConfig configures exporting spans of upstream flushes to an
+// OpenTelemetry collector over OTLP/HTTP, in its JSON encoding.
+type OTLPConfig struct {
+	Endpoint string  `codf:"endpoint"` // Traces URL, as in http://collector:4318/v1/traces
+	Service  string  `codf:"service"`  // service.name of exported spans
+	Sample   float64 `codf:"sample"`   // Fraction of batches to trace
+	Headers  map[string]string
+}
+
+var _ codf.Walker = (*OTLPConfig)(nil)
+
+func (c *OTLPConfig) Statement(stmt *codf.Statement) error {
+	if ok, err := bindStatement(c, stmt); ok {
+		if err == nil && (c.Sample < 0 || c.Sample > 1) {
+			err = fmt.Errorf("sample must be between 0 and 1; got %v", c.Sample)
+		}
+		return err
+	}
+
+	switch name := stmt.Name(); name {
+	case "header":
+		var key, value string
+		if err := parseArgs(stmt.Parameters(), &key, &value); err != nil {
+			return err
+		}
+		if c.Headers == nil {
+			c.Headers = map[string]string{}
+		}
+		c.Headers[key] = value
+		return nil
+	default:
+		return fmt.Errorf("unrecognized directive %s", name)
+	}
+}
+
+func (c *OTLPConfig) EnterSection(sect *codf.Section) (codf.Walker, error) {
+	return nil, fmt.Errorf("unrecognized section %s", sect.Name())
+}
+
+var _ codf.WalkExiter = (*OTLPConfig)(nil)
+
+func (c *OTLPConfig) ExitSection(codf.Walker, *codf.Section, codf.ParentNode) error {
+	if c.Endpoint == "" {
+		return fmt.Errorf("otlp requires an endpoint")
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid otlp endpoint: %v", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("otlp endpoint must be http or https; got %q", c.Endpoint)
+	}
+	return nil
+}
+
+const (
+	maxSpanBatch  = 512              // Spans per export; more are exported early
+	maxSpanQueue  = 4 * maxSpanBatch // Spans waiting to be exported; more are dropped
+	spanExportDue = 5 * time.Second  // How long spans may wait to be exported
+)
+
+// tracer records spans of upstream flushes and exports them in the
+// background.
+var tracer = newSpanExporter()
+
+func init() {
+	status.Set("otlp_spans_exported", &tracer.exported)
+	status.Set("otlp_spans_dropped", &tracer.dropped)
+}
+
+// spanExporter queues spans and exports them to the configured endpoint.
+// Without an endpoint, no spans are recorded.
+type spanExporter struct {
+	mu     sync.Mutex
+	cfg    OTLPConfig
+	queue  []otlpSpan
+	client *http.Client
+	kick   chan struct{}
+
+	exported expvar.Int
+	dropped  expvar.Int
+}
+
+func newSpanExporter() *spanExporter {
+	return &spanExporter{
+		client: &http.Client{Transport: newTransport(), Timeout: 10 * time.Second},
+		kick:   make(chan struct{}, 1),
+	}
+}
+
+// configure replaces the exporter's config. Queued spans are exported to the
+// new endpoint.
+func (e *spanExporter) configure(cfg OTLPConfig) {
+	e.mu.Lock()
+	e.cfg = cfg
+	if cfg.Endpoint == "" {
+		e.queue = nil
+	}
+	e.mu.Unlock()
+}
+
+// run exports queued spans until ctx is done.
+func (e *spanExporter) run(ctx context.Context) {
+	ticker := time.NewTicker(spanExportDue)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			e.export(context.Background()) // Last chance
+			return
+		case <-ticker.C:
+		case <-e.kick:
+		}
+		e.export(ctx)
+	}
+}
+
+// sampled reports whether the batch with the given trace ID is traced. The
+// decision is made from the ID so that every attempt of a batch agrees.
+func (e *spanExporter) sampled(traceID [16]byte) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.cfg.Endpoint == "" {
+		return false
+	}
+	rate := e.cfg.Sample
+	return rate >= 1 || float64(binary.BigEndian.Uint64(traceID[8:])) < rate*math.MaxUint64
+}
+
+// flushSpan is a span covering one attempt to flush a batch upstream.
+type flushSpan struct {
+	span otlpSpan
+}
+
+// startFlush starts a span of an attempt to send batch to port's upstream
+// with req, returning a copy of req carrying the span's trace context. It
+// returns a nil span if the batch isn't traced.
+func (e *spanExporter) startFlush(port string, batch *tracedBatch, req *http.Request) (*flushSpan, *http.Request) {
+	if !e.sampled(batch.traceID) {
+		return nil, req
+	}
+
+	var spanID [8]byte
+	if _, err := rand.Read(spanID[:]); err != nil {
+		panic(err)
+	}
+	fs := &flushSpan{span: otlpSpan{
+		TraceID: hex.EncodeToString(batch.traceID[:]),
+		SpanID:  hex.EncodeToString(spanID[:]),
+		Name:    "flush",
+		Kind:    3, // SPAN_KIND_CLIENT
+		Start:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes: []otlpAttr{
+			stringAttr("janus.port", port),
+			stringAttr("janus.batch.id", batch.id),
+			intAttr("janus.batch.bytes", int64(batch.size)),
+			intAttr("janus.batch.retry", int64(batch.attempts-1)),
+			stringAttr("server.address", req.URL.Host),
+			stringAttr("url.full", redactURL(req.URL).String()),
+		},
+	}}
+
+	dup := new(http.Request)
+	*dup = *req
+	dup.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		dup.Header[k] = v
+	}
+	dup.Header.Set("Traceparent", "00-"+fs.span.TraceID+"-"+fs.span.SpanID+"-01")
+	return fs, dup
+}
+
+// end ends the span with the response or error of the attempt and queues it
+// for export. If failed, class is the class of the failure.
+func (s *flushSpan) end(resp *http.Response, failed bool, class errorClass, err error) {
+	if s == nil {
+		return
+	}
+	s.span.End = strconv.FormatInt(time.Now().UnixNano(), 10)
+	if resp != nil {
+		s.span.Attributes = append(s.span.Attributes, intAttr("http.response.status_code", int64(resp.StatusCode)))
+	}
+	if failed {
+		s.span.Attributes = append(s.span.Attributes, stringAttr("error.type", class.String()))
+		s.span.Status.Code = 2 // STATUS_CODE_ERROR
+		if err != nil {
+			s.span.Status.Message = err.Error()
+		} else if resp != nil {
+			s.span.Status.Message = resp.Status
+		}
+	} else {
+		s.span.Status.Code = 1 // STATUS_CODE_OK
+	}
+	tracer.queueSpan(s.span)
+}
+
+func (e *spanExporter) queueSpan(span otlpSpan) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.queue) >= maxSpanQueue {
+		e.dropped.Add(1)
+		return
+	}
+	e.queue = append(e.queue, span)
+	if len(e.queue) >= maxSpanBatch {
+		select {
+		case e.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// export sends queued spans to the endpoint, up to maxSpanBatch at a time.
+// Spans that fail to export are dropped.
+func (e *spanExporter) export(ctx context.Context) {
+	for {
+		e.mu.Lock()
+		cfg, spans := e.cfg, e.queue
+		if len(spans) > maxSpanBatch {
+			spans = spans[:maxSpanBatch]
+		}
+		e.queue = e.queue[len(spans):]
+		e.mu.Unlock()
+		if len(spans) == 0 || cfg.Endpoint == "" {
+			return
+		}
+
+		if err := e.send(ctx, cfg, spans); err != nil {
+			e.dropped.Add(int64(len(spans)))
+			glog.Warningf("Unable to export %d spans to %s: %v", len(spans), cfg.Endpoint, err)
+			return
+		}
+		e.exported.Add(int64(len(spans)))
+	}
+}
+
+func (e *spanExporter) send(ctx context.Context, cfg OTLPConfig, spans []otlpSpan) error {
+	service := cfg.Service
+	if service == "" {
+		service = "janus"
+	}
+	resourceAttrs := []otlpAttr{stringAttr("service.name", service)}
+	if host := instance.id(); host != "" {
+		resourceAttrs = append(resourceAttrs, stringAttr("host.name", host))
+	}
+
+	body, err := json.Marshal(otlpTraces{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: resourceAttrs},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "janus"},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/JSON encoding of trace exports. Only the fields used here are
+// defined. IDs are hex and 64-bit integers are strings, as the encoding
+// requires.
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID    string     `json:"traceId"`
+	SpanID     string     `json:"spanId"`
+	Name       string     `json:"name"`
+	Kind       int        `json:"kind"`
+	Start      string     `json:"startTimeUnixNano"`
+	End        string     `json:"endTimeUnixNano"`
+	Attributes []otlpAttr `json:"attributes"`
+	Status     struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	String *string `json:"stringValue,omitempty"`
+	Int    *string `json:"intValue,omitempty"`
+}
+
+func stringAttr(key, value string) otlpAttr {
+	return otlpAttr{Key: key, Value: otlpValue{String: &value}}
+}
+
+func intAttr(key string, value int64) otlpAttr {
+	s := strconv.FormatInt(value, 10)
+	return otlpAttr{Key: key, Value: otlpValue{Int: &s}}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// maxRejectBody is the number of bytes of a 400 response read to find the
+// lines the upstream rejected.
+const maxRejectBody = 64 << 10
+
+// rejectedLineNumber matches the line numbers InfluxDB 2.x gives for lines it
+// couldn't parse.
+var rejectedLineNumber = regexp.MustCompile(`(?m)^line (\d+):`)
+
+// partialWriteCount matches the number of points InfluxDB 2.x says it wrote
+// in a partial write error.
+var partialWriteCount = regexp.MustCompile(`partial write error \((\d+) written\)`)
+
+// dropRejected drops the lines of body that the upstream names in resp, a
+// 400 response, as ones it couldn't parse. If the upstream wrote none of
+// body, the rest of it is sent again; otherwise the rest was written and the
+// batch is done. If the response doesn't name any of the lines, it's returned
+// as is.
+func (t *splitTransport) dropRejected(req *http.Request, body []byte, resp *http.Response) (*http.Response, error) {
+	msg := influxError(captureBody(resp, maxRejectBody))
+	quoted, numbers := rejectedLines(msg)
+	if len(quoted) == 0 && len(numbers) == 0 {
+		return resp, nil
+	}
+
+	lines, err := decodeBody(req, body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	var kept, rejected [][]byte
+	for i, line := range bytes.Split(lines, []byte{'\n'}) {
+		if numbers[i+1] || quoted[string(bytes.TrimSuffix(line, []byte{'\r'}))] {
+			rejected = append(rejected, line)
+		} else if len(line) > 0 {
+			kept = append(kept, line)
+		}
+	}
+	if len(rejected) == 0 {
+		return resp, nil
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	for _, line := range rejected {
+		t.stats.addLineRejected()
+		if t.dead != nil && t.dead.proxy == nil {
+			// Written upstream, the dead letter would pass through here again.
+			t.dead.add(deadRejected, line)
+		}
+	}
+	glog.Errorf("Dropping %d of %d lines of batch to %v; rejected by the upstream: %s",
+		len(rejected), len(rejected)+len(kept), redactURL(req.URL), msg)
+	if len(kept) == 0 || !nothingWritten(msg) {
+		return noContent(req), nil
+	}
+
+	rest, err := encodeBody(req, append(bytes.Join(kept, []byte{'\n'}), '\n'))
+	if err != nil {
+		return nil, err
+	}
+	return t.send(req, rest)
+}
+
+// nothingWritten reports whether msg, the error of a 400 response naming
+// lines the upstream couldn't parse, shows that it wrote none of the batch.
+// InfluxDB 1.x writes the points it could parse and says so with a "partial
+// write:" error; otherwise it wrote nothing. InfluxDB 2.x rejects the whole
+// batch when lines fail to parse, unless its error gives a count of points
+// written.
+func nothingWritten(msg string) bool {
+	if m := partialWriteCount.FindStringSubmatch(msg); m != nil {
+		return m[1] == "0"
+	}
+	return !strings.HasPrefix(msg, "partial write:")
+}
+
+// influxError returns the error message of an InfluxDB error response body:
+// the error of 1.x responses or the message of 2.x responses. Bodies that
+// aren't JSON are returned as is.
+func influxError(body []byte) string {
+	var e struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &e); err != nil {
+		return string(body)
+	}
+	if e.Error != "" {
+		return e.Error
+	}
+	return e.Message
+}
+
+// rejectedLines returns the lines quoted in msg as ones InfluxDB couldn't
+// parse, and the 1-based numbers of lines it gives instead.
+func rejectedLines(msg string) (quoted map[string]bool, numbers map[int]bool) {
+	const prefix = "unable to parse '"
+	quoted, numbers = map[string]bool{}, map[int]bool{}
+	for rest := msg; ; {
+		i := strings.Index(rest, prefix)
+		if i < 0 {
+			break
+		}
+		rest = rest[i+len(prefix):]
+		j := strings.Index(rest, "': ")
+		if j < 0 {
+			break
+		}
+		quoted[rest[:j]] = true
+		rest = rest[j:]
+	}
+	for _, m := range rejectedLineNumber.FindAllStringSubmatch(msg, -1) {
+		if n, err := strconv.Atoi(m[1]); err == nil {
+			numbers[n] = true
+		}
+	}
+	return quoted, numbers
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRejectedLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		quoted  []string
+		numbers []int
+	}{
+		{
+			"1.x single",
+			`{"error":"partial write: unable to parse 'cpu,host=a value=': missing field value dropped=0"}`,
+			[]string{"cpu,host=a value="}, nil,
+		},
+		{
+			"1.x several",
+			`{"error":"partial write: unable to parse 'cpu value=': missing field value\nunable to parse 'mem used=1i,free': invalid field format dropped=0"}`,
+			[]string{"cpu value=", "mem used=1i,free"}, nil,
+		},
+		{
+			"1.x quotes inside lines",
+			`{"error":"unable to parse 'weather,loc=o'hare temp=\"it's\"x': invalid boolean"}`,
+			[]string{`weather,loc=o'hare temp="it's"x`}, nil,
+		},
+		{
+			"2.x partial write",
+			`{"code":"invalid","message":"partial write error (1 written): unable to parse 'cpu value=': missing field value"}`,
+			[]string{"cpu value="}, nil,
+		},
+		{
+			"2.x line numbers",
+			`{"code":"invalid","message":"failed to parse line protocol:\nerrors encountered on line(s):\nline 2: missing field value\nline 4: invalid field format"}`,
+			nil, []int{2, 4},
+		},
+		{
+			"not JSON",
+			"unable to parse 'cpu value=': missing field value",
+			[]string{"cpu value="}, nil,
+		},
+		{
+			"no lines",
+			`{"error":"database not found: \"metrics\""}`,
+			nil, nil,
+		},
+		{
+			"unterminated quote",
+			`{"error":"unable to parse 'cpu value="}`,
+			nil, nil,
+		},
+	}
+	for _, tt := range tests {
+		quoted, numbers := rejectedLines(influxError([]byte(tt.body)))
+		wantQuoted, wantNumbers := map[string]bool{}, map[int]bool{}
+		for _, line := range tt.quoted {
+			wantQuoted[line] = true
+		}
+		for _, n := range tt.numbers {
+			wantNumbers[n] = true
+		}
+		if !reflect.DeepEqual(quoted, wantQuoted) || !reflect.DeepEqual(numbers, wantNumbers) {
+			t.Errorf("%s: rejectedLines() = %v, %v; want %v, %v", tt.name, quoted, numbers, wantQuoted, wantNumbers)
+		}
+	}
+}
+
+func TestDropRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    string
+		reject   string // Body of the first 400 response
+		sent     string // Body sent again, if any
+		rejected uint64
+	}{
+		{
+			"1.x partial write",
+			"a=1\nbad\nb=2\n",
+			`{"error":"partial write: unable to parse 'bad': invalid field format dropped=0"}`,
+			"", 1,
+		},
+		{
+			"1.x nothing written",
+			"a=1\nbad\nb=2\n",
+			`{"error":"unable to parse 'bad': invalid field format"}`,
+			"a=1\nb=2\n", 1,
+		},
+		{
+			"CRLF",
+			"a=1\r\nbad\r\nb=2\r\n",
+			`{"error":"unable to parse 'bad': invalid field format"}`,
+			"a=1\r\nb=2\r\n", 1,
+		},
+		{
+			"2.x partial write",
+			"a=1\nbad\nb=2\n",
+			`{"code":"invalid","message":"partial write error (2 written): unable to parse 'bad': invalid field format"}`,
+			"", 1,
+		},
+		{
+			"2.x none written",
+			"a=1\nbad\nb=2\n",
+			`{"code":"invalid","message":"partial write error (0 written): unable to parse 'bad': invalid field format"}`,
+			"a=1\nb=2\n", 1,
+		},
+		{
+			"line numbers",
+			"a=1\nbad\nb=2\nworse\n",
+			`{"code":"invalid","message":"errors encountered on line(s):\nline 2: invalid field format\nline 4: missing field value"}`,
+			"a=1\nb=2\n", 2,
+		},
+		{
+			"all rejected",
+			"bad\n",
+			`{"error":"unable to parse 'bad': invalid field format"}`,
+			"", 1,
+		},
+	}
+	for _, tt := range tests {
+		var sent []string
+		stats := new(portStats)
+		rt := &splitTransport{
+			stats: stats,
+			base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				body, _ := ioutil.ReadAll(req.Body)
+				if len(sent) == 0 && string(body) == tt.lines {
+					sent = append(sent, "")
+					return testResponse(req, http.StatusBadRequest, tt.reject), nil
+				}
+				sent = append(sent, string(body))
+				return testResponse(req, http.StatusNoContent, ""), nil
+			}),
+		}
+
+		req, _ := http.NewRequest("POST", "http://localhost/write", bytes.NewReader([]byte(tt.lines)))
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("%s: status = %d; want %d", tt.name, resp.StatusCode, http.StatusNoContent)
+		}
+
+		want := []string{""}
+		if tt.sent != "" {
+			want = append(want, tt.sent)
+		}
+		if !reflect.DeepEqual(sent, want) {
+			t.Errorf("%s: sent %q; want %q", tt.name, sent[1:], want[1:])
+		}
+		if stats.LinesRejected != tt.rejected {
+			t.Errorf("%s: lines_rejected = %d; want %d", tt.name, stats.LinesRejected, tt.rejected)
+		}
+	}
+}
+
+func TestDropRejectedUnnamed(t *testing.T) {
+	rt := &splitTransport{
+		stats: new(portStats),
+		base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return testResponse(req, http.StatusBadRequest, `{"error":"database not found"}`), nil
+		}),
+	}
+	req, _ := http.NewRequest("POST", "http://localhost/write", bytes.NewReader([]byte("a=1\n")))
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d; want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != `{"error":"database not found"}` {
+		t.Errorf("body = %q; want the upstream's", body)
+	}
+}
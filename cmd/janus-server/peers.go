@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"go.spiff.io/codf"
+)
+
+// PeersConfig restricts a port to datagrams sent from the addresses of a set
+// of hosts.
+type PeersConfig struct {
+	Hosts   []string      // Hostnames or IPs of the expected senders; empty allows any
+	Refresh time.Duration // How often to resolve Hosts again
+}
+
+const defaultPeerRefresh = time.Minute
+
+// handleExpectPeers parses `expect-peers off` or `expect-peers HOST...
+// [refresh D]`.
+func (p *PortConfig) handleExpectPeers(args []codf.ExprNode) error {
+	if len(args) == 1 {
+		if w, ok := codf.Word(args[0]); ok && w == "off" {
+			p.Peers = PeersConfig{}
+			return nil
+		}
+	}
+
+	peers := PeersConfig{Refresh: defaultPeerRefresh}
+	for i := 0; i < len(args); i++ {
+		var host string
+		if err := parseArg(args[i], &host); err != nil {
+			return argError(i, args[i], err)
+		}
+		if host == "refresh" && i+1 < len(args) {
+			i++
+			if err := parseArg(args[i], &peers.Refresh); err != nil {
+				return argError(i, args[i], err)
+			} else if peers.Refresh <= 0 {
+				return argError(i, args[i], fmt.Errorf("refresh must be > 0s; got %v", peers.Refresh))
+			}
+			continue
+		}
+		if host == "" {
+			return argError(i, args[i], errors.New("host must not be empty"))
+		}
+		peers.Hosts = append(peers.Hosts, host)
+	}
+	if len(peers.Hosts) == 0 {
+		return errors.New("expect-peers requires at least one host")
+	}
+	p.Peers = peers
+	return nil
+}
+
+// peerFilter tracks the addresses of a port's expected peers. A host that
+// can't be resolved keeps the addresses it last resolved to.
+type peerFilter struct {
+	cfg PeersConfig
+
+	mu      sync.RWMutex
+	byHost  map[string][]string // Resolved addresses of each host
+	allowed map[string]bool     // All resolved addresses
+}
+
+func newPeerFilter(cfg PeersConfig) *peerFilter {
+	return &peerFilter{cfg: cfg, byHost: map[string][]string{}, allowed: map[string]bool{}}
+}
+
+// allow reports whether a datagram from addr is from an expected peer.
+func (f *peerFilter) allow(addr net.Addr) bool {
+	udp, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	ip := udp.IP
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.allowed[ip.String()]
+}
+
+// resolve looks up the addresses of every host.
+func (f *peerFilter) resolve(ctx context.Context) {
+	byHost := make(map[string][]string, len(f.cfg.Hosts))
+	for _, host := range f.cfg.Hosts {
+		addrs, err := dns.LookupHost(ctx, host)
+		if err != nil {
+			f.mu.RLock()
+			byHost[host] = f.byHost[host]
+			f.mu.RUnlock()
+			glog.Warningf("Unable to resolve expected peer %s; keeping its last %d addresses: %v", host, len(byHost[host]), err)
+			continue
+		}
+		byHost[host] = addrs
+	}
+
+	allowed := map[string]bool{}
+	for _, addrs := range byHost {
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				continue
+			}
+			if v4 := ip.To4(); v4 != nil {
+				ip = v4
+			}
+			allowed[ip.String()] = true
+		}
+	}
+
+	f.mu.Lock()
+	f.byHost, f.allowed = byHost, allowed
+	f.mu.Unlock()
+}
+
+// run resolves the hosts every refresh interval until ctx is done.
+func (f *peerFilter) run(ctx context.Context) {
+	ticker := time.NewTicker(f.cfg.Refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			f.resolve(ctx)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+var pidfile = flag.String("pidfile", "", "File to write the process ID to; also locked so only one janus runs against it")
+
+// pidFile is a locked PID file. The lock is held until the file is released
+// or the process exits.
+type pidFile struct {
+	path string
+	file *os.File
+}
+
+// writePidFile locks the file at path and writes the process ID to it. It
+// fails if another process holds the lock.
+func writePidFile(path string) (*pidFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = lockFile(f); err == errLocked {
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+		if pid := string(bytes.TrimSpace(data)); pid != "" {
+			return nil, fmt.Errorf("pidfile %s is locked by another janus (pid %s)", path, pid)
+		}
+		return nil, fmt.Errorf("pidfile %s is locked by another janus", path)
+	} else if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to lock pidfile %s: %v", path, err)
+	}
+
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to write pidfile %s: %v", path, err)
+	}
+	return &pidFile{path: path, file: f}, nil
+}
+
+// release removes the PID file and releases its lock. It does nothing if the
+// lock was already given up by unlock.
+func (p *pidFile) release() error {
+	if p.file == nil {
+		return nil
+	}
+	err := os.Remove(p.path)
+	if cerr := p.unlock(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// unlock releases the lock without removing the PID file, so that another
+// process can take it.
+func (p *pidFile) unlock() error {
+	if p.file == nil {
+		return nil
+	}
+	err := p.file.Close()
+	p.file = nil
+	return err
+}
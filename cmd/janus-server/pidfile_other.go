@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/golang/glog"
+)
+
+var errLocked = errors.New("file is locked")
+
+// lockFile does nothing: pidfiles and write-ahead logs are only locked on
+// Linux.
+func lockFile(f *os.File) error {
+	glog.Warningf("Unable to lock %s: locking is not supported on this platform", f.Name())
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import "bytes"
+
+// stage processes the lines of payloads before they're written to a proxy.
+// Stages may be shared by the listeners of a port and must be safe for
+// concurrent use.
+type stage interface {
+	// apply appends line, possibly modified, to dst and returns the result.
+	// A line is dropped by returning dst unchanged.
+	apply(dst, line []byte) []byte
+}
+
+// stageFunc adapts a function to a stage.
+type stageFunc func(dst, line []byte) []byte
+
+func (fn stageFunc) apply(dst, line []byte) []byte { return fn(dst, line) }
+
+// pipeline runs payloads through a sequence of stages.
+type pipeline struct {
+	stages []stage
+}
+
+// process returns payload after passing each of its lines through every
+// stage, using bufs for intermediate results. The returned slice is only
+// valid until bufs are next used.
+func (pl *pipeline) process(bufs *[2][]byte, payload []byte) []byte {
+	for i, st := range pl.stages {
+		buf := &bufs[i%2]
+		*buf = appendLines((*buf)[:0], payload, st.apply)
+		payload = *buf
+	}
+	return payload
+}
+
+// tagStage returns a stage adding encoded tags to each line.
+func tagStage(tags []byte) stage {
+	return stageFunc(func(dst, line []byte) []byte {
+		return appendTagged(dst, line, tags)
+	})
+}
+
+// appendLines appends each line of payload to dst, passing it through fn
+// first. Blank lines and comments are passed through unchanged, and lines
+// that fn drops are omitted.
+func appendLines(dst, payload []byte, fn func(dst, line []byte) []byte) []byte {
+	for len(payload) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(payload, '\n'); i == -1 {
+			line, payload = payload, nil
+		} else {
+			line, payload = payload[:i], payload[i+1:]
+		}
+
+		if trimmed := bytes.TrimSpace(line); len(trimmed) == 0 || trimmed[0] == '#' {
+			dst = append(dst, line...)
+		} else {
+			n := len(dst)
+			if dst = fn(dst, line); len(dst) == n {
+				continue
+			}
+		}
+		dst = append(dst, '\n')
+	}
+	return dst
+}
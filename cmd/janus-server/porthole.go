@@ -2,23 +2,59 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
 
 	"go.spiff.io/dagr/outflux"
 	"golang.org/x/net/context"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 type porthole struct {
 	orig  *Addr
+	port  string // Name of the port, if any
+	index int    // Index of the listener in the port
 	proxy *outflux.Proxy
+	stats *portStats
+	lines *lineCounter
+	trace *batchTracer
 
 	rdtimeout time.Duration
+	rcvbuf    int
+	reuseport bool
+	rebind    RebindConfig
+	onFailure string // Bind failure policy
+
+	dedup    *dedupFilter   // Drops repeated payloads, if enabled
+	peers    *peerFilter    // Drops datagrams from unexpected senders, if enabled
+	sources  *sourceStats   // Counts traffic per sender, if enabled
+	dead     *deadLetter    // Records dropped payloads, if enabled
+	sampler  *sampler       // Picks the payloads to forward, if sampling
+	buffer   *bufferLimit   // Bounds undelivered bytes, if enabled
+	wal      *writeAheadLog // Logs payloads until they're delivered, if enabled
+	record   *recorder      // Records received datagrams, if enabled
+	decoder  *decoder       // Converts payloads to line protocol, if needed
+	script   *scriptHook    // Transforms payloads once processed, if enabled
+	pipeline pipeline
+	queue    *writeQueue
+	affinity listenerAffinity
+	bound    int32 // Set while listening; accessed atomically
+
+	mu   sync.Mutex
+	conn *net.UDPConn // The bound socket, while listening
 }
 
-func newPorthole(addr *Addr, proxy *outflux.Proxy, rdtimeout time.Duration) (*porthole, error) {
+// newPorthole returns the index'th listener of g, on addr, writing to g's
+// proxy. Its payloads are passed through stages after adding any tags of addr.
+func newPorthole(addr *Addr, index int, g *gateway, stages []stage, reuseport bool) (*porthole, error) {
 	if addr == nil {
 		return nil, errors.New("porthole: addr is nil")
 	}
@@ -26,17 +62,96 @@ func newPorthole(addr *Addr, proxy *outflux.Proxy, rdtimeout time.Duration) (*po
 	dup := new(Addr)
 	*dup = *addr
 
+	if len(addr.Tags) > 0 {
+		stages = append([]stage{tagStage(encodeTags(addr.Tags))}, stages...)
+	}
+
+	dec, err := newDecoder(g.cfg, g.stats, g.dead)
+	if err != nil {
+		return nil, err
+	}
+
 	return &porthole{
 		orig:      dup,
-		rdtimeout: rdtimeout,
-		proxy:     proxy,
+		port:      g.cfg.Name,
+		index:     index,
+		rdtimeout: g.cfg.ReadTimeout,
+		rcvbuf:    g.cfg.ReadBuffer,
+		reuseport: reuseport,
+		rebind:    g.cfg.Rebind,
+		onFailure: g.cfg.OnBindFailure,
+		proxy:     g.out,
+		stats:     g.stats,
+		lines:     g.lines,
+		trace:     g.trace,
+		dedup:     g.dedup,
+		peers:     g.peers,
+		sources:   g.sources,
+		dead:      g.dead,
+		sampler:   g.sampler,
+		buffer:    g.buffer,
+		wal:       g.wal,
+		record:    g.record,
+		decoder:   dec,
+		script:    g.script,
+		pipeline:  pipeline{stages: stages},
+		queue:     g.queue,
 	}, nil
 }
 
-func memclr(block []byte) {
-	for i := range block { // optimized to memclr
-		block[i] = 0
+// isBound reports whether p is bound to its address.
+func (p *porthole) isBound() bool { return atomic.LoadInt32(&p.bound) == 1 }
+
+// setConn records conn as p's bound socket, or that p is unbound if conn is
+// nil.
+func (p *porthole) setConn(conn *net.UDPConn) {
+	p.mu.Lock()
+	p.conn = conn
+	p.mu.Unlock()
+	if conn != nil {
+		atomic.StoreInt32(&p.bound, 1)
+	} else {
+		atomic.StoreInt32(&p.bound, 0)
+	}
+}
+
+// localAddr returns the address p's socket is bound to, or "" if p isn't
+// bound.
+func (p *porthole) localAddr() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return ""
 	}
+	return p.conn.LocalAddr().String()
+}
+
+// file returns a duplicate of p's socket, or nil if p isn't bound.
+func (p *porthole) file() (*os.File, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil, nil
+	}
+	return p.conn.File()
+}
+
+// maxDatagram is the size of a pooled read buffer. It is sized to the IPv4
+// limit for a UDP payload.
+const maxDatagram = 65507
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, maxDatagram)
+		return &buf
+	},
+}
+
+func getBuffer() *[]byte { return bufferPool.Get().(*[]byte) }
+
+func putBuffer(buf *[]byte) {
+	*buf = (*buf)[:cap(*buf)]
+	bufferPool.Put(buf)
 }
 
 func (p *porthole) listen(ctx context.Context) (err error) {
@@ -49,98 +164,309 @@ func (p *porthole) listen(ctx context.Context) (err error) {
 		return err
 	}
 
-	conn, err := net.ListenUDP(p.orig.Network, addr)
+	conn, err := activatedConn(p.port, p.index, addr)
 	if err != nil {
 		return err
+	} else if conn != nil {
+		glog.Infof("Using activated socket for %v", p.orig)
+	} else if addr.IP.IsMulticast() {
+		if conn, err = listenMulticast(p.orig, addr); err != nil {
+			return err
+		}
+	} else if p.orig.Interface != "" {
+		return fmt.Errorf("%v does not resolve to a multicast address", p.orig)
+	} else if conn, err = listenUDP(ctx, p.orig, addr, p.reuseport); err != nil {
+		return err
+	}
+
+	if p.rcvbuf > 0 {
+		if err = setReadBuffer(conn, p.rcvbuf); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	p.setConn(conn)
+	defer p.setConn(nil)
+	glog.Infof("Bound %v to %v", p.orig, conn.LocalAddr())
+
+	if err = waitPrivileges(ctx); err != nil {
+		conn.Close()
+		return err
 	}
 
 	// Basically just here to ensure the connection is closed one way or another.
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	type result struct {
-		n      int
-		client *net.UDPAddr
-		err    error
-	}
-
-	var (
-		// Sized to ipv4 limit, should be increased or just made to be a configurable buffer
-		msg     [65507]byte
-		buf     = msg[:]
-		n       int
-		timeout = p.rdtimeout
-		errch   = make(chan result, 1)
-	)
+	go p.watchDrops(ctx, conn)
 
 	go func() {
 		<-ctx.Done()
-		errch <- result{err: ctx.Err()}
-
 		clerr := conn.Close()
 		if clerr != nil {
 			glog.Errorf("Error closing UDP conn for %v: %v", addr, clerr)
 		}
 	}()
 
-	asyncRead := func(dst []byte) {
+	var (
+		timeout = p.rdtimeout
+		batch   = newBatchReader(conn, p.orig.Network)
+		msgs    = make([]ipv4.Message, readBatchSize)
+		bufs    = make([]*[]byte, readBatchSize)
+	)
+	defer func() {
+		for _, buf := range bufs {
+			if buf != nil {
+				putBuffer(buf)
+			}
+		}
+	}()
+
+	for {
+		for i, buf := range bufs {
+			if buf == nil {
+				buf = getBuffer()
+				bufs[i], msgs[i].Buffers = buf, [][]byte{*buf}
+			}
+		}
+
 		if timeout > 0 {
-			if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
-				errch <- result{err: err}
-				return
+			if err = conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+				return err
 			}
 		}
 
-		var res result
-		res.n, res.client, res.err = conn.ReadFromUDP(dst)
-		errch <- res
+		n, err := batch.ReadBatch(msgs, 0)
+		if err != nil {
+			if cerr := ctx.Err(); cerr != nil {
+				return cerr
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				p.stats.addReadError()
+				continue
+			}
+			return err
+		}
+
+		p.affinity.read(conn, n)
+		for i := 0; i < n; i++ {
+			if p.peers != nil && !p.peers.allow(msgs[i].Addr) {
+				p.stats.addPeerDropped()
+				p.dead.add(deadPeer, (*bufs[i])[:msgs[i].N])
+				continue
+			}
+			buf := bufs[i]
+			bufs[i] = nil
+			*buf = (*buf)[:msgs[i].N]
+			p.stats.addPacket(msgs[i].N)
+			if p.sources != nil {
+				p.sources.add(msgs[i].Addr, msgs[i].N)
+			}
+			if p.record != nil {
+				p.record.record(p.orig, msgs[i].Addr, *buf)
+			}
+			p.queue.push(ctx, queuedPacket{from: p, buf: buf})
+		}
 	}
+}
+
+// batchReader reads multiple datagrams from a connection at once.
+type batchReader interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+}
 
-	read := func(dst []byte) (int, *net.UDPAddr, error) {
-		go asyncRead(dst)
-		r := <-errch
-		return r.n, r.client, r.err
+// newBatchReader returns a batchReader for conn. IPv4 and IPv6 messages are
+// the same type, so only the socket options used to read differ.
+func newBatchReader(conn *net.UDPConn, network string) batchReader {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); network == "udp6" || (ok && addr.IP.To4() == nil) {
+		return ipv6.NewPacketConn(conn)
 	}
+	return ipv4.NewPacketConn(conn)
+}
 
-	for {
-		n, _, err = read(buf)
-		if err == context.Canceled || err == context.DeadlineExceeded {
-			// Don't clear buffer or we have a possible race condition, just exit now
-			return err
+// write decodes, transforms, and writes a payload received by p to its proxy,
+// using sc for intermediate buffers.
+func (p *porthole) write(block []byte, sc *writeScratch) error {
+	if p.dedup != nil && p.dedup.duplicate(block) {
+		p.stats.addDuplicate()
+		return nil
+	}
+
+	if p.sampler != nil && !p.sampler.keep() {
+		p.stats.addSampledOut()
+		return nil
+	}
+
+	payload := block
+	if p.decoder != nil {
+		var err error
+		sc.decoded, err = p.decoder.decode(sc.decoded[:0], block)
+		if err != nil {
+			p.stats.addDecodeError()
+			p.dead.add(deadDecode, block)
+			if glog.V(1) {
+				glog.Warningf("Unable to decode payload from %v: %v", p.orig, err)
+			}
+			return nil
 		}
+		payload = sc.decoded
+	}
+
+	payload = p.pipeline.process(&sc.bufs, payload)
+	if p.script != nil && len(payload) > 0 {
+		payload = p.script.run(payload)
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	return p.send(payload)
+}
 
-		block := buf[:n]
+// send writes payload, once processed, to p's proxy.
+func (p *porthole) send(payload []byte) error {
+	if p.buffer != nil && !p.buffer.reserve(len(payload)) {
+		p.dead.add(deadBuffer, payload)
+		return nil
+	}
 
-		switch te := err.(type) {
-		case nil:
-		case net.Error:
-			memclr(block)
-			if !te.Temporary() {
-				return err
+	if p.wal != nil {
+		// A payload that isn't logged can't be delivered at least once, so
+		// it's dropped.
+		if err := p.wal.append(payload); err != nil {
+			if p.buffer != nil {
+				p.buffer.cancel(len(payload))
 			}
-			continue
-		default:
-			memclr(block)
-			return err
+			p.stats.addWALError()
+			glog.Errorf("Dropping payload; unable to append to write-ahead log of %v: %v", p.orig, err)
+			return nil
 		}
+	}
 
-		if _, err = p.proxy.Write(block); err != nil {
-			return err
+	start := time.Now()
+	_, err := p.proxy.Write(payload)
+	p.stats.addWriteWait(time.Since(start))
+	if err != nil {
+		if p.buffer != nil {
+			p.buffer.cancel(len(payload))
 		}
+		p.stats.addWriteError()
+		return err
+	}
+	p.lines.add(countLines(payload), len(payload))
+	p.trace.accumulate()
+	return nil
+}
+
+// dropCheckInterval is how often listeners check for datagrams dropped by
+// the kernel.
+const dropCheckInterval = 10 * time.Second
 
-		memclr(block)
+// watchDrops periodically checks how many datagrams the kernel has dropped
+// for conn, usually because its receive buffer was full, and reports any
+// new drops. It stops when ctx ends or if drops can't be read.
+func (p *porthole) watchDrops(ctx context.Context, conn *net.UDPConn) {
+	last, err := socketDrops(conn)
+	if err != nil {
+		if glog.V(1) {
+			glog.Warningf("Unable to read kernel drops for %v: %v", p.orig, err)
+		}
+		return
 	}
 
-	if err == nil {
-		err = ctx.Err()
+	ticker := time.NewTicker(dropCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		drops, err := socketDrops(conn)
+		if err != nil {
+			if ctx.Err() == nil {
+				glog.Warningf("Unable to read kernel drops for %v: %v", p.orig, err)
+			}
+			return
+		}
+		if drops > last {
+			p.stats.addKernelDrops(drops - last)
+			glog.Warningf("Kernel dropped %d packets on %v (%d total); consider raising so-rcvbuf",
+				drops-last, p.orig, drops)
+		}
+		last = drops
+	}
+}
+
+// setReadBuffer sets the socket receive buffer of conn to size bytes and logs
+// the size the OS actually used, which may differ: Linux doubles the requested
+// size and caps it at net.core.rmem_max.
+func setReadBuffer(conn *net.UDPConn, size int) error {
+	if err := conn.SetReadBuffer(size); err != nil {
+		return err
+	}
+
+	if effective, err := readBufferSize(conn); err != nil {
+		glog.Infof("Set receive buffer of %v to %d bytes", conn.LocalAddr(), size)
+	} else {
+		glog.Infof("Set receive buffer of %v to %d bytes (effective: %d)", conn.LocalAddr(), size, effective)
+	}
+	return nil
+}
+
+// listenUDP binds a UDP connection to addr, resolved from orig, with orig's
+// socket options. If reuseport is true, the socket is bound with SO_REUSEPORT
+// so that it can overlap an existing listener.
+func listenUDP(ctx context.Context, orig *Addr, addr *net.UDPAddr, reuseport bool) (*net.UDPConn, error) {
+	if !reuseport && orig.Device == "" && !orig.FreeBind {
+		return net.ListenUDP(orig.Network, addr)
+	}
+
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		if reuseport {
+			if err := reusePort(network, address, c); err != nil {
+				return err
+			}
+		}
+		return setSocketOptions(orig, c)
+	}}
+	conn, err := lc.ListenPacket(ctx, orig.Network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// listenMulticast binds a UDP connection to the multicast group addr and joins
+// it on orig's interface, or the system's default one. Multicast sockets are
+// always bound with SO_REUSEADDR, so other processes may join the group too.
+func listenMulticast(orig *Addr, addr *net.UDPAddr) (*net.UDPConn, error) {
+	var ifi *net.Interface
+	if orig.Interface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(orig.Interface); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := net.ListenMulticastUDP(orig.Network, ifi, addr)
+	if err != nil {
+		return nil, err
 	}
-	return err
+	glog.Infof("Joined multicast group %v", orig)
+	return conn, nil
 }
 
+// Listen reads from p's address until ctx is done, binding it again after
+// failures as allowed by the port's rebind and bind failure policies.
 func (p *porthole) Listen(ctx context.Context) (err error) {
-	const retries = 10
+	retries := p.rebind.Retries
+	if p.onFailure == bindRetryForever {
+		retries = 0
+	}
 	addr := p.orig.String()
-	for i := 1; i <= retries; i++ {
+	rebind := newBackoffState(p.rebind.Backoff, 1)
+	for i := 1; ; {
 		t := time.Now()
 		glog.Infof("[%d] Binding to %v", i, addr)
 
@@ -150,30 +476,26 @@ func (p *porthole) Listen(ctx context.Context) (err error) {
 			return
 		}
 
-		if oe, ok := err.(*net.OpError); ok && oe.Op == "listen" {
-			// Give up if we failed to even open the listener -- something else is
-			// using that port, probably.
-			glog.Errorf("[%d] Unable to bind to %v -- will not retry: %v", i, addr, err)
-		} else if i == retries {
-			glog.Errorf("[%d] All attempts to bind to %v have failed -- will not retry: %v", i, addr, err)
-			return err
+		if time.Since(t) > time.Minute {
+			// Forget earlier failures if the connection survived long enough -- may
+			// be DNS change or server went away mysteriously in this case.
+			rebind.succeed()
 		}
 
-		if time.Since(t) > time.Minute {
-			// Reset counter if the connection survived long enough -- may be DNS change
-			// or server went away mysteriously in this case.
-			i = 1
+		failures := rebind.fail()
+		if retries > 0 && failures >= retries {
+			glog.Errorf("[%d] All attempts to bind to %v have failed -- will not retry: %v", i, addr, err)
+			return err
 		}
 
-		wait := time.Second*2*time.Duration(i) + DefaultBackoff.backoff(i, retries)
-		glog.Errorf("[%d] Unable to bind to %v -- will retry in %v", i, addr, wait)
+		wait := p.rebind.Delay*time.Duration(failures) + rebind.next()
+		glog.Errorf("[%d] Unable to bind to %v -- will retry in %v: %v", i, addr, wait, err)
 
 		select {
 		case <-time.After(wait):
 		case <-ctx.Done():
 			return ctx.Err()
 		}
+		i = failures + 1
 	}
-
-	return err
 }
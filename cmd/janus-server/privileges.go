@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// privileges is closed once janus has dropped privileges, or once it knows it
+// won't. Listeners bind their sockets and wait on it before reading.
+var privileges = struct {
+	once    sync.Once
+	dropped chan struct{}
+}{dropped: make(chan struct{})}
+
+// privilegesDropped unblocks listeners waiting for privileges to be dropped.
+func privilegesDropped() {
+	privileges.once.Do(func() { close(privileges.dropped) })
+}
+
+// waitPrivileges blocks until privileges are dropped or ctx is done.
+func waitPrivileges(ctx context.Context) error {
+	select {
+	case <-privileges.dropped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// bindTimeout is how long to wait for listeners to bind before dropping
+// privileges anyway.
+const bindTimeout = 10 * time.Second
+
+// waitBound blocks until every listener of the running gateways is bound, or
+// until timeout passes. It reports whether all of them were bound.
+func (s *server) waitBound(timeout time.Duration) bool {
+	bound := func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, g := range s.gateways {
+			for _, p := range g.in {
+				if !p.isBound() {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	deadline := time.Now().Add(timeout)
+	for !bound() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+// dropPrivileges switches to the given user and group once the running
+// gateways' listeners are bound. If group is empty, the user's primary group
+// is used.
+func (s *server) dropPrivileges(username, group string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid uid %q of user %s", u.Uid, username)
+	}
+
+	gidStr := u.Gid
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return fmt.Errorf("invalid gid %q", gidStr)
+	}
+
+	if os.Geteuid() == uid && os.Getegid() == gid {
+		return nil // Already dropped, as in a process started by an upgrade
+	}
+
+	if !s.waitBound(bindTimeout) {
+		glog.Warningf("Not all listeners were bound after %v; dropping privileges anyway", bindTimeout)
+	}
+	if err := setIDs(uid, gid); err != nil {
+		return fmt.Errorf("unable to switch to user %s (%d) and group %d: %v", username, uid, gid, err)
+	}
+	glog.Infof("Dropped privileges to user %s (%d) and group %d", username, uid, gid)
+	return nil
+}
@@ -0,0 +1,15 @@
+package main
+
+import "syscall"
+
+// setIDs sets the group, supplementary groups, and user of the process, in
+// that order, since the user can't change groups once set.
+func setIDs(uid, gid int) error {
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
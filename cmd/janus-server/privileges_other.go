@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func setIDs(uid, gid int) error {
+	return errors.New("dropping privileges is not supported on this platform")
+}
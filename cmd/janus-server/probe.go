@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"go.spiff.io/codf"
+	"golang.org/x/net/context"
+)
+
+// ProbeConfig configures active health checks of a port's upstream.
+type ProbeConfig struct {
+	Interval time.Duration // Time between probes; 0 disables probing
+	Method   string        // HEAD or GET
+	Path     string        // Path probed on the forward host
+	Timeout  time.Duration // Timeout of each probe
+	Failures int           // Consecutive failed probes before the upstream is down
+}
+
+// handleHealthCheck parses `health-check off` or
+// `health-check INTERVAL [method HEAD|GET] [path PATH] [timeout D] [failures N]`.
+func (p *PortConfig) handleHealthCheck(args []codf.ExprNode) error {
+	if len(args) == 1 {
+		if w, ok := codf.Word(args[0]); ok && w == "off" {
+			p.HealthCheck.Interval = 0
+			return nil
+		}
+	}
+
+	hc := ProbeConfig{Method: "GET", Path: "/ping", Timeout: 5 * time.Second, Failures: 2}
+	if err := parseArgsUpTo(args, &hc.Interval); err != nil {
+		return err
+	}
+	err := parseKwargs("health-check", args[1:], kwargs{
+		"method":   {dest: &hc.Method},
+		"path":     {dest: &hc.Path},
+		"timeout":  {dest: &hc.Timeout},
+		"failures": {dest: &hc.Failures},
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case hc.Interval <= 0:
+		return fmt.Errorf("health-check interval must be > 0s; got %v", hc.Interval)
+	case hc.Method != "GET" && hc.Method != "HEAD":
+		return fmt.Errorf("invalid health-check method %q; must be GET or HEAD", hc.Method)
+	case hc.Timeout <= 0:
+		return fmt.Errorf("health-check timeout must be > 0s; got %v", hc.Timeout)
+	case hc.Failures < 1:
+		return fmt.Errorf("health-check failures must be >= 1; got %d", hc.Failures)
+	}
+
+	p.HealthCheck = hc
+	return nil
+}
+
+// upstreamProbe periodically checks that an upstream is up. While it's down,
+// flushes wait for it to come back instead of spending their retries.
+type upstreamProbe struct {
+	cfg    ProbeConfig
+	url    *url.URL
+	client *http.Client
+
+	mu    sync.Mutex
+	fails int
+	down  bool
+	up    chan struct{} // Closed while the upstream is up
+}
+
+func newUpstreamProbe(cfg ProbeConfig, forward *url.URL, rt http.RoundTripper) *upstreamProbe {
+	u := *forward
+	u.Path, u.RawPath, u.RawQuery = cfg.Path, "", ""
+
+	up := make(chan struct{})
+	close(up)
+	return &upstreamProbe{
+		cfg:    cfg,
+		url:    &u,
+		client: &http.Client{Transport: rt, Timeout: cfg.Timeout},
+		up:     up,
+	}
+}
+
+func (p *upstreamProbe) run(ctx context.Context) {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		p.record(p.probe(ctx))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *upstreamProbe) probe(ctx context.Context) error {
+	req, err := http.NewRequest(p.cfg.Method, p.url.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+func (p *upstreamProbe) record(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		p.fails = 0
+		if p.down {
+			glog.Infof("Upstream %v passed its health check; resuming flushes", redactURL(p.url))
+			p.down = false
+			close(p.up)
+		}
+		return
+	}
+
+	p.fails++
+	if glog.V(1) {
+		glog.Warningf("Health check of %v failed (%d/%d): %v", redactURL(p.url), p.fails, p.cfg.Failures, err)
+	}
+	if !p.down && p.fails >= p.cfg.Failures {
+		glog.Errorf("Upstream %v failed %d health checks; holding flushes until it recovers: %v",
+			redactURL(p.url), p.fails, err)
+		p.down = true
+		p.up = make(chan struct{})
+	}
+}
+
+// isDown reports whether the upstream is known to be down.
+func (p *upstreamProbe) isDown() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.down
+}
+
+// wait blocks until the upstream is up or ctx is done.
+func (p *upstreamProbe) wait(ctx context.Context) error {
+	p.mu.Lock()
+	up := p.up
+	p.mu.Unlock()
+
+	select {
+	case <-up:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
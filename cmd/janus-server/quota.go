@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"go.spiff.io/codf"
+	"go.spiff.io/dagr/outflux"
+)
+
+// Overflow policies for lines exceeding a port's quota.
+const (
+	overflowDrop   = "drop"   // Drop the line
+	overflowMark   = "mark"   // Forward the line tagged overflow=true
+	overflowDivert = "divert" // Forward the line to another database
+)
+
+// overflowTags are the encoded tags added to lines marked as overflow.
+var overflowTags = encodeTags([]Tag{{"overflow", "true"}})
+
+// QuotaConfig limits the rate at which a port forwards lines.
+type QuotaConfig struct {
+	Lines    int           // Lines allowed per period; 0 if the port has no quota
+	Per      time.Duration // The period
+	Overflow string        // Overflow policy
+	DivertDB string        // Database to divert lines to
+}
+
+// handleQuota parses `quota LINES per PERIOD [overflow POLICY] [db NAME]`,
+// where db is required by, and only allowed with, the divert policy.
+func (p *PortConfig) handleQuota(args []codf.ExprNode) error {
+	q := QuotaConfig{Per: time.Second, Overflow: overflowDrop}
+	if err := parseArgsUpTo(args, &q.Lines); err != nil {
+		return err
+	}
+
+	err := parseKwargs("quota", args[1:], kwargs{
+		"per":      {dest: &q.Per},
+		"overflow": {dest: &q.Overflow},
+		"db":       {dest: &q.DivertDB},
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case q.Lines < 1:
+		return fmt.Errorf("quota lines must be >= 1; got %d", q.Lines)
+	case q.Per <= 0:
+		return fmt.Errorf("quota period must be > 0s; got %v", q.Per)
+	}
+
+	switch q.Overflow {
+	case overflowDrop, overflowMark:
+		if q.DivertDB != "" {
+			return fmt.Errorf("quota db is only allowed with overflow %s", overflowDivert)
+		}
+	case overflowDivert:
+		if q.DivertDB == "" {
+			return fmt.Errorf("quota overflow %s requires a db", overflowDivert)
+		}
+	default:
+		return fmt.Errorf("invalid quota overflow policy %q; must be drop, mark, or divert", q.Overflow)
+	}
+
+	p.Quota = q
+	return nil
+}
+
+// withDB returns a copy of u with its db parameter set to db.
+func withDB(u *url.URL, db string) *url.URL {
+	dup := *u
+	params := dup.Query()
+	params.Set("db", db)
+	dup.RawQuery = params.Encode()
+	return &dup
+}
+
+// quotaStage is a token bucket allowing up to cfg.Lines lines per cfg.Per.
+// Lines over the quota are handled according to the overflow policy.
+type quotaStage struct {
+	cfg    QuotaConfig
+	stats  *portStats
+	divert *outflux.Proxy
+	dead   *deadLetter
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	buf    []byte
+}
+
+func newQuotaStage(cfg QuotaConfig, stats *portStats, divert *outflux.Proxy, dead *deadLetter) *quotaStage {
+	return &quotaStage{
+		cfg:    cfg,
+		stats:  stats,
+		divert: divert,
+		dead:   dead,
+		tokens: float64(cfg.Lines),
+		last:   time.Now(),
+	}
+}
+
+func (q *quotaStage) take() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	rate := float64(q.cfg.Lines) / q.cfg.Per.Seconds()
+	q.tokens += now.Sub(q.last).Seconds() * rate
+	q.last = now
+	if max := float64(q.cfg.Lines); q.tokens > max {
+		q.tokens = max
+	}
+
+	if q.tokens < 1 {
+		return false
+	}
+	q.tokens--
+	return true
+}
+
+func (q *quotaStage) apply(dst, line []byte) []byte {
+	if q.take() {
+		return append(dst, line...)
+	}
+
+	q.stats.addOverflow()
+	switch q.cfg.Overflow {
+	case overflowMark:
+		return appendTagged(dst, line, overflowTags)
+	case overflowDivert:
+		q.mu.Lock()
+		q.buf = append(append(q.buf[:0], line...), '\n')
+		_, err := q.divert.Write(q.buf)
+		q.mu.Unlock()
+		if err != nil {
+			glog.Errorf("Unable to divert overflow to db %s: %v", q.cfg.DivertDB, err)
+		}
+	default:
+		q.stats.addDrop()
+		q.dead.add(deadQuota, line)
+	}
+	return dst
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	readOnly        = flag.Bool("read-only", false, "Run listeners and pipelines but discard all writes to upstreams")
+	readOnlyLatency = flag.Duration("read-only-latency", 20*time.Millisecond, "Simulated upstream latency in read-only mode")
+)
+
+// discardTransport stands in for upstreams in read-only mode. It reads and
+// discards each request body, waits for a simulated latency, and responds
+// with 204 No Content.
+type discardTransport struct {
+	latency time.Duration
+}
+
+func (t *discardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(ioutil.Discard, req.Body)
+		req.Body.Close()
+	}
+
+	if t.latency > 0 {
+		timer := time.NewTimer(t.latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	return noContent(req), nil
+}
+
+// noContent returns a 204 No Content response to req, for requests that are
+// acknowledged without reaching an upstream.
+func noContent(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:     "204 No Content",
+		StatusCode: http.StatusNoContent,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}
+}
+
+// upstreamTransport returns the transport requests to upstreams are sent
+// through, configured by cfg, which discards them in read-only mode.
+func upstreamTransport(cfg TransportConfig) http.RoundTripper {
+	if *readOnly {
+		return &discardTransport{latency: *readOnlyLatency}
+	}
+	t := newTransport()
+	cfg.apply(t)
+	return t
+}
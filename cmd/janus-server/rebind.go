@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"go.spiff.io/codf"
+)
+
+// Policies for a listener that can't be bound, or has failed and used up its
+// rebind retries.
+const (
+	bindFatal        = "fatal"         // Stop the port, and with it the process
+	bindIgnore       = "ignore"        // Stop the listener and keep the rest of the port running
+	bindRetryForever = "retry-forever" // Keep retrying regardless of rebind retries
+)
+
+// RebindConfig controls how a port's listeners retry after failing to bind
+// or read. The wait after the Nth failure in a row is N times Delay plus the
+// Nth wait of Backoff.
+type RebindConfig struct {
+	Retries int           // Failures in a row before giving up; 0 retries forever
+	Delay   time.Duration // Added to the wait for each failure in a row
+	Backoff backoff
+}
+
+var DefaultRebind = RebindConfig{
+	Retries: 10,
+	Delay:   2 * time.Second,
+	Backoff: DefaultBackoff,
+}
+
+// handleRebind parses `rebind [retries N|forever] [delay D] [backoff
+// BACKOFF...]`. The backoff takes the parameters of the backoff directive and
+// must come last.
+func (p *PortConfig) handleRebind(args []codf.ExprNode) error {
+	r := DefaultRebind
+	var (
+		rest    []codf.ExprNode
+		forever bool
+	)
+	for i := 0; i < len(args); i += 2 {
+		key, _ := codf.Word(args[i])
+		if key == "backoff" {
+			b, err := parseBackoff("rebind backoff", args[i+1:])
+			if err != nil {
+				return err
+			}
+			r.Backoff = b
+			break
+		}
+		if i+1 < len(args) && key == "retries" {
+			if w, ok := codf.Word(args[i+1]); ok && w == "forever" {
+				forever = true
+				continue
+			}
+		}
+		end := i + 2
+		if end > len(args) {
+			end = len(args)
+		}
+		rest = append(rest, args[i:end]...)
+	}
+
+	err := parseKwargs("rebind", rest, kwargs{
+		"retries": {dest: &r.Retries},
+		"delay":   {dest: &r.Delay},
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case r.Retries < 1:
+		return fmt.Errorf("rebind retries must be >= 1 or forever; got %d", r.Retries)
+	case r.Delay < 0:
+		return fmt.Errorf("rebind delay must be >= 0s; got %v", r.Delay)
+	}
+	if forever {
+		r.Retries = 0
+	}
+	p.Rebind = r
+	return nil
+}
+
+// handleOnBindFailure parses `on-bind-failure fatal|ignore|retry-forever`.
+func (p *PortConfig) handleOnBindFailure(args []codf.ExprNode) error {
+	var policy string
+	if err := parseArgs(args, &policy); err != nil {
+		return err
+	}
+	switch policy {
+	case bindFatal, bindIgnore, bindRetryForever:
+	default:
+		return fmt.Errorf("invalid bind failure policy %q; must be fatal, ignore, or retry-forever", policy)
+	}
+	p.OnBindFailure = policy
+	return nil
+}
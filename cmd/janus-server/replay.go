@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// replayMain runs `janus-server replay [-keep] DIR URL`, which sends the
+// spooled batches and write-ahead log segments in DIR to URL with a port's
+// default batching and backoff, deleting each file once it's delivered.
+func replayMain(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	keep := fs.Bool("keep", false, "Keep files after they're delivered")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: janus-server replay [-keep] DIR URL")
+	}
+
+	dir := fs.Arg(0)
+	forward, err := url.Parse(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	if isSRV(forward) {
+		err = validateSRV(forward)
+	} else if forward.Scheme != "http" && forward.Scheme != "https" {
+		err = fmt.Errorf("replay URL must be http or https; got %q", fs.Arg(1))
+	}
+	if err != nil {
+		return err
+	}
+
+	paths, err := replayFiles(dir)
+	if err != nil {
+		return err
+	} else if len(paths) == 0 {
+		glog.Infof("Nothing to replay in %s", dir)
+		return nil
+	}
+
+	cfg := NewPortConfig()
+	cfg.Forward = forward
+	stats := new(portStats)
+	flushes := new(flushHistory)
+	target, base := resolveUpstream(forward, cfg)
+	transport := &classifyTransport{
+		base:      base(),
+		port:      "replay->" + redactURL(forward).String(),
+		stats:     stats,
+		lockout:   &authLockout{threshold: cfg.AuthLockout},
+		lines:     newLineCounter(0, nil),
+		trace:     newBatchTracer(""),
+		flushes:   flushes,
+		bodyLimit: cfg.ErrorBodyLimit,
+	}
+	proxy := newProxy(cfg, target, transport)
+	proxy.Start(ctx, cfg.FlushInterval)
+
+	for i, path := range paths {
+		body, err := readReplayFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if len(body) > 0 {
+			if _, err := proxy.Write(body); err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			if err := proxy.Flush(withFlushID(ctx)); err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			if failed, _ := flushes.failures(1); failed > 0 {
+				return fmt.Errorf("%s: upstream did not accept the replayed batch; %d of %d files replayed", path, i, len(paths))
+			}
+		}
+
+		if !*keep {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+		glog.Infof("Replayed %s (%d bytes)", path, len(body))
+	}
+
+	s := stats.snapshot()
+	glog.Infof("Replayed %d files from %s in %d flushes", len(paths), dir, s.Flushes)
+	return nil
+}
+
+// replayFiles returns the spool and write-ahead log files in dir, oldest
+// first.
+func replayFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, fi := range infos {
+		if name := fi.Name(); !fi.IsDir() && (strings.HasSuffix(name, spoolFileExt) || strings.HasSuffix(name, walFileExt)) {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	// Both kinds of file are named by Unix nanoseconds, so names sort by time.
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// readReplayFile returns the line protocol in path. Spooled batches are
+// request bodies, which may be gzipped.
+func readReplayFile(path string) ([]byte, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil || len(body) < 2 || body[0] != 0x1f || body[1] != 0x8b {
+		return body, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
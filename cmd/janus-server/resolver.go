@@ -0,0 +1,189 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"go.spiff.io/codf"
+)
+
+// dns is the resolver used for listener addresses and upstream connections.
+var dns = newResolver()
+
+func init() {
+	status.Set("dns_lookups", &dns.lookups)
+	status.Set("dns_cache_hits", &dns.hits)
+	status.Set("dns_lookup_failures", &dns.failures)
+}
+
+// DNSConfig configures host overrides and caching for name resolution.
+type DNSConfig struct {
+	TTL   time.Duration       `codf:"ttl,min=0"` // How long to cache lookups; 0 disables caching
+	Hosts map[string][]string // Static addresses for hosts
+}
+
+var _ codf.Walker = (*DNSConfig)(nil)
+
+func (d *DNSConfig) Statement(stmt *codf.Statement) error {
+	if ok, err := bindStatement(d, stmt); ok {
+		return err
+	}
+
+	switch name := stmt.Name(); name {
+	case "host":
+		return d.handleHost(stmt.Parameters())
+	default:
+		return fmt.Errorf("unrecognized directive %s", name)
+	}
+}
+
+func (d *DNSConfig) EnterSection(sect *codf.Section) (codf.Walker, error) {
+	return nil, fmt.Errorf("unrecognized section %s", sect.Name())
+}
+
+func (d *DNSConfig) handleHost(args []codf.ExprNode) error {
+	var (
+		host  string
+		addrs []string
+	)
+	if err := parseArgs(args, &host, &addrs); err != nil {
+		return err
+	}
+
+	for i, addr := range addrs {
+		if net.ParseIP(addr) == nil {
+			return argError(i+1, args[i+1], fmt.Errorf("invalid IP address %q", addr))
+		}
+	}
+
+	if d.Hosts == nil {
+		d.Hosts = map[string][]string{}
+	}
+	d.Hosts[host] = append(d.Hosts[host], addrs...)
+	return nil
+}
+
+type cachedHost struct {
+	addrs   []string
+	expires time.Time
+}
+
+// resolver looks up hosts using static overrides, then a TTL cache, and then
+// the system resolver. If a lookup fails and an expired cache entry exists,
+// the expired addresses are used.
+type resolver struct {
+	lookups  expvar.Int
+	hits     expvar.Int
+	failures expvar.Int
+
+	mu    sync.Mutex
+	cfg   DNSConfig
+	cache map[string]cachedHost
+}
+
+func newResolver() *resolver {
+	return &resolver{cache: map[string]cachedHost{}}
+}
+
+// configure replaces the resolver's overrides and TTL and clears its cache.
+func (r *resolver) configure(cfg DNSConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cfg = cfg
+	r.cache = map[string]cachedHost{}
+}
+
+func (r *resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	r.mu.Lock()
+	if addrs, ok := r.cfg.Hosts[host]; ok {
+		r.mu.Unlock()
+		return addrs, nil
+	}
+	cached, ok := r.cache[host]
+	ttl := r.cfg.TTL
+	r.mu.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		r.hits.Add(1)
+		return cached.addrs, nil
+	}
+
+	r.lookups.Add(1)
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		r.failures.Add(1)
+		if ok {
+			glog.Warningf("Lookup of %s failed, using expired addresses: %v", host, err)
+			return cached.addrs, nil
+		}
+		return nil, err
+	}
+
+	if ttl > 0 {
+		r.mu.Lock()
+		r.cache[host] = cachedHost{addrs: addrs, expires: time.Now().Add(ttl)}
+		r.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+// ResolveUDPAddr is net.ResolveUDPAddr using r to look up hosts.
+func (r *resolver) ResolveUDPAddr(network, hostport string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil || host == "" || net.ParseIP(host) != nil {
+		return net.ResolveUDPAddr(network, hostport)
+	}
+
+	addrs, err := r.LookupHost(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		switch {
+		case ip == nil:
+		case network == "udp4" && ip.To4() == nil:
+		case network == "udp6" && ip.To4() != nil:
+		default:
+			return net.ResolveUDPAddr(network, net.JoinHostPort(addr, port))
+		}
+	}
+	return nil, fmt.Errorf("no %s address found for %s", network, host)
+}
+
+// DialContext dials address, trying each address of its host in turn.
+func (r *resolver) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	d := net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.spiff.io/codf"
+)
+
+// retryBuckets is the number of buckets a retry budget's window is split
+// into. The window slides a bucket at a time.
+const retryBuckets = 10
+
+// RetryBudgetConfig limits retries to a fraction of a port's flushes over a
+// sliding window. Batches whose retries would exceed the budget are dropped.
+type RetryBudgetConfig struct {
+	Ratio  float64       // Retries allowed per flush; 0 disables the budget
+	Window time.Duration // Window that flushes and retries are counted over
+	Min    int           // Retries always allowed per window, however few flushes there were
+}
+
+// handleRetryBudget parses `retry-budget off` or
+// `retry-budget RATIO [window D] [min N]`.
+func (p *PortConfig) handleRetryBudget(args []codf.ExprNode) error {
+	if len(args) == 1 {
+		if w, ok := codf.Word(args[0]); ok && w == "off" {
+			p.RetryBudget = RetryBudgetConfig{}
+			return nil
+		}
+	}
+
+	b := RetryBudgetConfig{Window: time.Minute, Min: 10}
+	if err := parseArgsUpTo(args, &b.Ratio); err != nil {
+		return err
+	}
+	err := parseKwargs("retry-budget", args[1:], kwargs{
+		"window": {dest: &b.Window},
+		"min":    {dest: &b.Min},
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case b.Ratio <= 0 || b.Ratio > 1:
+		return fmt.Errorf("retry-budget ratio must be > 0 and <= 1; got %v", b.Ratio)
+	case b.Window < retryBuckets*time.Millisecond:
+		return fmt.Errorf("retry-budget window must be >= %v; got %v", retryBuckets*time.Millisecond, b.Window)
+	case b.Min < 0:
+		return fmt.Errorf("retry-budget min must be >= 0; got %d", b.Min)
+	}
+	p.RetryBudget = b
+	return nil
+}
+
+// retryBudget counts a port's flushes and retries over a sliding window.
+type retryBudget struct {
+	cfg RetryBudgetConfig
+
+	mu      sync.Mutex
+	buckets [retryBuckets]struct{ flushes, retries int }
+	cur     int       // Index of the current bucket
+	start   time.Time // When the current bucket began
+}
+
+func newRetryBudget(cfg RetryBudgetConfig) *retryBudget {
+	return &retryBudget{cfg: cfg, start: time.Now()}
+}
+
+// advance moves to the bucket covering now, clearing buckets that have left
+// the window. Must be called with b.mu held.
+func (b *retryBudget) advance(now time.Time) {
+	width := b.cfg.Window / retryBuckets
+	for n := 0; now.Sub(b.start) >= width; n++ {
+		if n >= retryBuckets {
+			b.start = now // Idle for the whole window; everything is clear
+			break
+		}
+		b.cur = (b.cur + 1) % retryBuckets
+		b.buckets[b.cur].flushes, b.buckets[b.cur].retries = 0, 0
+		b.start = b.start.Add(width)
+	}
+}
+
+// flush counts the first attempt of a batch.
+func (b *retryBudget) flush() {
+	b.mu.Lock()
+	b.advance(time.Now())
+	b.buckets[b.cur].flushes++
+	b.mu.Unlock()
+}
+
+// retry reports whether a retry is within the budget, counting it if so.
+func (b *retryBudget) retry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(time.Now())
+
+	var flushes, retries int
+	for _, bucket := range b.buckets {
+		flushes += bucket.flushes
+		retries += bucket.retries
+	}
+	if allowed := int(b.cfg.Ratio * float64(flushes)); retries >= b.cfg.Min && retries >= allowed {
+		return false
+	}
+	b.buckets[b.cur].retries++
+	return true
+}
+
+// maxRetryAfter bounds how long a batch waits for an upstream's Retry-After.
+const maxRetryAfter = 5 * time.Minute
+
+// classSet is a set of error classes, as a bit per class.
+type classSet uint
+
+func (s classSet) has(class errorClass) bool { return s&(1<<uint(class)) != 0 }
+
+// allClasses holds every error class.
+const allClasses = classSet(1<<numErrorClasses - 1)
+
+// defaultDropOn holds the classes of failed flushes dropped by default:
+// schema errors fail the same way however often they're sent.
+const defaultDropOn = classSet(1 << classSchema)
+
+// handleRetryOn parses `retry-on all`, `retry-on none`, or
+// `retry-on CLASS...`. Failed flushes of other classes are dropped rather
+// than retried.
+func (p *PortConfig) handleRetryOn(args []codf.ExprNode) error {
+	if len(args) == 0 {
+		return errors.New("retry-on requires at least one error class")
+	}
+
+	var retried classSet
+	for i, arg := range args {
+		name, ok := codf.Word(arg)
+		if !ok {
+			return argError(i, arg, errors.New("expected an error class"))
+		}
+		switch name {
+		case "all":
+			retried = allClasses
+			continue
+		case "none":
+			continue
+		}
+		class := errorClass(-1)
+		for c, cname := range errorClassNames {
+			if cname == name {
+				class = errorClass(c)
+			}
+		}
+		if class < 0 {
+			return argError(i, arg, fmt.Errorf("invalid error class %q", name))
+		}
+		retried |= 1 << uint(class)
+	}
+	p.DropOn = allClasses &^ retried
+	return nil
+}
+
+// retryAfter returns how long resp asks for retries to wait, up to
+// maxRetryAfter, or 0 if it doesn't say.
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = time.Until(t)
+	}
+	switch {
+	case d < 0:
+		return 0
+	case d > maxRetryAfter:
+		return maxRetryAfter
+	}
+	return d
+}
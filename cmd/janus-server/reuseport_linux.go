@@ -0,0 +1,21 @@
+package main
+
+import "syscall"
+
+// reusePortSupported is true where listeners can be bound with SO_REUSEPORT.
+const reusePortSupported = true
+
+// soReusePort is SO_REUSEPORT from asm-generic/socket.h, which package syscall
+// does not define for Linux.
+const soReusePort = 0xf
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// rollupInterval is the width of each rollup.
+const rollupInterval = time.Minute
+
+// rollup holds the change in a port's counters over one rollupInterval.
+type rollup struct {
+	Start    time.Time         `json:"start"`
+	Counters map[string]uint64 `json:"counters"`
+}
+
+// rollupRing retains a fixed number of a port's most recent rollups.
+type rollupRing struct {
+	mu    sync.Mutex
+	slots []rollup
+	next  int
+	full  bool
+}
+
+func newRollupRing(size int) *rollupRing {
+	if size < 1 {
+		size = 1
+	}
+	return &rollupRing{slots: make([]rollup, size)}
+}
+
+func (r *rollupRing) add(ru rollup) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.slots[r.next] = ru
+	r.next = (r.next + 1) % len(r.slots)
+	r.full = r.full || r.next == 0
+}
+
+// list returns the ring's rollups, oldest first.
+func (r *rollupRing) list() []rollup {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]rollup(nil), r.slots[:r.next]...)
+	}
+	return append(append([]rollup(nil), r.slots[r.next:]...), r.slots[:r.next]...)
+}
+
+// rollupSlots returns the number of rollups to keep for a retention period.
+func rollupSlots(retention time.Duration) int {
+	return int(retention / rollupInterval)
+}
+
+// rollup records a rollup of every running gateway's counters each
+// rollupInterval until ctx is done. Rollups are kept per port, so a port's
+// history survives its gateway being replaced by a reload.
+func (s *server) rollup(ctx context.Context) {
+	ticker := time.NewTicker(rollupInterval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for {
+		var t time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case t = <-ticker.C:
+		}
+
+		s.mu.Lock()
+		if s.config.RollupRetention <= 0 {
+			s.mu.Unlock()
+			start = t
+			continue
+		}
+
+		for key, g := range s.gateways {
+			fields := g.stats.snapshot().fields()
+			delta := make(map[string]uint64, len(fields))
+			for name, n := range fields {
+				delta[name] = n - g.rolled[name]
+			}
+			g.rolled = fields
+
+			ring := s.rollups[key]
+			if ring == nil {
+				ring = newRollupRing(rollupSlots(s.config.RollupRetention))
+				s.rollups[key] = ring
+			}
+			ring.add(rollup{Start: start, Counters: delta})
+		}
+		s.mu.Unlock()
+		start = t
+	}
+}
+
+// portRollups returns the retained rollups of each port.
+func (s *server) portRollups() map[string][]rollup {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rollups := make(map[string][]rollup, len(s.rollups))
+	for key, ring := range s.rollups {
+		rollups[key] = ring.list()
+	}
+	return rollups
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"go.spiff.io/codf"
+	"go.spiff.io/dagr/outflux"
+)
+
+// RouteConfig sends lines whose measurements match any of its patterns to
+// another upstream, or to the port's upstream with different query
+// parameters.
+type RouteConfig struct {
+	Name      string
+	Match     []string // Measurement patterns, as used by path.Match
+	Forward   *url.URL `codf:"pass"`      // Upstream of the route; the port's if nil
+	DB        string   `codf:"db"`        // Overrides the db parameter, if set
+	RP        string   `codf:"rp"`        // Overrides the rp parameter, if set
+	Precision string   `codf:"precision"` // Overrides the precision parameter, if set
+}
+
+var _ codf.WalkExiter = (*RouteConfig)(nil)
+
+func (r *RouteConfig) Statement(stmt *codf.Statement) error {
+	if ok, err := bindStatement(r, stmt); ok {
+		return err
+	}
+
+	switch name := stmt.Name(); name {
+	case "match":
+		return r.handleMatch(stmt.Parameters())
+	default:
+		return fmt.Errorf("unrecognized directive %s", name)
+	}
+}
+
+func (r *RouteConfig) EnterSection(sect *codf.Section) (codf.Walker, error) {
+	return nil, fmt.Errorf("unrecognized section %s", sect.Name())
+}
+
+func (r *RouteConfig) ExitSection(codf.Walker, *codf.Section, codf.ParentNode) error {
+	switch {
+	case len(r.Match) == 0:
+		return fmt.Errorf("route %s requires at least one match pattern", r.Name)
+	case r.Forward == nil && r.DB == "" && r.RP == "" && r.Precision == "":
+		return fmt.Errorf("route %s requires a forwarding URL, db, rp, or precision", r.Name)
+	case r.Forward != nil && isSRV(r.Forward):
+		return validateSRV(r.Forward)
+	}
+
+	switch r.Precision {
+	case "", "h", "m", "s", "ms", "u", "us", "ns":
+	default:
+		return fmt.Errorf("invalid route precision %q; must be h, m, s, ms, us, or ns", r.Precision)
+	}
+	return nil
+}
+
+// upstream returns the route's forwarding URL, which is forward, the port's,
+// if the route doesn't set one, with any overridden parameters replaced.
+func (r *RouteConfig) upstream(forward *url.URL) *url.URL {
+	if r.Forward != nil {
+		forward = r.Forward
+	}
+	dup := *forward
+	params := dup.Query()
+	for key, value := range map[string]string{"db": r.DB, "rp": r.RP, "precision": r.Precision} {
+		if value != "" {
+			params.Set(key, value)
+		}
+	}
+	dup.RawQuery = params.Encode()
+	return &dup
+}
+
+// handleMatch parses `match PATTERN...`. It may be given more than once.
+func (r *RouteConfig) handleMatch(args []codf.ExprNode) error {
+	var patterns []string
+	if err := parseArgs(args, &patterns); err != nil {
+		return err
+	}
+	if len(patterns) == 0 {
+		return errors.New("match requires at least one pattern")
+	}
+	for i, pat := range patterns {
+		if _, err := path.Match(pat, ""); err != nil {
+			return argError(i, args[i], fmt.Errorf("invalid pattern %q: %v", pat, err))
+		}
+	}
+	r.Match = append(r.Match, patterns...)
+	return nil
+}
+
+// enterRoute begins a route section named by its parameter.
+func (p *PortConfig) enterRoute(args []codf.ExprNode) (codf.Walker, error) {
+	route := new(RouteConfig)
+	if err := parseArgs(args, &route.Name); err != nil {
+		return nil, err
+	}
+	for _, r := range p.Routes {
+		if r.Name == route.Name {
+			return nil, fmt.Errorf("route %s is already defined", route.Name)
+		}
+	}
+	p.Routes = append(p.Routes, route)
+	return route, nil
+}
+
+// matches reports whether the escaped measurement name matches any of the
+// route's patterns.
+func (r *RouteConfig) matches(name string) bool {
+	for _, pat := range r.Match {
+		if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// routeTarget is a route and the proxy sending its lines upstream. If the
+// route's precision differs from the port's, timestamps are converted from
+// the port's unit to the route's.
+type routeTarget struct {
+	cfg      *RouteConfig
+	proxy    *outflux.Proxy
+	from, to time.Duration
+}
+
+func newRouteTarget(cfg *RouteConfig, port, route *url.URL, proxy *outflux.Proxy) *routeTarget {
+	return &routeTarget{
+		cfg:   cfg,
+		proxy: proxy,
+		from:  precisionUnit(port),
+		to:    precisionUnit(route),
+	}
+}
+
+// appendLine appends line to dst with its timestamp, if any, converted to
+// the route's precision.
+func (r *routeTarget) appendLine(dst, line []byte) []byte {
+	if r.from == r.to {
+		return append(dst, line...)
+	}
+	ts, start, ok := lineTimestamp(bytes.TrimRight(line, " \t\r"))
+	if !ok {
+		return append(dst, line...)
+	}
+	n, err := strconv.ParseInt(string(ts), 10, 64)
+	if err != nil {
+		return append(dst, line...)
+	}
+
+	t := unixIn(n, r.from)
+	if r.to >= time.Second {
+		n = t.Unix() / int64(r.to/time.Second)
+	} else {
+		n = t.UnixNano() / int64(r.to)
+	}
+	dst = append(dst, line[:start]...)
+	return strconv.AppendInt(dst, n, 10)
+}
+
+// routeStage sends each line to the first route matching its measurement.
+// Lines matching no route are passed on to the port's upstream.
+type routeStage struct {
+	routes []*routeTarget
+	stats  *portStats
+	dead   *deadLetter
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (st *routeStage) apply(dst, line []byte) []byte {
+	end := measurementEnd(line)
+	if end == -1 {
+		return append(dst, line...)
+	}
+
+	name := string(line[:end])
+	for _, r := range st.routes {
+		if !r.cfg.matches(name) {
+			continue
+		}
+
+		st.mu.Lock()
+		st.buf = append(r.appendLine(st.buf[:0], line), '\n')
+		_, err := r.proxy.Write(st.buf)
+		st.mu.Unlock()
+		if err != nil {
+			glog.Errorf("Unable to write to route %s: %v", r.cfg.Name, err)
+			st.stats.addDrop()
+			st.dead.add(deadRoute, line)
+		} else {
+			st.stats.addRouted(1)
+		}
+		return dst
+	}
+	return append(dst, line...)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+
+	"go.spiff.io/codf"
+)
+
+// SampleConfig limits a port to forwarding a fraction of its payloads.
+type SampleConfig struct {
+	Rate  float64 // Probability of forwarding a payload; 0 disables sampling
+	Every int     // Forward every Nth payload instead, if > 0
+}
+
+// handleSample parses `sample FRACTION` or `sample every N`.
+func (p *PortConfig) handleSample(args []codf.ExprNode) error {
+	var s SampleConfig
+	if len(args) == 2 {
+		var kw string
+		if err := parseArgs(args, &kw, &s.Every); err != nil {
+			return err
+		} else if kw != "every" {
+			return argError(0, args[0], fmt.Errorf("expected every; got %s", kw))
+		} else if s.Every < 1 {
+			return fmt.Errorf("sample every must be >= 1; got %d", s.Every)
+		}
+		p.Sample = s
+		return nil
+	}
+
+	if err := parseArgs(args, &s.Rate); err != nil {
+		return err
+	} else if s.Rate <= 0 || s.Rate > 1 {
+		return fmt.Errorf("sample fraction must be > 0 and <= 1; got %v", s.Rate)
+	}
+	p.Sample = s
+	return nil
+}
+
+// enabled reports whether any payloads are sampled out.
+func (s SampleConfig) enabled() bool {
+	return s.Every > 1 || (s.Rate > 0 && s.Rate < 1)
+}
+
+// sampler decides which payloads a port forwards. It's shared by the port's
+// listeners.
+type sampler struct {
+	cfg SampleConfig
+	n   uint64 // Payloads seen, for every-N sampling; accessed atomically
+}
+
+// keep reports whether the next payload is forwarded.
+func (s *sampler) keep() bool {
+	if s.cfg.Every > 0 {
+		return (atomic.AddUint64(&s.n, 1)-1)%uint64(s.cfg.Every) == 0
+	}
+	return rand.Float64() < s.cfg.Rate
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/golang/glog"
+
+	"go.spiff.io/codf"
+	"go.spiff.io/dagr/outflux"
+)
+
+// Policies for lines violating a port's schema.
+const (
+	schemaDrop       = "drop"       // Drop the line
+	schemaQuarantine = "quarantine" // Forward the line to another database
+)
+
+// Line protocol field types.
+const (
+	fieldFloat    = "float"
+	fieldInteger  = "integer"
+	fieldUnsigned = "unsigned"
+	fieldString   = "string"
+	fieldBoolean  = "boolean"
+)
+
+// SchemaConfig describes the points a port accepts. Measurements, tag keys,
+// and field keys are matched escaped, as they appear in line protocol.
+type SchemaConfig struct {
+	Tags         []schemaTags  // Tags required of matching measurements
+	Fields       []schemaField // Types allowed of matching fields
+	OnViolation  string        // Violation policy
+	QuarantineDB string        // Database to quarantine lines in
+}
+
+// schemaTags requires tags of measurements matching a pattern.
+type schemaTags struct {
+	Match string // Measurement pattern, as used by path.Match
+	Tags  []string
+}
+
+// schemaField restricts the types of fields matching a pattern, in
+// measurements matching a pattern.
+type schemaField struct {
+	Match string // Measurement pattern, as used by path.Match
+	Field string // Field key pattern, as used by path.Match
+	Types []string
+}
+
+var _ codf.WalkExiter = (*SchemaConfig)(nil)
+
+func (s *SchemaConfig) Statement(stmt *codf.Statement) error {
+	switch name := stmt.Name(); name {
+	case "require-tags":
+		return s.handleRequireTags(stmt.Parameters())
+	case "field-type":
+		return s.handleFieldType(stmt.Parameters())
+	case "on-violation":
+		return s.handleOnViolation(stmt.Parameters())
+	default:
+		return fmt.Errorf("unrecognized directive %s", name)
+	}
+}
+
+func (s *SchemaConfig) EnterSection(sect *codf.Section) (codf.Walker, error) {
+	return nil, fmt.Errorf("unrecognized section %s", sect.Name())
+}
+
+func (s *SchemaConfig) ExitSection(codf.Walker, *codf.Section, codf.ParentNode) error {
+	if len(s.Tags) == 0 && len(s.Fields) == 0 {
+		return errors.New("schema requires at least one require-tags or field-type")
+	}
+	return nil
+}
+
+// handleRequireTags parses `require-tags PATTERN TAG...`. It may be given more
+// than once.
+func (s *SchemaConfig) handleRequireTags(args []codf.ExprNode) error {
+	var (
+		rule schemaTags
+		tags []string
+	)
+	if err := parseArgs(args, &rule.Match, &tags); err != nil {
+		return err
+	} else if _, err := path.Match(rule.Match, ""); err != nil {
+		return argError(0, args[0], fmt.Errorf("invalid pattern %q: %v", rule.Match, err))
+	}
+	for _, tag := range tags {
+		rule.Tags = append(rule.Tags, tagEscaper.Replace(tag))
+	}
+	s.Tags = append(s.Tags, rule)
+	return nil
+}
+
+// handleFieldType parses `field-type PATTERN FIELD TYPE...`. It may be given
+// more than once.
+func (s *SchemaConfig) handleFieldType(args []codf.ExprNode) error {
+	var rule schemaField
+	if err := parseArgs(args, &rule.Match, &rule.Field, &rule.Types); err != nil {
+		return err
+	}
+	for i, pat := range []string{rule.Match, rule.Field} {
+		if _, err := path.Match(pat, ""); err != nil {
+			return argError(i, args[i], fmt.Errorf("invalid pattern %q: %v", pat, err))
+		}
+	}
+	for i, typ := range rule.Types {
+		switch typ {
+		case fieldFloat, fieldInteger, fieldUnsigned, fieldString, fieldBoolean:
+		default:
+			return argError(i+2, args[i+2], fmt.Errorf("invalid field type %q; must be float, integer, unsigned, string, or boolean", typ))
+		}
+	}
+	s.Fields = append(s.Fields, rule)
+	return nil
+}
+
+// handleOnViolation parses `on-violation drop` or `on-violation quarantine db
+// NAME`.
+func (s *SchemaConfig) handleOnViolation(args []codf.ExprNode) error {
+	var policy, db string
+	if err := parseArgsUpTo(args, &policy); err != nil {
+		return err
+	}
+	err := parseKwargs("on-violation", args[1:], kwargs{
+		"db": {dest: &db},
+	})
+	if err != nil {
+		return err
+	}
+
+	switch policy {
+	case schemaDrop:
+		if db != "" {
+			return fmt.Errorf("on-violation db is only allowed with %s", schemaQuarantine)
+		}
+	case schemaQuarantine:
+		if db == "" {
+			return fmt.Errorf("on-violation %s requires a db", schemaQuarantine)
+		}
+	default:
+		return fmt.Errorf("invalid schema violation policy %q; must be drop or quarantine", policy)
+	}
+	s.OnViolation, s.QuarantineDB = policy, db
+	return nil
+}
+
+// enterSchema begins a port's schema section, which takes no parameters.
+func (p *PortConfig) enterSchema(args []codf.ExprNode) (codf.Walker, error) {
+	if len(args) > 0 {
+		return nil, errors.New("schema takes no parameters")
+	}
+	if p.Schema != nil {
+		return nil, errors.New("schema is already defined")
+	}
+	p.Schema = &SchemaConfig{OnViolation: schemaDrop}
+	return p.Schema, nil
+}
+
+// clone returns a deep copy of s.
+func (s *SchemaConfig) clone() *SchemaConfig {
+	dup := *s
+	dup.Tags = make([]schemaTags, len(s.Tags))
+	for i, rule := range s.Tags {
+		rule.Tags = append([]string(nil), rule.Tags...)
+		dup.Tags[i] = rule
+	}
+	dup.Fields = make([]schemaField, len(s.Fields))
+	for i, rule := range s.Fields {
+		rule.Types = append([]string(nil), rule.Types...)
+		dup.Fields[i] = rule
+	}
+	return &dup
+}
+
+// violation returns why line violates the schema, or an empty string if it
+// doesn't. Lines without a field set are left for the upstream to reject.
+func (s *SchemaConfig) violation(line []byte) string {
+	end := keyEnd(line)
+	mend := measurementEnd(line)
+	if end == -1 || mend == -1 {
+		return ""
+	}
+	name := string(line[:mend])
+
+	var tags map[string]bool
+	for _, rule := range s.Tags {
+		if ok, _ := path.Match(rule.Match, name); !ok {
+			continue
+		}
+		if tags == nil {
+			tags = lineTagKeys(line[mend:end])
+		}
+		for _, tag := range rule.Tags {
+			if !tags[tag] {
+				return "missing tag " + tag
+			}
+		}
+	}
+
+	if len(s.Fields) == 0 {
+		return ""
+	}
+	for _, pair := range splitFields(line[end+1 : fieldsEnd(line, end+1)]) {
+		eq := unescapedIndex(pair, '=')
+		if eq == -1 {
+			continue
+		}
+		key, typ := string(pair[:eq]), fieldType(pair[eq+1:])
+		for _, rule := range s.Fields {
+			if ok, _ := path.Match(rule.Match, name); !ok {
+				continue
+			}
+			if ok, _ := path.Match(rule.Field, key); ok && !hasString(rule.Types, typ) {
+				return "field " + key + " is " + typ
+			}
+		}
+	}
+	return ""
+}
+
+// lineTagKeys returns the escaped keys of a line protocol tag set, including
+// its leading comma.
+func lineTagKeys(set []byte) map[string]bool {
+	keys := map[string]bool{}
+	for len(set) > 0 {
+		set = set[1:]
+		end := unescapedIndex(set, ',')
+		if end == -1 {
+			end = len(set)
+		}
+		if eq := unescapedIndex(set[:end], '='); eq != -1 {
+			keys[string(set[:eq])] = true
+		}
+		set = set[end:]
+	}
+	return keys
+}
+
+// fieldType returns the type of a line protocol field value.
+func fieldType(value []byte) string {
+	switch {
+	case len(value) == 0:
+		return fieldFloat
+	case value[0] == '"':
+		return fieldString
+	case value[len(value)-1] == 'i':
+		return fieldInteger
+	case value[len(value)-1] == 'u':
+		return fieldUnsigned
+	}
+	switch string(bytes.ToLower(value)) {
+	case "t", "true", "f", "false":
+		return fieldBoolean
+	}
+	return fieldFloat
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaStage drops or quarantines lines violating a port's schema.
+type schemaStage struct {
+	cfg        *SchemaConfig
+	stats      *portStats
+	quarantine *outflux.Proxy
+	dead       *deadLetter
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (st *schemaStage) apply(dst, line []byte) []byte {
+	why := st.cfg.violation(line)
+	if why == "" {
+		return append(dst, line...)
+	}
+
+	st.stats.addSchemaViolation()
+	if glog.V(2) {
+		glog.Infof("Schema violation, %s: %q", why, line)
+	}
+	if st.cfg.OnViolation != schemaQuarantine {
+		st.stats.addDrop()
+		st.dead.add(deadSchema, line)
+		return dst
+	}
+
+	st.mu.Lock()
+	st.buf = append(append(st.buf[:0], line...), '\n')
+	_, err := st.quarantine.Write(st.buf)
+	st.mu.Unlock()
+	if err != nil {
+		glog.Errorf("Unable to quarantine line in db %s: %v", st.cfg.QuarantineDB, err)
+	}
+	return dst
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/golang/glog"
+
+	"go.spiff.io/codf"
+	"go.starlark.net/starlark"
+)
+
+// ScriptConfig is a Starlark script that transforms a port's payloads. The
+// script's source is read with the config, so a reload picks up changes to
+// it.
+type ScriptConfig struct {
+	Path   string // Empty if the port has no script
+	Source string
+}
+
+// handleScript parses `script off` or `script PATH`.
+func (p *PortConfig) handleScript(args []codf.ExprNode) error {
+	var path string
+	if err := parseArgs(args, &path); err != nil {
+		return err
+	}
+	if w, ok := codf.Word(args[0]); ok && w == "off" {
+		p.Script = ScriptConfig{}
+		return nil
+	}
+	if path == "" {
+		return errors.New("script path must not be empty")
+	}
+
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	p.Script = ScriptConfig{Path: path, Source: string(src)}
+	return nil
+}
+
+// scriptFunc is the function a port's script must define. It's called with
+// each payload and returns what to do with it.
+const scriptFunc = "transform"
+
+// scriptTimeout is how long a script may run, when loaded or for a single
+// payload, before it's cancelled. A script can loop over a large range, so
+// without a limit it could hold a write worker forever.
+const scriptTimeout = time.Second
+
+// scriptHook runs each payload of a port, once it has passed through the
+// port's stages, through the transform function of the port's script:
+//
+//	def transform(payload):
+//	    return payload              # Send it, possibly modified
+//	    return None                 # Drop it
+//	    return ("archive", payload) # Send it to the route named archive
+//
+// Payloads are line protocol, one or more lines each. The script's globals
+// are frozen once it has run, so calls can't share state and may run
+// concurrently. A call running past its timeout is cancelled and counts as a
+// script error.
+type scriptHook struct {
+	path    string
+	fn      starlark.Value
+	timeout time.Duration
+	routes  map[string]*routeTarget
+	stats   *portStats
+	dead    *deadLetter
+}
+
+// newScriptHook runs the script of cfg and returns a hook calling its
+// transform function. Payloads may be re-routed to any of routes.
+func newScriptHook(cfg ScriptConfig, routes []*routeTarget, stats *portStats, dead *deadLetter) (*scriptHook, error) {
+	thread := &starlark.Thread{Name: "script " + cfg.Path, Print: scriptPrint}
+	timer := cancelAfter(thread, scriptTimeout)
+	globals, err := starlark.ExecFile(thread, cfg.Path, cfg.Source, nil)
+	timer.Stop()
+	if err != nil {
+		return nil, fmt.Errorf("unable to run script %s: %v", cfg.Path, err)
+	}
+	globals.Freeze()
+
+	fn, ok := globals[scriptFunc].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("script %s must define a function %s(payload)", cfg.Path, scriptFunc)
+	}
+
+	h := &scriptHook{
+		path:    cfg.Path,
+		fn:      fn,
+		timeout: scriptTimeout,
+		routes:  make(map[string]*routeTarget, len(routes)),
+		stats:   stats,
+		dead:    dead,
+	}
+	for _, r := range routes {
+		h.routes[r.cfg.Name] = r
+	}
+	return h, nil
+}
+
+// cancelAfter cancels thread once d has passed, unless the returned timer is
+// stopped first.
+func cancelAfter(thread *starlark.Thread, d time.Duration) *time.Timer {
+	return time.AfterFunc(d, func() {
+		thread.Cancel(fmt.Sprintf("ran longer than %v", d))
+	})
+}
+
+// scriptPrint logs what a script prints.
+func scriptPrint(thread *starlark.Thread, msg string) {
+	glog.Infof("%s: %s", thread.Name, msg)
+}
+
+// run passes payload to the script and returns the payload to send, or nil
+// if the script dropped or re-routed it, or failed.
+func (h *scriptHook) run(payload []byte) []byte {
+	thread := &starlark.Thread{Name: "script " + h.path, Print: scriptPrint}
+	timer := cancelAfter(thread, h.timeout)
+	result, err := starlark.Call(thread, h.fn, starlark.Tuple{starlark.String(payload)}, nil)
+	timer.Stop()
+	if err != nil {
+		if e, ok := err.(*starlark.EvalError); ok {
+			err = errors.New(e.Backtrace())
+		}
+		return h.fail(payload, err)
+	}
+
+	switch result := result.(type) {
+	case starlark.NoneType:
+		h.stats.addScriptDropped()
+		return nil
+	case starlark.String:
+		return withNewline(result)
+	case starlark.Tuple:
+		if len(result) == 2 {
+			name, okName := starlark.AsString(result[0])
+			body, okBody := result[1].(starlark.String)
+			if okName && okBody {
+				h.route(name, withNewline(body), payload)
+				return nil
+			}
+		}
+	}
+	return h.fail(payload, fmt.Errorf("%s returned %s; must return a string, None, or a (route, string) tuple", scriptFunc, result.Type()))
+}
+
+// route writes payload, returned by the script for the original payload, to
+// the route named name.
+func (h *scriptHook) route(name string, payload, orig []byte) {
+	r, ok := h.routes[name]
+	if !ok {
+		h.fail(orig, fmt.Errorf("%s returned undefined route %q", scriptFunc, name))
+		return
+	}
+
+	lines := appendLines(nil, payload, r.appendLine)
+	if _, err := r.proxy.Write(lines); err != nil {
+		glog.Errorf("Unable to write to route %s: %v", name, err)
+		h.stats.addDrop()
+		h.dead.add(deadRoute, payload)
+		return
+	}
+	h.stats.addRouted(countLines(lines))
+}
+
+// fail drops payload after the script failed to handle it.
+func (h *scriptHook) fail(payload []byte, err error) []byte {
+	h.stats.addScriptError()
+	h.dead.add(deadScript, payload)
+	if glog.V(1) {
+		glog.Warningf("Dropping payload; script %s failed: %v", h.path, err)
+	}
+	return nil
+}
+
+// withNewline returns s, ending with a newline.
+func withNewline(s starlark.String) []byte {
+	b := []byte(s)
+	if len(b) > 0 && !bytes.HasSuffix(b, []byte{'\n'}) {
+		b = append(b, '\n')
+	}
+	return b
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScriptHookRun(t *testing.T) {
+	const src = `
+def transform(payload):
+    if payload.startswith("drop"):
+        return None
+    if payload.startswith("bad"):
+        return 1
+    if payload.startswith("loop"):
+        for i in range(2000000000):
+            pass
+    return payload.replace("cpu", "cpu_total").rstrip("\n")
+`
+	stats := new(portStats)
+	h, err := newScriptHook(ScriptConfig{Path: "test.star", Source: src}, nil, stats, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.timeout = 10 * time.Millisecond
+
+	if got, want := string(h.run([]byte("cpu value=1\n"))), "cpu_total value=1\n"; got != want {
+		t.Errorf("run = %q; want %q", got, want)
+	}
+	if got := h.run([]byte("drop value=1\n")); got != nil {
+		t.Errorf("run dropped = %q; want nil", got)
+	}
+	if got := h.run([]byte("bad value=1\n")); got != nil {
+		t.Errorf("run bad result = %q; want nil", got)
+	}
+
+	start := time.Now()
+	if got := h.run([]byte("loop value=1\n")); got != nil {
+		t.Errorf("run loop = %q; want nil", got)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("run loop took %v; want it cancelled after %v", d, h.timeout)
+	}
+
+	if s := stats.snapshot(); s.ScriptDropped != 1 || s.ScriptErrors != 2 {
+		t.Errorf("script_dropped = %d, script_errors = %d; want 1, 2", s.ScriptDropped, s.ScriptErrors)
+	}
+}
+
+func TestNewScriptHookInvalid(t *testing.T) {
+	for _, src := range []string{
+		"x = ",
+		"def other(payload):\n    return payload\n",
+		"transform = 1\n",
+	} {
+		if _, err := newScriptHook(ScriptConfig{Path: "test.star", Source: src}, nil, new(portStats), nil); err == nil {
+			t.Errorf("%q: want error", src)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// selfReportMeasurement is the measurement name used for points written by
+// a port reporting on itself.
+const selfReportMeasurement = "janus_port"
+
+// selfReport periodically writes the gateway's own counters into its proxy as
+// line protocol until ctx is done.
+func (g *gateway) selfReport(ctx context.Context, interval time.Duration) {
+	host := instance.id()
+
+	listen := make([]string, len(g.cfg.Listen))
+	for i, addr := range g.cfg.Listen {
+		listen[i] = addr.String()
+	}
+
+	var prefix bytes.Buffer
+	prefix.WriteString(selfReportMeasurement)
+	if host != "" {
+		prefix.WriteString(",host=")
+		prefix.WriteString(tagEscaper.Replace(host))
+	}
+	prefix.WriteString(",listen=")
+	prefix.WriteString(tagEscaper.Replace(strings.Join(listen, " ")))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var buf bytes.Buffer
+	for {
+		var t time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case t = <-ticker.C:
+		}
+
+		fields := g.stats.snapshot().fields()
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf.Reset()
+		buf.Write(prefix.Bytes())
+		for i, key := range keys {
+			if i == 0 {
+				buf.WriteByte(' ')
+			} else {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(key)
+			buf.WriteByte('=')
+			buf.WriteString(strconv.FormatUint(fields[key], 10))
+			buf.WriteByte('i')
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(timestamp(g.cfg.Forward, t), 10))
+		buf.WriteByte('\n')
+
+		if _, err := g.out.Write(buf.Bytes()); err != nil {
+			glog.Errorf("Unable to write self-report for %v: %v", g, err)
+		}
+	}
+}
+
+// timestamp returns t as an integer timestamp in the precision requested by
+// the forward URL's precision parameter, defaulting to nanoseconds.
+func timestamp(forward *url.URL, t time.Time) int64 {
+	switch forward.Query().Get("precision") {
+	case "h":
+		return t.Unix() / 3600
+	case "m":
+		return t.Unix() / 60
+	case "s":
+		return t.Unix()
+	case "ms":
+		return t.UnixNano() / int64(time.Millisecond)
+	case "u", "us":
+		return t.UnixNano() / int64(time.Microsecond)
+	default:
+		return t.UnixNano()
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+var (
+	selfTest        = flag.Bool("selftest", false, "Send a test point through each port of the config to a fake upstream, then exit")
+	selfTestTimeout = flag.Duration("selftest-timeout", 10*time.Second, "How long -selftest waits for each port's test point to be flushed")
+)
+
+// selfTestMain loads the config in cfgfiles and checks that a test point sent
+// to each enabled port is flushed upstream. Each port is run on its own with
+// a single loopback listener, forwarding to an embedded fake upstream.
+// Stages that may route the point elsewhere or drop it on purpose (sampling,
+// quotas, budgets, routes, expected peers, and schemas) are disabled, as are
+// the write-ahead log, recording, and dead-lettering, which would touch the
+// port's files.
+func selfTestMain(ctx context.Context, cfgfiles []string) error {
+	config, err := loadConfig(cfgfiles)
+	if err != nil {
+		return err
+	}
+
+	upstream := newFakeUpstream()
+	defer upstream.Close()
+
+	tested := 0
+	for _, cfg := range config.Ports {
+		if !cfg.Enabled {
+			continue
+		}
+		if err := selfTestPort(ctx, cfg, upstream); err != nil {
+			return fmt.Errorf("%v: %v", describePort(cfg), err)
+		}
+		glog.Infof("Self-test passed for %v", describePort(cfg))
+		tested++
+	}
+	if tested == 0 {
+		return errors.New("no enabled ports to test")
+	}
+	return nil
+}
+
+func selfTestPort(ctx context.Context, orig *PortConfig, upstream *fakeUpstream) error {
+	cfg := orig.clone()
+
+	var tags []Tag
+	if len(cfg.Listen) > 0 {
+		tags = cfg.Listen[0].Tags
+	}
+	cfg.Listen = []*Addr{{Network: "udp", Addr: "127.0.0.1:0", Tags: tags}}
+
+	forward := *cfg.Forward
+	forward.Scheme, forward.Host, forward.User = "http", upstream.host, nil
+	cfg.Forward = &forward
+
+	cfg.Sample = SampleConfig{}
+	cfg.Quota = QuotaConfig{}
+	cfg.Budget = ""
+	cfg.Routes = nil
+	cfg.WAL = WALConfig{}
+	cfg.Record = ""
+	cfg.DeadLetter = DeadLetterConfig{}
+	cfg.SelfReport = false
+	cfg.Peers = PeersConfig{}
+	cfg.Schema = nil
+
+	g, err := newGateway(cfg, false, newByteLimiter(0), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *selfTestTimeout)
+	defer cancel()
+	errch := make(chan error, 1)
+	go func() { errch <- g.Start(ctx) }()
+
+	addr, err := selfTestAddr(ctx, g.in[0], errch)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(nonce)
+	if _, err := conn.Write(selfTestPayload(cfg.Protocol, id)); err != nil {
+		return err
+	}
+
+	// Flush until the point arrives, since it passes through the port's
+	// write queue before reaching the proxy.
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for !upstream.received(id) {
+		select {
+		case err := <-errch:
+			return fmt.Errorf("port stopped: %v", err)
+		case <-ctx.Done():
+			return fmt.Errorf("test point was not flushed within %v", *selfTestTimeout)
+		case <-ticker.C:
+		}
+		if err := g.out.Flush(withFlushID(ctx)); err != nil && ctx.Err() == nil {
+			return fmt.Errorf("flush failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// selfTestAddr waits for p to bind and returns its address.
+func selfTestAddr(ctx context.Context, p *porthole, errch <-chan error) (*net.UDPAddr, error) {
+	for {
+		p.mu.Lock()
+		conn := p.conn
+		p.mu.Unlock()
+		if conn != nil {
+			return conn.LocalAddr().(*net.UDPAddr), nil
+		}
+
+		select {
+		case err := <-errch:
+			return nil, fmt.Errorf("port stopped: %v", err)
+		case <-ctx.Done():
+			return nil, fmt.Errorf("listener did not bind within %v", *selfTestTimeout)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// selfTestPayload returns a test point in proto, tagged with id.
+func selfTestPayload(proto, id string) []byte {
+	switch proto {
+	case protoStatsd:
+		return []byte("janus_selftest:1|c|#selftest:" + id + "\n")
+	case protoGraphite:
+		return []byte("janus_selftest;selftest=" + id + " 1 -1\n")
+	case protoJSON:
+		return []byte(`{"measurement":"janus_selftest","tags":{"selftest":"` + id + `"},"fields":{"value":1}}`)
+	}
+	return []byte("janus_selftest,selftest=" + id + " value=1i\n")
+}
+
+// fakeUpstream accepts every batch written to it and keeps the bodies.
+type fakeUpstream struct {
+	*httptest.Server
+	host string
+
+	mu     sync.Mutex
+	bodies [][]byte
+}
+
+func newFakeUpstream() *fakeUpstream {
+	u := new(fakeUpstream)
+	u.Server = httptest.NewServer(http.HandlerFunc(u.serveHTTP))
+	if parsed, err := url.Parse(u.Server.URL); err == nil {
+		u.host = parsed.Host
+	}
+	return u
+}
+
+func (u *fakeUpstream) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err == nil && req.Header.Get("Content-Encoding") == "gzip" {
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(body)); err == nil {
+			body, err = ioutil.ReadAll(zr)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	u.mu.Lock()
+	u.bodies = append(u.bodies, body)
+	u.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// received reports whether a batch holding id has been written.
+func (u *fakeUpstream) received(id string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, body := range u.bodies {
+		if bytes.Contains(body, []byte(id)) {
+			return true
+		}
+	}
+	return false
+}
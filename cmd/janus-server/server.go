@@ -0,0 +1,401 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"go.spiff.io/dagr/outflux"
+	"golang.org/x/net/context"
+)
+
+// server owns the set of running gateways and applies configuration to them,
+// both at startup and when reloading.
+type server struct {
+	ctx    context.Context
+	cancel context.CancelFunc // Cancels ctx; called when a gateway fails and isn't restarted
+
+	wg sync.WaitGroup
+
+	mu       sync.Mutex
+	config   *Config
+	maxreqs  outflux.Option
+	inflight *byteLimiter
+	egress   *rateLimiter // Bounds bytes sent to upstreams, if limited
+	gateways map[string]*runningGateway
+	rollups  map[string]*rollupRing
+	budgets  map[string]*budgetPool
+
+	base       *Config            // The config loaded from files, without dynamic ports
+	dynamic    []*PortConfig      // Ports read from the port source
+	entries    []sourceEntry      // Entries last read from the port source
+	stopSource context.CancelFunc // Stops watching the port source, if any
+
+	failures []time.Time // Recent gateway failures, for the supervisor
+
+	loaded    time.Time // When the running config was applied
+	configErr error     // Why the last load or reload failed, if it did
+	failed    time.Time // When configErr occurred
+}
+
+type runningGateway struct {
+	*gateway
+	reuseport bool
+	cancel    context.CancelFunc
+	supervision
+	rolled map[string]uint64 // Counters as of the last rollup
+	logged portStats         // Counters as of the last stats log
+	done   chan struct{}     // Closed once the gateway has stopped and closed its listeners
+}
+
+func newServer(ctx context.Context, cancel context.CancelFunc) *server {
+	return &server{
+		ctx:      ctx,
+		cancel:   cancel,
+		gateways: map[string]*runningGateway{},
+		rollups:  map[string]*rollupRing{},
+		budgets:  map[string]*budgetPool{},
+	}
+}
+
+// portKey returns the key used to match a port across configurations. Ports
+// are identified by their listeners.
+func portKey(cfg *PortConfig) string {
+	addrs := make([]string, len(cfg.Listen))
+	for i, addr := range cfg.Listen {
+		addrs[i] = addr.String()
+	}
+	sort.Strings(addrs)
+	return strings.Join(addrs, " ")
+}
+
+// apply starts, stops, and replaces gateways so that the server's running
+// gateways match config. Ports whose configuration is unchanged are left
+// running. If config sets a reload overlap, replaced gateways keep running
+// alongside their replacements for that long before being stopped.
+func (s *server) apply(config *Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Dynamic ports are parsed again, since they may use the config's
+	// templates and budgets. They're dropped if the port source changed.
+	sourceChanged := s.base == nil || !reflect.DeepEqual(s.base.PortSource, config.PortSource)
+	prevEntries, prev := s.entries, s.dynamic
+	if sourceChanged {
+		s.entries = nil
+	}
+	s.dynamic = parseDynamic(config, s.entries)
+
+	if err := s.applyLocked(config); err != nil {
+		s.entries, s.dynamic = prevEntries, prev
+		return err
+	}
+	if sourceChanged {
+		s.watchSource(config)
+	}
+	return nil
+}
+
+// requestLimit returns the request limit of a port: its own, if it sets
+// max-requests, or else shared, the limit of all ports.
+func requestLimit(cfg *PortConfig, shared outflux.Option) outflux.Option {
+	if cfg.MaxRequests > 0 {
+		return outflux.RequestLimit(cfg.MaxRequests)
+	}
+	return shared
+}
+
+// applyLocked applies config and the server's dynamic ports. Must be called
+// with s.mu held.
+func (s *server) applyLocked(base *Config) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	config := s.withDynamic(base)
+
+	maxreqs, inflight, egress, limitsChanged := s.maxreqs, s.inflight, s.egress, false
+	if s.config == nil || s.config.MaxRequests != config.MaxRequests {
+		maxreqs, limitsChanged = outflux.RequestLimit(config.MaxRequests), true
+	}
+	if s.config == nil || s.config.MaxInflightBytes != config.MaxInflightBytes {
+		inflight, limitsChanged = newByteLimiter(config.MaxInflightBytes), true
+	}
+	if s.config == nil || s.config.MaxEgressRate != config.MaxEgressRate {
+		egress, limitsChanged = newRateLimiter(config.MaxEgressRate), true
+	}
+
+	type change struct {
+		key string
+		old *runningGateway
+		new *gateway
+	}
+
+	// Existing budgets are kept, so that their running members stay in
+	// them, and only reconfigured once the new config is known to be good.
+	budgets := make(map[string]*budgetPool, len(config.Budgets))
+	for name, cfg := range config.Budgets {
+		if pool := s.budgets[name]; pool != nil {
+			budgets[name] = pool
+		} else {
+			budgets[name] = newBudgetPool(*cfg)
+		}
+	}
+
+	var (
+		overlap   = config.ReloadOverlap
+		reuseport = overlap > 0
+		next      = make(map[string]*runningGateway, len(config.Ports))
+		changes   []change
+	)
+
+	// discard releases the gateways built so far, once the config is
+	// refused.
+	discard := func() {
+		for _, c := range changes {
+			c.new.close()
+		}
+	}
+
+	// Build all gateways before touching any running ones so that a bad port
+	// doesn't leave a partially applied configuration behind.
+	for _, cfg := range config.Ports {
+		if !cfg.Enabled {
+			glog.Infof("Skipping disabled port %v -> %v", cfg.Listen, cfg.Forward.Host)
+			continue
+		}
+
+		key := portKey(cfg)
+		if _, dup := next[key]; dup {
+			discard()
+			return fmt.Errorf("duplicate port for listeners %v", key)
+		}
+
+		// Gateways the supervisor has given up on are replaced even if their
+		// config is unchanged.
+		old := s.gateways[key]
+		if old != nil && !limitsChanged && old.reuseport == reuseport && old.state != gatewayFailed && reflect.DeepEqual(old.cfg, cfg) {
+			next[key] = old
+			continue
+		}
+		next[key] = nil
+
+		g, err := newGateway(cfg, reuseport, inflight, egress, budgets[cfg.Budget], requestLimit(cfg, maxreqs))
+		if err != nil {
+			discard()
+			return fmt.Errorf("error configuring %v -> %v gateway: %v", cfg.Listen, cfg.Forward.Host, err)
+		}
+		// A lockout outlives reloads until the upstream's credentials change or
+		// it's reset through the admin API.
+		if old != nil && sameCredentials(old.cfg.Forward, cfg.Forward) {
+			g.lockout.inherit(old.lockout)
+		}
+		changes = append(changes, change{key, old, g})
+	}
+
+	dns.configure(config.DNS)
+	instance.configure(config.Identity)
+	tracer.configure(config.OTLP)
+	setEventHooks(config.Hooks)
+	for name, pool := range budgets {
+		pool.configure(*config.Budgets[name])
+	}
+
+	for key, old := range s.gateways {
+		if _, ok := next[key]; !ok {
+			glog.Infof("Stopping removed gateway %v", old)
+			s.retire(old)
+			portStatus.Delete(key)
+			affinityStatus.Delete(key)
+			delete(s.rollups, key)
+		}
+	}
+
+	for _, c := range changes {
+		portStatus.Set(c.key, expvar.Func(c.new.status))
+		affinityStatus.Set(c.key, expvar.Func(c.new.affinity))
+
+		if c.old == nil {
+			next[c.key] = s.start(c.new, reuseport, nil)
+			continue
+		}
+
+		if !(reuseport && c.old.reuseport) {
+			// The old gateway's sockets are closed asynchronously, once it's
+			// drained, so the new one waits for them to be released before
+			// binding.
+			glog.Infof("Replacing gateway %v", c.old)
+			s.retire(c.old)
+			next[c.key] = s.start(c.new, reuseport, c.old.done)
+			continue
+		}
+
+		glog.Infof("Replacing gateway %v; overlapping old and new listeners for %v", c.old, overlap)
+		next[c.key] = s.start(c.new, reuseport, nil)
+		old := c.old
+		time.AfterFunc(overlap, func() {
+			glog.Infof("Overlap of %v ended after %v; stopping old gateway", old, overlap)
+			s.retire(old)
+		})
+	}
+
+	if s.config == nil {
+		defer s.publishLimits()
+		defer s.publishHealth()
+		defer s.publishConfig()
+		defer s.publishSupervisor()
+		defer s.publishListeners()
+		go s.rollup(s.ctx)
+		go s.logStats(s.ctx)
+		go tracer.run(s.ctx)
+	} else if s.config.RollupRetention != config.RollupRetention {
+		s.rollups = map[string]*rollupRing{}
+	}
+	s.config = config
+	s.base = base
+	s.maxreqs = maxreqs
+	s.inflight = inflight
+	s.egress = egress
+	s.gateways = next
+	s.budgets = budgets
+	s.loaded, s.configErr = time.Now(), nil
+	return nil
+}
+
+// retire stops g once it has flushed what it's buffered, waiting up to the
+// shutdown delay for the flush, so that replacing or removing a port doesn't
+// lose its lines. It doesn't block.
+func (s *server) retire(g *runningGateway) {
+	go func() {
+		s.mu.Lock()
+		gw := g.gateway
+		s.mu.Unlock()
+
+		ctx, done := context.WithTimeout(s.ctx, *shutdownDelay)
+		gw.drain(ctx)
+		done()
+		g.cancel()
+	}()
+}
+
+// start runs g once after is closed, if it isn't nil.
+func (s *server) start(g *gateway, reuseport bool, after <-chan struct{}) *runningGateway {
+	ctx, cancel := context.WithCancel(s.ctx)
+	rg := &runningGateway{
+		gateway:   g,
+		reuseport: reuseport,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.run(ctx, rg, after)
+	return rg
+}
+
+func (s *server) run(ctx context.Context, g *runningGateway, after <-chan struct{}) {
+	defer s.wg.Done()
+	defer close(g.done)
+
+	if after != nil {
+		select {
+		case <-after:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	s.mu.Lock()
+	gw := g.gateway
+	s.mu.Unlock()
+	for {
+		gwid := gw.String()
+
+		glog.Infof("Starting gateway %v", gwid)
+		s.gatewayStarted(g)
+		err := gw.Start(ctx)
+		if ctx.Err() != nil && s.ctx.Err() == nil {
+			// Stopped by apply, not by a failure or shutdown.
+			glog.Infof("Gateway %v stopped", gwid)
+			return
+		}
+
+		if err == context.Canceled || err == context.DeadlineExceeded || err == nil {
+			glog.Infof("Gateway %v closed", gwid)
+			s.cancel()
+			return
+		}
+
+		glog.Errorf("Gateway %v failed: %v", gwid, err)
+		emitEvent(eventGatewayDown, gwid, "Gateway failed: %v", err)
+
+		next, shutdown := s.supervise(ctx, g, err)
+		if shutdown {
+			s.cancel()
+		}
+		if next == nil {
+			return
+		}
+		gw = next
+	}
+}
+
+// flush flushes every running gateway, for shutdown. The gateways keep
+// running, so flushes are bounded by ctx.
+func (s *server) flush(ctx context.Context) {
+	s.mu.Lock()
+	gateways := make([]*gateway, 0, len(s.gateways))
+	for _, g := range s.gateways {
+		gateways = append(gateways, g.gateway)
+	}
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, g := range gateways {
+		wg.Add(1)
+		go func(g *gateway) {
+			defer wg.Done()
+			g.drain(ctx)
+		}(g)
+	}
+	wg.Wait()
+}
+
+// reload loads the given config files and applies them. If the config cannot
+// be loaded or applied, the running gateways are left as they are.
+func (s *server) reload(cfgfiles []string) error {
+	for _, fp := range cfgfiles {
+		if fp == "-" {
+			return errors.New("cannot reload config read from standard input")
+		}
+	}
+
+	config, err := loadConfig(cfgfiles)
+	if err != nil {
+		return err
+	}
+	if err := s.apply(config); err != nil {
+		return err
+	}
+	snapshotConfig(config)
+	logPorts(config)
+	return nil
+}
+
+// configFailed records that loading or applying a config failed, leaving the
+// server running a stale config, if any.
+func (s *server) configFailed(err error) {
+	s.mu.Lock()
+	s.configErr, s.failed = err, time.Now()
+	s.mu.Unlock()
+}
+
+// Wait blocks until all gateways have stopped.
+func (s *server) Wait() {
+	s.wg.Wait()
+}
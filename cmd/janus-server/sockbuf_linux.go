@@ -0,0 +1,18 @@
+package main
+
+import "syscall"
+
+// readBufferSize returns the effective SO_RCVBUF of conn.
+func readBufferSize(conn syscall.Conn) (size int, err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		size, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	return size, err
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func readBufferSize(conn syscall.Conn) (int, error) {
+	return 0, errors.New("reading SO_RCVBUF is not supported on this platform")
+}
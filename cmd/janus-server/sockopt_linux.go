@@ -0,0 +1,24 @@
+package main
+
+import "syscall"
+
+// setSocketOptions sets the socket options of orig on its socket before it's
+// bound.
+func setSocketOptions(orig *Addr, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if orig.Device != "" {
+			if err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, orig.Device); err != nil {
+				return
+			}
+		}
+		if orig.FreeBind {
+			// IP_FREEBIND applies to IPv6 sockets as well.
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_FREEBIND, 1)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
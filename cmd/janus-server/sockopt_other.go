@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setSocketOptions(orig *Addr, c syscall.RawConn) error {
+	if orig.Device != "" || orig.FreeBind {
+		return errors.New("device and freebind are not supported on this platform")
+	}
+	return nil
+}
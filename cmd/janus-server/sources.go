@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+
+	"go.spiff.io/codf"
+)
+
+// SourceStatsConfig controls per-sender counters of a port.
+type SourceStatsConfig struct {
+	Max int // Senders to count separately; past it, new senders are counted as other. 0 disables
+	Top int // Senders to report, busiest first
+}
+
+var DefaultSourceStats = SourceStatsConfig{Max: 1024, Top: 20}
+
+// handleSourceStats parses `source-stats off` or `source-stats [max N] [top
+// N]`.
+func (p *PortConfig) handleSourceStats(args []codf.ExprNode) error {
+	if len(args) == 1 {
+		if w, ok := codf.Word(args[0]); ok && w == "off" {
+			p.SourceStats = SourceStatsConfig{}
+			return nil
+		}
+	}
+
+	cfg := DefaultSourceStats
+	err := parseKwargs("source-stats", args, kwargs{
+		"max": {dest: &cfg.Max},
+		"top": {dest: &cfg.Top},
+	})
+	switch {
+	case err != nil:
+		return err
+	case cfg.Max < 1:
+		return fmt.Errorf("source-stats max must be >= 1; got %d", cfg.Max)
+	case cfg.Top < 1:
+		return fmt.Errorf("source-stats top must be >= 1; got %d", cfg.Top)
+	}
+	p.SourceStats = cfg
+	return nil
+}
+
+// sourceOther is the address reported for senders past a port's source-stats
+// max.
+const sourceOther = "other"
+
+// sourceCount is the traffic received from one sender, as published.
+type sourceCount struct {
+	Addr    string `json:"addr"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// sourceStats counts the packets and bytes received from each sender IP. It's
+// shared by a port's listeners.
+type sourceStats struct {
+	cfg SourceStatsConfig
+
+	mu    sync.Mutex
+	byIP  map[string]*sourceCount
+	other sourceCount
+}
+
+func newSourceStats(cfg SourceStatsConfig) *sourceStats {
+	return &sourceStats{
+		cfg:   cfg,
+		byIP:  make(map[string]*sourceCount),
+		other: sourceCount{Addr: sourceOther},
+	}
+}
+
+// add counts a packet of n bytes from addr.
+func (s *sourceStats) add(addr net.Addr, n int) {
+	ip := sourceIP(addr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.byIP[ip]
+	if c == nil {
+		if len(s.byIP) >= s.cfg.Max {
+			c = &s.other
+		} else {
+			c = &sourceCount{Addr: ip}
+			s.byIP[ip] = c
+		}
+	}
+	c.Packets++
+	c.Bytes += uint64(n)
+}
+
+// sourceIP returns the IP of a sender, without its port.
+func sourceIP(addr net.Addr) string {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return udp.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// top returns the senders that sent the most bytes, busiest first, followed
+// by the senders counted as other, if any.
+func (s *sourceStats) top() []sourceCount {
+	s.mu.Lock()
+	list := make([]sourceCount, 0, len(s.byIP))
+	for _, c := range s.byIP {
+		list = append(list, *c)
+	}
+	other := s.other
+	s.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Bytes != list[j].Bytes {
+			return list[i].Bytes > list[j].Bytes
+		}
+		return list[i].Addr < list[j].Addr
+	})
+	if len(list) > s.cfg.Top {
+		list = list[:s.cfg.Top]
+	}
+	if other.Packets > 0 {
+		list = append(list, other)
+	}
+	return list
+}
+
+// sourceStatuses returns the busiest senders of each running port that counts
+// them, keyed by port.
+func (s *server) sourceStatuses() map[string][]sourceCount {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make(map[string][]sourceCount, len(s.gateways))
+	for key, g := range s.gateways {
+		if g.sources != nil {
+			statuses[key] = g.sources.top()
+		}
+	}
+	return statuses
+}
+
+// handleSources responds with the busiest senders of all ports, or only of
+// the port given by the port query parameter.
+func (s *server) handleSources(w http.ResponseWriter, r *http.Request) {
+	sources := s.sourceStatuses()
+	if port := r.URL.Query().Get("port"); port != "" {
+		list, ok := sources[port]
+		if !ok {
+			http.Error(w, "no such port, or it doesn't count sources", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, list)
+		return
+	}
+	writeJSON(w, sources)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/glog"
+)
+
+// splitTransport splits batches the upstream rejects as too large (413
+// Request Entity Too Large) in half at a line boundary and sends the halves,
+// splitting them again as needed, so that an oversized batch isn't retried
+// as is until the proxy gives up on it. A single line that's still too large
+// is dropped, and dead-lettered if the port writes dead letters to a file.
+//
+// Lines the upstream rejects as invalid in a 400 response are dropped, and
+// the rest of the batch is sent again if the upstream didn't write it (see
+// dropRejected).
+//
+// Batches holding more lines than the limit of lines, if any, are sent in
+// pieces of at most that many lines, so that lines written while a flush
+// takes the proxy's buffer don't carry a request past the port's flush-lines.
+//
+// If any piece fails, so does the batch, and the proxy retries all of it.
+// Pieces already written are written again, which InfluxDB treats as
+// overwriting the same points.
+type splitTransport struct {
+	base  http.RoundTripper
+	stats *portStats
+	dead  *deadLetter
+	lines *lineCounter // Caps the lines of each request, if any
+}
+
+func (t *splitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.lines != nil {
+		if limit := t.lines.maxLines(); limit > 0 {
+			return t.sendCapped(req, body, limit)
+		}
+	}
+	return t.send(req, body)
+}
+
+// sendCapped sends body in pieces of at most limit lines.
+func (t *splitTransport) sendCapped(req *http.Request, body []byte, limit int) (*http.Response, error) {
+	lines, err := decodeBody(req, body)
+	if err != nil {
+		return nil, err
+	}
+	if countLines(lines) <= limit {
+		return t.send(req, body)
+	}
+
+	if glog.V(1) {
+		glog.Infof("Splitting batch of %d lines to %v into pieces of %d lines", countLines(lines), redactURL(req.URL), limit)
+	}
+	for len(lines) > 0 {
+		var piece []byte
+		piece, lines = cutLines(lines, limit)
+		if piece, err = encodeBody(req, piece); err != nil {
+			return nil, err
+		}
+		resp, err := t.send(req, piece)
+		if err != nil || resp.StatusCode/100 != 2 {
+			return resp, err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	return noContent(req), nil
+}
+
+// send sends body with req's method, URL, and headers, splitting it if the
+// upstream rejects it as too large and dropping lines it rejects as invalid.
+func (t *splitTransport) send(req *http.Request, body []byte) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(withBody(req, body))
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusRequestEntityTooLarge:
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return t.split(req, body)
+	case http.StatusBadRequest:
+		return t.dropRejected(req, body, resp)
+	}
+	return resp, nil
+}
+
+// split sends the halves of body, which the upstream rejected as too large.
+func (t *splitTransport) split(req *http.Request, body []byte) (*http.Response, error) {
+	lines, err := decodeBody(req, body)
+	if err != nil {
+		return nil, err
+	}
+
+	first, second := splitBatch(lines)
+	if len(second) == 0 {
+		t.stats.addTooLarge()
+		if t.dead != nil && t.dead.proxy == nil {
+			// Written upstream, the dead letter would be too large as well.
+			t.dead.add(deadTooLarge, lines)
+		}
+		glog.Errorf("Dropping line of %d bytes to %v; rejected by the upstream as too large", len(lines), redactURL(req.URL))
+		return noContent(req), nil
+	}
+
+	t.stats.addSplitBatch()
+	if glog.V(1) {
+		glog.Infof("Splitting batch of %d bytes to %v; rejected by the upstream as too large", len(lines), redactURL(req.URL))
+	}
+	for _, half := range [][]byte{first, second} {
+		if half, err = encodeBody(req, half); err != nil {
+			return nil, err
+		}
+		resp, err := t.send(req, half)
+		if err != nil || resp.StatusCode/100 != 2 {
+			return resp, err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	return noContent(req), nil
+}
+
+// splitBatch splits lines at the line boundary closest to its middle. second
+// is empty if lines holds a single line.
+func splitBatch(lines []byte) (first, second []byte) {
+	lines = bytes.TrimRight(lines, "\n")
+	mid := len(lines) / 2
+	i := bytes.IndexByte(lines[mid:], '\n')
+	if j := bytes.LastIndexByte(lines[:mid], '\n'); j >= 0 && (i < 0 || mid-j < i) {
+		i = j
+	} else if i >= 0 {
+		i += mid
+	}
+	if i < 0 {
+		return lines, nil
+	}
+	return lines[:i+1], lines[i+1:]
+}
+
+// cutLines splits lines after its first n lines. tail is empty if lines holds
+// no more than n lines.
+func cutLines(lines []byte, n int) (head, tail []byte) {
+	i := 0
+	for ; n > 0; n-- {
+		j := bytes.IndexByte(lines[i:], '\n')
+		if j < 0 {
+			return lines, nil
+		}
+		i += j + 1
+	}
+	return lines[:i], lines[i:]
+}
+
+// withBody returns a copy of req sending body.
+func withBody(req *http.Request, body []byte) *http.Request {
+	dup := new(http.Request)
+	*dup = *req
+	dup.Body = ioutil.NopCloser(bytes.NewReader(body))
+	dup.ContentLength = int64(len(body))
+	dup.GetBody = nil
+	return dup
+}
+
+// decodeBody returns the lines of body, the body of req.
+func decodeBody(req *http.Request, body []byte) ([]byte, error) {
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		return gunzip(body)
+	}
+	return body, nil
+}
+
+// encodeBody returns lines encoded as the body of req.
+func encodeBody(req *http.Request, lines []byte) ([]byte, error) {
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		return gzipBytes(lines)
+	}
+	return lines, nil
+}
+
+func gunzip(body []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+func gzipBytes(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(body)
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return fn(req) }
+
+// testResponse returns a response to req with the given status code and body.
+func testResponse(req *http.Request, code int, body string) *http.Response {
+	return &http.Response{
+		Status:     http.StatusText(code),
+		StatusCode: code,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}
+}
+
+func TestSplitBatch(t *testing.T) {
+	tests := []struct {
+		name          string
+		in            string
+		first, second string
+	}{
+		{"empty", "", "", ""},
+		{"newline", "\n", "", ""},
+		{"single line", "a=1\n", "a=1", ""},
+		{"single line without newline", "a=1", "a=1", ""},
+		{"two lines", "a=1\nb=2\n", "a=1\n", "b=2"},
+		{"no trailing newline", "a=1\nb=2\nc=3", "a=1\nb=2\n", "c=3"},
+		{"midpoint on newline", "ab\ncd\nef\ngh\n", "ab\ncd\n", "ef\ngh"},
+		{"closest boundary before", "a\nbbbbbbbbbb\n", "a\n", "bbbbbbbbbb"},
+		{"closest boundary after", "bbbbbbbbbb\na\n", "bbbbbbbbbb\n", "a"},
+	}
+	for _, tt := range tests {
+		first, second := splitBatch([]byte(tt.in))
+		if string(first) != tt.first || string(second) != tt.second {
+			t.Errorf("%s: splitBatch(%q) = %q, %q; want %q, %q", tt.name, tt.in, first, second, tt.first, tt.second)
+		}
+	}
+}
+
+// TestSplitTransport checks that a batch rejected as too large is delivered
+// in pieces the upstream accepts, with and without gzip, and that a line too
+// large on its own is dropped.
+func TestSplitTransport(t *testing.T) {
+	const maxBody = 12
+	lines := "a=1\nb=2\nc=3\nd=4\ne=5\nf=6\ntoo-large=1234567890\ng=7\n"
+
+	for _, encoding := range []string{"", "gzip"} {
+		var delivered []string
+		stats := new(portStats)
+		rt := &splitTransport{
+			stats: stats,
+			base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				body, err := ioutil.ReadAll(req.Body)
+				if err != nil {
+					return nil, err
+				}
+				if body, err = decodeBody(req, body); err != nil {
+					t.Fatalf("%q: unable to decode body: %v", encoding, err)
+				}
+				if len(body) > maxBody {
+					return testResponse(req, http.StatusRequestEntityTooLarge, ""), nil
+				}
+				delivered = append(delivered, string(body))
+				return testResponse(req, http.StatusNoContent, ""), nil
+			}),
+		}
+
+		body := []byte(lines)
+		req, _ := http.NewRequest("POST", "http://localhost/write", nil)
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+			body, _ = encodeBody(req, body)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%q: %v", encoding, err)
+		} else if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("%q: status = %d; want %d", encoding, resp.StatusCode, http.StatusNoContent)
+		}
+
+		got := ""
+		for _, piece := range delivered {
+			got += strings.TrimSuffix(piece, "\n") + "\n"
+		}
+		if want := strings.Replace(lines, "too-large=1234567890\n", "", 1); got != want {
+			t.Errorf("%q: delivered %q; want %q", encoding, got, want)
+		}
+		if stats.TooLarge != 1 {
+			t.Errorf("%q: too_large = %d; want 1", encoding, stats.TooLarge)
+		}
+		if stats.SplitBatches == 0 {
+			t.Errorf("%q: split_batches = 0; want > 0", encoding)
+		}
+	}
+}
+
+func TestCutLines(t *testing.T) {
+	tests := []struct {
+		in         string
+		n          int
+		head, tail string
+	}{
+		{"", 2, "", ""},
+		{"a=1\n", 2, "a=1\n", ""},
+		{"a=1\nb=2\n", 2, "a=1\nb=2\n", ""},
+		{"a=1\nb=2\nc=3\n", 2, "a=1\nb=2\n", "c=3\n"},
+		{"a=1\nb=2\nc=3", 1, "a=1\n", "b=2\nc=3"},
+		{"a=1", 1, "a=1", ""},
+	}
+	for _, tt := range tests {
+		head, tail := cutLines([]byte(tt.in), tt.n)
+		if string(head) != tt.head || string(tail) != tt.tail {
+			t.Errorf("cutLines(%q, %d) = %q, %q; want %q, %q", tt.in, tt.n, head, tail, tt.head, tt.tail)
+		}
+	}
+}
+
+// TestSplitTransportLineCap checks that batches past the line limit are sent
+// in pieces of at most that many lines.
+func TestSplitTransportLineCap(t *testing.T) {
+	lines := "a=1\nb=2\nc=3\nd=4\ne=5\n"
+
+	for _, encoding := range []string{"", "gzip"} {
+		var delivered []string
+		rt := &splitTransport{
+			stats: new(portStats),
+			lines: newLineCounter(2, nil),
+			base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				body, err := ioutil.ReadAll(req.Body)
+				if err != nil {
+					return nil, err
+				}
+				if body, err = decodeBody(req, body); err != nil {
+					t.Fatalf("%q: unable to decode body: %v", encoding, err)
+				}
+				delivered = append(delivered, string(body))
+				return testResponse(req, http.StatusNoContent, ""), nil
+			}),
+		}
+
+		body := []byte(lines)
+		req, _ := http.NewRequest("POST", "http://localhost/write", nil)
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+			body, _ = encodeBody(req, body)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%q: %v", encoding, err)
+		} else if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("%q: status = %d; want %d", encoding, resp.StatusCode, http.StatusNoContent)
+		}
+		want := []string{"a=1\nb=2\n", "c=3\nd=4\n", "e=5\n"}
+		if !reflect.DeepEqual(delivered, want) {
+			t.Errorf("%q: delivered %q; want %q", encoding, delivered, want)
+		}
+	}
+}
+
+func TestGzipRoundTrip(t *testing.T) {
+	for _, in := range []string{"", "a=1\n", strings.Repeat("cpu,host=a usage=0.5 1\n", 1000)} {
+		z, err := gzipBytes([]byte(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := gunzip(z)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != in {
+			t.Errorf("gunzip(gzipBytes(%d bytes)) = %d bytes; want the same", len(in), len(out))
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spool holds batches while an upstream's circuit is open. When a spool
+// grows past its maximum size, its oldest batches are dropped.
+type spool interface {
+	push(body []byte) error
+	// pushFront returns a batch taken by pop to the head of the spool, to
+	// be replayed before any other.
+	pushFront(body []byte) error
+	// pop removes and returns the oldest batch. It returns false if the
+	// spool is empty.
+	pop() (body []byte, ok bool, err error)
+	len() int
+	// size returns the bytes of the batches held.
+	size() int64
+}
+
+// memorySpool holds batches in memory.
+type memorySpool struct {
+	max   int64
+	stats *portStats
+
+	mu     sync.Mutex
+	bodies [][]byte
+	bytes  int64
+}
+
+func (s *memorySpool) push(body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bodies = append(s.bodies, body)
+	s.bytes += int64(len(body))
+	for s.bytes > s.max && len(s.bodies) > 0 {
+		s.bytes -= int64(len(s.bodies[0]))
+		s.bodies[0], s.bodies = nil, s.bodies[1:]
+		s.stats.addSpoolDropped()
+	}
+	return nil
+}
+
+func (s *memorySpool) pushFront(body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bytes+int64(len(body)) > s.max {
+		// It would be the oldest batch, so it's the one dropped.
+		s.stats.addSpoolDropped()
+		return nil
+	}
+	s.bodies = append([][]byte{body}, s.bodies...)
+	s.bytes += int64(len(body))
+	return nil
+}
+
+func (s *memorySpool) pop() ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.bodies) == 0 {
+		return nil, false, nil
+	}
+	body := s.bodies[0]
+	s.bodies[0], s.bodies = nil, s.bodies[1:]
+	s.bytes -= int64(len(body))
+	return body, true, nil
+}
+
+func (s *memorySpool) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bodies)
+}
+
+func (s *memorySpool) size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+// diskSpool writes batches to files in a directory, one per batch, so that
+// they survive restarts. Each port needs its own directory.
+type diskSpool struct {
+	dir   string
+	max   int64
+	stats *portStats
+
+	mu    sync.Mutex
+	files []string // Oldest first
+	sizes map[string]int64
+	bytes int64
+}
+
+const spoolFileExt = ".spool"
+
+// newDiskSpool returns a spool in dir, creating it if needed. Batches left in
+// dir from an earlier run are kept.
+func newDiskSpool(dir string, max int64, stats *portStats) (*diskSpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &diskSpool{dir: dir, max: max, stats: stats, sizes: map[string]int64{}}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range infos {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), spoolFileExt) {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		s.files = append(s.files, path)
+		s.sizes[path] = fi.Size()
+		s.bytes += fi.Size()
+	}
+	sort.Strings(s.files) // Names sort by time
+	return s, nil
+}
+
+func (s *diskSpool) push(body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", time.Now().UnixNano(), spoolFileExt))
+	for s.sizes[path] != 0 {
+		path = strings.TrimSuffix(path, spoolFileExt) + "-" + spoolFileExt
+	}
+	if err := ioutil.WriteFile(path, body, 0600); err != nil {
+		return err
+	}
+	s.files = append(s.files, path)
+	s.sizes[path] = int64(len(body))
+	s.bytes += int64(len(body))
+
+	for s.bytes > s.max && len(s.files) > 0 {
+		if err := s.remove(s.files[0]); err != nil {
+			return err
+		}
+		s.stats.addSpoolDropped()
+	}
+	return nil
+}
+
+// pushFront writes body to a file named to sort before the oldest batch's.
+func (s *diskSpool) pushFront(body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bytes+int64(len(body)) > s.max {
+		// It would be the oldest batch, so it's the one dropped.
+		s.stats.addSpoolDropped()
+		return nil
+	}
+
+	ts := time.Now().UnixNano()
+	if len(s.files) > 0 {
+		ts = spoolFileTime(s.files[0]) - 1
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", ts, spoolFileExt))
+	if err := ioutil.WriteFile(path, body, 0600); err != nil {
+		return err
+	}
+	s.files = append([]string{path}, s.files...)
+	s.sizes[path] = int64(len(body))
+	s.bytes += int64(len(body))
+	return nil
+}
+
+// spoolFileTime returns the time in the name of a spool file, in Unix
+// nanoseconds.
+func spoolFileTime(path string) int64 {
+	name := strings.TrimSuffix(filepath.Base(path), spoolFileExt)
+	ts, _ := strconv.ParseInt(strings.TrimRight(name, "-"), 10, 64)
+	return ts
+}
+
+// remove deletes the oldest file, which must be path. Must be called with
+// s.mu held.
+func (s *diskSpool) remove(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.bytes -= s.sizes[path]
+	delete(s.sizes, path)
+	s.files = s.files[1:]
+	return nil
+}
+
+func (s *diskSpool) pop() ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.files) == 0 {
+		return nil, false, nil
+	}
+	path := s.files[0]
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	return body, true, s.remove(path)
+}
+
+func (s *diskSpool) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files)
+}
+
+func (s *diskSpool) size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// TestSpoolPushFront checks that a batch returned to a spool is replayed
+// before the rest, and that it's dropped if the spool has no room for it.
+func TestSpoolPushFront(t *testing.T) {
+	dir, err := ioutil.TempDir("", "janus-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	disk, err := newDiskSpool(dir, 8, new(portStats))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spools := map[string]spool{
+		"memory": &memorySpool{max: 8, stats: new(portStats)},
+		"disk":   disk,
+	}
+	for name, s := range spools {
+		s.push([]byte("a=1\n"))
+		s.push([]byte("b=2\n"))
+		body, _, _ := s.pop()
+		if err := s.pushFront(body); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if body, _, _ := s.pop(); string(body) != "a=1\n" {
+			t.Errorf("%s: popped %q after pushFront; want %q", name, body, "a=1\n")
+		}
+
+		s.push([]byte("c=3\n"))
+		if err := s.pushFront([]byte("a=1\n")); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if n := s.len(); n != 2 {
+			t.Errorf("%s: spool holds %d batches past its max; want 2", name, n)
+		}
+		if body, _, _ := s.pop(); string(body) != "b=2\n" {
+			t.Errorf("%s: popped %q; want %q", name, body, "b=2\n")
+		}
+	}
+
+	// Batches returned to the head of a disk spool stay there across restarts.
+	disk.pushFront([]byte("z=0\n"))
+	reopened, err := newDiskSpool(dir, 8, new(portStats))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _, _ := reopened.pop(); string(body) != "z=0\n" {
+		t.Errorf("reopened disk spool popped %q; want %q", body, "z=0\n")
+	}
+}
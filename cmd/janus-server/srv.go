@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// srvSchemePrefix marks a forwarding URL whose host is an SRV record naming
+// the upstream's targets, as in srv+https://_influx._tcp.example.com/write.
+const srvSchemePrefix = "srv+"
+
+// isSRV reports whether u names its upstream by SRV record.
+func isSRV(u *url.URL) bool { return strings.HasPrefix(u.Scheme, srvSchemePrefix) }
+
+// validateSRV checks that an SRV forwarding URL uses a supported scheme and
+// has no port, since targets carry their own.
+func validateSRV(u *url.URL) error {
+	switch scheme := strings.TrimPrefix(u.Scheme, srvSchemePrefix); {
+	case scheme != "http" && scheme != "https":
+		return fmt.Errorf("invalid forwarding scheme %s; must be srv+http or srv+https", u.Scheme)
+	case u.Port() != "":
+		return fmt.Errorf("forwarding URL %v must not have a port; SRV targets set it", redactURL(u))
+	}
+	return nil
+}
+
+// srvBaseURL returns a copy of u with the srv+ prefix removed from its scheme.
+// Its host is still the SRV name, and is replaced by a target per request.
+func srvBaseURL(u *url.URL) *url.URL {
+	dup := *u
+	dup.Scheme = strings.TrimPrefix(u.Scheme, srvSchemePrefix)
+	return &dup
+}
+
+// srvUpstream picks targets for an SRV record, resolving it again once its
+// targets are older than the refresh interval.
+type srvUpstream struct {
+	name    string
+	refresh time.Duration
+
+	mu       sync.Mutex
+	targets  []*net.SRV
+	resolved time.Time
+}
+
+func newSRVUpstream(name string, refresh time.Duration) *srvUpstream {
+	return &srvUpstream{name: name, refresh: refresh}
+}
+
+// resolve looks up the record's targets. If the lookup fails, the previous
+// targets are kept, if there are any.
+func (s *srvUpstream) resolve(ctx context.Context) error {
+	_, targets, err := net.DefaultResolver.LookupSRV(ctx, "", "", s.name)
+	if err == nil && len(targets) == 0 {
+		err = errors.New("no targets")
+	}
+	if err != nil {
+		if len(s.targets) == 0 {
+			return fmt.Errorf("unable to resolve SRV record %s: %v", s.name, err)
+		}
+		glog.Warningf("Unable to resolve SRV record %s; keeping %d targets: %v", s.name, len(s.targets), err)
+		s.resolved = time.Now()
+		return nil
+	}
+
+	if glog.V(1) {
+		glog.Infof("Resolved SRV record %s to %d targets", s.name, len(targets))
+	}
+	s.targets, s.resolved = targets, time.Now()
+	return nil
+}
+
+// pick returns the host:port of a target, chosen by weight from those with
+// the lowest priority, as described by RFC 2782.
+func (s *srvUpstream) pick(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.targets) == 0 || time.Since(s.resolved) >= s.refresh {
+		if err := s.resolve(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	// Targets are sorted by priority, so the first share the lowest.
+	var (
+		best  = s.targets[0].Priority
+		group []*net.SRV
+		total int
+	)
+	for _, t := range s.targets {
+		if t.Priority != best {
+			break
+		}
+		group = append(group, t)
+		total += int(t.Weight)
+	}
+
+	target := group[0]
+	if total > 0 {
+		n := rand.Intn(total + 1)
+		for _, t := range group {
+			if n -= int(t.Weight); n <= 0 {
+				target = t
+				break
+			}
+		}
+	} else {
+		target = group[rand.Intn(len(group))]
+	}
+
+	host := strings.TrimSuffix(target.Target, ".")
+	return net.JoinHostPort(host, strconv.Itoa(int(target.Port))), nil
+}
+
+// srvTransport sends each request to a target of an SRV record.
+type srvTransport struct {
+	base http.RoundTripper
+	srv  *srvUpstream
+}
+
+func (t *srvTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host, err := t.srv.pick(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	u := *req.URL
+	u.Host = host
+	dup := req.WithContext(req.Context())
+	dup.URL, dup.Host = &u, host
+	return t.base.RoundTrip(dup)
+}
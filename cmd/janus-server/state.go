@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateDump is a snapshot of the server's state for post-mortem use.
+type stateDump struct {
+	Time             time.Time                    `json:"time"`
+	ConfigHash       string                       `json:"config_hash"`
+	Ports            map[string]map[string]uint64 `json:"ports"`
+	Buffers          map[string]portBuffers       `json:"buffers"`
+	Unhealthy        map[string]string            `json:"unhealthy,omitempty"`
+	InflightBytes    int64                        `json:"inflight_bytes"`
+	InflightRequests int64                        `json:"inflight_requests"`
+	Events           []*Event                     `json:"recent_events"`
+}
+
+// portBuffers is what a port holds that hasn't been sent upstream yet.
+type portBuffers struct {
+	Lines         int64 `json:"buffered_lines"`              // Lines written to the proxy since its last request
+	Bytes         int64 `json:"buffered_bytes"`              // Bytes written to the proxy since its last request
+	Undelivered   int64 `json:"undelivered_bytes,omitempty"` // Bytes not yet delivered, with max-buffer-bytes
+	QueueDepth    int   `json:"queue_depth"`                 // Packets waiting in the write queue
+	QueueCapacity int   `json:"queue_capacity"`
+}
+
+func (s *server) state() *stateDump {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dump := &stateDump{
+		Time:    time.Now(),
+		Ports:   make(map[string]map[string]uint64, len(s.gateways)),
+		Buffers: make(map[string]portBuffers, len(s.gateways)),
+		Events:  recentEvents(),
+	}
+	if s.config != nil {
+		dump.ConfigHash = s.config.Hash
+	}
+	if s.inflight != nil {
+		dump.InflightBytes, dump.InflightRequests = s.inflight.usage()
+	}
+	for key, g := range s.gateways {
+		dump.Ports[key] = g.stats.snapshot().fields()
+		batch := g.lines.batch()
+		buffers := portBuffers{
+			Lines:         batch.points,
+			Bytes:         batch.size,
+			QueueDepth:    g.queue.depth(),
+			QueueCapacity: g.cfg.Workers.Queue,
+		}
+		if g.buffer != nil {
+			buffers.Undelivered = g.buffer.usage()
+		}
+		dump.Buffers[key] = buffers
+		if g.lockout.isLocked() {
+			if dump.Unhealthy == nil {
+				dump.Unhealthy = map[string]string{}
+			}
+			dump.Unhealthy[key] = "auth"
+		}
+	}
+	return dump
+}
+
+// stateFile returns the configured state file path, if any.
+func (s *server) stateFile() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.config == nil {
+		return ""
+	}
+	return s.config.StateFile
+}
+
+// dumpState writes the server's state to its state file, if one is
+// configured. The file is replaced atomically.
+func (s *server) dumpState() error {
+	path := s.stateFile()
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.state(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data to a temporary file beside path and renames it
+// over path, so that readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
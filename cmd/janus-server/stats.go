@@ -0,0 +1,250 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// portStats holds the operational counters of a single port. Fields are only
+// accessed atomically.
+type portStats struct {
+	Packets        uint64 // Datagrams received
+	Bytes          uint64 // Bytes received
+	ReadErrors     uint64 // Temporary read errors
+	DecodeErrors   uint64 // Payloads that could not be decoded
+	DecodeFixed    uint64 // Recoverable decoding issues fixed up
+	DecodeDropped  uint64 // Lines dropped for recoverable decoding issues
+	DecodeRejected uint64 // Payloads rejected for recoverable decoding issues
+	WriteErrors    uint64 // Failed writes to the proxy
+	Flushes        uint64 // Successful requests to the upstream
+	Overflowed     uint64 // Lines exceeding the port's quota
+	Dropped        uint64 // Lines dropped
+	QueueDrops     uint64 // Packets dropped because the write queue was full
+	SampledOut     uint64 // Payloads not forwarded by sampling
+	Duplicates     uint64 // Payloads dropped as duplicates within the dedup window
+	ScriptErrors   uint64 // Payloads dropped because the port's script failed
+	ScriptDropped  uint64 // Payloads dropped by the port's script
+	Skewed         uint64 // Lines dropped for timestamps outside the accepted window
+	Routed         uint64 // Lines sent to a route's upstream
+	QueueBlocked   uint64 // Packets that waited for room in the write queue
+	QueueWait      uint64 // Time spent waiting for room in the write queue, in nanoseconds
+	WriteWait      uint64 // Time spent in writes to the proxy, in nanoseconds
+	KernelDrops    uint64 // Packets dropped by the kernel before they were read
+	CircuitOpens   uint64 // Times the circuit breaker opened
+	Spooled        uint64 // Batches spooled while the circuit was open
+	SpoolDropped   uint64 // Spooled batches dropped to stay within the spool's size
+	Replayed       uint64 // Spooled batches delivered after the circuit closed
+	Retries        uint64 // Flush attempts after the first of a batch
+	RetryDropped   uint64 // Batches dropped because the retry budget was exhausted
+	NotRetried     uint64 // Batches dropped because their failures aren't retried
+	LockedOut      uint64 // Batches dropped because the upstream was locked out
+	BufferDropped  uint64 // Payloads dropped because the buffer was full
+	BufferEvicted  uint64 // Batches dropped to make room in the buffer
+	PeerDropped    uint64 // Datagrams dropped for coming from unexpected senders
+	SchemaViolated uint64 // Lines dropped or quarantined for violating the schema
+	TagsLimited    uint64 // Lines dropped or stripped of tags past the cardinality limit
+	Aggregated     uint64 // Lines combined into aggregated points
+	Downsampled    uint64 // Lines combined into downsampled points
+	DeadLettered   uint64 // Dropped payloads and lines written to the dead letter sink
+	SplitBatches   uint64 // Batches split after the upstream rejected them as too large
+	TooLarge       uint64 // Lines dropped after the upstream rejected them as too large
+	LinesRejected  uint64 // Lines dropped after the upstream rejected them as invalid
+	WALErrors      uint64 // Payloads dropped because they couldn't be appended to the write-ahead log
+	LastPacket     int64  // Time of the last datagram received, in Unix nanoseconds
+
+	FlushErrors [numErrorClasses]uint64 // Failed requests to the upstream, by class
+}
+
+func (s *portStats) addPacket(n int) {
+	atomic.AddUint64(&s.Packets, 1)
+	atomic.AddUint64(&s.Bytes, uint64(n))
+	atomic.StoreInt64(&s.LastPacket, time.Now().UnixNano())
+}
+
+func (s *portStats) addReadError() { atomic.AddUint64(&s.ReadErrors, 1) }
+
+func (s *portStats) addDecodeError() { atomic.AddUint64(&s.DecodeErrors, 1) }
+
+func (s *portStats) addDecodeFixed() { atomic.AddUint64(&s.DecodeFixed, 1) }
+
+func (s *portStats) addDecodeDropped() { atomic.AddUint64(&s.DecodeDropped, 1) }
+
+func (s *portStats) addDecodeRejected() { atomic.AddUint64(&s.DecodeRejected, 1) }
+
+func (s *portStats) addWriteError() { atomic.AddUint64(&s.WriteErrors, 1) }
+
+func (s *portStats) addOverflow() { atomic.AddUint64(&s.Overflowed, 1) }
+
+func (s *portStats) addDrop() { atomic.AddUint64(&s.Dropped, 1) }
+
+func (s *portStats) addQueueDrop() { atomic.AddUint64(&s.QueueDrops, 1) }
+
+func (s *portStats) addSampledOut() { atomic.AddUint64(&s.SampledOut, 1) }
+
+func (s *portStats) addDuplicate() { atomic.AddUint64(&s.Duplicates, 1) }
+
+func (s *portStats) addScriptError() { atomic.AddUint64(&s.ScriptErrors, 1) }
+
+func (s *portStats) addScriptDropped() { atomic.AddUint64(&s.ScriptDropped, 1) }
+
+func (s *portStats) addSkewed() { atomic.AddUint64(&s.Skewed, 1) }
+
+func (s *portStats) addRouted(n int) { atomic.AddUint64(&s.Routed, uint64(n)) }
+
+func (s *portStats) addQueueWait(d time.Duration) {
+	atomic.AddUint64(&s.QueueBlocked, 1)
+	atomic.AddUint64(&s.QueueWait, uint64(d))
+}
+
+func (s *portStats) addWriteWait(d time.Duration) { atomic.AddUint64(&s.WriteWait, uint64(d)) }
+
+func (s *portStats) addKernelDrops(n uint64) { atomic.AddUint64(&s.KernelDrops, n) }
+
+func (s *portStats) addCircuitOpen() { atomic.AddUint64(&s.CircuitOpens, 1) }
+
+func (s *portStats) addSpooled() { atomic.AddUint64(&s.Spooled, 1) }
+
+func (s *portStats) addSpoolDropped() { atomic.AddUint64(&s.SpoolDropped, 1) }
+
+func (s *portStats) addReplayed() { atomic.AddUint64(&s.Replayed, 1) }
+
+func (s *portStats) addRetry() { atomic.AddUint64(&s.Retries, 1) }
+
+func (s *portStats) addRetryDropped() { atomic.AddUint64(&s.RetryDropped, 1) }
+
+func (s *portStats) addNotRetried() { atomic.AddUint64(&s.NotRetried, 1) }
+
+func (s *portStats) addLockedOut() { atomic.AddUint64(&s.LockedOut, 1) }
+
+func (s *portStats) addBufferDropped() { atomic.AddUint64(&s.BufferDropped, 1) }
+
+func (s *portStats) addBufferEvicted() { atomic.AddUint64(&s.BufferEvicted, 1) }
+
+func (s *portStats) addPeerDropped() { atomic.AddUint64(&s.PeerDropped, 1) }
+
+func (s *portStats) addSchemaViolation() { atomic.AddUint64(&s.SchemaViolated, 1) }
+
+func (s *portStats) addTagsLimited() { atomic.AddUint64(&s.TagsLimited, 1) }
+
+func (s *portStats) addAggregated() { atomic.AddUint64(&s.Aggregated, 1) }
+
+func (s *portStats) addDownsampled() { atomic.AddUint64(&s.Downsampled, 1) }
+
+func (s *portStats) addDeadLettered() { atomic.AddUint64(&s.DeadLettered, 1) }
+
+func (s *portStats) addSplitBatch() { atomic.AddUint64(&s.SplitBatches, 1) }
+
+func (s *portStats) addTooLarge() { atomic.AddUint64(&s.TooLarge, 1) }
+
+func (s *portStats) addLineRejected() { atomic.AddUint64(&s.LinesRejected, 1) }
+
+func (s *portStats) addWALError() { atomic.AddUint64(&s.WALErrors, 1) }
+
+func (s *portStats) addFlush() { atomic.AddUint64(&s.Flushes, 1) }
+
+func (s *portStats) addFlushError(class errorClass) { atomic.AddUint64(&s.FlushErrors[class], 1) }
+
+// snapshot returns a copy of s that is safe to read without atomics.
+func (s *portStats) snapshot() portStats {
+	snap := portStats{
+		Packets:        atomic.LoadUint64(&s.Packets),
+		Bytes:          atomic.LoadUint64(&s.Bytes),
+		ReadErrors:     atomic.LoadUint64(&s.ReadErrors),
+		DecodeErrors:   atomic.LoadUint64(&s.DecodeErrors),
+		DecodeFixed:    atomic.LoadUint64(&s.DecodeFixed),
+		DecodeDropped:  atomic.LoadUint64(&s.DecodeDropped),
+		DecodeRejected: atomic.LoadUint64(&s.DecodeRejected),
+		WriteErrors:    atomic.LoadUint64(&s.WriteErrors),
+		Flushes:        atomic.LoadUint64(&s.Flushes),
+		Overflowed:     atomic.LoadUint64(&s.Overflowed),
+		Dropped:        atomic.LoadUint64(&s.Dropped),
+		QueueDrops:     atomic.LoadUint64(&s.QueueDrops),
+		SampledOut:     atomic.LoadUint64(&s.SampledOut),
+		Duplicates:     atomic.LoadUint64(&s.Duplicates),
+		ScriptErrors:   atomic.LoadUint64(&s.ScriptErrors),
+		ScriptDropped:  atomic.LoadUint64(&s.ScriptDropped),
+		Skewed:         atomic.LoadUint64(&s.Skewed),
+		Routed:         atomic.LoadUint64(&s.Routed),
+		QueueBlocked:   atomic.LoadUint64(&s.QueueBlocked),
+		QueueWait:      atomic.LoadUint64(&s.QueueWait),
+		WriteWait:      atomic.LoadUint64(&s.WriteWait),
+		KernelDrops:    atomic.LoadUint64(&s.KernelDrops),
+		CircuitOpens:   atomic.LoadUint64(&s.CircuitOpens),
+		Spooled:        atomic.LoadUint64(&s.Spooled),
+		SpoolDropped:   atomic.LoadUint64(&s.SpoolDropped),
+		Replayed:       atomic.LoadUint64(&s.Replayed),
+		Retries:        atomic.LoadUint64(&s.Retries),
+		RetryDropped:   atomic.LoadUint64(&s.RetryDropped),
+		NotRetried:     atomic.LoadUint64(&s.NotRetried),
+		LockedOut:      atomic.LoadUint64(&s.LockedOut),
+		BufferDropped:  atomic.LoadUint64(&s.BufferDropped),
+		BufferEvicted:  atomic.LoadUint64(&s.BufferEvicted),
+		PeerDropped:    atomic.LoadUint64(&s.PeerDropped),
+		SchemaViolated: atomic.LoadUint64(&s.SchemaViolated),
+		TagsLimited:    atomic.LoadUint64(&s.TagsLimited),
+		Aggregated:     atomic.LoadUint64(&s.Aggregated),
+		Downsampled:    atomic.LoadUint64(&s.Downsampled),
+		DeadLettered:   atomic.LoadUint64(&s.DeadLettered),
+		SplitBatches:   atomic.LoadUint64(&s.SplitBatches),
+		TooLarge:       atomic.LoadUint64(&s.TooLarge),
+		LinesRejected:  atomic.LoadUint64(&s.LinesRejected),
+		WALErrors:      atomic.LoadUint64(&s.WALErrors),
+		LastPacket:     atomic.LoadInt64(&s.LastPacket),
+	}
+	for i := range s.FlushErrors {
+		snap.FlushErrors[i] = atomic.LoadUint64(&s.FlushErrors[i])
+	}
+	return snap
+}
+
+// fields returns the snapshot's counters keyed by their metric names.
+func (s portStats) fields() map[string]uint64 {
+	fields := map[string]uint64{
+		"packets":         s.Packets,
+		"bytes":           s.Bytes,
+		"read_errors":     s.ReadErrors,
+		"decode_errors":   s.DecodeErrors,
+		"decode_fixed":    s.DecodeFixed,
+		"decode_dropped":  s.DecodeDropped,
+		"decode_rejected": s.DecodeRejected,
+		"write_errors":    s.WriteErrors,
+		"flushes":         s.Flushes,
+		"overflowed":      s.Overflowed,
+		"dropped":         s.Dropped,
+		"queue_drops":     s.QueueDrops,
+		"sampled_out":     s.SampledOut,
+		"duplicates":      s.Duplicates,
+		"script_errors":   s.ScriptErrors,
+		"script_dropped":  s.ScriptDropped,
+		"skewed":          s.Skewed,
+		"routed":          s.Routed,
+		"queue_blocked":   s.QueueBlocked,
+		"queue_wait_ns":   s.QueueWait,
+		"write_wait_ns":   s.WriteWait,
+		"kernel_drops":    s.KernelDrops,
+		"circuit_opens":   s.CircuitOpens,
+		"spooled":         s.Spooled,
+		"spool_dropped":   s.SpoolDropped,
+		"replayed":        s.Replayed,
+		"retries":         s.Retries,
+		"retry_dropped":   s.RetryDropped,
+		"not_retried":     s.NotRetried,
+		"locked_out":      s.LockedOut,
+		"buffer_dropped":  s.BufferDropped,
+		"buffer_evicted":  s.BufferEvicted,
+		"peer_dropped":    s.PeerDropped,
+		"schema_violated": s.SchemaViolated,
+		"tags_limited":    s.TagsLimited,
+		"aggregated":      s.Aggregated,
+		"downsampled":     s.Downsampled,
+		"dead_lettered":   s.DeadLettered,
+		"split_batches":   s.SplitBatches,
+		"too_large":       s.TooLarge,
+		"lines_rejected":  s.LinesRejected,
+		"wal_errors":      s.WALErrors,
+	}
+	for class, n := range s.FlushErrors {
+		fields["flush_errors_"+errorClass(class).String()] = n
+	}
+	return fields
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+)
+
+var statsdTypes = map[string]string{
+	"c":  "counter",
+	"g":  "gauge",
+	"ms": "timing",
+	"h":  "histogram",
+	"d":  "distribution",
+	"s":  "set",
+}
+
+// maxStatsdGauges bounds the number of gauges a decoder remembers. Once
+// reached, remembered gauges are forgotten and changes start over from 0.
+const maxStatsdGauges = 4096
+
+// statsdGauges remembers the last value of each gauge decoded, so that gauge
+// values with a sign, which StatsD treats as changes to the gauge, can be
+// written as the value they result in.
+type statsdGauges struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newStatsdGauges() *statsdGauges {
+	return &statsdGauges{values: map[string]float64{}}
+}
+
+// update sets the gauge key to value, or changes it by value if delta is true,
+// and returns the gauge's new value. Changes to unknown gauges start from 0.
+func (g *statsdGauges) update(key string, value float64, delta bool) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if delta {
+		value += g.values[key]
+	}
+	if _, ok := g.values[key]; !ok && len(g.values) >= maxStatsdGauges {
+		g.values = map[string]float64{}
+	}
+	g.values[key] = value
+	return value
+}
+
+// decodeStatsd converts StatsD lines of the form
+// NAME:VALUE|TYPE[|@RATE][|#TAG:VALUE,...] to line protocol. Each metric
+// becomes a point in the measurement NAME with a value field and a
+// metric_type tag. Sets keep their value as a string; other values are
+// floats. Gauge values with a sign change the gauge's last value and are
+// written as the result. StatsD has no timestamps, so none are checked for.
+func (d *decoder) decodeStatsd(dst, payload []byte) ([]byte, error) {
+	for len(payload) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(payload, '\n'); i == -1 {
+			line, payload = payload, nil
+		} else {
+			line, payload = payload[:i], payload[i+1:]
+		}
+
+		line, err := d.checkWhitespace(line)
+		if err != nil {
+			return dst, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		if dst, err = d.appendStatsdLine(dst, line); err != nil {
+			return dst, fmt.Errorf("statsd: %v", err)
+		}
+	}
+	return dst, nil
+}
+
+func (d *decoder) appendStatsdLine(dst, line []byte) ([]byte, error) {
+	colon := bytes.IndexByte(line, ':')
+	if colon <= 0 {
+		return dst, fmt.Errorf("missing name: %q", line)
+	}
+	name, rest := line[:colon], line[colon+1:]
+
+	parts := bytes.Split(rest, []byte{'|'})
+	if len(parts) < 2 {
+		return dst, fmt.Errorf("missing type: %q", line)
+	}
+
+	value := parts[0]
+	typ, ok := statsdTypes[string(parts[1])]
+	if !ok {
+		return dst, fmt.Errorf("unknown type %q: %q", parts[1], line)
+	}
+
+	var (
+		rate []byte
+		tags []Tag
+	)
+	for _, part := range parts[2:] {
+		switch {
+		case len(part) > 1 && part[0] == '@':
+			r, err := strconv.ParseFloat(string(part[1:]), 64)
+			if err != nil || math.IsNaN(r) || math.IsInf(r, 0) {
+				return dst, fmt.Errorf("invalid sample rate %q: %q", part[1:], line)
+			}
+			if d.level != unchecked && (r <= 0 || r > 1) {
+				if fix, err := d.issue(line, "sample rate out of range"); !fix {
+					return dst, err
+				}
+				r = 1
+			}
+			rate = strconv.AppendFloat(nil, r, 'g', -1, 64)
+		case len(part) > 1 && part[0] == '#':
+			for _, kv := range bytes.Split(part[1:], []byte{','}) {
+				if i := bytes.IndexByte(kv, ':'); i > 0 {
+					tags = append(tags, Tag{string(kv[:i]), string(kv[i+1:])})
+				} else if len(kv) > 0 {
+					tags = append(tags, Tag{string(kv), "true"})
+				}
+			}
+		}
+	}
+
+	key := append([]byte(measurementEscaper.Replace(string(name))), encodeTags(append(tags, Tag{"metric_type", typ}))...)
+	if typ != "set" {
+		// Values are written as parsed, since ParseFloat accepts numbers,
+		// such as hex floats and those with a plus sign, that line protocol
+		// doesn't.
+		f, keep, err := d.parseValue(line, value)
+		if !keep {
+			return dst, err
+		}
+		if typ == "gauge" {
+			delta := value[0] == '+' || value[0] == '-'
+			f = d.gauges.update(string(key), f, delta)
+		}
+		value = strconv.AppendFloat(nil, f, 'g', -1, 64)
+	}
+
+	dst = append(dst, key...)
+	dst = append(dst, " value="...)
+	if typ == "set" {
+		dst = appendFieldString(dst, string(value))
+	} else {
+		dst = append(dst, value...)
+	}
+	if rate != nil {
+		dst = append(dst, ",sample_rate="...)
+		dst = append(dst, rate...)
+	}
+	return append(dst, '\n'), nil
+}
+
+// parseValue parses the value of a statsd or Graphite line. NaN and
+// infinities are invalid, since line protocol can't hold them. An out of
+// range value is an issue, clamped to the largest float when fixed. As with
+// issue, it returns false if the line should be dropped.
+func (d *decoder) parseValue(line, value []byte) (f float64, keep bool, err error) {
+	f, err = strconv.ParseFloat(string(value), 64)
+	if isRangeError(err) && d.level != unchecked {
+		if fix, err := d.issue(line, "value out of range"); !fix {
+			return 0, false, err
+		}
+		return math.Copysign(math.MaxFloat64, f), true, nil
+	} else if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false, fmt.Errorf("invalid value %q: %q", value, line)
+	}
+	return f, true, nil
+}
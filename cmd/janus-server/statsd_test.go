@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func newTestDecoder(t *testing.T, proto string, level strictness) *decoder {
+	t.Helper()
+	cfg := NewPortConfig()
+	cfg.Protocol, cfg.Strictness = proto, level
+	cfg.Forward = &url.URL{Scheme: "http", Host: "localhost:8086", Path: "/write", RawQuery: "db=test"}
+	d, err := newDecoder(cfg, new(portStats), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDecodeStatsd(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"hits:1|c", "hits,metric_type=counter value=1\n"},
+		{"hits:+1|c", "hits,metric_type=counter value=1\n"},
+		{"hits:2|c|@0.5", "hits,metric_type=counter value=2,sample_rate=0.5\n"},
+		{"req.time:320|ms|#host:a,canary", "req.time,host=a,canary=true,metric_type=timing value=320\n"},
+		{"users:alice|s", "users,metric_type=set value=\"alice\"\n"},
+		{"my metric:1|g", "my\\ metric,metric_type=gauge value=1\n"},
+		{"a:1|c\n\nb:2|c\n", "a,metric_type=counter value=1\nb,metric_type=counter value=2\n"},
+		{"hits:0x1p-2|c|@0x1p-1", "hits,metric_type=counter value=0.25,sample_rate=0.5\n"},
+	}
+	for _, tt := range tests {
+		d := newTestDecoder(t, protoStatsd, unchecked)
+		got, err := d.decode(nil, []byte(tt.in))
+		if err != nil {
+			t.Errorf("decode(%q): %v", tt.in, err)
+		} else if string(got) != tt.want {
+			t.Errorf("decode(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeStatsdGaugeDeltas(t *testing.T) {
+	d := newTestDecoder(t, protoStatsd, unchecked)
+	steps := []struct {
+		in, want string
+	}{
+		{"temp:+5|g", "temp,metric_type=gauge value=5\n"},
+		{"temp:10|g", "temp,metric_type=gauge value=10\n"},
+		{"temp:+2.5|g", "temp,metric_type=gauge value=12.5\n"},
+		{"temp:-15|g", "temp,metric_type=gauge value=-2.5\n"},
+		{"temp:-1|g|#room:b", "temp,room=b,metric_type=gauge value=-1\n"},
+		{"temp:0|g", "temp,metric_type=gauge value=0\n"},
+	}
+	for _, step := range steps {
+		got, err := d.decode(nil, []byte(step.in))
+		if err != nil {
+			t.Fatalf("decode(%q): %v", step.in, err)
+		}
+		if string(got) != step.want {
+			t.Errorf("decode(%q) = %q; want %q", step.in, got, step.want)
+		}
+	}
+}
+
+func TestDecodeStatsdOutOfRange(t *testing.T) {
+	tests := []struct {
+		level strictness
+		want  string
+	}{
+		{permissive, "hits,metric_type=counter value=-1.7976931348623157e+308\nok,metric_type=counter value=1\n"},
+		{lenient, "ok,metric_type=counter value=1\n"},
+	}
+	for _, tt := range tests {
+		d := newTestDecoder(t, protoStatsd, tt.level)
+		got, err := d.decode(nil, []byte("hits:-1e400|c\nok:1|c\n"))
+		if err != nil {
+			t.Errorf("%v: %v", tt.level, err)
+		} else if string(got) != tt.want {
+			t.Errorf("%v: decode = %q; want %q", tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeStatsdInvalid(t *testing.T) {
+	for _, in := range []string{
+		":1|c",
+		"hits:1",
+		"hits:1|x",
+		"hits:one|c",
+		"hits:|g",
+		"hits:1|c|@fast",
+		"hits:NaN|c",
+		"hits:+Inf|ms",
+		"hits:-infinity|g",
+		"hits:1|c|@NaN",
+	} {
+		d := newTestDecoder(t, protoStatsd, strict)
+		if got, err := d.decode(nil, []byte(in)); err == nil {
+			t.Errorf("decode(%q) = %q; want error", in, got)
+		}
+	}
+}
+
+func TestDecodeStatsdSampleRate(t *testing.T) {
+	const in = "hits:1|c|@2"
+	if _, err := newTestDecoder(t, protoStatsd, strict).decode(nil, []byte(in)); err == nil {
+		t.Errorf("strict decode(%q) succeeded; want error", in)
+	}
+
+	got, err := newTestDecoder(t, protoStatsd, permissive).decode(nil, []byte(in))
+	if want := "hits,metric_type=counter value=1,sample_rate=1\n"; err != nil || string(got) != want {
+		t.Errorf("permissive decode(%q) = %q, %v; want %q", in, got, err, want)
+	}
+
+	got, err = newTestDecoder(t, protoStatsd, lenient).decode(nil, []byte(in))
+	if err != nil || len(got) != 0 {
+		t.Errorf("lenient decode(%q) = %q, %v; want nothing", in, got, err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// logStats logs a summary of each gateway's counters every stats interval
+// until ctx is done. The interval is read from the running config, so that
+// reloads may change or disable it.
+func (s *server) logStats(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		var t time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case t = <-ticker.C:
+		}
+
+		s.mu.Lock()
+		interval := s.config.StatsInterval
+		if interval <= 0 || t.Sub(last) < interval {
+			s.mu.Unlock()
+			if interval <= 0 {
+				last = t
+			}
+			continue
+		}
+
+		for _, g := range s.gateways {
+			snap := g.stats.snapshot()
+			prev := g.logged
+			g.logged = snap
+
+			var failures uint64
+			for class := range snap.FlushErrors {
+				failures += snap.FlushErrors[class] - prev.FlushErrors[class]
+			}
+			glog.Infof("Stats for %v over %v: packets=%d bytes=%d flushes=%d flush_failures=%d write_errors=%d drops=%d queue=%d/%d",
+				g, t.Sub(last).Round(time.Second),
+				snap.Packets-prev.Packets,
+				snap.Bytes-prev.Bytes,
+				snap.Flushes-prev.Flushes,
+				failures,
+				snap.WriteErrors-prev.WriteErrors,
+				(snap.Dropped-prev.Dropped)+(snap.QueueDrops-prev.QueueDrops)+(snap.KernelDrops-prev.KernelDrops),
+				g.queue.depth(), g.cfg.Workers.Queue)
+		}
+		s.mu.Unlock()
+		last = t
+	}
+}
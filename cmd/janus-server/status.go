@@ -0,0 +1,97 @@
+package main
+
+import "expvar"
+
+// status holds process-wide state published through expvar.
+var status = expvar.NewMap("janus")
+
+// portStatus holds the counters of each running port, keyed by listeners.
+var portStatus = new(expvar.Map).Init()
+
+func init() {
+	status.Set("ports", portStatus)
+}
+
+// publishLimits publishes the server's request, in-flight byte, and egress
+// rate limits and the current usage of the first two.
+func (s *server) publishLimits() {
+	limit := func(fn func(*server) int64) expvar.Func {
+		return func() interface{} {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return fn(s)
+		}
+	}
+
+	status.Set("max_requests", limit(func(s *server) int64 { return int64(s.config.MaxRequests) }))
+	status.Set("max_inflight_bytes", limit(func(s *server) int64 { return s.inflight.limit }))
+	status.Set("max_egress_rate", limit(func(s *server) int64 { return s.config.MaxEgressRate }))
+	status.Set("inflight_bytes", limit(func(s *server) int64 { n, _ := s.inflight.usage(); return n }))
+	status.Set("inflight_requests", limit(func(s *server) int64 { _, n := s.inflight.usage(); return n }))
+}
+
+// publishHealth publishes the conditions that make running ports unhealthy,
+// keyed by port, with the reason for each.
+func (s *server) publishHealth() {
+	status.Set("unhealthy", expvar.Func(func() interface{} {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		unhealthy := map[string]string{}
+		for key, g := range s.gateways {
+			if g.lockout.isLocked() {
+				unhealthy[key] = "auth"
+			}
+		}
+		return unhealthy
+	}))
+}
+
+// publishConfig publishes the hash of the running config and when it was
+// applied. If a later load failed, the config is marked stale and the error
+// is included.
+func (s *server) publishConfig() {
+	status.Set("config", expvar.Func(func() interface{} {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		st := map[string]interface{}{
+			"hash":   s.config.Hash,
+			"loaded": s.loaded,
+			"stale":  s.configErr != nil,
+		}
+		if s.configErr != nil {
+			st["error"] = s.configErr.Error()
+			st["failed"] = s.failed
+		}
+		return st
+	}))
+}
+
+// listenerStatus is the state of a listener, as published.
+type listenerStatus struct {
+	Addr  string `json:"addr"`            // The configured address
+	Bound string `json:"bound,omitempty"` // The address bound, while bound
+}
+
+// listenerStatuses returns the state of each running port's listeners, keyed
+// by port.
+func (s *server) listenerStatuses() map[string][]listenerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make(map[string][]listenerStatus, len(s.gateways))
+	for key, g := range s.gateways {
+		list := make([]listenerStatus, len(g.in))
+		for i, p := range g.in {
+			list[i] = listenerStatus{Addr: p.orig.String(), Bound: p.localAddr()}
+		}
+		statuses[key] = list
+	}
+	return statuses
+}
+
+// publishListeners publishes the addresses each running port's listeners are
+// bound to.
+func (s *server) publishListeners() {
+	status.Set("listeners", expvar.Func(func() interface{} {
+		return s.listenerStatuses()
+	}))
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"go.spiff.io/codf"
+)
+
+// Gateway failure policies.
+const (
+	failureShutdown = "shutdown" // Shut down the process
+	failureRestart  = "restart"  // Restart the gateway, leaving the others running
+)
+
+// gatewayUptimeReset is how long a restarted gateway must run before its
+// earlier failures stop growing its restart backoff.
+const gatewayUptimeReset = time.Minute
+
+// SupervisorConfig controls what happens when a gateway fails.
+type SupervisorConfig struct {
+	Policy string // failureShutdown or failureRestart
+
+	// MaxFailures is the number of gateway failures within Window, across
+	// all gateways, at which the process is shut down even when restarting.
+	// 0 never shuts down.
+	MaxFailures int
+	// MaxRestarts is the number of times a single gateway may be restarted
+	// within Window. A gateway that fails again is left failed, without
+	// shutting down the process, until a reload replaces it. 0 is unlimited.
+	MaxRestarts int
+	Window      time.Duration
+	Backoff     backoff // Wait before restarting a gateway
+}
+
+func defaultSupervisor() SupervisorConfig {
+	b, _ := strategyBackoff(backoffExponential)
+	b.Interval, b.Max = time.Second, time.Minute
+	return SupervisorConfig{
+		Policy:      failureShutdown,
+		MaxFailures: 5,
+		Window:      10 * time.Minute,
+		Backoff:     b,
+	}
+}
+
+// handleOnGatewayFailure parses `on-gateway-failure shutdown` or
+// `on-gateway-failure restart [max-failures N] [max-restarts N] [window D]
+// [backoff BACKOFF...]`. The backoff takes the parameters of the backoff directive and
+// must come last.
+func (c *Config) handleOnGatewayFailure(args []codf.ExprNode) error {
+	sup := defaultSupervisor()
+	if err := parseArgsUpTo(args, &sup.Policy); err != nil {
+		return err
+	}
+	switch sup.Policy {
+	case failureShutdown:
+		if len(args) > 1 {
+			return fmt.Errorf("on-gateway-failure shutdown takes no other parameters")
+		}
+		c.Supervisor = sup
+		return nil
+	case failureRestart:
+	default:
+		return fmt.Errorf("invalid gateway failure policy %q; must be shutdown or restart", sup.Policy)
+	}
+
+	rest := args[1:]
+	for i := 0; i < len(rest); i += 2 {
+		if key, _ := codf.Word(rest[i]); key == "backoff" {
+			b, err := parseBackoff("on-gateway-failure backoff", rest[i+1:])
+			if err != nil {
+				return err
+			}
+			if err := b.Check(); err != nil {
+				return fmt.Errorf("on-gateway-failure backoff: %v", err)
+			}
+			sup.Backoff, rest = b, rest[:i]
+			break
+		}
+	}
+
+	err := parseKwargs("on-gateway-failure", rest, kwargs{
+		"max-failures": {dest: &sup.MaxFailures},
+		"max-restarts": {dest: &sup.MaxRestarts},
+		"window":       {dest: &sup.Window},
+	})
+	if err != nil {
+		return err
+	}
+	switch {
+	case sup.MaxFailures < 0:
+		return fmt.Errorf("max-failures must be >= 0; got %d", sup.MaxFailures)
+	case sup.MaxRestarts < 0:
+		return fmt.Errorf("max-restarts must be >= 0; got %d", sup.MaxRestarts)
+	case sup.Window <= 0:
+		return fmt.Errorf("window must be > 0s; got %v", sup.Window)
+	}
+	c.Supervisor = sup
+	return nil
+}
+
+// Supervisor states of a gateway.
+const (
+	gatewayRunning    = "running"
+	gatewayBackingOff = "backing-off" // Failed and waiting to be restarted
+	gatewayFailed     = "failed"      // Failed and not restarted
+)
+
+// supervision is the supervisor's record of a running gateway.
+type supervision struct {
+	state     string
+	started   time.Time     // When the gateway was last started
+	restarts  int           // Times the gateway has been restarted
+	failures  []time.Time   // Recent failures, within the window
+	lastError string        // The gateway's last failure, if any
+	retryAt   time.Time     // When the gateway is restarted, while backing off
+	backoff   *backoffState // Backoff of restarts, once the gateway has failed
+}
+
+// supervisorStatus is the supervisor's state of a gateway, as published.
+type supervisorStatus struct {
+	State     string     `json:"state"`
+	Started   time.Time  `json:"started"`
+	Restarts  int        `json:"restarts"`
+	LastError string     `json:"last_error,omitempty"`
+	RetryAt   *time.Time `json:"retry_at,omitempty"`
+}
+
+func (sv *supervision) status() supervisorStatus {
+	st := supervisorStatus{
+		State:     sv.state,
+		Started:   sv.started,
+		Restarts:  sv.restarts,
+		LastError: sv.lastError,
+	}
+	if sv.state == gatewayBackingOff {
+		retryAt := sv.retryAt
+		st.RetryAt = &retryAt
+	}
+	return st
+}
+
+// supervisorStatuses returns the supervisor's state of each gateway, keyed by
+// port.
+func (s *server) supervisorStatuses() map[string]supervisorStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make(map[string]supervisorStatus, len(s.gateways))
+	for key, g := range s.gateways {
+		statuses[key] = g.supervision.status()
+	}
+	return statuses
+}
+
+// publishSupervisor publishes the supervisor's state of each gateway.
+func (s *server) publishSupervisor() {
+	status.Set("supervisor", expvar.Func(func() interface{} {
+		return s.supervisorStatuses()
+	}))
+}
+
+// handleSupervisor responds with the supervisor's state of each gateway.
+func (s *server) handleSupervisor(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.supervisorStatuses())
+}
+
+// gatewayStarted records that g has been started.
+func (s *server) gatewayStarted(g *runningGateway) {
+	s.mu.Lock()
+	g.state, g.started, g.retryAt = gatewayRunning, time.Now(), time.Time{}
+	s.mu.Unlock()
+}
+
+// gatewayFailed records a failure of g and returns how long to wait before
+// restarting it. If it mustn't be restarted, restart is false and shutdown
+// reports whether the process should shut down.
+func (s *server) gatewayFailed(g *runningGateway, err error) (wait time.Duration, restart, shutdown bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	g.state, g.lastError = gatewayFailed, err.Error()
+	sup := s.config.Supervisor
+	if sup.Policy != failureRestart {
+		return 0, false, true
+	}
+
+	s.failures = append(recentFailures(s.failures, now, sup.Window), now)
+	if sup.MaxFailures > 0 && len(s.failures) >= sup.MaxFailures {
+		glog.Errorf("%d gateway failures within %v; shutting down", len(s.failures), sup.Window)
+		return 0, false, true
+	}
+
+	g.failures = append(recentFailures(g.failures, now, sup.Window), now)
+	if sup.MaxRestarts > 0 && len(g.failures) > sup.MaxRestarts {
+		glog.Errorf("Gateway %v has failed %d times within %v; not restarting it until it's reloaded",
+			g, len(g.failures), sup.Window)
+		return 0, false, false
+	}
+
+	if g.backoff == nil {
+		g.backoff = newBackoffState(sup.Backoff, 1)
+	}
+	if now.Sub(g.started) > gatewayUptimeReset {
+		g.backoff.succeed()
+	}
+	g.backoff.fail()
+	wait = g.backoff.next()
+	g.state, g.retryAt = gatewayBackingOff, now.Add(wait)
+	return wait, true, false
+}
+
+// recentFailures returns the times in failures within window of now, reusing
+// its storage.
+func recentFailures(failures []time.Time, now time.Time, window time.Duration) []time.Time {
+	recent := failures[:0]
+	for _, t := range failures {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	return recent
+}
+
+// restart replaces the failed gateway of g with a new one built from the same
+// config, returning it to be started. It returns nil if ctx, the context g
+// runs in, is done.
+func (s *server) restart(ctx context.Context, g *runningGateway) (*gateway, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ctx.Err() != nil {
+		// Stopped by apply while waiting to restart.
+		return nil, nil
+	}
+
+	cfg := g.cfg
+	next, err := newGateway(cfg, g.reuseport, s.inflight, s.egress, s.budgets[cfg.Budget], requestLimit(cfg, s.maxreqs))
+	if err != nil {
+		g.state, g.lastError = gatewayFailed, err.Error()
+		return nil, err
+	}
+
+	key := portKey(cfg)
+	g.gateway, g.rolled, g.logged = next, nil, portStats{}
+	g.restarts++
+	portStatus.Set(key, expvar.Func(next.status))
+	affinityStatus.Set(key, expvar.Func(next.affinity))
+	return next, nil
+}
+
+// supervise records the failure of g, waits out its restart backoff, and
+// restarts it, returning the new gateway. If the gateway isn't restarted, it
+// returns nil and whether the process should shut down.
+func (s *server) supervise(ctx context.Context, g *runningGateway, err error) (next *gateway, shutdown bool) {
+	wait, restart, shutdown := s.gatewayFailed(g, err)
+	if !restart {
+		return nil, shutdown
+	}
+
+	glog.Errorf("Restarting gateway %v in %v", g, wait)
+	sleep(ctx, wait)
+	if next, err = s.restart(ctx, g); err != nil {
+		glog.Errorf("Unable to restart gateway %v: %v", g, err)
+	}
+	return next, false
+}
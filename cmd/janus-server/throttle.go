@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// throttleChunk is the most a throttled body reads before waiting for the
+// bytes it read, so that large batches are smoothed rather than sent in a
+// burst after one long wait.
+const throttleChunk = 32 * 1024
+
+// rateLimiter is a token bucket bounding a byte rate, allowing bursts of up to
+// one second of bytes. Bytes are reserved before they're waited for, so
+// concurrent writers share the rate in the order they asked for it. Methods
+// of a nil rateLimiter don't wait.
+type rateLimiter struct {
+	rate float64 // Bytes per second
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter of rate bytes per second, or nil if rate
+// is <= 0.
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait blocks until n bytes may be sent or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(deficit / l.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttleTransport is an http.RoundTripper that sends request bodies no
+// faster than each of its limiters allows.
+type throttleTransport struct {
+	base   http.RoundTripper
+	limits []*rateLimiter
+}
+
+// newThrottleTransport returns base throttled by the given limiters, which
+// may be nil. If all are nil, it returns base.
+func newThrottleTransport(base http.RoundTripper, limits ...*rateLimiter) http.RoundTripper {
+	var used []*rateLimiter
+	for _, l := range limits {
+		if l != nil {
+			used = append(used, l)
+		}
+	}
+	if len(used) == 0 {
+		return base
+	}
+	return &throttleTransport{base: base, limits: used}
+}
+
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return t.base.RoundTrip(req)
+	}
+	dup := *req
+	dup.Body = &throttledBody{ReadCloser: req.Body, ctx: req.Context(), limits: t.limits}
+	return t.base.RoundTrip(&dup)
+}
+
+// throttledBody is a request body read no faster than its limiters allow.
+type throttledBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	limits []*rateLimiter
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := b.ReadCloser.Read(p)
+	for _, l := range b.limits {
+		if werr := l.wait(b.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
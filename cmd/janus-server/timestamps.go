@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.spiff.io/codf"
+)
+
+// TimestampConfig controls how a port treats line protocol timestamps.
+type TimestampConfig struct {
+	Add       bool // Append the time received to points without a timestamp
+	Normalize bool // Convert timestamps to the precision of the upstream
+}
+
+func (t TimestampConfig) enabled() bool { return t.Add || t.Normalize }
+
+// handleTimestamps parses `timestamps off` or `timestamps add|normalize...`.
+func (p *PortConfig) handleTimestamps(args []codf.ExprNode) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected 1 or more arguments; got 0")
+	}
+	if w, ok := codf.Word(args[0]); ok && w == "off" && len(args) == 1 {
+		p.Timestamps = TimestampConfig{}
+		return nil
+	}
+
+	var t TimestampConfig
+	for i, arg := range args {
+		switch opt, _ := codf.Word(arg); opt {
+		case "add":
+			t.Add = true
+		case "normalize":
+			t.Normalize = true
+		default:
+			return argError(i, arg, fmt.Errorf("invalid timestamps option %v; must be add or normalize", arg))
+		}
+	}
+	p.Timestamps = t
+	return nil
+}
+
+// Smallest magnitudes of current timestamps in each precision. Anything
+// below 1e11 is taken to be in seconds.
+const (
+	minNanoseconds  = 1e17
+	minMicroseconds = 1e14
+	minMilliseconds = 1e11
+)
+
+// timestampUnit guesses the precision of ts from its magnitude. This holds
+// for times between 1973 and 5138, which covers anything an agent sends.
+func timestampUnit(ts int64) time.Duration {
+	if ts < 0 {
+		ts = -ts
+	}
+	switch {
+	case ts >= minNanoseconds:
+		return time.Nanosecond
+	case ts >= minMicroseconds:
+		return time.Microsecond
+	case ts >= minMilliseconds:
+		return time.Millisecond
+	default:
+		return time.Second
+	}
+}
+
+// lineTimestamp returns the timestamp of line, the index it starts at, and
+// whether the line has one. Lines without a field set have no timestamp.
+func lineTimestamp(line []byte) (ts []byte, start int, ok bool) {
+	end := keyEnd(line)
+	if end == -1 {
+		return nil, -1, false
+	}
+	fend := fieldsEnd(line, end+1)
+	if fend == len(line) {
+		return nil, fend, false
+	}
+	return line[fend+1:], fend + 1, true
+}
+
+// precisionUnit returns the unit of timestamps sent to forward, as set by its
+// precision parameter.
+func precisionUnit(forward *url.URL) time.Duration {
+	switch forward.Query().Get("precision") {
+	case "h":
+		return time.Hour
+	case "m":
+		return time.Minute
+	case "s":
+		return time.Second
+	case "ms":
+		return time.Millisecond
+	case "u", "us":
+		return time.Microsecond
+	default:
+		return time.Nanosecond
+	}
+}
+
+// unixIn returns the time of ts, counted in unit since the Unix epoch.
+func unixIn(ts int64, unit time.Duration) time.Time {
+	if unit >= time.Second {
+		return time.Unix(ts*int64(unit/time.Second), 0)
+	}
+	perSec := int64(time.Second / unit)
+	return time.Unix(ts/perSec, ts%perSec*int64(unit))
+}
+
+// timestampStage adds missing timestamps to points and converts those it
+// finds to the precision set by the forwarding URL's precision parameter.
+// Without normalizing, a point sent in seconds to an upstream expecting
+// nanoseconds is silently written in 1970. Points whose timestamps then fall
+// outside the window set by older and future are dropped.
+type timestampStage struct {
+	cfg     TimestampConfig
+	forward *url.URL
+	older   time.Duration // Oldest accepted point, relative to now; 0 accepts all
+	future  time.Duration // Newest accepted point, relative to now; 0 accepts all
+	stats   *portStats
+	dead    *deadLetter
+}
+
+func (st *timestampStage) apply(dst, line []byte) []byte {
+	line = bytes.TrimRight(line, " \t\r")
+	ts, start, ok := lineTimestamp(line)
+	switch {
+	case !ok && start != -1 && st.cfg.Add:
+		dst = append(dst, line...)
+		dst = append(dst, ' ')
+		return strconv.AppendInt(dst, timestamp(st.forward, time.Now()), 10)
+	case !ok:
+		return append(dst, line...)
+	}
+
+	n, err := strconv.ParseInt(string(ts), 10, 64)
+	if err != nil {
+		return append(dst, line...) // Left for the upstream to reject
+	}
+
+	var t time.Time
+	if st.cfg.Normalize {
+		t = unixIn(n, timestampUnit(n))
+		n = timestamp(st.forward, t)
+	} else {
+		t = unixIn(n, precisionUnit(st.forward))
+	}
+
+	if !st.accept(t) {
+		st.stats.addSkewed()
+		st.dead.add(deadTimestamp, line)
+		return dst
+	}
+	dst = append(dst, line[:start]...)
+	return strconv.AppendInt(dst, n, 10)
+}
+
+// accept reports whether t falls within the stage's window.
+func (st *timestampStage) accept(t time.Time) bool {
+	now := time.Now()
+	switch {
+	case st.older > 0 && now.Sub(t) > st.older:
+		return false
+	case st.future > 0 && t.Sub(now) > st.future:
+		return false
+	}
+	return true
+}
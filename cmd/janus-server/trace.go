@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// maxPendingBatches bounds the number of undelivered batches a batchTracer
+// remembers. Batches the proxy gave up on are otherwise never forgotten.
+// Batches held by write-ahead log segments are kept past the bound, since
+// their segments can't be deleted until they're resolved.
+const maxPendingBatches = 64
+
+// batchTracer assigns IDs to batches of lines as they accumulate in a proxy's
+// buffer and follows each batch through its flush and any retries, which are
+// recognized by the flush ID their requests carry (see withFlushID).
+type batchTracer struct {
+	header string // Request header to send batch IDs in, if any
+
+	mu      sync.Mutex
+	current string                  // ID of the batch being accumulated
+	pending map[string]*tracedBatch // Batches sent but not delivered, by key
+}
+
+type tracedBatch struct {
+	id       string
+	attempts int
+	key      string    // Flush ID, or hash of the body, of the batch's requests
+	size     int       // Bytes in the batch
+	traceID  [16]byte  // Trace of the batch's flush spans
+	raw      int64     // Bytes written to the proxy for the batch, before encoding
+	evicted  bool      // Whether the batch was dropped to bound the buffer; guarded by the bufferLimit
+	wal      *walGroup // Write-ahead log segments holding the batch, if any
+	logged   bool      // Whether wal is set; guarded by the batchTracer
+	retryAt  time.Time // When the upstream asked for the batch to be retried, if it did
+}
+
+func newBatchTracer(header string) *batchTracer {
+	return &batchTracer{
+		header:  header,
+		pending: map[string]*tracedBatch{},
+	}
+}
+
+// newTraceID returns a random OpenTelemetry trace ID, shared by the spans
+// of a batch's flush attempts.
+func newTraceID() (id [16]byte) {
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func newBatchID() string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// accumulate is called when lines are written to the proxy, assigning an ID
+// to the batch they join if it doesn't have one yet.
+func (t *batchTracer) accumulate() {
+	t.mu.Lock()
+	if t.current == "" {
+		t.current = newBatchID()
+	}
+	t.mu.Unlock()
+}
+
+// flushKey is the context key of a flush ID.
+type flushKey struct{}
+
+// withFlushID returns ctx carrying a new flush ID, to flush a proxy with. A
+// proxy sends a batch and its retries within the flush that took it, so
+// requests carrying the same flush ID are attempts of the same batch, even
+// if another batch has the same lines.
+func withFlushID(ctx context.Context) context.Context {
+	return context.WithValue(ctx, flushKey{}, newBatchID())
+}
+
+// begin returns the batch sent by req and a copy of req carrying the batch's
+// ID header, if any. Attempts of a batch are recognized by the flush ID of
+// req's context. A request without one, sent by a flush the proxy started by
+// itself, is recognized by its body, which is read to hash it.
+func (t *batchTracer) begin(req *http.Request) (*tracedBatch, *http.Request, error) {
+	dup := new(http.Request)
+	*dup = *req
+
+	key, ok := req.Context().Value(flushKey{}).(string)
+	size := int(req.ContentLength)
+	if !ok {
+		var body []byte
+		if req.Body != nil {
+			var err error
+			body, err = ioutil.ReadAll(req.Body)
+			req.Body.Close()
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		sum := sha1.Sum(body)
+		key, size = string(sum[:]), len(body)
+		dup.Body = ioutil.NopCloser(bytes.NewReader(body))
+		dup.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	if size < 0 {
+		size = 0
+	}
+
+	t.mu.Lock()
+	batch, ok := t.pending[key]
+	if !ok {
+		id := t.current
+		if id == "" {
+			id = newBatchID()
+		}
+		t.current = ""
+
+		if len(t.pending) >= maxPendingBatches {
+			t.forget()
+		}
+		batch = &tracedBatch{id: id, key: key, size: size, traceID: newTraceID()}
+		t.pending[key] = batch
+	}
+	batch.attempts++
+	t.mu.Unlock()
+
+	if t.header != "" {
+		dup.Header = make(http.Header, len(req.Header)+1)
+		for k, v := range req.Header {
+			dup.Header[k] = v
+		}
+		dup.Header.Set(t.header, batch.id)
+	}
+	return batch, dup, nil
+}
+
+// forget drops the pending batches that aren't held by write-ahead log
+// segments. Must be called with t.mu held.
+func (t *batchTracer) forget() {
+	for key, batch := range t.pending {
+		if !batch.logged {
+			delete(t.pending, key)
+		}
+	}
+}
+
+// logged marks batch as held by write-ahead log segments, so that it isn't
+// forgotten until it's delivered or given up on.
+func (t *batchTracer) logged(batch *tracedBatch) {
+	t.mu.Lock()
+	batch.logged = true
+	t.mu.Unlock()
+}
+
+// delivered forgets a batch once the upstream has accepted it or it has been
+// given up on.
+func (t *batchTracer) delivered(batch *tracedBatch) {
+	t.mu.Lock()
+	delete(t.pending, batch.key)
+	t.mu.Unlock()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestBatchTracerBegin(t *testing.T) {
+	tr := newBatchTracer("X-Batch")
+	attempt := func(ctx context.Context) *tracedBatch {
+		t.Helper()
+		req, _ := http.NewRequest("POST", "http://localhost/write", bytes.NewReader([]byte("a=1\n")))
+		batch, dup, err := tr.begin(req.WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := dup.Header.Get("X-Batch"); got != batch.id {
+			t.Errorf("batch header = %q; want %q", got, batch.id)
+		}
+		return batch
+	}
+
+	first := withFlushID(context.Background())
+	a := attempt(first)
+	if b := attempt(first); b != a || b.attempts != 2 {
+		t.Errorf("retry in the same flush: got batch %s attempt %d; want batch %s attempt 2", b.id, b.attempts, a.id)
+	}
+	if c := attempt(withFlushID(context.Background())); c == a || c.attempts != 1 {
+		t.Errorf("same lines in another flush: got batch %s attempt %d; want a new batch", c.id, c.attempts)
+	}
+
+	// Without a flush ID, batches are told apart by their body.
+	d := attempt(context.Background())
+	if e := attempt(context.Background()); e != d || e.attempts != 2 {
+		t.Errorf("retry without a flush ID: got batch %s attempt %d; want batch %s attempt 2", e.id, e.attempts, d.id)
+	}
+}
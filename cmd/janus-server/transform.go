@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"go.spiff.io/codf"
+	"golang.org/x/net/context"
+)
+
+// handleTransform parses `transform off` or `transform exec PATH [ARG...]`.
+func (p *PortConfig) handleTransform(args []codf.ExprNode) error {
+	var kind string
+	var command []string
+	if len(args) == 1 {
+		if err := parseArgs(args, &kind); err != nil {
+			return err
+		}
+	} else if err := parseArgs(args, &kind, &command); err != nil {
+		return err
+	}
+
+	switch kind {
+	case "off":
+		if len(command) > 0 {
+			return fmt.Errorf("transform off takes no arguments")
+		}
+		p.Transform = nil
+	case "exec":
+		if len(command) == 0 {
+			return fmt.Errorf("transform exec requires a command")
+		}
+		p.Transform = command
+	default:
+		return argError(0, args[0], fmt.Errorf("invalid transform %q; must be exec or off", kind))
+	}
+	return nil
+}
+
+// execTransport pipes the body of each request through an external command
+// before sending it, replacing the body with the command's output. If the
+// command fails, so does the request, and the proxy retries it as it would
+// any failed flush.
+type execTransport struct {
+	base    http.RoundTripper
+	command []string
+	timeout time.Duration // Kills the command after this long, if > 0
+}
+
+func (t *execTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	gzipped := req.Header.Get("Content-Encoding") == "gzip"
+	if gzipped {
+		var err error
+		if body, err = gunzip(body); err != nil {
+			return nil, err
+		}
+	}
+
+	out, err := t.run(req.Context(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if gzipped {
+		if out, err = gzipBytes(out); err != nil {
+			return nil, err
+		}
+	}
+	return t.base.RoundTrip(withBody(req, out))
+}
+
+// run passes body to the command on stdin and returns its stdout.
+func (t *execTransport) run(ctx context.Context, body []byte) ([]byte, error) {
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.command[0], t.command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("transform %s failed: %v: %q", t.command[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.Bytes(), nil
+}
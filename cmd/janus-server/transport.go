@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.spiff.io/codf"
+)
+
+// TransportConfig configures the HTTP transport of a port's connections to
+// its upstreams.
+type TransportConfig struct {
+	Proxy   *url.URL // Proxy to connect through; nil uses HTTP_PROXY and HTTPS_PROXY
+	NoProxy bool     // Connect directly, ignoring the environment
+
+	// Connection pool options. Zero values keep the defaults of newTransport.
+	MaxIdle             int           // Idle connections kept across all hosts
+	MaxIdlePerHost      int           // Idle connections kept per host
+	IdleTimeout         time.Duration // How long an idle connection is kept
+	TLSHandshakeTimeout time.Duration
+	HTTP2               bool // Negotiate HTTP/2 with upstreams that support it
+}
+
+// handleConnections parses `connections [max-idle N] [max-idle-per-host N]
+// [idle-timeout D] [tls-handshake-timeout D] [http2 BOOL]`.
+func (p *PortConfig) handleConnections(args []codf.ExprNode) error {
+	t := p.Transport
+	err := parseKwargs("connections", args, kwargs{
+		"max-idle":              {dest: &t.MaxIdle},
+		"max-idle-per-host":     {dest: &t.MaxIdlePerHost},
+		"idle-timeout":          {dest: &t.IdleTimeout},
+		"tls-handshake-timeout": {dest: &t.TLSHandshakeTimeout},
+		"http2":                 {dest: &t.HTTP2},
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case t.MaxIdle < 0:
+		return fmt.Errorf("connections max-idle must be >= 0; got %d", t.MaxIdle)
+	case t.MaxIdlePerHost < 0:
+		return fmt.Errorf("connections max-idle-per-host must be >= 0; got %d", t.MaxIdlePerHost)
+	case t.IdleTimeout < 0:
+		return fmt.Errorf("connections idle-timeout must be >= 0s; got %v", t.IdleTimeout)
+	case t.TLSHandshakeTimeout < 0:
+		return fmt.Errorf("connections tls-handshake-timeout must be >= 0s; got %v", t.TLSHandshakeTimeout)
+	}
+	p.Transport = t
+	return nil
+}
+
+// handleHTTPProxy parses `http-proxy URL|env|off`.
+func (p *PortConfig) handleHTTPProxy(args []codf.ExprNode) error {
+	if len(args) == 1 {
+		if w, ok := codf.Word(args[0]); ok && (w == "env" || w == "off") {
+			p.Transport.Proxy, p.Transport.NoProxy = nil, w == "off"
+			return nil
+		}
+	}
+
+	var proxy *url.URL
+	if err := parseArgs(args, &proxy); err != nil {
+		return err
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return argError(0, args[0], fmt.Errorf("http-proxy must be http, https, or socks5; got %q", proxy.Scheme))
+	}
+	p.Transport.Proxy, p.Transport.NoProxy = proxy, false
+	return nil
+}
+
+// apply sets the config's options on t.
+func (c TransportConfig) apply(t *http.Transport) {
+	switch {
+	case c.NoProxy:
+		t.Proxy = nil
+	case c.Proxy != nil:
+		t.Proxy = http.ProxyURL(c.Proxy)
+	}
+
+	if c.MaxIdle > 0 {
+		t.MaxIdleConns = c.MaxIdle
+	}
+	if c.MaxIdlePerHost > 0 {
+		t.MaxIdleConnsPerHost = c.MaxIdlePerHost
+	}
+	if c.IdleTimeout > 0 {
+		t.IdleConnTimeout = c.IdleTimeout
+	}
+	if c.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = c.TLSHandshakeTimeout
+	}
+
+	// Transports with a custom dialer only use HTTP/2 when forced to. An
+	// empty TLSNextProto keeps it off regardless.
+	if c.HTTP2 {
+		t.ForceAttemptHTTP2 = true
+	} else {
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+}
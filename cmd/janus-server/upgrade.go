@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	upgradeDrain   = flag.Duration("upgrade-drain", 5*time.Second, "How long a process upgraded by SIGTTIN keeps reading alongside its replacement, once the replacement is ready, before shutting down")
+	upgradeTimeout = flag.Duration("upgrade-timeout", time.Minute, "How long a process upgraded by SIGTTIN waits for its replacement to be ready before stopping it and giving up on the upgrade")
+)
+
+// upgradeEnv is set to the parent's PID in a process started by an upgrade.
+// Its inherited listeners are passed the same way as by systemd socket
+// activation, except that LISTEN_PID is unset: the parent can't know the
+// child's PID before starting it.
+const upgradeEnv = "JANUS_UPGRADE"
+
+// upgradeReadyEnv is set to the file descriptor of a pipe that a process
+// started by an upgrade writes to once it's ready, passed after its
+// listeners. The parent keeps running until then.
+const upgradeReadyEnv = "JANUS_UPGRADE_READY"
+
+// readyPipe is the pipe to tell the parent that this process is ready, if
+// it was started by an upgrade.
+var readyPipe *os.File
+
+// upgrading is set while an upgrade is started and once it has succeeded.
+var upgrading int32
+
+// httpListeners are the listeners of the admin API and debug endpoints, by
+// what they serve. They're passed to the new process on upgrade, since it
+// couldn't bind to their addresses while this process holds them.
+var httpListeners struct {
+	sync.Mutex
+	m map[string]*net.TCPListener
+}
+
+func addHTTPListener(what string, l *net.TCPListener) {
+	httpListeners.Lock()
+	defer httpListeners.Unlock()
+	if httpListeners.m == nil {
+		httpListeners.m = make(map[string]*net.TCPListener)
+	}
+	httpListeners.m[what] = l
+}
+
+func removeHTTPListener(what string) {
+	httpListeners.Lock()
+	defer httpListeners.Unlock()
+	delete(httpListeners.m, what)
+}
+
+// pidLock is the process's locked pidfile, if any. It's handed off to the
+// new process on upgrade.
+var pidLock *pidFile
+
+// listenerFiles returns duplicates of the sockets of all bound listeners,
+// along with the name of each listener's port, followed by those of the admin
+// API and debug endpoints.
+func (s *server) listenerFiles() (files []*os.File, names []string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, g := range s.gateways {
+		for _, p := range g.in {
+			f, err := p.file()
+			if err != nil {
+				closeFiles(files)
+				return nil, nil, fmt.Errorf("unable to pass listener %v: %v", p.orig, err)
+			} else if f == nil {
+				continue // Not bound
+			}
+			files = append(files, f)
+			names = append(names, g.cfg.Name)
+		}
+	}
+
+	httpListeners.Lock()
+	defer httpListeners.Unlock()
+	for what, l := range httpListeners.m {
+		f, err := l.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, fmt.Errorf("unable to pass %s listener %v: %v", what, l.Addr(), err)
+		}
+		files = append(files, f)
+		names = append(names, what)
+	}
+	return files, names, nil
+}
+
+// isUpgradeSignal reports whether sig starts an upgrade.
+func isUpgradeSignal(sig os.Signal) bool {
+	return isSignal(sig, upgradeSignals)
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// upgrade starts a new janus from the current executable with the same
+// arguments, passing it the sockets of all bound listeners. The returned
+// channel receives nil once the new process is ready, after which the caller
+// should shut down after the upgrade drain period, during which both
+// processes read from the sockets. If the new process exits or isn't ready
+// within the upgrade timeout, it's stopped and the channel receives an error.
+func (s *server) upgrade(cfgfiles []string) (<-chan error, error) {
+	if !activationSupported {
+		return nil, errors.New("upgrades are not supported on this platform")
+	}
+	for _, fp := range cfgfiles {
+		if fp == "-" {
+			return nil, errors.New("cannot upgrade with config read from standard input")
+		}
+	}
+	if !atomic.CompareAndSwapInt32(&upgrading, 0, 1) {
+		return nil, errors.New("an upgrade is already in progress")
+	}
+	started := false
+	defer func() {
+		if !started {
+			atomic.StoreInt32(&upgrading, 0)
+		}
+	}()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	files, names, err := s.listenerFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer closeFiles(files)
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyW.Close()
+
+	env := make([]string, 0, len(os.Environ())+4)
+	for _, kv := range os.Environ() {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", upgradeEnv, upgradeReadyEnv:
+			continue
+		}
+		env = append(env, kv)
+	}
+	env = append(env,
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		upgradeEnv+"="+strconv.Itoa(os.Getpid()),
+		upgradeReadyEnv+"="+strconv.Itoa(listenFDStart+len(files)),
+	)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW) // Passed starting at fd 3, as with activation
+
+	// The new process takes the pidfile's lock; take it back if it fails.
+	if pidLock != nil {
+		pidLock.unlock()
+	}
+	if err := cmd.Start(); err != nil {
+		ready.Close()
+		relockPidFile()
+		return nil, err
+	}
+	started = true
+
+	glog.Infof("Started new janus (pid %d) with %d listeners; waiting for it to be ready", cmd.Process.Pid, len(files))
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }() // Reap the child if it exits before this process does
+
+	result := make(chan error, 1)
+	go func() {
+		err := awaitReady(ready, exited, *upgradeTimeout)
+		if err != nil {
+			cmd.Process.Kill()
+			<-exited
+			relockPidFile()
+			atomic.StoreInt32(&upgrading, 0)
+		}
+		ready.Close()
+		result <- err
+	}()
+	return result, nil
+}
+
+// awaitReady waits for the new process of an upgrade to write to ready. It
+// fails if the process exits first or isn't ready within timeout.
+func awaitReady(ready *os.File, exited <-chan error, timeout time.Duration) error {
+	read := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := ready.Read(b[:])
+		read <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-read:
+		if err == io.EOF {
+			return errors.New("new process exited before it was ready")
+		}
+		return err
+	case err := <-exited:
+		if err == nil {
+			err = errors.New("exited")
+		}
+		return fmt.Errorf("new process exited before it was ready: %v", err)
+	case <-timer.C:
+		return fmt.Errorf("new process wasn't ready after %v", timeout)
+	}
+}
+
+// relockPidFile takes back the pidfile's lock after an upgrade failed.
+func relockPidFile() {
+	if pidLock == nil {
+		return
+	}
+	if relocked, err := writePidFile(pidLock.path); err != nil {
+		glog.Errorf("Unable to lock pidfile again: %v", err)
+	} else {
+		pidLock = relocked
+	}
+}
+
+// reportReady tells the process that started this one in an upgrade, if any,
+// that it's ready, so that it can shut down.
+func reportReady() {
+	if readyPipe == nil {
+		return
+	}
+	if _, err := readyPipe.Write([]byte{1}); err != nil {
+		glog.Errorf("Unable to report ready to the upgraded process: %v", err)
+	}
+	readyPipe.Close()
+	readyPipe = nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// upgradeSignals are the signals that start an upgrade. Upgrades were started
+// by SIGUSR2 until it was given to toggling verbose logging; SIGTTIN is used
+// instead.
+var upgradeSignals = []os.Signal{syscall.SIGTTIN}
+
+// takeReadyPipe sets readyPipe from the environment, if this process was
+// started by an upgrade. It must be called before any commands are started,
+// so that they don't inherit the pipe.
+func takeReadyPipe() {
+	fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv))
+	os.Unsetenv(upgradeReadyEnv)
+	if err != nil || fd < listenFDStart {
+		return
+	}
+	syscall.CloseOnExec(fd)
+	readyPipe = os.NewFile(uintptr(fd), "upgrade-ready")
+}
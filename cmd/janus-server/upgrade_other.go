@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// upgradeSignals is empty: upgrades rely on socket activation, which is only
+// supported on Linux.
+var upgradeSignals []os.Signal
+
+// takeReadyPipe does nothing: processes are only started by upgrades on
+// Linux.
+func takeReadyPipe() {}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// errorClass categorizes a failed flush to an upstream.
+type errorClass int
+
+const (
+	classAuth      errorClass = iota // 401 and 403 responses
+	classSchema                      // 400 responses, usually malformed points
+	classThrottled                   // 429 responses
+	classClient                      // Other 4xx responses
+	classServer                      // 5xx responses
+	classTimeout                     // Timeouts and deadlines
+	classRefused                     // Refused connections
+	classNetwork                     // Other transport errors
+
+	numErrorClasses
+)
+
+var errorClassNames = [numErrorClasses]string{
+	classAuth:      "auth",
+	classSchema:    "schema",
+	classThrottled: "throttled",
+	classClient:    "client",
+	classServer:    "server",
+	classTimeout:   "timeout",
+	classRefused:   "refused",
+	classNetwork:   "network",
+}
+
+func (c errorClass) String() string { return errorClassNames[c] }
+
+// classifyStatus returns the class of an HTTP status code and whether it is a
+// failure.
+func classifyStatus(code int) (class errorClass, failed bool) {
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return classAuth, true
+	case code == http.StatusBadRequest:
+		return classSchema, true
+	case code == http.StatusTooManyRequests:
+		return classThrottled, true
+	case code >= 400 && code < 500:
+		return classClient, true
+	case code >= 500:
+		return classServer, true
+	}
+	return 0, false
+}
+
+func classifyError(err error) errorClass {
+	var nerr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &nerr) && nerr.Timeout():
+		return classTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return classRefused
+	}
+	return classNetwork
+}
+
+// authLockout tracks consecutive authentication failures against an
+// upstream. Once threshold failures are seen in a row, the upstream is locked
+// out until reset or its credentials change. A threshold <= 0 never locks
+// out.
+type authLockout struct {
+	threshold int
+
+	mu       sync.Mutex
+	failures int
+	locked   bool
+}
+
+func (a *authLockout) isLocked() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.locked
+}
+
+// fail records an authentication failure and returns true if it caused the
+// upstream to become locked out.
+func (a *authLockout) fail() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.failures++
+	if a.locked || a.threshold <= 0 || a.failures < a.threshold {
+		return false
+	}
+	a.locked = true
+	return true
+}
+
+func (a *authLockout) succeed() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.failures = 0
+}
+
+// reset clears the failures and lockout and returns true if the upstream was
+// locked out.
+func (a *authLockout) reset() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	locked := a.locked
+	a.failures, a.locked = 0, false
+	return locked
+}
+
+// inherit takes over the failures and lockout of prev, for a gateway
+// replacing another with the same credentials.
+func (a *authLockout) inherit(prev *authLockout) {
+	prev.mu.Lock()
+	failures, locked := prev.failures, prev.locked
+	prev.mu.Unlock()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.failures, a.locked = failures, locked && a.threshold > 0
+}
+
+// classifyTransport is an http.RoundTripper that counts and logs failed
+// requests by class. Up to bodyLimit bytes of failed responses' bodies are
+// logged; the body is left intact for the caller. Batches are dropped while
+// the upstream is locked out.
+type classifyTransport struct {
+	base      http.RoundTripper
+	port      string // Port description, for events
+	stats     *portStats
+	lockout   *authLockout
+	lines     *lineCounter
+	trace     *batchTracer
+	flushes   *flushHistory
+	probe     *upstreamProbe // Active health checks of the upstream, if any
+	retries   *retryBudget   // Limits retries across flushes, if any
+	buffer    *bufferLimit   // Bounds undelivered bytes, if any
+	wal       *writeAheadLog // Logs payloads until their batch is resolved, if any
+	backoff   *backoffState  // Carries given up batches into later retries, if any
+	adaptive  *adaptiveSizer // Sizes batches from flush results, if any
+	dead      *deadLetter    // Records dropped batches, if enabled
+	dropOn    classSet       // Classes of failures dropped rather than retried
+	bodyLimit int
+
+	// maxAttempts is the number of attempts after which the proxy gives up
+	// on a batch, or 0 if it never does.
+	maxAttempts int
+}
+
+func (t *classifyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.probe != nil && !t.lockout.isLocked() {
+		if err := t.probe.wait(req.Context()); err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+	}
+
+	batch, req, err := t.trace.begin(req)
+	if err != nil {
+		return nil, err
+	}
+	if batch.attempts == 1 {
+		// The proxy's buffer has been taken for this batch. Retries resend it
+		// and leave the buffer being accumulated alone, along with lines
+		// written since it was taken.
+		if lines, size, ok := batchLines(req); ok {
+			batch.raw = int64(size)
+			t.lines.remove(lines, size)
+		} else {
+			batch.raw = t.lines.batch().size
+			t.lines.reset()
+		}
+		t.sent(batch)
+	}
+	switch {
+	case t.lockout.isLocked():
+		t.stats.addLockedOut()
+		glog.Errorf("Dropping batch %s to %v; upstream is locked out after authentication failures",
+			batch.id, redactURL(req.URL))
+		t.deadLetter(deadLockedOut, batch, req)
+		return t.drop(batch, req), nil
+	case batch.attempts == 1:
+		if t.retries != nil {
+			t.retries.flush()
+		}
+	case t.buffer != nil && t.buffer.evicted(batch):
+		t.deadLetter(deadBuffer, batch, req)
+		return t.drop(batch, req), nil
+	case t.retries != nil && !t.retries.retry():
+		t.stats.addRetryDropped()
+		glog.Errorf("Dropping batch %s to %v after %d attempts; retry budget exhausted",
+			batch.id, redactURL(req.URL), batch.attempts-1)
+		t.deadLetter(deadRetryBudget, batch, req)
+		return t.drop(batch, req), nil
+	default:
+		if wait := time.Until(batch.retryAt); wait > 0 {
+			sleep(req.Context(), wait)
+			if err := req.Context().Err(); err != nil {
+				return nil, err
+			}
+		}
+		t.stats.addRetry()
+		glog.Infof("Retrying batch %s to %v (attempt %d)", batch.id, redactURL(req.URL), batch.attempts)
+	}
+
+	span, req := tracer.startFlush(t.port, batch, req)
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	switch {
+	case err == errSpooled:
+		// The port's circuit breaker holds the batch until it can be
+		// replayed, so the proxy is done with it.
+		t.trace.delivered(batch)
+		t.abandon(batch)
+		return noContent(req), nil
+	case errors.Is(err, errCircuitOpen):
+		t.failed(batch, req)
+		return nil, err
+	}
+	if t.adaptive != nil {
+		// Only errors and responses that signal an overloaded upstream
+		// shrink batches.
+		overloaded := err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		t.adaptive.observe(!overloaded, time.Since(start))
+	}
+	if err != nil {
+		class := classifyError(err)
+		span.end(nil, true, class, err)
+		t.stats.addFlushError(class)
+		t.flushes.record(false)
+		glog.Errorf("Flush of batch %s to %v failed (%v): %v", batch.id, redactURL(req.URL), class, err)
+		if t.dropOn.has(class) {
+			return t.reject(batch, req, class), nil
+		}
+		t.failed(batch, req)
+		return nil, err
+	}
+
+	class, failed := classifyStatus(resp.StatusCode)
+	span.end(resp, failed, class, nil)
+	if !failed {
+		t.stats.addFlush()
+		t.flushes.record(true)
+		t.lockout.succeed()
+		if t.backoff != nil {
+			t.backoff.succeed()
+		}
+		t.trace.delivered(batch)
+		t.release(batch)
+		if glog.V(1) {
+			glog.Infof("Flushed batch %s to %v (attempt %d)", batch.id, redactURL(req.URL), batch.attempts)
+		}
+		return resp, nil
+	}
+
+	t.stats.addFlushError(class)
+	t.flushes.record(false)
+	body := captureBody(resp, t.bodyLimit)
+	glog.Errorf("Flush of batch %s to %v failed (%v): %s: %q", batch.id, redactURL(req.URL), class, resp.Status, body)
+
+	if class == classAuth && t.lockout.fail() {
+		glog.Errorf("Flushes to %v have failed authentication %d times in a row; "+
+			"locking out upstream until its credentials change or it is reset at /lockout/reset",
+			redactURL(req.URL), t.lockout.threshold)
+		emitEvent(eventAuthLockout, t.port, "Upstream %v locked out after %d authentication failures",
+			redactURL(req.URL), t.lockout.threshold)
+	}
+
+	if t.dropOn.has(class) {
+		resp.Body.Close()
+		return t.reject(batch, req, class), nil
+	}
+	if class == classThrottled {
+		if wait := retryAfter(resp); wait > 0 {
+			batch.retryAt = time.Now().Add(wait)
+		}
+	}
+	t.failed(batch, req)
+	return resp, nil
+}
+
+// reject drops batch after a failure of a class that isn't retried.
+func (t *classifyTransport) reject(batch *tracedBatch, req *http.Request, class errorClass) *http.Response {
+	t.stats.addNotRetried()
+	glog.Errorf("Dropping batch %s to %v; %v failures aren't retried", batch.id, redactURL(req.URL), class)
+	return t.drop(batch, req)
+}
+
+// drop acknowledges batch without sending it, so that the proxy doesn't
+// retry it, and returns the response standing in for the upstream's.
+func (t *classifyTransport) drop(batch *tracedBatch, req *http.Request) *http.Response {
+	t.trace.delivered(batch)
+	t.abandon(batch)
+	req.Body.Close()
+	return noContent(req)
+}
+
+// sent is called on the first attempt of batch, once it has been taken from
+// the proxy's buffer.
+func (t *classifyTransport) sent(batch *tracedBatch) {
+	if t.buffer != nil {
+		t.buffer.sent(batch)
+	}
+	if t.wal != nil {
+		t.wal.sent(batch)
+		t.trace.logged(batch)
+	}
+}
+
+// release is called once batch is delivered.
+func (t *classifyTransport) release(batch *tracedBatch) {
+	if t.buffer != nil {
+		t.buffer.release(batch)
+	}
+	if t.wal != nil {
+		t.wal.release(batch)
+	}
+}
+
+// abandon is called once batch is given up on, dropped, or handed off to the
+// circuit breaker's spool. Its write-ahead log segments are kept for the next
+// run to recover.
+func (t *classifyTransport) abandon(batch *tracedBatch) {
+	if t.buffer != nil {
+		t.buffer.release(batch)
+	}
+	if t.wal != nil {
+		t.wal.abandon(batch)
+	}
+}
+
+// failed is called after a failed attempt of batch, sent by req, abandoning
+// it if the proxy won't try it again.
+func (t *classifyTransport) failed(batch *tracedBatch, req *http.Request) {
+	if t.maxAttempts > 0 && batch.attempts >= t.maxAttempts {
+		glog.Errorf("Giving up on batch %s after %d attempts", batch.id, batch.attempts)
+		t.deadLetter(deadGivenUp, batch, req)
+		t.trace.delivered(batch)
+		t.abandon(batch)
+		if t.backoff != nil {
+			t.backoff.fail()
+		}
+	}
+}
+
+// deadLetter records batch, sent by req, as dropped for reason. req's body
+// is left as it is.
+func (t *classifyTransport) deadLetter(reason string, batch *tracedBatch, req *http.Request) {
+	if t.dead == nil || req.GetBody == nil {
+		return
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		glog.Errorf("Unable to dead-letter batch %s: %v", batch.id, err)
+		return
+	}
+	payload, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		glog.Errorf("Unable to dead-letter batch %s: %v", batch.id, err)
+		return
+	}
+	t.dead.addBatch(reason, batch, payload)
+}
+
+// batchLines returns the number of lines and bytes, before encoding, of the
+// batch req sends, or false if its body can't be read again.
+func batchLines(req *http.Request) (lines, size int, ok bool) {
+	if req.GetBody == nil {
+		return 0, 0, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return 0, 0, false
+	}
+	payload, err := ioutil.ReadAll(body)
+	body.Close()
+	if err == nil {
+		payload, err = decodeBody(req, payload)
+	}
+	if err != nil {
+		return 0, 0, false
+	}
+	return countLines(payload), len(payload), true
+}
+
+// captureBody reads up to limit bytes from resp's body and returns them,
+// replacing the body with one that still yields the full content.
+func captureBody(resp *http.Response, limit int) []byte {
+	if limit <= 0 || resp.Body == nil {
+		return nil
+	}
+
+	buf := make([]byte, limit)
+	n, _ := io.ReadFull(resp.Body, buf)
+	buf = buf[:n]
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), resp.Body), resp.Body}
+	return buf
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestLockedOutBatchIsDropped(t *testing.T) {
+	stats := new(portStats)
+	lockout := &authLockout{threshold: 1}
+	lockout.fail()
+	buffer := newBufferLimit(BufferConfig{Max: 1 << 20, Overflow: bufferDropNewest}, stats)
+	buffer.reserve(4)
+	lines := newLineCounter(0, nil)
+	lines.add(1, 4)
+
+	ct := &classifyTransport{
+		base: roundTripFunc(func(*http.Request) (*http.Response, error) {
+			t.Fatal("locked out batch was sent upstream")
+			return nil, nil
+		}),
+		stats:   stats,
+		lockout: lockout,
+		lines:   lines,
+		trace:   newBatchTracer(""),
+		flushes: new(flushHistory),
+		buffer:  buffer,
+	}
+
+	req, _ := http.NewRequest("POST", "http://localhost/write", bytes.NewReader([]byte("a=1\n")))
+	resp, err := ct.RoundTrip(req.WithContext(withFlushID(req.Context())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d; want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if n := len(ct.trace.pending); n != 0 {
+		t.Errorf("%d batches still pending", n)
+	}
+	if n := buffer.usage(); n != 0 {
+		t.Errorf("buffer holds %d bytes; want 0", n)
+	}
+	if stats.LockedOut != 1 {
+		t.Errorf("locked_out = %d; want 1", stats.LockedOut)
+	}
+}
+
+func TestAuthLockoutInherit(t *testing.T) {
+	prev := &authLockout{threshold: 2}
+	prev.fail()
+	prev.fail()
+
+	next := &authLockout{threshold: 2}
+	next.inherit(prev)
+	if !next.isLocked() {
+		t.Error("lockout wasn't inherited")
+	}
+	if !next.reset() || next.isLocked() {
+		t.Error("reset didn't clear the lockout")
+	}
+
+	off := new(authLockout)
+	off.inherit(prev)
+	if off.isLocked() {
+		t.Error("lockout inherited with lockouts disabled")
+	}
+}
+
+func TestSameCredentials(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"http://db:8086", "http://db2:8086?db=x", true},
+		{"http://u:p@db:8086", "http://u:p@db2:8086", true},
+		{"http://u:p@db:8086", "http://u:q@db:8086", false},
+		{"http://db:8086?u=a&p=b", "http://db:8086?p=b&u=a", true},
+		{"http://db:8086?u=a&p=b", "http://db:8086?u=a&p=c", false},
+		{"http://db:8086", "http://u@db:8086", false},
+	}
+	for _, tt := range tests {
+		a, _ := url.Parse(tt.a)
+		b, _ := url.Parse(tt.b)
+		if got := sameCredentials(a, b); got != tt.want {
+			t.Errorf("sameCredentials(%s, %s) = %v; want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"go.spiff.io/codf"
+	"go.spiff.io/dagr/outflux"
+)
+
+// WALConfig configures a port's write-ahead log.
+type WALConfig struct {
+	Dir  string // Directory of the log's segments; empty disables the log
+	Sync bool   // Whether to fsync each append
+}
+
+// handleWAL parses `wal off` or `wal DIR [sync BOOL]`.
+func (p *PortConfig) handleWAL(args []codf.ExprNode) error {
+	if len(args) == 1 {
+		if w, ok := codf.Word(args[0]); ok && w == "off" {
+			p.WAL = WALConfig{}
+			return nil
+		}
+	}
+
+	var w WALConfig
+	if err := parseArgsUpTo(args, &w.Dir); err != nil {
+		return err
+	}
+	err := parseKwargs("wal", args[1:], kwargs{
+		"sync": {dest: &w.Sync},
+	})
+	if err != nil {
+		return err
+	}
+	if w.Dir == "" {
+		return errors.New("wal directory must not be empty")
+	}
+	p.WAL = w
+	return nil
+}
+
+const walFileExt = ".wal"
+
+// walLockFile is the file locked by the write-ahead log using a directory.
+const walLockFile = "LOCK"
+
+// walLockInterval is how often a write-ahead log tries again to lock its
+// directory while another holds it.
+const walLockInterval = 100 * time.Millisecond
+
+// writeAheadLog appends each payload written to a port's proxy to a segment
+// file first. A new segment is started for each batch the proxy sends, and
+// segments are deleted once their batch is delivered. Since a payload may be
+// logged just before a batch is taken and land in the next one, a batch's
+// segments are only deleted once the batch after it is delivered as well.
+// Segments of batches that aren't delivered are kept.
+//
+// Segments left by an earlier run are written to the proxy when the port
+// starts, so payloads are delivered at least once across restarts. Only the
+// log holding the lock on the directory recovers them; a log replacing
+// another on a reload or upgrade waits for the old one to close first.
+type writeAheadLog struct {
+	cfg WALConfig
+
+	mu     sync.Mutex
+	last   int64           // Sequence number of the last segment created
+	cur    *os.File        // Segment being appended to, if any
+	own    map[string]bool // Segments created by this log, never recovered
+	open   []string        // Segments whose payloads are in the proxy's buffer
+	groups []*walGroup     // Segments of sent batches, oldest first
+	lock   *os.File        // Locked file in the directory, once recovered
+	closed bool
+}
+
+// walGroup is the set of segments holding a sent batch.
+type walGroup struct {
+	segments []string
+	resolved bool // Whether the batch was delivered or abandoned
+	kept     bool // Whether the batch was abandoned, keeping its segments
+}
+
+// openWAL returns the write-ahead log in cfg.Dir, creating the directory if
+// needed.
+func openWAL(cfg WALConfig) (*writeAheadLog, error) {
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{cfg: cfg, own: make(map[string]bool)}, nil
+}
+
+// lockDir takes an exclusive lock on the log's directory, waiting for any
+// other log using it, in this process or another, to close.
+func (w *writeAheadLog) lockDir(ctx context.Context) error {
+	path := filepath.Join(w.cfg.Dir, walLockFile)
+	for waiting := false; ; waiting = true {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		if err = lockFile(f); err == nil {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			if w.closed {
+				f.Close()
+				return errors.New("write-ahead log closed")
+			}
+			w.lock = f
+			return nil
+		}
+		f.Close()
+		if err != errLocked {
+			return err
+		}
+
+		if !waiting {
+			glog.Infof("Write-ahead log %s is in use; waiting to recover it", w.cfg.Dir)
+		}
+		timer := time.NewTimer(walLockInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// walSegments returns the paths of the segments in dir, oldest first.
+func walSegments(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, fi := range infos {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), walFileExt) {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, fi.Name()))
+	}
+	sort.Strings(paths) // Names sort by sequence
+	return paths, nil
+}
+
+// recover locks the log's directory, then writes the segments left by an
+// earlier run or a log that used the directory before to proxy. They're
+// deleted once the batches holding them are delivered.
+func (w *writeAheadLog) recover(ctx context.Context, proxy *outflux.Proxy) error {
+	if err := w.lockDir(ctx); err != nil {
+		return err
+	}
+	paths, err := walSegments(w.cfg.Dir)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	recovered := 0
+	for _, path := range paths {
+		if w.own[path] {
+			continue
+		}
+		recovered++
+		seq, _ := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), walFileExt), 10, 64)
+		if seq > w.last {
+			w.last = seq
+		}
+
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if len(body) > 0 {
+			if _, err := proxy.Write(body); err != nil {
+				return err
+			}
+		}
+		w.open = append(w.open, path)
+	}
+	if recovered > 0 {
+		glog.Infof("Recovered %d write-ahead log segments from %s", recovered, w.cfg.Dir)
+	}
+	return nil
+}
+
+// append logs payload before it's written to the proxy.
+func (w *writeAheadLog) append(payload []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.cur == nil {
+		seq := time.Now().UnixNano()
+		if seq <= w.last {
+			seq = w.last + 1
+		}
+		path := filepath.Join(w.cfg.Dir, fmt.Sprintf("%020d%s", seq, walFileExt))
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		w.last, w.cur = seq, f
+		w.own[path] = true
+		w.open = append(w.open, path)
+	}
+
+	if _, err := w.cur.Write(payload); err != nil {
+		return err
+	}
+	if w.cfg.Sync {
+		return w.cur.Sync()
+	}
+	return nil
+}
+
+// sent starts a new segment for the payloads after batch, which holds those
+// of the open segments.
+func (w *writeAheadLog) sent(batch *tracedBatch) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.cur != nil {
+		if err := w.cur.Close(); err != nil {
+			glog.Errorf("Unable to close write-ahead log segment: %v", err)
+		}
+		w.cur = nil
+	}
+	batch.wal = &walGroup{segments: w.open}
+	w.groups = append(w.groups, batch.wal)
+	w.open = nil
+}
+
+// release resolves the segments of batch once it's delivered, deleting any
+// that can no longer hold undelivered payloads.
+func (w *writeAheadLog) release(batch *tracedBatch) { w.resolve(batch, false) }
+
+// abandon resolves the segments of batch, which won't be delivered, keeping
+// them for the next run to recover.
+func (w *writeAheadLog) abandon(batch *tracedBatch) { w.resolve(batch, true) }
+
+func (w *writeAheadLog) resolve(batch *tracedBatch, keep bool) {
+	if batch.wal == nil {
+		return
+	}
+	w.mu.Lock()
+	if !batch.wal.resolved {
+		batch.wal.resolved, batch.wal.kept = true, keep
+	}
+	w.clean()
+	w.mu.Unlock()
+}
+
+// clean stops tracking each resolved batch followed by another resolved
+// batch, deleting its segments if both were delivered. Must be called with
+// w.mu held.
+func (w *writeAheadLog) clean() {
+	for len(w.groups) >= 2 && w.groups[0].resolved && w.groups[1].resolved {
+		if !w.groups[0].kept && !w.groups[1].kept {
+			for _, path := range w.groups[0].segments {
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					glog.Errorf("Unable to remove write-ahead log segment: %v", err)
+				}
+			}
+		}
+		w.groups[0], w.groups = nil, w.groups[1:]
+	}
+}
+
+// close closes the segment being appended to and unlocks the directory.
+// Segments are kept for the next log using the directory to recover.
+func (w *writeAheadLog) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	if w.cur != nil {
+		w.cur.Close()
+		w.cur = nil
+	}
+	if w.lock != nil {
+		w.lock.Close()
+		w.lock = nil
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"go.spiff.io/codf"
+	"golang.org/x/net/context"
+)
+
+// Write queue overflow policies.
+const (
+	queueBlock      = "block"       // Wait for room, stalling reads
+	queueDropOldest = "drop-oldest" // Drop the oldest queued packet
+	queueDropNewest = "drop-newest" // Drop the packet being queued
+)
+
+// WorkerConfig configures the workers writing a port's packets to its proxy.
+type WorkerConfig struct {
+	Count    int    // Number of workers
+	Queue    int    // Packets that may wait for a worker
+	Overflow string // Policy for packets received while the queue is full
+
+	// BlockTimeout is how long the block policy waits for room before
+	// dropping a packet. Zero waits indefinitely.
+	BlockTimeout time.Duration
+}
+
+// handleWorkers parses
+// `workers N [queue DEPTH] [overflow POLICY] [block-timeout DURATION]`.
+func (p *PortConfig) handleWorkers(args []codf.ExprNode) error {
+	w := p.Workers
+	if err := parseArgsUpTo(args, &w.Count); err != nil {
+		return err
+	}
+
+	err := parseKwargs("workers", args[1:], kwargs{
+		"queue":         {dest: &w.Queue},
+		"overflow":      {dest: &w.Overflow},
+		"block-timeout": {dest: &w.BlockTimeout},
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case w.Count < 1:
+		return fmt.Errorf("workers must be >= 1; got %d", w.Count)
+	case w.Queue < 1:
+		return fmt.Errorf("worker queue must be >= 1; got %d", w.Queue)
+	case w.BlockTimeout < 0:
+		return fmt.Errorf("worker block-timeout must be >= 0s; got %v", w.BlockTimeout)
+	case w.BlockTimeout > 0 && w.Overflow != queueBlock:
+		return fmt.Errorf("worker block-timeout is only allowed with overflow %s", queueBlock)
+	}
+
+	switch w.Overflow {
+	case queueBlock, queueDropOldest, queueDropNewest:
+	default:
+		return fmt.Errorf("invalid worker queue overflow policy %q; must be block, drop-oldest, or drop-newest", w.Overflow)
+	}
+
+	p.Workers = w
+	return nil
+}
+
+// queuedPacket is a datagram waiting to be written by a worker.
+type queuedPacket struct {
+	from *porthole
+	buf  *[]byte
+}
+
+// writeQueue decouples a gateway's listeners from writes to its proxy. Read
+// loops push packets to the queue and a pool of workers decodes, transforms,
+// and writes them. With more than one worker, packets may be written out of
+// order.
+type writeQueue struct {
+	cfg   WorkerConfig
+	stats *portStats
+	dead  *deadLetter // Records dropped packets, if enabled
+	ch    chan queuedPacket
+}
+
+func newWriteQueue(cfg WorkerConfig, stats *portStats) *writeQueue {
+	return &writeQueue{
+		cfg:   cfg,
+		stats: stats,
+		ch:    make(chan queuedPacket, cfg.Queue),
+	}
+}
+
+// push queues a packet, handling a full queue according to the overflow
+// policy. The buffer is returned to the pool if the packet is dropped.
+func (q *writeQueue) push(ctx context.Context, pkt queuedPacket) {
+	if q.cfg.Overflow == queueBlock {
+		q.wait(ctx, pkt)
+		return
+	}
+
+	for {
+		select {
+		case q.ch <- pkt:
+			return
+		default:
+		}
+
+		drop := pkt
+		if q.cfg.Overflow == queueDropOldest {
+			select {
+			case drop = <-q.ch:
+			default:
+				continue // A worker emptied the queue; retry
+			}
+		}
+
+		q.stats.addQueueDrop()
+		q.dead.add(deadOverflow, *drop.buf)
+		putBuffer(drop.buf)
+		if glog.V(1) {
+			glog.Warningf("Write queue for %v is full; dropping packet", drop.from.orig)
+		}
+		if drop == pkt {
+			return
+		}
+	}
+}
+
+// wait queues a packet, waiting for room if the queue is full. Time spent
+// waiting is recorded, and the packet is dropped if the block timeout passes
+// first.
+func (q *writeQueue) wait(ctx context.Context, pkt queuedPacket) {
+	select {
+	case q.ch <- pkt:
+		return
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if q.cfg.BlockTimeout > 0 {
+		timer := time.NewTimer(q.cfg.BlockTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	start := time.Now()
+	defer func() { q.stats.addQueueWait(time.Since(start)) }()
+
+	select {
+	case q.ch <- pkt:
+	case <-ctx.Done():
+		putBuffer(pkt.buf)
+	case <-timeout:
+		q.stats.addQueueDrop()
+		q.dead.add(deadOverflow, *pkt.buf)
+		putBuffer(pkt.buf)
+		if glog.V(1) {
+			glog.Warningf("Write queue for %v stayed full for %v; dropping packet", pkt.from.orig, q.cfg.BlockTimeout)
+		}
+	}
+}
+
+// depth returns the number of packets waiting for a worker.
+func (q *writeQueue) depth() int { return len(q.ch) }
+
+// run starts the queue's workers and waits for them to stop. It returns the
+// first write error, after which the other workers are stopped.
+func (q *writeQueue) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errch := make(chan error, q.cfg.Count)
+	for i := 0; i < q.cfg.Count; i++ {
+		go func() { errch <- q.work(ctx) }()
+	}
+
+	var err error
+	for i := 0; i < q.cfg.Count; i++ {
+		if werr := <-errch; werr != nil && err == nil {
+			err = werr
+			cancel()
+		}
+	}
+	return err
+}
+
+// writeScratch holds the buffers a worker uses to decode and transform
+// payloads.
+type writeScratch struct {
+	decoded []byte
+	bufs    [2][]byte
+}
+
+func (q *writeQueue) work(ctx context.Context) error {
+	var sc writeScratch
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case pkt := <-q.ch:
+			err := pkt.from.write(*pkt.buf, &sc)
+			putBuffer(pkt.buf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
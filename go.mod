@@ -4,5 +4,6 @@ require (
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	go.spiff.io/codf v0.0.0-20180705032556-c6340b1a2463
 	go.spiff.io/dagr v1.1.2
+	go.starlark.net v0.0.0-20200306205701-8dd3e2ee1dd5
 	golang.org/x/net v0.0.0-20180702212446-ed29d75add3d
 )